@@ -1,33 +1,131 @@
 package rtransfer
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 const maxRetryTime = time.Second * 20
 
+// RetryPolicy controls how long Send waits between attempts and when it gives
+// up. Zero fields take their values from UnlimitedRetries.
+type RetryPolicy struct {
+	// InitialBackoff is the longest wait after the first failed attempt.
+	// Each further failure doubles it, up to MaxBackoff. The actual wait is
+	// picked at random between zero and that, so that clients that failed
+	// together don't all retry together.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// NoJitter makes every wait the longest one, which is predictable.
+	NoJitter bool
+
+	// MaxAttempts is how many attempts to make before returning the last
+	// error. Zero means no limit.
+	MaxAttempts int
+
+	// MaxDuration is how long after the first attempt to keep retrying.
+	// Zero means no limit.
+	MaxDuration time.Duration
+}
+
+// UnlimitedRetries retries forever, and is the policy used when none is set.
+var UnlimitedRetries = RetryPolicy{
+	InitialBackoff: time.Millisecond * 200,
+	MaxBackoff:     maxRetryTime,
+}
+
 type Dialer interface {
 	Dial() (net.Conn, error)
 }
 
+// The ErrCode values are part of the protocol: servers and clients of
+// different versions exchange them as numbers, so they keep their values and
+// new ones only ever go at the end.
 const (
-	ErrSuccess = rtErrno(iota)
+	ErrSuccess = ErrCode(iota)
 	ErrAlreadyExists
 	ErrEmptyFilename
 	ErrWrongFile
 	ErrOpen
+	ErrInvalidName
+	ErrInvalidSize
+	ErrSourceChanged
+	ErrUnsupportedVersion
+	ErrTooLarge
+	ErrNoSpace
+	ErrInvalidRange
+	ErrUnsupportedFeature
+	ErrUnauthorized
+	ErrServerIdentity
+	ErrAppendMismatch
+	ErrRejected
+	ErrProtocol
+	ErrTooManyRetransmits
+	ErrHashMismatch
+	ErrBusy
+	ErrIdentityRequired
 )
 
-type rtErrno int
+// ErrCode is the code a server sends back when it rejects a transfer. A
+// client that finds something wrong itself, such as a file that changed
+// while it was being sent, returns the code on its own. ErrProtocol is
+// never sent, but wraps the errors a client returns when the server breaks
+// the protocol. Nor is ErrTooManyRetransmits, which a client gives up with
+// when a block has been sent again more often than
+// SendOptions.MaxRetransmits allows, or ErrHashMismatch, which
+// SendWithResult returns when the server's digest of the stored file isn't
+// the sender's, and which the server logs when a file it received doesn't
+// match the hash the client gave.
+type ErrCode int
+
+// TransferError is a code a transfer was turned away with. Send returns one
+// when the server rejected the file, and the server returns one to the
+// errors it logs and hands to RecvDone, so callers on either side can
+// recover the code with errors.As. Since it unwraps to its Code,
+// errors.Is(err, ErrAlreadyExists) works too, as it does for the codes a
+// client returns on its own.
+type TransferError struct {
+	Code ErrCode
+
+	// Reason explains Code, when there is more to say than the code. It
+	// is empty if the server didn't give one.
+	Reason string
+}
+
+func (te TransferError) Error() string {
+	if te.Reason == "" {
+		return te.Code.Error()
+	}
+	return te.Code.Error() + ": " + te.Reason
+}
+
+// Unwrap returns the code, so that errors.Is matches a TransferError
+// against it.
+func (te TransferError) Unwrap() error {
+	return te.Code
+}
 
-func (errType rtErrno) Error() string {
-	switch errType {
+func (code ErrCode) Error() string {
+	switch code {
 	case ErrSuccess:
 		return "success"
 	case ErrAlreadyExists:
@@ -38,21 +136,363 @@ func (errType rtErrno) Error() string {
 		return "attempt to copy a different file than the one the server is currently waiting for"
 	case ErrOpen:
 		return "could not open the file for writing on the server"
+	case ErrInvalidName:
+		return "the file name is absolute or leads outside the archive directory"
+	case ErrInvalidSize:
+		return "the file size is negative or too large to transfer"
+	case ErrSourceChanged:
+		return "the file changed while it was being sent"
+	case ErrUnsupportedVersion:
+		return "the peer speaks a protocol version this one doesn't"
+	case ErrTooLarge:
+		return "the file is larger than the server accepts"
+	case ErrNoSpace:
+		return "the server doesn't have enough free space for the file"
+	case ErrInvalidRange:
+		return "the block range doesn't fit the file or overlaps another being sent"
+	case ErrUnsupportedFeature:
+		return "the server doesn't support a feature the transfer needs"
+	case ErrUnauthorized:
+		return "the client didn't prove it knows the server's secret"
+	case ErrServerIdentity:
+		return "the server couldn't prove it is the one expected"
+	case ErrAppendMismatch:
+		return "the server's copy of the file isn't as long as the append offset"
+	case ErrRejected:
+		return "the server doesn't accept the file"
+	case ErrProtocol:
+		return "the peer sent a message the protocol doesn't allow at that point"
+	case ErrTooManyRetransmits:
+		return "a block was sent again more times than allowed"
+	case ErrHashMismatch:
+		return "the server's digest of the stored file doesn't match the sender's"
+	case ErrBusy:
+		return "another connection is still sending that part of the file"
+	case ErrIdentityRequired:
+		return "the server proves its identity, and the client didn't ask it to"
 	default:
 		return "unknown error"
 	}
 }
 
+// ErrMessage returns the message for the ErrCode numbered code, as a
+// program that has only the number, such as one reading it from a log, would
+// show it. Codes it doesn't know give "unknown error".
+func ErrMessage(code int) string {
+	return ErrCode(code).Error()
+}
+
+// SendOptions holds optional settings for the sending side of a transfer. A
+// nil *SendOptions means the defaults.
+type SendOptions struct {
+	// FollowSymlinks makes SendDir send what symbolic links point to instead
+	// of skipping them.
+	FollowSymlinks bool
+
+	// PreserveSymlinks makes SendDir recreate symbolic links on the server
+	// as links to the same target. The server only takes relative targets
+	// that stay inside its archive directory. FollowSymlinks wins if both
+	// are set.
+	PreserveSymlinks bool
+
+	// Retry decides when a failing transfer is given up on. The zero value
+	// retries forever.
+	Retry RetryPolicy
+
+	// Deadline, if set, is when to give up on the send however many more
+	// attempts Retry would allow. Dialing, waiting between attempts and
+	// sending all count towards it, and an attempt in progress is cut
+	// off. The send then fails with context.DeadlineExceeded, which is a
+	// timeout.
+	Deadline time.Time
+
+	// RestartOnChange makes a transfer start over when the file's size or
+	// modification time changes between attempts. Otherwise the transfer
+	// fails with ErrSourceChanged.
+	RestartOnChange bool
+
+	// Logger receives the sender's diagnostic messages.
+	Logger Logger
+
+	// Codec is how messages are put on the wire. It must match the
+	// server's. Nil means GobCodec.
+	Codec MessageCodec
+
+	// IdleTimeout, if positive, is how long to wait on a silent server
+	// before treating the connection as lost and retrying.
+	IdleTimeout time.Duration
+
+	// Parallelism, if more than one, is how many connections SendContext
+	// splits a file's blocks across. Each retries on its own. A file that
+	// changes during a parallel transfer fails with ErrSourceChanged even
+	// if RestartOnChange is set.
+	Parallelism int
+
+	// Delta asks a server that already has a file of the same name, and
+	// is willing to replace it, for the blocks it holds, and sends only
+	// the ones that differ. It doesn't combine with Parallelism.
+	Delta bool
+
+	// Secret, if set, is the shared secret to answer the server's
+	// challenge with. It must match the server's ServerOptions.Secret.
+	Secret []byte
+
+	// ExpectServerID, if set, is the ed25519 public key of the server. The
+	// server must prove it holds the matching ServerOptions.Identity before
+	// anything is sent, or the transfer fails with ErrServerIdentity. It
+	// is checked before the client answers the server's challenge for
+	// Secret. The proof isn't tied to the connection, so it doesn't stop
+	// an attacker who relays the handshake to the real server; that still
+	// takes TLS.
+	ExpectServerID []byte
+
+	// Checkpoint, if set, is a file in which to record how far the
+	// transfer has got. Sending the same file again with the same
+	// Checkpoint, say after the process restarts, picks up from there even
+	// if the server has restarted too, as long as the file hasn't changed
+	// and the server still has its partial copy. The checkpoint is removed
+	// once the file is sent. Parallel transfers don't use it.
+	Checkpoint string
+
+	// ResumeFrom, if positive, is the offset the client proposes to resume
+	// the file from, for callers that keep track of how far a transfer got
+	// themselves. It is rounded down to the start of a block. The server
+	// has the last word: one that has less of the file resumes from where
+	// its copy ends, and one that still has the transfer in progress from
+	// where it got to. It takes the place of a Checkpoint on the first
+	// attempt, and doesn't apply to parallel transfers or appends.
+	ResumeFrom int64
+
+	// AppendFrom, if positive, sends only the bytes of the file from that
+	// offset on, appending them to the server's copy, which must be
+	// exactly AppendFrom bytes long, or longer only by what an append from
+	// the same offset wrote before it was cut short, which is picked up
+	// after. Otherwise the transfer fails with ErrAppendMismatch. It is
+	// meant for files that only grow, like logs, and turns off Parallelism
+	// and Delta.
+	AppendFrom int64
+
+	// Force asks the server to replace its copy of the file, if it has
+	// one, even if its overwrite policy would refuse. The server must
+	// allow forced sends with ServerOptions.AllowForce, and otherwise
+	// holds the send to its policy.
+	Force bool
+
+	// AsyncProgress calls the notifier from a goroutine of its own, so
+	// that a slow notifier doesn't hold up the transfer. Its calls still
+	// come in order, but progress updates it falls behind on are merged
+	// into the latest. The last of them has been made by the time the
+	// send returns.
+	AsyncProgress bool
+
+	// ProgressInterval and ProgressBytes, if either is set, hold the
+	// notifier's progress updates back to one every ProgressInterval, or
+	// every ProgressBytes bytes, whichever comes first. The update that
+	// finishes the file, and the last one held back when the send
+	// returns, are always made. Zero for both means an update per block.
+	ProgressInterval time.Duration
+	ProgressBytes    int64
+
+	// MaxRetransmits, if positive, is how many times any one block may be
+	// sent again after its first try before the transfer fails with
+	// ErrTooManyRetransmits. A link that breaks on the same block every
+	// time would otherwise be retried for as long as the RetryPolicy
+	// allows.
+	MaxRetransmits int
+
+	// Compression compresses the blocks of the file on the wire, if the
+	// server supports it. Blocks are compressed one at a time, so it pays
+	// off for files that compress well block by block, like logs.
+	Compression Compression
+
+	// HashAlgo is the digest SendWithResult asks the server to take of
+	// the stored file. Empty means HashSHA256. A server that doesn't
+	// support choosing fails the send with ErrUnsupportedFeature, unless
+	// HashSHA256 is the one asked for.
+	HashAlgo HashAlgo
+
+	// HashWhileSending never reads the whole file to hash it before
+	// sending it. Without it, a file is hashed up front only when the
+	// server asks, because it could store the file as a copy of one it has
+	// (ServerOptions.Dedup), or find it the same as its own under
+	// OverwriteIfDifferent. With it, the server isn't given the hash even
+	// then, and receives the file.
+	HashWhileSending bool
+
+	// Mmap reads the file through a memory mapping of it rather than with
+	// a read for each block, which saves a system call and a copy per
+	// block on large files. A file that can't be mapped, or a platform
+	// that can't map files, falls back to reading, as does a file sent
+	// over a Mux. A file that shrinks while mapped fails the attempt, and
+	// the next one finds it changed.
+	Mmap bool
+
+	// Tracer, if set, records a span for the send, with one for the
+	// handshake and one for the data of each attempt under it, as children
+	// of the span in the context passed to SendContext. Its trace context
+	// goes to the server, whose own Tracer continues the trace.
+	Tracer Tracer
+}
+
+func (opts *SendOptions) retryPolicy() RetryPolicy {
+	if opts == nil {
+		return UnlimitedRetries
+	}
+	return opts.Retry
+}
+
+func (opts *SendOptions) deadline() time.Time {
+	if opts == nil {
+		return time.Time{}
+	}
+	return opts.Deadline
+}
+
+func (opts *SendOptions) logger() Logger {
+	if opts == nil {
+		return orDefault(nil)
+	}
+	return orDefault(opts.Logger)
+}
+
+func (opts *SendOptions) idleTimeout() time.Duration {
+	if opts == nil {
+		return 0
+	}
+	return opts.IdleTimeout
+}
+
+func (opts *SendOptions) secret() []byte {
+	if opts == nil {
+		return nil
+	}
+	return opts.Secret
+}
+
+func (opts *SendOptions) serverID() []byte {
+	if opts == nil {
+		return nil
+	}
+	return opts.ExpectServerID
+}
+
+func (opts *SendOptions) checkpoint() string {
+	if opts == nil {
+		return ""
+	}
+	return opts.Checkpoint
+}
+
+func (opts *SendOptions) compression() Compression {
+	if opts == nil {
+		return CompressionNone
+	}
+	return opts.Compression
+}
+
+func (opts *SendOptions) hashAlgo() HashAlgo {
+	if opts == nil || opts.HashAlgo == "" {
+		return HashSHA256
+	}
+	return opts.HashAlgo
+}
+
+func (opts *SendOptions) tracer() Tracer {
+	if opts == nil {
+		return nil
+	}
+	return opts.Tracer
+}
+
+func (opts *SendOptions) maxRetransmits() int {
+	if opts == nil {
+		return 0
+	}
+	return opts.MaxRetransmits
+}
+
+func (opts *SendOptions) resumeFrom() int64 {
+	if opts == nil {
+		return 0
+	}
+	return opts.ResumeFrom
+}
+
+func (opts *SendOptions) appendFrom() int64 {
+	if opts == nil {
+		return 0
+	}
+	return opts.AppendFrom
+}
+
+// wrapNotifier returns the notifier the transfer should call in place of
+// notifier, and a function that waits for the calls made through it.
+func (opts *SendOptions) wrapNotifier(notifier SendNotifier) (SendNotifier, func()) {
+	wait := func() {}
+	if opts == nil || notifier == nil {
+		return notifier, wait
+	}
+	if opts.AsyncProgress {
+		q := newNotifyQueue()
+		notifier, wait = &asyncSendNotifier{q, notifier}, q.close
+	}
+	if opts.ProgressInterval > 0 || opts.ProgressBytes > 0 {
+		tn := &throttledSendNotifier{notifier, progressThrottle{
+			interval: opts.ProgressInterval,
+			bytes:    opts.ProgressBytes,
+		}}
+		inner := wait
+		notifier, wait = tn, func() {
+			tn.throttle.flush(tn.notifier.UpdateProgress)
+			inner()
+		}
+	}
+	return notifier, wait
+}
+
+func (opts *SendOptions) codec() MessageCodec {
+	if opts == nil {
+		return GobCodec
+	}
+	return orDefaultCodec(opts.Codec)
+}
+
 type SendNotifier interface {
 	SendStart()
 	RecvAck()
 	UpdateProgress(numBytes, totBytes int64)
 }
 
+// SendDoneNotifier is a SendNotifier that also hears how the send ended.
+// The Send functions call SendDone once, after their last attempt, with the
+// error they are about to return, so a nil error means the server has
+// stored everything.
+type SendDoneNotifier interface {
+	SendNotifier
+	SendDone(err error)
+}
+
+// sendDone tells notifier that the send ended with err, if it wants to know,
+// and returns err.
+func sendDone(notifier SendNotifier, err error) error {
+	if dn, ok := notifier.(SendDoneNotifier); ok {
+		dn.SendDone(err)
+	}
+	return err
+}
+
+// RecvNotifier follows one connection to a server. The server makes one for
+// each connection once it knows the name of the file coming in.
 type RecvNotifier interface {
 	SendAck()
 	RecvStart()
 	UpdateProgress(numBytes, totBytes int64)
+
+	// RecvDone is called once when the connection ends, with the name of
+	// the file, or "" if the client never said, and the error that ended
+	// it. A nil error means the file is stored, or, for a connection
+	// carrying part of a file sent in parallel, that the part is written.
+	RecvDone(name string, err error)
 }
 
 func init() {
@@ -60,312 +500,3130 @@ func init() {
 	gob.Register(ackMessage{})
 	gob.Register(dataMessage{})
 	gob.Register(dataAckMessage{})
+	gob.Register(resultMessage{})
 }
 
 const payloadSize = 4096
 
+// partSuffix is appended to the name of a file while the server is still
+// receiving it. The file is renamed to its real name once it is complete.
+const partSuffix = ".rtpart"
+
+// protocolVersion is the major version of the wire format. Peers with
+// different major versions can't talk to each other; features added within a
+// version are negotiated as capabilities.
+const protocolVersion = 1
+
+// capability is a set of optional protocol features. The client asks for the
+// ones it wants in its start message and the server acks the subset it
+// supports.
+type capability uint32
+
+const (
+	// capRanges lets a start message ask for a range of blocks, so that a
+	// file can be sent over several connections at once.
+	capRanges = capability(1 << iota)
+
+	// capDelta asks the server for the signatures of the file it already
+	// has, and lets data messages copy blocks from it.
+	capDelta
+
+	// capAppend lets a start message append to the server's file.
+	capAppend
+
+	// capReuse keeps the connection open once the file is sent, for the
+	// start message of another.
+	capReuse
+
+	// capMux turns the connection into one carrying several transfers at
+	// once. See muxMessage.
+	capMux
+
+	// capCancel makes the transfer a dry run. The server checks the start
+	// message as it would any other, without opening anything, and once it
+	// acks it the client sends a data message with Cancel set in place of
+	// the blocks.
+	capCancel
+
+	// capSymlink lets a start message carry a symbolic link. See
+	// startMessage.LinkTarget.
+	capSymlink
+
+	// capList asks for a listing of the archive in place of a transfer,
+	// with a start message that names no file. See listMessage.
+	capList
+
+	// capResult has the server follow the last data ack of a file with a
+	// resultMessage. See resultMessage.
+	capResult
+
+	// capStream lets a start message give the size as UnknownSize. The
+	// file is then sent block by block until a data message with End set.
+	capStream
+
+	// capGzip and capZstd compress the data of each block. A client asks
+	// for the compressions it can fall back to as well as the one it
+	// wants, and the server acks the best one it supports.
+	capGzip
+	capZstd
+
+	// capDedup lets the server store the file as a copy of one it already
+	// has with the same Hash, and ack every block straight away. See
+	// ServerOptions.Dedup.
+	capDedup
+
+	// capSparse lets the server ack the blocks after SeqNum it already
+	// has, so that only the gaps are sent. See ackMessage.Committed.
+	capSparse
+
+	// capHashAlgo lets a start message choose the digest the server puts
+	// in its result. See startMessage.HashAlgo.
+	capHashAlgo
+
+	// capRecord asks for the server's record of the last time it received
+	// a file in place of a transfer, with a start message that names the
+	// file in RecordOf rather than Name. See recordMessage.
+	capRecord
+
+	// capHashRequest lets the server ask for the SHA-256 of a file the
+	// start message gave none for. See ackMessage.NeedHash.
+	capHashRequest
+)
+
+// serverCapabilities is every capability this server supports.
+const serverCapabilities = capRanges | capDelta | capAppend | capReuse | capMux | capCancel | capSymlink | capList | capResult |
+	capStream | capGzip | capZstd | capDedup | capSparse | capHashAlgo | capRecord |
+	capHashRequest
+
+// compatibleVersion reports whether a peer declaring version can talk to this
+// one. Peers that predate versioning send zero and speak version 1.
+func compatibleVersion(version int) bool {
+	return version == 0 || version == protocolVersion
+}
+
 type startMessage struct {
-	Name string
-	Size int64
+	Version      int
+	Capabilities capability
+
+	// Stream tells apart the transfers of a multiplexed connection. The
+	// other messages of the transfer carry it too.
+	Stream uint32
+
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+
+	// Mode holds the permission bits of the file. Zero means the sender
+	// has none to offer and the server picks.
+	Mode os.FileMode
+
+	// Uid and Gid are the user and group that own the file, if HasOwner
+	// is set. A sender on a system without them leaves it unset.
+	HasOwner bool
+	Uid      int
+	Gid      int
+
+	// Hash is the SHA-256 of the file's contents, if the sender knows it.
+	Hash []byte
+
+	// RangeStart and RangeEnd, if RangeEnd is set, limit the connection to
+	// blocks [RangeStart, RangeEnd) of the file. They need capRanges.
+	RangeStart int64
+	RangeEnd   int64
+
+	// Restart asks the server to discard a partial file it has for Name if
+	// it was started with a different Size or ModTime, rather than fail.
+	Restart bool
+
+	// Rewind asks the server to discard the blocks of the range it already
+	// has and take them again, because they didn't match the file.
+	Rewind bool
+
+	// ResumeFrom, if set, is the number of blocks the client recorded the
+	// server acking in an earlier process, or that its caller proposed. A
+	// server that no longer knows of the transfer may pick up its partial
+	// file from there, or from where it ends if it is shorter.
+	ResumeFrom int64
+
+	// AppendFrom, if set, is the size of the server's copy of the file,
+	// which the client extends to Size. Blocks are then counted from
+	// AppendFrom rather than the start of the file. It needs capAppend.
+	AppendFrom int64
+
+	// LinkTarget, if set, makes Name a symbolic link to it rather than a
+	// file, with the target in slash-separated form. Like a directory, a
+	// link carries no data. It needs capSymlink.
+	LinkTarget string
+
+	// Force asks the server to replace the file if it already has one,
+	// which it does only if it was set up to allow it.
+	Force bool
+
+	// TraceContext, if set, is the trace context of the sender's span, as
+	// its Tracer injected it.
+	TraceContext []byte
+
+	// HashAlgo is the digest the server takes of the file for its result.
+	// Empty means SHA-256. Any other needs capHashAlgo.
+	HashAlgo HashAlgo
+
+	// RecordOf is the file a start message asking for capRecord wants the
+	// record of. Name is left empty, so that a server that doesn't know
+	// capRecord turns the request down rather than take it for a file.
+	RecordOf string
 }
 
 type ackMessage struct {
+	Version      int
+	Capabilities capability
+	Stream       uint32
+
 	Name    string
-	SeqNum  int
+	SeqNum  int64
 	Size    int64
-	ErrType rtErrno
+	ErrType ErrCode
+
+	// Reason explains ErrType, when the server has more to say than the
+	// code.
+	Reason string
+
+	// Signatures describe the blocks of the server's existing copy of the
+	// file, if the client asked for capDelta and there is one.
+	Signatures []blockSignature
+
+	// PrefixHash is the SHA-256 of the blocks of the range before SeqNum,
+	// followed by those in Committed, as the server has them, so that the
+	// client can check them before resuming. It is nil when there are none.
+	PrefixHash []byte
+
+	// Committed lists the blocks of the range after SeqNum the server
+	// already has, in order, if the client asked for capSparse. The client
+	// sends only the others.
+	Committed []blockRun
+
+	// NeedHash asks a client that offered capHashRequest for the SHA-256
+	// of the file, which the server needs to decide what to do with it.
+	// The client sends the start message again with Hash set, and the
+	// server acks that one instead.
+	NeedHash bool
+}
+
+// err returns nil if the ack accepts the transfer, and otherwise a
+// TransferError with its code and reason.
+func (ack ackMessage) err() error {
+	if ack.ErrType == ErrSuccess {
+		return nil
+	}
+	return TransferError{Code: ack.ErrType, Reason: ack.Reason}
 }
 
+// dataMessage carries block SeqNum of the file. If Copy is set, it carries
+// no data, and the server takes the block from its existing copy of the
+// file, starting at Offset.
 type dataMessage struct {
-	SeqNum int
+	Stream uint32
+	SeqNum int64
 	Data   []byte
+	Copy   bool
+	Offset int64
+
+	// Cancel ends a dry run started with capCancel. It carries no block.
+	Cancel bool
+
+	// End ends a stream started with capStream, once its blocks are all
+	// sent. It carries no block, and the server acks it once the file is
+	// stored.
+	End bool
 }
 
 type dataAckMessage struct {
-	SeqNum int
+	Stream uint32
+	SeqNum int64
+}
+
+// resultMessage ends the transfer of a file that asked for capResult, once
+// the server has stored it. A connection that sent a range of the file gets
+// one too, with no StoredPath unless it was the one to store the file.
+type resultMessage struct {
+	Stream uint32
+
+	// StoredPath is where the server stored the file: its slash-separated
+	// path in the archive directory, or its name in the server's Store.
+	StoredPath string
+	Size       int64
+
+	// Hash is the digest the start message asked for of the file as the
+	// server read it back once it was stored. It is nil if the server
+	// can't read what it stores, or was asked for none.
+	Hash []byte
+}
+
+// maxSize is the largest file the protocol can describe: every block of it,
+// including a partial last one, starts at an offset an int64 can hold.
+const maxSize = math.MaxInt64 - payloadSize + 1
+
+// validSize reports whether size is a file size that can be transferred.
+func validSize(size int64) bool {
+	return size >= 0 && size <= maxSize
 }
 
-func getNumBlocks(size int64) int {
-	numBlocks := size / payloadSize
-	if size%payloadSize != 0 {
+// BlockSize is the size of the blocks the protocol sends files in, and so
+// the unit that transfers resume in.
+const BlockSize = payloadSize
+
+// BlockCount returns how many blocks of blockSize bytes a file of size bytes
+// takes. Every block but the last is full, and an empty file has none. It
+// is the count servers and senders agree on for blockSize BlockSize.
+// blockSize must be positive.
+func BlockCount(size int64, blockSize int) int64 {
+	numBlocks := size / int64(blockSize)
+	if size%int64(blockSize) != 0 {
 		numBlocks++
 	}
-	return int(numBlocks)
+	return numBlocks
+}
+
+// BlockOffset returns the offset in the file at which block seq of
+// blockSize bytes starts. For seq equal to the block count, that is the
+// size rounded up to a whole block.
+func BlockOffset(seq int64, blockSize int) int64 {
+	return seq * int64(blockSize)
+}
+
+func getNumBlocks(size int64) int64 {
+	return BlockCount(size, payloadSize)
 }
 
-func getFilePos(seqNum int) int64 {
-	return int64(seqNum) * int64(payloadSize)
+func getFilePos(seqNum int64) int64 {
+	return BlockOffset(seqNum, payloadSize)
 }
 
 func Send(dialer Dialer, fpath string, notifier SendNotifier) error {
-	retryTime := time.Millisecond * 200
+	_, err := SendContext(context.Background(), dialer, fpath, notifier, nil)
+	return err
+}
 
-	cleanup := func(conn net.Conn) {
-		logf("retrying after %v", retryTime)
-		c := time.After(retryTime)
-		if conn != nil {
-			conn.Close()
-		}
-		if retryTime < maxRetryTime {
-			retryTime *= 2
+// SendContext is like Send, but takes options, reports statistics about the
+// transfer and gives up when ctx is done, closing the connection if a
+// transfer is in progress. It returns ctx.Err() in that case.
+func SendContext(ctx context.Context, dialer Dialer, fpath string, notifier SendNotifier, opts *SendOptions) (Stats, error) {
+	st, err := sendFile(ctx, dialer, newFileSource(fpath, opts), notifier, opts)
+	return st.Stats, err
+}
+
+// SendResult describes a file once the server has stored it.
+type SendResult struct {
+	// StoredPath is where the server stored the file: its slash-separated
+	// path in the server's archive directory, or its name in the server's
+	// Store. It differs from the name the file was sent under when the
+	// server has a PathFunc.
+	StoredPath string
+
+	// Hash is the digest HashAlgo names of the file as the server stored
+	// it. It is nil if the server keeps its files in a Store, or if
+	// HashAlgo is HashNone. Verified reports whether the sender checked it
+	// against its own digest of the file.
+	Hash     []byte
+	HashAlgo HashAlgo
+	Verified bool
+
+	// Bytes is the size of the stored file.
+	Bytes int64
+
+	// Stats are the statistics of the transfer: how much crossed the
+	// wire, how long it took and how many times it reconnected.
+	Stats Stats
+}
+
+// SendWithResult is like SendContext, but waits for the server to store the
+// file and returns what it says of the stored file. It fails with
+// ErrUnsupportedFeature, before sending anything, if the server can't say.
+// If the server's digest of the stored file isn't the sender's, it returns
+// the result with ErrHashMismatch.
+func SendWithResult(ctx context.Context, dialer Dialer, fpath string, notifier SendNotifier, opts *SendOptions) (SendResult, error) {
+	src := newFileSource(fpath, opts)
+	src.wantResult = true
+	if _, err := src.hashAlgo.newHash(); err != nil {
+		return SendResult{}, err
+	}
+	st, err := sendFile(ctx, dialer, src, notifier, opts)
+	if err != nil {
+		return SendResult{}, err
+	}
+	if src.running != nil {
+		if err := src.finishDigest(); err != nil {
+			return SendResult{}, err
 		}
-		<-c
 	}
 
-	for {
-		conn, err := dialer.Dial()
-		if err != nil {
-			logf("Dial error: %v", err)
-			cleanup(conn)
-			continue
+	result := SendResult{
+		StoredPath: st.result.StoredPath,
+		Hash:       st.result.Hash,
+		HashAlgo:   src.hashAlgo,
+		Bytes:      st.result.Size,
+		Stats:      st.Stats,
+	}
+	if result.Hash != nil && src.digest != nil {
+		if !bytes.Equal(result.Hash, src.digest) {
+			return result, ErrHashMismatch
 		}
+		result.Verified = true
+	}
+	return result, nil
+}
 
-		err = send(conn, fpath, notifier)
-
-		// If the error was due to a malformed or invalid send request, don't
-		// retry.
-		if _, ok := err.(rtErrno); ok {
-			if conn != nil {
-				conn.Close()
-			}
-			return err
-		}
+// sendFile sends the file in src under its base name, and returns the
+// statistics of the transfer.
+func sendFile(ctx context.Context, dialer Dialer, src *fileSource, notifier SendNotifier, opts *SendOptions) (*sendStats, error) {
+	notifier = guardSendNotifier(notifier, opts.logger())
+	st := &sendStats{maxRetransmits: opts.maxRetransmits()}
+	name, err := sendName(src.fpath)
+	if err != nil {
+		return st, err
+	}
+	calls, wait := opts.wrapNotifier(notifier)
 
-		// If the error was due to a connection issue, try again.
-		if err != nil {
-			logf("Send error: %v", err)
-			cleanup(conn)
-			continue
-		}
+	ctx, span := startSpan(opts.tracer(), ctx, "rtransfer.Send")
+	span.SetAttribute(attrFile, name)
+	span.SetAttribute(attrBlockSize, payloadSize)
+	if tracer := opts.tracer(); tracer != nil {
+		src.traceContext = tracer.Inject(ctx)
+	}
 
-		break
+	if opts != nil && opts.Parallelism > 1 && opts.AppendFrom == 0 {
+		err = sendParallel(ctx, dialer, src, name, calls, opts, st)
+	} else {
+		err = retry(ctx, dialer, opts, st, func(conn net.Conn) error {
+			return send(conn, src, name, calls, st)
+		})
 	}
+	wait()
 
-	return nil
+	if src.info != nil {
+		span.SetAttribute(attrSize, src.info.Size())
+	}
+	span.SetAttribute(attrBlocks, st.Blocks)
+	span.SetAttribute(attrBytes, st.Bytes)
+	span.SetAttribute(attrRetransmits, st.Retransmissions)
+	span.SetAttribute(attrReconnects, st.Reconnects)
+	span.End(err)
+	return st, sendDone(notifier, err)
 }
 
-func send(conn net.Conn, fpath string, notifier SendNotifier) error {
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
+// SendAs is like Send, but the server stores the file as remoteName instead
+// of the base name of localPath. remoteName may be a relative path with
+// forward slashes, such as "logs/2024/app.log", which puts the file in
+// subdirectories of the archive directory that the server creates, unless
+// it has ServerOptions.ForbidSubpaths set. It may not climb out of the
+// archive directory with "..", or have empty or "." elements.
+func SendAs(dialer Dialer, localPath, remoteName string, notifier SendNotifier) error {
+	notifier = guardSendNotifier(notifier, orDefault(nil))
+	if !validRemoteName(remoteName) {
+		return sendDone(notifier, fmt.Errorf("Invalid remote name %q", remoteName))
+	}
 
-	info, err := os.Stat(fpath)
+	src := newFileSource(localPath, nil)
+	return sendDone(notifier, retry(context.Background(), dialer, nil, nil, func(conn net.Conn) error {
+		return send(conn, src, remoteName, notifier, nil)
+	}))
+}
+
+// SendConn makes one attempt at sending fpath to the server on the other end
+// of conn, for callers that make their own connections. It doesn't retry: if
+// the connection fails, the error is returned, and a later call over a new
+// connection picks up where the server left off.
+//
+// conn stays the caller's, and SendConn doesn't close it whether it succeeds
+// or not. The server hangs up once it has the file, so each file needs a
+// connection of its own. SendConn has no secret to answer a challenge with,
+// so the server must not ask for one.
+func SendConn(conn net.Conn, fpath string, notifier SendNotifier) error {
+	name, err := sendName(fpath)
 	if err != nil {
 		return err
 	}
+	notifier = guardSendNotifier(notifier, orDefault(nil))
+	src := newFileSource(fpath, nil)
+	return sendDone(notifier, send(conn, src, name, notifier, nil))
+}
 
-	if notifier != nil {
-		notifier.SendStart()
+// sendName returns the name the file at fpath is sent under, or
+// ErrEmptyFilename if fpath is empty, blank or nothing but a volume name and
+// separators, which leaves it no name the server would take. fpath is a
+// local path, so it is split with the local separator.
+func sendName(fpath string) (string, error) {
+	name := filepath.Base(fpath)
+	rest := fpath[len(filepath.VolumeName(fpath)):]
+	if strings.TrimSpace(fpath) == "" || strings.TrimSpace(name) == "" ||
+		strings.Trim(rest, "/"+string(filepath.Separator)) == "" {
+		return "", ErrEmptyFilename
 	}
+	return name, nil
+}
 
-	startMsg := startMessage{info.Name(), info.Size()}
-	if err := enc.Encode(startMsg); err != nil {
-		return err
-	}
+// validRemoteName reports whether name is a file name, or a clean relative
+// path with forward slashes, that the server can store a file as.
+func validRemoteName(name string) bool {
+	return isLocalName(name) && path.Clean(name) == name && !strings.Contains(name, `\`)
+}
 
-	if notifier != nil {
-		notifier.RecvAck()
-	}
+// retry dials and runs attempt until it succeeds, fails with an error from
+// the server that retrying will not fix, runs out of attempts under the retry
+// policy in opts, or ctx is done. It records reconnects and the elapsed time
+// in st, which may be nil.
+func retry(ctx context.Context, dialer Dialer, opts *SendOptions, st *sendStats, attempt func(conn net.Conn) error) error {
+	logger := opts.logger()
+	tracer := opts.tracer()
 
-	var ack ackMessage
-	if err := dec.Decode(&ack); err != nil {
-		return err
-	}
+	budget := newRetryBudget(opts.retryPolicy(), rand.Int63n)
 
-	if ack.ErrType != ErrSuccess {
-		var ret error = ack.ErrType
-		return ret
+	if deadline := opts.deadline(); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
 	}
 
-	f, err := os.Open(fpath)
-	if err != nil {
-		return err
+	connected := false
+	redialed := false
+
+	if st != nil {
+		defer func() { st.Elapsed = time.Since(budget.start) }()
 	}
 
-	numBlocks := getNumBlocks(info.Size())
-	seqNum := ack.SeqNum
-	for seqNum < numBlocks {
-		dataMsg := dataMessage{SeqNum: seqNum, Data: make([]byte, payloadSize)}
-		if n, err := f.Read(dataMsg.Data); err != io.EOF && err != nil {
-			return err
-		} else if err == io.EOF && seqNum != numBlocks-1 {
-			return fmt.Errorf(
-				"Hit end of file at %d, while the last block index expected was %d",
-				seqNum, numBlocks-1)
-		} else {
-			dataMsg.Data = dataMsg.Data[:n]
+	// cleanup closes conn after a failed attempt and waits out the backoff.
+	// It returns an error wrapping lastErr, and saying what kind of failure
+	// it was, once the policy says to give up.
+	cleanup := func(conn net.Conn, lastErr error) error {
+		if conn != nil {
+			conn.Close()
 		}
 
-		if err := enc.Encode(dataMsg); err != nil {
+		wait, err := budget.fail(lastErr)
+		if err != nil {
 			return err
 		}
 
-		var dataAckMsg dataAckMessage
-		if err := dec.Decode(&dataAckMsg); err != nil {
+		logger.Logf("retrying after %v", wait)
+		c := time.After(wait)
+		select {
+		case <-c:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 
-		if dataAckMsg.SeqNum != seqNum {
-			return fmt.Errorf(
-				"Server acked a payload with a different sequence number, got %d, want %d",
-				dataAckMsg.SeqNum, seqNum)
+		conn, err := dial(ctx, dialer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			kind := st.failed(err)
+			logger.Logf("Dial error (%v): %v", kind, err)
+			if err := cleanup(conn, err); err != nil {
+				return err
+			}
+			continue
 		}
 
-		seqNum++
+		if connected && st != nil {
+			st.Reconnects++
+		}
+		connected = true
+		conn = withIdleTimeout(conn, opts.idleTimeout())
+
+		// A connection from a ConnPool that carried an earlier transfer has
+		// been through the handshake already, as has the connection under
+		// a Mux stream.
+		pc, pooled := asPooled(conn)
+		reused := pooled && pc.session.started
+		_, muxed := asMuxStream(conn)
+
+		stop := closeOnDone(ctx, conn)
+		if !reused && !muxed {
+			_, span := startSpan(tracer, ctx, "rtransfer.handshake")
+			err = handshake(conn, opts)
+			span.End(err)
+		}
+		if err == nil {
+			if pooled {
+				pc.session.started = true
+			}
+			_, span := startSpan(tracer, ctx, "rtransfer.data")
+			span.SetAttribute(attrAttempt, budget.attempts+1)
+			err = attempt(conn)
+			span.End(err)
+		}
+		stop()
 
-		if notifier != nil {
-			numBytes := getFilePos(seqNum)
-			if numBytes > info.Size() {
-				numBytes = info.Size()
+		if ctx.Err() != nil {
+			conn.Close()
+			return ctx.Err()
+		}
+
+		kind := st.failed(err)
+		if permanent(err) {
+			if conn != nil {
+				conn.Close()
+			}
+			return err
+		}
+
+		// The server may have closed an idle connection while it sat in the
+		// pool, so try a fresh one straight away. That is only done once,
+		// so that a server that drops every connection still uses up
+		// attempts and is backed off from.
+		if err != nil && reused && !redialed {
+			logger.Logf("Reused connection failed (%v), dialing again: %v", kind, err)
+			conn.Close()
+			redialed = true
+			continue
+		}
+
+		// If the error was due to a connection issue, try again.
+		if err != nil {
+			logger.Logf("Send error (%v): %v", kind, err)
+			if err := cleanup(conn, err); err != nil {
+				return err
 			}
-			notifier.UpdateProgress(numBytes, info.Size())
+			continue
 		}
+
+		conn.Close()
+		break
 	}
 
 	return nil
 }
 
-type Server interface {
-	Serve(func() RecvNotifier) error
-	Stop()
+// permanent reports whether err ends a send for good rather than calling for
+// another attempt. That is the case for every ErrCode: one the server
+// answered with, such as ErrOpen, ErrNoSpace or ErrAlreadyExists, since a
+// server that can't write the file or already has it answers the same way
+// next time, and one the client found, such as a malformed request or a
+// server breaking the protocol. The exception is ErrBusy, which lasts
+// until the server notices the client's last connection died. Anything
+// else, such as a timeout or a reset connection, is taken to be transient.
+func permanent(err error) bool {
+	var code ErrCode
+	return errors.As(err, &code) && code != ErrBusy
 }
 
-type server struct {
-	listener   net.Listener
-	archiveDir string
-	name       string
-	size       int64
-	seqNum     int
+// backoff works out the waits between attempts under a retry policy.
+// random returns a number in [0, n), and is a parameter so that tests can
+// seed it.
+type backoff struct {
+	limit  time.Duration
+	max    time.Duration
+	jitter bool
+	random func(n int64) int64
 }
 
-func NewServer(listener net.Listener, archiveDir string) Server {
-	return &server{
-		listener:   listener,
-		archiveDir: archiveDir,
+func newBackoff(policy RetryPolicy, random func(n int64) int64) *backoff {
+	b := &backoff{
+		limit:  policy.InitialBackoff,
+		max:    policy.MaxBackoff,
+		jitter: !policy.NoJitter,
+		random: random,
+	}
+	if b.limit <= 0 {
+		b.limit = UnlimitedRetries.InitialBackoff
 	}
+	if b.max <= 0 {
+		b.max = UnlimitedRetries.MaxBackoff
+	}
+	if b.limit > b.max {
+		b.limit = b.max
+	}
+	return b
 }
 
-func fileExists(fpath string) bool {
-	if _, err := os.Stat(fpath); err != nil {
-		return false
+// next returns the wait before the next attempt.
+func (b *backoff) next() time.Duration {
+	wait := b.limit
+	if b.jitter {
+		wait = time.Duration(b.random(int64(wait) + 1))
 	}
-	return true
-}
 
-func (srv *server) recv(conn net.Conn, createNotifier func() RecvNotifier) error {
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
+	b.limit *= 2
+	if b.limit > b.max {
+		b.limit = b.max
+	}
+	return wait
+}
 
-	sendClientErr := func(errType rtErrno, err error) error {
-		if err := enc.Encode(ackMessage{ErrType: errType}); err != nil {
-			return fmt.Errorf("Error sending client an error message: %v", err)
-		}
-		return err
+// or returns the policy with its zero fields taken from defaults.
+func (policy RetryPolicy) or(defaults RetryPolicy) RetryPolicy {
+	if policy.InitialBackoff == 0 {
+		policy.InitialBackoff = defaults.InitialBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = defaults.MaxBackoff
 	}
+	if !policy.NoJitter {
+		policy.NoJitter = defaults.NoJitter
+	}
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = defaults.MaxAttempts
+	}
+	if policy.MaxDuration == 0 {
+		policy.MaxDuration = defaults.MaxDuration
+	}
+	return policy
+}
 
-	var notifier RecvNotifier
-	if createNotifier != nil {
-		notifier = createNotifier()
+// retryBudget counts the failed attempts made under a retry policy, and
+// works out how long to wait after each before the next.
+type retryBudget struct {
+	policy   RetryPolicy
+	backoff  *backoff
+	start    time.Time
+	attempts int
+}
+
+func newRetryBudget(policy RetryPolicy, random func(n int64) int64) *retryBudget {
+	return &retryBudget{policy: policy, backoff: newBackoff(policy, random), start: time.Now()}
+}
+
+// fail records an attempt that failed with err, and returns the wait before
+// the next one. Once the policy says to give up, it returns an error
+// wrapping err that says why instead.
+func (r *retryBudget) fail(err error) (time.Duration, error) {
+	r.attempts++
+	if r.policy.MaxAttempts > 0 && r.attempts >= r.policy.MaxAttempts {
+		return 0, fmt.Errorf("Giving up after %d attempts (%v): %w", r.attempts, classify(err), err)
 	}
 
-	if createNotifier != nil {
-		notifier.RecvStart()
+	wait := r.backoff.next()
+	if r.policy.MaxDuration > 0 {
+		remaining := r.policy.MaxDuration - time.Since(r.start)
+		if remaining <= 0 {
+			return 0, fmt.Errorf("Giving up after %v (%v): %w", r.policy.MaxDuration, classify(err), err)
+		}
+		if wait > remaining {
+			wait = remaining
+		}
 	}
+	return wait, nil
+}
 
-	var startMsg startMessage
-	if err := dec.Decode(&startMsg); err != nil {
-		return err
+// dial dials with dialer, giving up once ctx is done, which a Dialer can't be
+// told to do. A connection that arrives after that is closed.
+func dial(ctx context.Context, dialer Dialer) (net.Conn, error) {
+	if ctx.Done() == nil {
+		return dialer.Dial()
 	}
 
-	if startMsg.Name == "" {
-		return sendClientErr(ErrEmptyFilename,
-			fmt.Errorf("Client tried to send a file with no name"))
-	} else if srv.name != "" && srv.name != startMsg.Name {
-		retErr := fmt.Errorf("Client wants to send %s, but I'm waiting for %s",
-			startMsg.Name, srv.name)
-		return sendClientErr(ErrWrongFile, retErr)
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialed, 1)
+	go func() {
+		conn, err := dialer.Dial()
+		result <- dialed{conn, err}
+	}()
+
+	select {
+	case d := <-result:
+		return d.conn, d.err
+	case <-ctx.Done():
+		go func() {
+			if d := <-result; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
 	}
+}
+
+// closeOnDone closes conn if ctx is done before the returned stop function is
+// called, which unblocks any reads or writes in progress on it.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
 
-	fpath := path.Join(srv.archiveDir, startMsg.Name)
+// SendReader is like Send, but reads the contents from r instead of a file.
+// The server stores them as name. r must be seekable because a transfer
+// resumed after a reconnect picks up at whatever block the server asks for.
+func SendReader(dialer Dialer, name string, size int64, r io.ReadSeeker, notifier SendNotifier) error {
+	notifier = guardSendNotifier(notifier, orDefault(nil))
+	rewind := false
+	return sendDone(notifier, retry(context.Background(), dialer, nil, nil, func(conn net.Conn) error {
+		err := sendBlocks(conn, GobCodec, startMessage{Name: name, Size: size, Rewind: rewind}, r, nil, notifier, nil)
+		rewind = err == errPrefixMismatch
+		return err
+	}))
+}
 
-	if fileExists(fpath) && srv.name != startMsg.Name {
-		return sendClientErr(ErrAlreadyExists,
-			fmt.Errorf("Client tried to send a file (%s) that already exists", startMsg.Name))
+// SendRange sends the length bytes of fpath starting at offset, which the
+// server stores as a complete file named remoteName, which is checked as
+// for SendAs.
+func SendRange(dialer Dialer, fpath string, offset, length int64, remoteName string, notifier SendNotifier) error {
+	notifier = guardSendNotifier(notifier, orDefault(nil))
+	if !validRemoteName(remoteName) {
+		return sendDone(notifier, fmt.Errorf("Invalid remote name %q", remoteName))
 	}
 
-	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR, 0666)
+	f, err := os.Open(fpath)
 	if err != nil {
-		return sendClientErr(ErrOpen, err)
+		return sendDone(notifier, err)
 	}
 	defer f.Close()
 
-	if srv.name == "" {
-		srv.name = startMsg.Name
-		srv.size = startMsg.Size
-		srv.seqNum = 0
+	info, err := f.Stat()
+	if err != nil {
+		return sendDone(notifier, err)
 	}
-	if createNotifier != nil {
-		notifier.SendAck()
+	if offset < 0 || length < 0 || offset > info.Size() || length > info.Size()-offset {
+		return sendDone(notifier, fmt.Errorf("Range [%d, %d) is outside of %s, which has %d bytes",
+			offset, offset+length, fpath, info.Size()))
 	}
 
-	ackMsg := ackMessage{
-		Name:    srv.name,
-		Size:    srv.size,
-		SeqNum:  srv.seqNum,
-		ErrType: ErrSuccess,
-	}
-	if err := enc.Encode(ackMsg); err != nil {
-		return err
-	}
+	return SendReader(dialer, remoteName, length, io.NewSectionReader(f, offset, length), notifier)
+}
 
-	numBlocks := getNumBlocks(srv.size)
-	for srv.seqNum < numBlocks {
-		var dataMsg dataMessage
-		if err := dec.Decode(&dataMsg); err != nil {
-			return err
+// fileSource is a file being sent by Send, remembered across attempts so
+// that changes to it between them are noticed.
+type fileSource struct {
+	fpath           string
+	restartOnChange bool
+	delta           bool
+	checkpoint      string
+	resumeFrom      int64
+	appendFrom      int64
+	force           bool
+	wantResult      bool
+	compression     Compression
+	hashAlgo        HashAlgo
+	hashLater       bool
+	mmap            bool
+	traceContext    []byte
+	logger          Logger
+	codec           MessageCodec
+
+	// info is the file as it was on the first attempt, and hash the
+	// SHA-256 of its contents, once a server has asked for it. running
+	// takes the digest hashAlgo names of them as the file is sent, if a
+	// result was asked for, and digest is that digest once it is sent.
+	// rewind holds the first blocks of the ranges the server must start
+	// over. mu guards them for parallel transfers.
+	mu      sync.Mutex
+	info    os.FileInfo
+	hash    []byte
+	digest  []byte
+	running *runningHash
+	rewind  map[int64]bool
+}
+
+func newFileSource(fpath string, opts *SendOptions) *fileSource {
+	return &fileSource{
+		fpath:           fpath,
+		restartOnChange: opts != nil && opts.RestartOnChange,
+		delta:           opts != nil && opts.Delta,
+		checkpoint:      opts.checkpoint(),
+		resumeFrom:      opts.resumeFrom(),
+		appendFrom:      opts.appendFrom(),
+		force:           opts != nil && opts.Force,
+		compression:     opts.compression(),
+		hashAlgo:        opts.hashAlgo(),
+		hashLater:       opts != nil && opts.HashWhileSending,
+		mmap:            opts != nil && opts.Mmap,
+		logger:          opts.logger(),
+		codec:           opts.codec(),
+		rewind:          make(map[int64]bool),
+	}
+}
+
+// open opens the file for an attempt at sending it as name, and returns the
+// start message describing it.
+func (src *fileSource) open(name string) (*os.File, startMessage, error) {
+	f, err := os.Open(src.fpath)
+	if err != nil {
+		return nil, startMessage{}, err
+	}
+
+	startMsg, err := src.describe(f, name)
+	if err != nil {
+		f.Close()
+		return nil, startMessage{}, err
+	}
+	return f, startMsg, nil
+}
+
+func (src *fileSource) describe(f *os.File, name string) (startMessage, error) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	info, err := f.Stat()
+	if err != nil {
+		return startMessage{}, err
+	}
+
+	if src.info == nil {
+		src.info = info
+	} else if info.Size() != src.info.Size() || !info.ModTime().Equal(src.info.ModTime()) {
+		if !src.restartOnChange {
+			return startMessage{}, ErrSourceChanged
+		}
+		src.logger.Logf("%s changed since the last attempt, starting over", src.fpath)
+		src.info = info
+		src.hash = nil
+		src.running = nil
+	}
+
+	if src.running == nil && src.wantResult {
+		if src.running, err = newRunningHash(src.hashAlgo); err != nil {
+			return startMessage{}, err
+		}
+	}
+
+	startMsg := startMessage{
+		Name:    name,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode().Perm(),
+		Hash:    src.hash,
+		Restart: src.restartOnChange,
+		Force:   src.force,
+
+		TraceContext: src.traceContext,
+	}
+	startMsg.Uid, startMsg.Gid, startMsg.HasOwner = ownerOf(info)
+	if src.appendFrom > 0 {
+		if src.appendFrom > info.Size() {
+			src.logger.Logf("%s has %d bytes, fewer than the %d to append after",
+				src.fpath, info.Size(), src.appendFrom)
+			return startMessage{}, ErrInvalidSize
+		}
+		startMsg.AppendFrom = src.appendFrom
+		startMsg.Capabilities |= capAppend
+	} else if src.delta {
+		startMsg.Capabilities |= capDelta
+	}
+	if src.wantResult {
+		startMsg.Capabilities |= capResult
+		if src.hashAlgo != HashSHA256 {
+			startMsg.HashAlgo = src.hashAlgo
+			startMsg.Capabilities |= capHashAlgo
+		}
+	}
+	startMsg.Capabilities |= capDedup | capSparse | src.compression.capabilities()
+	return startMsg, nil
+}
+
+func send(conn net.Conn, src *fileSource, name string, notifier SendNotifier, st *sendStats) error {
+	f, startMsg, err := src.open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return src.sendBlocks(conn, startMsg, f, notifier, st)
+}
+
+// sendBlocks is like the function of the same name, but remembers when the
+// server's blocks of a range turn out not to match the file, so that the
+// next attempt at the range asks the server to start it over.
+func (src *fileSource) sendBlocks(conn net.Conn, startMsg startMessage, f *os.File, notifier SendNotifier, st *sendStats) (err error) {
+	first := startMsg.RangeStart
+
+	src.mu.Lock()
+	startMsg.Rewind = src.rewind[first]
+	delete(src.rewind, first)
+	resumeFrom := src.resumeFrom
+	src.resumeFrom = 0
+	src.mu.Unlock()
+
+	checkpointing := src.checkpoint != "" && startMsg.RangeEnd == 0
+	if checkpointing && !startMsg.Rewind {
+		startMsg.ResumeFrom = src.loadCheckpoint(startMsg)
+	}
+	if resumeFrom > 0 && startMsg.RangeEnd == 0 && startMsg.AppendFrom == 0 && !startMsg.Rewind {
+		startMsg.ResumeFrom = resumeFrom / payloadSize
+	}
+	if checkpointing {
+		notifier = newCheckpointNotifier(src.checkpoint, startMsg, notifier, src.logger)
+	}
+
+	// A Mux stream hands blocks to the connection's writer and goes on
+	// before they are sent, so they can't be slices of a mapping that may
+	// be gone by then.
+	var r io.ReadSeeker = f
+	if _, muxed := asMuxStream(conn); src.mmap && !muxed {
+		m, mapErr := mapFile(f, startMsg.Size)
+		if mapErr != nil {
+			src.logger.Logf("Couldn't map %s, reading it instead: %v", src.fpath, mapErr)
+		} else {
+			defer m.unmap()
+			defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+			defer m.catchFault(src.fpath, &err)
+			r = m.readerFrom(startMsg.AppendFrom)
+		}
+	}
+	if _, mapped := r.(*mappedReader); !mapped && startMsg.AppendFrom > 0 {
+		r = io.NewSectionReader(f, startMsg.AppendFrom, startMsg.Size-startMsg.AppendFrom)
+	}
+
+	src.mu.Lock()
+	running := src.running
+	src.mu.Unlock()
+	if m, mapped := r.(*mappedReader); mapped {
+		m.h = running
+	} else if running != nil {
+		hr, err := newHashingReader(r, running, startMsg.AppendFrom)
+		if err != nil {
+			return err
+		}
+		r = hr
+	}
+
+	var hashFile func() ([]byte, error)
+	if !src.hashLater {
+		hashFile = src.fileHash
+	}
+	err = sendBlocks(conn, src.codec, startMsg, r, hashFile, notifier, st)
+	if err == errPrefixMismatch {
+		src.logger.Logf("The server's copy of %s from block %d doesn't match, starting over",
+			src.fpath, first)
+		src.mu.Lock()
+		src.rewind[first] = true
+		src.mu.Unlock()
+	}
+	if checkpointing && (err == nil || err == errPrefixMismatch) {
+		if err := os.Remove(src.checkpoint); err != nil && !os.IsNotExist(err) {
+			src.logger.Logf("Couldn't remove checkpoint %s: %v", src.checkpoint, err)
+		}
+	}
+	return err
+}
+
+// errPrefixMismatch is returned by sendBlocks when the blocks the server
+// already has differ from the file. Another attempt with startMessage.Rewind
+// set sends them again.
+var errPrefixMismatch = errors.New("the server's partial file doesn't match")
+
+// sendBlocks runs one attempt at transferring the file described by startMsg,
+// reading it from r, to the server on the other end of conn, using codec. It
+// starts at the block the server acks, and counts the blocks it sends in st,
+// which may be nil. When appending, r holds only the bytes from
+// startMsg.AppendFrom on. If startMsg has no Hash, hashFile, if not nil,
+// returns it for a server that asks.
+func sendBlocks(conn net.Conn, codec MessageCodec, startMsg startMessage, r io.ReadSeeker, hashFile func() ([]byte, error), notifier SendNotifier, st *sendStats) error {
+	if !validSize(startMsg.Size) || startMsg.AppendFrom < 0 || startMsg.AppendFrom > startMsg.Size {
+		return ErrInvalidSize
+	}
+	size := startMsg.Size - startMsg.AppendFrom
+
+	enc, dec := streams(conn, codec)
+	pc, pooled := asPooled(conn)
+	if pooled {
+		startMsg.Capabilities |= capReuse
+	}
+	if startMsg.Hash == nil && hashFile != nil {
+		startMsg.Capabilities |= capHashRequest
+	}
+
+	if notifier != nil {
+		notifier.SendStart()
+	}
+
+	startMsg.Version = protocolVersion
+	if err := enc.Encode(startMsg); err != nil {
+		return err
+	}
+
+	if notifier != nil {
+		notifier.RecvAck()
+	}
+
+	var ack ackMessage
+	if err := dec.Decode(&ack); err != nil {
+		return err
+	}
+
+	if ack.NeedHash && startMsg.Capabilities&capHashRequest != 0 {
+		hash, err := hashFile()
+		if err != nil {
+			return err
+		}
+		startMsg.Hash = hash
+		if err := enc.Encode(startMsg); err != nil {
+			return err
+		}
+		ack = ackMessage{}
+		if err := dec.Decode(&ack); err != nil {
+			return err
+		}
+	}
+
+	if err := ack.err(); err != nil {
+		return err
+	}
+
+	if !compatibleVersion(ack.Version) {
+		return ErrUnsupportedVersion
+	}
+
+	if ack.NeedHash {
+		return fmt.Errorf("%w: Server asked for a hash the client didn't offer", ErrProtocol)
+	}
+
+	if startMsg.AppendFrom != 0 && ack.Capabilities&capAppend == 0 {
+		return ErrUnsupportedFeature
+	}
+
+	wantResult := startMsg.Capabilities&capResult != 0
+	if wantResult && ack.Capabilities&capResult == 0 {
+		return ErrUnsupportedFeature
+	}
+	if startMsg.Capabilities&capHashAlgo != 0 && ack.Capabilities&capHashAlgo == 0 {
+		return ErrUnsupportedFeature
+	}
+
+	numBlocks := getNumBlocks(size)
+	end := numBlocks
+	if startMsg.RangeEnd != 0 {
+		if ack.Capabilities&capRanges == 0 {
+			return ErrUnsupportedFeature
+		}
+		end = startMsg.RangeEnd
+	}
+
+	seqNum := ack.SeqNum
+	if seqNum < startMsg.RangeStart || seqNum > end {
+		return fmt.Errorf("%w: Server asked to resume at block %d, outside of [%d, %d)",
+			ErrProtocol, seqNum, startMsg.RangeStart, end)
+	}
+
+	committed := ack.Committed
+	if len(committed) > 0 && ack.Capabilities&capSparse == 0 {
+		committed = nil
+	}
+	if err := checkCommitted(committed, seqNum, end); err != nil {
+		return err
+	}
+
+	if ack.PrefixHash != nil {
+		runs := append([]blockRun{{startMsg.RangeStart, seqNum}}, committed...)
+		hash, err := hashRuns(r, runs, size)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, ack.PrefixHash) {
+			return errPrefixMismatch
+		}
+	}
+
+	var copies map[int64]int64
+	if ack.Capabilities&capDelta != 0 && len(ack.Signatures) > 0 {
+		var err error
+		if copies, err = findCopies(r, size, ack.Signatures); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.Seek(getFilePos(seqNum), io.SeekStart); err != nil {
+		return err
+	}
+
+	// A server that doesn't support the compression asked for acks a
+	// lesser one, or none.
+	comp := newBlockCompressor(startMsg.Capabilities & ack.Capabilities)
+
+	// Every block but the last is full. When the size is a multiple of
+	// payloadSize the last one is too, and an empty file has none at all.
+	// Encoding a message is done with its data once it returns, so every
+	// block is read into the same buffer.
+	buf := make([]byte, payloadSize)
+	var dataAckMsg dataAckMessage
+	for seqNum < end {
+		if len(committed) > 0 && committed[0].First == seqNum {
+			seqNum = committed[0].End
+			committed = committed[1:]
+			if _, err := r.Seek(getFilePos(seqNum), io.SeekStart); err != nil {
+				return err
+			}
+			if notifier != nil {
+				numBytes := getFilePos(seqNum)
+				if numBytes > size {
+					numBytes = size
+				}
+				notifier.UpdateProgress(numBytes, size)
+			}
+			continue
+		}
+
+		dataMsg := dataMessage{SeqNum: seqNum}
+		if offset, ok := copies[seqNum]; ok {
+			dataMsg.Copy = true
+			dataMsg.Offset = offset
+			if _, err := r.Seek(getFilePos(seqNum+1), io.SeekStart); err != nil {
+				return err
+			}
+		} else {
+			// A read may return less than it was asked for without being
+			// at the end, so fill the block however many reads it takes.
+			// A mapped file's blocks are sent straight from the mapping.
+			blockLen := size - getFilePos(seqNum)
+			if blockLen > payloadSize {
+				blockLen = payloadSize
+			}
+			var err error
+			if m, ok := r.(*mappedReader); ok {
+				dataMsg.Data, err = m.next(int(blockLen))
+			} else {
+				dataMsg.Data = buf[:blockLen]
+				_, err = io.ReadFull(r, dataMsg.Data)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return fmt.Errorf(
+					"Hit end of file at %d, while the last block index expected was %d",
+					seqNum, numBlocks-1)
+			} else if err != nil {
+				return err
+			}
+			if comp != nil {
+				if dataMsg.Data, err = comp.compress(dataMsg.Data); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := st.mayResend(seqNum); err != nil {
+			return err
+		}
+		if err := enc.Encode(dataMsg); err != nil {
+			return err
+		}
+		st.blockSent(seqNum, len(dataMsg.Data))
+
+		dataAckMsg = dataAckMessage{}
+		if err := dec.Decode(&dataAckMsg); err != nil {
+			return err
+		}
+
+		if dataAckMsg.SeqNum != seqNum {
+			return fmt.Errorf(
+				"%w: Server acked a payload with a different sequence number, got %d, want %d",
+				ErrProtocol, dataAckMsg.SeqNum, seqNum)
+		}
+
+		seqNum++
+
+		if notifier != nil {
+			numBytes := getFilePos(seqNum)
+			if numBytes > size {
+				numBytes = size
+			}
+			notifier.UpdateProgress(numBytes, size)
+		}
+	}
+
+	if wantResult {
+		var result resultMessage
+		if err := dec.Decode(&result); err != nil {
+			return err
+		}
+		st.resultReceived(result)
+	}
+
+	if pooled && ack.Capabilities&capReuse != 0 {
+		pc.reusable()
+	}
+	return nil
+}
+
+type Server interface {
+	Serve(func(name string) RecvNotifier) error
+	Stop()
+
+	// ShutdownContext stops accepting connections and waits for the
+	// transfers in progress to finish, or for ctx to be done, whichever
+	// comes first.
+	ShutdownContext(ctx context.Context) error
+
+	// ServeContext is like Serve, but once ctx is done it shuts the server
+	// down as ShutdownContext does, waiting for the transfers in progress
+	// however long they take, and returns nil.
+	ServeContext(ctx context.Context, createNotifier func(name string) RecvNotifier) error
+
+	// ArchiveDir returns the directory the server stores files in.
+	ArchiveDir() string
+
+	// ListFiles returns the files stored in the archive directory, and
+	// those still being received.
+	ListFiles() ([]FileInfo, error)
+}
+
+// ServerOptions holds optional settings for a server. A nil *ServerOptions
+// means the defaults.
+type ServerOptions struct {
+	// Logger receives the server's diagnostic messages.
+	Logger Logger
+
+	// StatsFunc, if set, is called with the statistics of each file the
+	// server finishes receiving.
+	StatsFunc func(name string, stats Stats)
+
+	// Codec is how messages are put on the wire. It must match the
+	// clients'. Nil means GobCodec.
+	Codec MessageCodec
+
+	// DiscardMetadata stores files with default permissions and the time
+	// they arrived, instead of the mode and modification time the client
+	// sent.
+	DiscardMetadata bool
+
+	// Overwrite decides what happens when a client sends a file that
+	// already exists. The default is OverwriteReject.
+	Overwrite OverwritePolicy
+
+	// AllowForce lets a client replace an existing file whatever the
+	// Overwrite policy says, by setting SendOptions.Force. Without it a
+	// forced send is held to the policy like any other.
+	AllowForce bool
+
+	// MaxFileSize, if positive, is the largest file the server accepts. A
+	// stream is cut off once it goes past it.
+	MaxFileSize int64
+
+	// MaxMessageSize, if positive, is the largest message the server reads
+	// from a client. A client that sends a bigger one is disconnected
+	// before the server makes room for it. The default fits a full block
+	// with room to spare, and a server using a codec of its own may need
+	// more.
+	MaxMessageSize int
+
+	// AsyncProgress calls each RecvNotifier from a goroutine of its own,
+	// as SendOptions.AsyncProgress does for senders. RecvDone is the last
+	// call, and the connection waits for it.
+	AsyncProgress bool
+
+	// ProgressInterval and ProgressBytes hold back the progress updates
+	// of each RecvNotifier as SendOptions.ProgressInterval and
+	// ProgressBytes do for senders. The last one held back is made before
+	// RecvDone.
+	ProgressInterval time.Duration
+	ProgressBytes    int64
+
+	// PathFunc, if set, maps the name a client sends a file as, and the
+	// time it starts arriving, to where the file is stored, relative to
+	// the archive directory. Directories along the way are created. The
+	// default stores it under its name. Whether the file already exists
+	// is checked at the path PathFunc returns, and a transfer resumed
+	// later stays at the path it started with.
+	PathFunc func(name string, recvTime time.Time) string
+
+	// AcceptFunc, if set, is called with the name and size of each file a
+	// client offers, before the server opens anything for it. A non-nil
+	// error turns the file away with ErrRejected, and its message goes to
+	// the client as the reason. The size of a stream is UnknownSize.
+	AcceptFunc func(name string, size int64) error
+
+	// Router, if set, picks the directory each file a client offers is
+	// stored in, from its name and size, in place of the archive
+	// directory. It is called after AcceptFunc, and an error turns the
+	// file away as AcceptFunc's does. An empty directory means the archive
+	// directory. A transfer resumed later stays in the directory it
+	// started in. Directories and symbolic links sent with SendDir still
+	// go in the archive directory, which is also all ListFiles lists. It
+	// can't be used with a Store.
+	Router func(name string, size int64) (archiveDir string, err error)
+
+	// MaxConcurrent, if positive, is how many connections the server
+	// handles at once. Further connections wait until one finishes.
+	MaxConcurrent int
+
+	// IdleTimeout, if positive, is how long to wait on a silent client
+	// before dropping the connection. The client can reconnect to resume.
+	IdleTimeout time.Duration
+
+	// HandshakeTimeout is how long a new connection has to get through the
+	// handshake and its first start message before it is dropped, and then
+	// how long it has to take the server's answer. The time the server takes
+	// to answer doesn't count. It keeps clients that connect and go quiet
+	// from holding on to a connection slot. Zero means ten seconds, and a
+	// negative value means no limit.
+	HandshakeTimeout time.Duration
+
+	// Secret, if set, makes the server challenge every client to prove it
+	// knows the secret before accepting anything from it. Clients must set
+	// the same SendOptions.Secret; those that don't fail with
+	// ErrUnauthorized.
+	Secret []byte
+
+	// Identity, if set, is the private key the server proves who it is
+	// with. Clients must then set SendOptions.ExpectServerID to its public
+	// key; those that don't fail with ErrIdentityRequired. It shows a
+	// client that the server holds the key, not that nothing sits in
+	// between, so it doesn't replace TLS against an attacker who can relay
+	// connections.
+	Identity ed25519.PrivateKey
+
+	// TempDir, if set, is where partial files are kept while they arrive,
+	// rather than beside where they will be stored. It suits an archive
+	// directory on a slow network mount with fast local disk to hand. A
+	// file is renamed into the archive once complete, or, if TempDir is on
+	// another filesystem, copied there, which takes longer and is logged.
+	// Free space is checked in TempDir.
+	TempDir string
+
+	// QuarantineDir, if set, makes the server check each file sent whole,
+	// rather than appended or in ranges over several connections, against
+	// its SHA-256, which it asks the client for, before acking the last
+	// block. The partial file of one that arrived corrupt is moved here,
+	// under the name it was sent as followed by the time, and the client
+	// sends the file again. A file with a .json suffix beside it records
+	// why: the hash expected and the one found, how many bytes arrived and
+	// from where. Without it, the server stores files as they arrive.
+	QuarantineDir string
+
+	// Preallocate reserves the whole of a file's space when its transfer
+	// starts, which keeps it from fragmenting and fails the transfer with
+	// ErrNoSpace straight away if the disk fills up in the meantime.
+	// Partial files then have their full size from the start.
+	Preallocate bool
+
+	// FileMode is the permissions of the files the server creates, and
+	// DirMode of the directories, including the archive directory if it
+	// doesn't exist. Both are subject to the umask, and zero means 0666 and
+	// 0777. A file keeps FileMode only if the client sent no mode of its
+	// own or DiscardMetadata is set.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// Store, if set, is where the server keeps the files it receives, in
+	// place of the archive directory. See Store for what it can't do.
+	Store Store
+
+	// Sink, if set, is called with the name and size of each file a
+	// client starts sending, and the writer it returns is given the file's
+	// bytes in order as they arrive, or only the bytes appended for an
+	// append. The file is still stored as usual. The writer is closed once
+	// the file is in, or, if the file fails, closed with CloseWithError
+	// when it has that method, as an io.PipeWriter does. An error from Sink
+	// turns the file away with ErrOpen, and one from the writer is logged.
+	// It can't be used with a Store.
+	Sink func(name string, size int64) (io.WriteCloser, error)
+
+	// HealthAddr, if set, is a TCP address on which Serve answers HTTP
+	// readiness probes, for load balancers and orchestrators. A GET of any
+	// path gets 200 and "OK" while the server is taking connections and
+	// can write to the archive directory, and 503 and "NotReady" with the
+	// reason otherwise. The probes stop with Serve. An address that isn't
+	// a host and port is logged, and Serve returns the error straight
+	// away.
+	HealthAddr string
+
+	// Tracer, if set, records a span for each file the server receives,
+	// as a child of the sender's span if the sender traced it too.
+	Tracer Tracer
+
+	// Dedup stores a file the server already has the contents of, under
+	// another name, as a copy of that file, without the client sending
+	// any blocks. The server knows the contents of the files it has
+	// received since it started, and checks that a file still has them
+	// before copying it. It only applies to new files sent whole, and not
+	// with a Store.
+	Dedup bool
+
+	// ReceivedIndex, if set, is the file in which the server keeps a
+	// record of the last time it received each file in full, which
+	// clients can ask for with LastReceived. The server appends a line to
+	// it for each file, and a server started with the same ReceivedIndex
+	// knows what its predecessor received, and compacts it. Without it,
+	// the server keeps no records, and LastReceived finds none. It should
+	// be outside the archive directory, where a client could send a file
+	// over it.
+	ReceivedIndex string
+
+	// ProxyProtocol makes the server expect every connection to start
+	// with a PROXY protocol header, version 1 or 2, as a load balancer
+	// such as HAProxy sends, and take the client's address from it. A
+	// connection without one is dropped, so it is only for a server that
+	// clients reach through the balancer alone.
+	ProxyProtocol bool
+
+	// ForbidSubpaths turns away, with ErrInvalidName, files and directories
+	// whose names put them in a subdirectory, such as "logs/app.log", so
+	// that clients can't lay out the archive directory themselves. SendDir
+	// then only works for a directory with no subdirectories. A PathFunc
+	// may still put files in subdirectories.
+	ForbidSubpaths bool
+
+	// PreserveOwner gives each file the server receives the user and group
+	// that own it on the client, by their numeric IDs, for backups within
+	// one set of accounts. Only a server running as root on a Unix system
+	// can; any other logs that it can't and leaves files owned by itself.
+	// It doesn't apply to a Store.
+	PreserveOwner bool
+}
+
+type server struct {
+	listener   net.Listener
+	archiveDir string
+	logger     Logger
+	statsFunc  func(name string, stats Stats)
+	codec      MessageCodec
+	noMetadata bool
+	overwrite  OverwritePolicy
+	allowForce bool
+	maxSize    int64
+	maxMsg     int
+	tracer     Tracer
+	async      bool
+	progEvery  time.Duration
+	progBytes  int64
+	pathFunc   func(name string, recvTime time.Time) string
+	accept     func(name string, size int64) error
+	router     func(name string, size int64) (string, error)
+	sink       func(name string, size int64) (io.WriteCloser, error)
+	idle       time.Duration
+	handshake  time.Duration
+	secret     []byte
+	identity   ed25519.PrivateKey
+	prealloc   bool
+	fileMode   os.FileMode
+	dirMode    os.FileMode
+	store      Store
+	healthAddr string
+	dedup      bool
+	tempDir    string
+	quarantine string
+	proxied    bool
+	chown      bool
+	flat       bool
+
+	// err is what is wrong with the server's options, if anything. Serve
+	// returns it rather than start.
+	err error
+
+	// slots holds a token for each connection being handled, if the
+	// number is limited.
+	slots chan bool
+
+	// openMu makes the handshakes of connections for the same file, such
+	// as those of a parallel transfer, agree on one transfer.
+	openMu sync.Mutex
+
+	mu        sync.Mutex
+	transfers map[string]*transfer
+
+	// held maps each range of blocks a connection is receiving to a
+	// channel closed when it lets go, so that a client that reconnects
+	// before the server notices its last connection died doesn't have two
+	// connections writing the same blocks.
+	held map[heldKey]chan struct{}
+
+	// contents maps the SHA-256 of each file received whole to where it
+	// was stored, for Dedup.
+	contents map[string]string
+
+	// records maps the name of each file received in full to the record
+	// of the last time it was, if the server keeps them in recordsPath.
+	// recordsMu keeps appends to recordsPath in order.
+	records     map[string]ReceiveRecord
+	recordsMu   sync.Mutex
+	recordsPath string
+
+	// active maps each open connection to the name of the file it is
+	// receiving, or "" before the start message arrives. wg counts them.
+	// waiting holds the connections kept open for another file that
+	// haven't sent its start message yet.
+	active   map[net.Conn]string
+	waiting  map[net.Conn]bool
+	wg       sync.WaitGroup
+	shutdown bool
+}
+
+// transfer is the server's record of a file it has started receiving, kept
+// so that a client that reconnects can resume where it left off.
+type transfer struct {
+	// root is the archive directory the file is stored in, and path where
+	// in it.
+	root    string
+	path    string
+	size    int64
+	modTime time.Time
+	started time.Time
+
+	// offset is where the blocks go in the file: zero, or the size the
+	// file had before a client started appending to it.
+	offset int64
+
+	// signatures describe the existing file the client may copy blocks
+	// from, if it asked to.
+	signatures []blockSignature
+
+	// w is the file being written, if it goes to a Store. The connections
+	// of the transfer share it, and the one that finishes the file closes
+	// it.
+	w WriterAtCloser
+
+	// hash takes the digests of the file as its blocks are written, so
+	// that it needn't be read back for them. It is nil for a Store.
+	hash *runningHash
+
+	// sink passes the blocks on to ServerOptions.Sink's writer, if there
+	// is one.
+	sink *blockSink
+
+	// mu guards the rest, which connections sending parts of the file in
+	// parallel share. ranges maps the first block of each range being
+	// sent to it, and received counts the blocks written in all of them.
+	mu        sync.Mutex
+	ranges    map[int64]*blockRange
+	received  int64
+	finishing bool
+	stats     Stats
+}
+
+// blockRange is a run of blocks [first, end) of a file that one connection
+// at a time sends, next the first of them not yet written, and ahead those
+// after next that have been.
+type blockRange struct {
+	first int64
+	next  int64
+	end   int64
+	ahead map[int64]bool
+}
+
+// length is how many bytes of the file the transfer carries.
+func (tr *transfer) length() int64 {
+	return tr.size - tr.offset
+}
+
+// prefix returns how many blocks at the start of the file are in, across its
+// ranges. tr.mu must be held.
+func (tr *transfer) prefix() int64 {
+	var n int64
+	for rng := tr.ranges[0]; rng != nil; rng = tr.ranges[rng.end] {
+		if rng.next < rng.end {
+			return rng.next
+		}
+		n = rng.end
+	}
+	return n
+}
+
+func (r *blockRange) overlaps(first, end int64) bool {
+	return first < r.end && r.first < end
+}
+
+func NewServer(listener net.Listener, archiveDir string) Server {
+	return NewServerWithOptions(listener, archiveDir, nil)
+}
+
+func NewServerWithOptions(listener net.Listener, archiveDir string, opts *ServerOptions) Server {
+	return newServer(listener, archiveDir, opts)
+}
+
+// NewServerChecked is like NewServerWithOptions, but returns an error if the
+// archive directory or TempDir isn't a directory and can't be created, or
+// another setting is invalid. The server NewServerWithOptions returns logs
+// these, and its Serve returns the error straight away.
+func NewServerChecked(listener net.Listener, archiveDir string, opts *ServerOptions) (Server, error) {
+	srv := newServer(listener, archiveDir, opts)
+	if srv.err != nil {
+		return nil, srv.err
+	}
+	return srv, nil
+}
+
+func newServer(listener net.Listener, archiveDir string, opts *ServerOptions) *server {
+	if opts == nil {
+		opts = &ServerOptions{}
+	}
+
+	var slots chan bool
+	if opts.MaxConcurrent > 0 {
+		slots = make(chan bool, opts.MaxConcurrent)
+	}
+
+	srv := &server{
+		listener:    listener,
+		archiveDir:  archiveDir,
+		logger:      orDefault(opts.Logger),
+		statsFunc:   opts.StatsFunc,
+		codec:       orDefaultCodec(opts.Codec),
+		noMetadata:  opts.DiscardMetadata,
+		overwrite:   opts.Overwrite,
+		allowForce:  opts.AllowForce,
+		maxSize:     opts.MaxFileSize,
+		maxMsg:      opts.MaxMessageSize,
+		tracer:      opts.Tracer,
+		async:       opts.AsyncProgress,
+		progEvery:   opts.ProgressInterval,
+		progBytes:   opts.ProgressBytes,
+		pathFunc:    opts.PathFunc,
+		accept:      opts.AcceptFunc,
+		router:      opts.Router,
+		sink:        opts.Sink,
+		idle:        opts.IdleTimeout,
+		handshake:   orDuration(opts.HandshakeTimeout, defaultHandshakeTimeout),
+		secret:      opts.Secret,
+		identity:    opts.Identity,
+		prealloc:    opts.Preallocate,
+		fileMode:    orMode(opts.FileMode, 0666),
+		dirMode:     orMode(opts.DirMode, 0777),
+		store:       opts.Store,
+		healthAddr:  opts.HealthAddr,
+		dedup:       opts.Dedup,
+		tempDir:     opts.TempDir,
+		quarantine:  opts.QuarantineDir,
+		proxied:     opts.ProxyProtocol,
+		chown:       opts.PreserveOwner,
+		flat:        opts.ForbidSubpaths,
+		slots:       slots,
+		transfers:   make(map[string]*transfer),
+		held:        make(map[heldKey]chan struct{}),
+		contents:    make(map[string]string),
+		records:     make(map[string]ReceiveRecord),
+		recordsPath: opts.ReceivedIndex,
+		active:      make(map[net.Conn]string),
+		waiting:     make(map[net.Conn]bool),
+	}
+
+	srv.loadRecords()
+
+	if srv.chown && !canChown() {
+		srv.logger.Logf("Can't give files their owners without running as root, so PreserveOwner has no effect")
+		srv.chown = false
+	}
+
+	if srv.router != nil && srv.store != nil {
+		srv.err = errors.New("A Router can't be used with a Store")
+		srv.logger.Logf("%v", srv.err)
+	}
+
+	if srv.sink != nil && srv.store != nil {
+		srv.err = errors.New("A Sink can't be used with a Store")
+		srv.logger.Logf("%v", srv.err)
+	}
+
+	if srv.healthAddr != "" {
+		if err := checkAddr("tcp", srv.healthAddr); err != nil {
+			srv.err = fmt.Errorf("Invalid health address: %v", err)
+			srv.logger.Logf("%v", srv.err)
+		}
+	}
+
+	// Every transfer would fail with ErrOpen if this doesn't work, so
+	// Serve fails instead.
+	if srv.store == nil && srv.err == nil {
+		if err := os.MkdirAll(archiveDir, srv.dirMode); err != nil {
+			srv.err = fmt.Errorf("Invalid archive directory: %v", err)
+			srv.logger.Logf("%v", srv.err)
+		} else if srv.tempDir != "" {
+			if err := os.MkdirAll(srv.tempDir, srv.dirMode); err != nil {
+				srv.err = fmt.Errorf("Invalid temporary directory: %v", err)
+				srv.logger.Logf("%v", srv.err)
+			}
+		}
+		if srv.err == nil && srv.quarantine != "" {
+			if err := os.MkdirAll(srv.quarantine, srv.dirMode); err != nil {
+				srv.err = fmt.Errorf("Invalid quarantine directory: %v", err)
+				srv.logger.Logf("%v", srv.err)
+			}
+		}
+	}
+
+	return srv
+}
+
+// orMode returns mode, or def if mode is zero.
+func orMode(mode, def os.FileMode) os.FileMode {
+	if mode == 0 {
+		return def
+	}
+	return mode
+}
+
+func orDuration(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+func fileExists(fpath string) bool {
+	if _, err := os.Stat(fpath); err != nil {
+		return false
+	}
+	return true
+}
+
+// isLocalName reports whether name, joined to the archive directory, names
+// something inside it.
+func isLocalName(name string) bool {
+	if path.IsAbs(name) || filepath.IsAbs(name) {
+		return false
+	}
+
+	clean := path.Clean(filepath.ToSlash(name))
+	return clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// isSubpath reports whether name, which isLocalName accepts, puts what it
+// names in a subdirectory of the archive directory.
+func isSubpath(name string) bool {
+	return strings.Contains(path.Clean(filepath.ToSlash(name)), "/")
+}
+
+// recv handles a connection from a client. A client that asks for capReuse
+// may send another file once one is done, so recv keeps taking start
+// messages until the client hangs up or a transfer fails.
+func (srv *server) recv(conn net.Conn, createNotifier func(name string) RecvNotifier) error {
+	enc := srv.codec.NewEncoder(conn)
+
+	// The connection is dropped unless the client gets its first start
+	// message in, and then takes the server's answer to it, in time. The
+	// idle timeout can't see to this, as a client that trickles bytes
+	// keeps it from running out. What the server does in between, such as
+	// hashing the file it has, doesn't count.
+	var timer *time.Timer
+	if srv.handshake > 0 {
+		expire := func() {
+			srv.logger.Logf("Client at %s took too long over the handshake", conn.RemoteAddr())
+			conn.Close()
+		}
+		timer = time.AfterFunc(srv.handshake, expire)
+		defer timer.Stop()
+		enc = &handshakeEncoder{Encoder: enc, timeout: srv.handshake, expire: expire}
+	}
+
+	// fail reports the end of a connection that didn't get as far as a
+	// file.
+	fail := func(err error) error {
+		if createNotifier != nil {
+			newGuardedRecvNotifier(createNotifier, "", srv.logger).RecvDone("", err)
+		}
+		return err
+	}
+
+	// The handshake happens before the decoder exists, since a decoder
+	// may read ahead of the message it decodes.
+	if pc, ok := conn.(*proxyConn); ok {
+		if err := pc.readHeader(); err != nil {
+			return fail(err)
+		}
+	}
+	// refuse turns the client away with code once it has sent its start
+	// message, which it reads from r. Reading it first means closing the
+	// connection doesn't reset it before the client sees the ack.
+	refuse := func(r io.Reader, code ErrCode, err error) error {
+		var startMsg startMessage
+		srv.newDecoder(r).Decode(&startMsg)
+		return fail(sendClientErr(enc, code, err))
+	}
+	if srv.identity != nil {
+		if ok, unread, err := proveIdentity(conn, srv.identity); err != nil {
+			return fail(err)
+		} else if !ok {
+			// The client doesn't know the server has an identity. It
+			// still gets through the challenge, if it asks for one, so
+			// that it hears why it is turned away.
+			r := io.MultiReader(bytes.NewReader(unread), conn)
+			if srv.secret != nil {
+				_, unread, err := challenge(readWriter{r, conn}, srv.secret)
+				if err != nil {
+					return fail(err)
+				}
+				r = io.MultiReader(bytes.NewReader(unread), conn)
+			}
+			return refuse(r, ErrIdentityRequired,
+				fmt.Errorf("Client at %s didn't ask the server to prove its identity", conn.RemoteAddr()))
+		}
+	}
+	if srv.secret != nil {
+		if ok, unread, err := challenge(conn, srv.secret); err != nil {
+			return fail(err)
+		} else if !ok {
+			return refuse(io.MultiReader(bytes.NewReader(unread), conn), ErrUnauthorized,
+				fmt.Errorf("Client at %s failed the challenge", conn.RemoteAddr()))
+		}
+	}
+
+	dec := srv.newDecoder(conn)
+	for files := 0; ; files++ {
+		var startMsg startMessage
+		if err := dec.Decode(&startMsg); err != nil {
+			// A client that kept the connection open hangs up when it has
+			// no more files to send.
+			if files > 0 {
+				return nil
+			}
+			return fail(err)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if startMsg.Capabilities&capMux != 0 && startMsg.Name == "" {
+			return srv.recvMux(conn, enc, dec, createNotifier)
+		}
+		if startMsg.Capabilities&capList != 0 && startMsg.Name == "" {
+			return srv.sendList(enc)
+		}
+		if startMsg.Capabilities&capRecord != 0 && startMsg.Name == "" {
+			return srv.sendRecord(enc, startMsg.RecordOf)
+		}
+		if !srv.claim(conn, startMsg.Name) {
+			return nil
+		}
+		if err := srv.recvFile(enc, dec, startMsg, conn.RemoteAddr(), createNotifier); err != nil {
+			return err
+		}
+		if startMsg.Capabilities&capReuse == 0 || !srv.park(conn) {
+			return nil
+		}
+	}
+}
+
+// claim records that conn is receiving name. It returns false if conn was
+// waiting for another file and the server has begun shutting down.
+func (srv *server) claim(conn net.Conn, name string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.waiting[conn] {
+		delete(srv.waiting, conn)
+		if srv.shutdown {
+			return false
+		}
+	}
+	srv.active[conn] = name
+	return true
+}
+
+// park records that conn is waiting for another file, so that
+// ShutdownContext closes it rather than wait. It returns false if the server
+// is shutting down.
+func (srv *server) park(conn net.Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.shutdown {
+		return false
+	}
+	srv.active[conn] = ""
+	srv.waiting[conn] = true
+	return true
+}
+
+// sendClientErr acks a start message with errType, and returns a
+// TransferError with errType and err as the reason.
+func sendClientErr(enc Encoder, errType ErrCode, err error) error {
+	if err := enc.Encode(ackMessage{Version: protocolVersion, ErrType: errType}); err != nil {
+		return fmt.Errorf("Error sending client an error message: %v", err)
+	}
+	return TransferError{Code: errType, Reason: err.Error()}
+}
+
+// rejectFile turns away the file a client offered, giving it reason.
+func rejectFile(enc Encoder, reason error) error {
+	ack := ackMessage{Version: protocolVersion, ErrType: ErrRejected, Reason: reason.Error()}
+	if err := enc.Encode(ack); err != nil {
+		return fmt.Errorf("Error sending client an error message: %v", err)
+	}
+	return ack.err()
+}
+
+// recvFile receives the file described by startMsg, which the client at
+// client sent over the connection enc and dec use.
+func (srv *server) recvFile(enc Encoder, dec Decoder, startMsg startMessage, client net.Addr, createNotifier func(name string) RecvNotifier) (err error) {
+	var notifier RecvNotifier
+	if createNotifier != nil {
+		notifier = newGuardedRecvNotifier(createNotifier, startMsg.Name, srv.logger)
+		if srv.async {
+			notifier = &asyncRecvNotifier{newNotifyQueue(), notifier}
+		}
+		if srv.progEvery > 0 || srv.progBytes > 0 {
+			notifier = &throttledRecvNotifier{notifier, progressThrottle{
+				interval: srv.progEvery,
+				bytes:    srv.progBytes,
+			}}
+		}
+		notifier.RecvStart()
+		defer func() { notifier.RecvDone(startMsg.Name, err) }()
+	}
+
+	if srv.tracer != nil {
+		ctx := srv.tracer.Extract(context.Background(), startMsg.TraceContext)
+		_, span := srv.tracer.Start(ctx, "rtransfer.recv")
+		span.SetAttribute(attrFile, startMsg.Name)
+		span.SetAttribute(attrSize, startMsg.Size)
+		span.SetAttribute(attrBlockSize, payloadSize)
+		defer func() { span.End(err) }()
+	}
+
+	if !compatibleVersion(startMsg.Version) {
+		return sendClientErr(enc, ErrUnsupportedVersion,
+			fmt.Errorf("Client speaks protocol version %d, I speak %d", startMsg.Version, protocolVersion))
+	}
+
+	if startMsg.Name == "" {
+		return sendClientErr(enc, ErrEmptyFilename,
+			fmt.Errorf("Client tried to send a file with no name"))
+	}
+
+	if !isLocalName(startMsg.Name) {
+		return sendClientErr(enc, ErrInvalidName,
+			fmt.Errorf("Client tried to send a file outside the archive (%s)", startMsg.Name))
+	}
+
+	if srv.flat && isSubpath(startMsg.Name) {
+		return sendClientErr(enc, ErrInvalidName,
+			fmt.Errorf("Client tried to send a file into a subdirectory (%s)", startMsg.Name))
+	}
+
+	streaming := startMsg.Size == UnknownSize && startMsg.Capabilities&capStream != 0
+	if !validSize(startMsg.Size) && !streaming {
+		return sendClientErr(enc, ErrInvalidSize,
+			fmt.Errorf("Client tried to send a file with size %d", startMsg.Size))
+	}
+
+	if streaming && (startMsg.AppendFrom != 0 || startMsg.RangeEnd != 0 || startMsg.IsDir || startMsg.LinkTarget != "") {
+		return sendClientErr(enc, ErrUnsupportedFeature,
+			fmt.Errorf("Client tried to stream %s as something other than a whole file", startMsg.Name))
+	}
+
+	if srv.maxSize > 0 && startMsg.Size > srv.maxSize {
+		return sendClientErr(enc, ErrTooLarge,
+			fmt.Errorf("Client tried to send %s with %d bytes, over the limit of %d",
+				startMsg.Name, startMsg.Size, srv.maxSize))
+	}
+
+	if startMsg.AppendFrom < 0 || (!streaming && startMsg.AppendFrom > startMsg.Size) {
+		return sendClientErr(enc, ErrInvalidSize,
+			fmt.Errorf("Client tried to append %s at %d, past its size of %d",
+				startMsg.Name, startMsg.AppendFrom, startMsg.Size))
+	}
+
+	if _, err := startMsg.HashAlgo.newHash(); err != nil {
+		return sendClientErr(enc, ErrUnsupportedFeature, err)
+	}
+
+	if startMsg.IsDir {
+		return srv.recvDir(enc, startMsg.Name)
+	}
+
+	if startMsg.LinkTarget != "" {
+		if srv.store != nil {
+			return sendClientErr(enc, ErrUnsupportedFeature,
+				fmt.Errorf("Client tried to send a link (%s), which a Store can't hold", startMsg.Name))
+		}
+		return srv.recvLink(enc, startMsg)
+	}
+
+	if srv.accept != nil {
+		if reason := srv.accept(startMsg.Name, startMsg.Size); reason != nil {
+			return rejectFile(enc, reason)
+		}
+	}
+
+	root, reason := srv.root(startMsg.Name, startMsg.Size)
+	if reason != nil {
+		return rejectFile(enc, reason)
+	}
+
+	if startMsg.Hash == nil && startMsg.Capabilities&capHashRequest != 0 && srv.needsHash(startMsg, root) {
+		if startMsg, err = askHash(enc, dec, startMsg); err != nil {
+			return err
+		}
+	}
+
+	if known, err := srv.recvKnown(enc, startMsg, root); known || err != nil {
+		return err
+	}
+
+	// A client that reconnected while the server still has its last
+	// connection waits a while for the server to notice that one died.
+	tr, rng, f, errType, err := srv.openTransfer(startMsg, root)
+	var busy *busyError
+	if errors.As(err, &busy) {
+		timer := time.NewTimer(busyWait)
+		select {
+		case <-busy.released:
+			timer.Stop()
+			tr, rng, f, errType, err = srv.openTransfer(startMsg, root)
+		case <-timer.C:
+		}
+	}
+	if err != nil {
+		return sendClientErr(enc, errType, err)
+	}
+	if tr == nil {
+		return srv.dryRun(enc, dec, startMsg)
+	}
+	defer srv.letGo(heldKey{tr.path, rng.first})
+	defer f.Close()
+
+	// A stream can't be resumed, so nothing is kept of one that fails.
+	if streaming {
+		defer func() {
+			if err != nil {
+				srv.dropStream(tr, startMsg.Name, err)
+			}
+		}()
+	}
+
+	fpath := tr.path
+	partPath := srv.partPath(fpath)
+
+	if createNotifier != nil {
+		notifier.SendAck()
+	}
+
+	// The existing file stays in place until this one is complete, so the
+	// client can copy blocks out of it.
+	var basis *os.File
+	if tr.signatures != nil {
+		if basis, err = os.Open(fpath); err != nil {
+			return sendClientErr(enc, ErrOpen, err)
+		}
+		defer basis.Close()
+	}
+
+	// A client that can't skip the blocks the range has after next sends
+	// them all, so they are taken again.
+	tr.mu.Lock()
+	ackMsg := ackMessage{
+		Version:      protocolVersion,
+		Capabilities: pickCompression(startMsg.Capabilities & srv.capabilities()),
+		Name:         startMsg.Name,
+		Size:         tr.size,
+		SeqNum:       rng.next,
+		ErrType:      ErrSuccess,
+		Signatures:   tr.signatures,
+	}
+	if ackMsg.Capabilities&capSparse != 0 {
+		ackMsg.Committed = rng.aheadRuns()
+	} else {
+		rng.ahead = nil
+	}
+	tr.mu.Unlock()
+
+	// Only this connection writes the range, so its blocks can be read
+	// without holding tr.mu. A file in a Store may not be readable, and
+	// then the client takes the blocks it was acked on trust.
+	r, readable := f.(io.ReaderAt)
+	if (ackMsg.SeqNum > rng.first || len(ackMsg.Committed) > 0) && readable {
+		blocks := io.NewSectionReader(r, tr.offset, tr.length())
+		runs := append([]blockRun{{rng.first, ackMsg.SeqNum}}, ackMsg.Committed...)
+		if ackMsg.PrefixHash, err = hashRuns(blocks, runs, tr.length()); err != nil {
+			return sendClientErr(enc, ErrOpen, err)
+		}
+	}
+	if err := enc.Encode(ackMsg); err != nil {
+		return err
+	}
+
+	// A connection that ends before the file is in records the blocks the
+	// server has, so that a later server can pick them up. It may stop
+	// before recording them, and then the client sends them again. A file
+	// that arrived corrupt has nothing worth picking up.
+	var discarded bool
+	if !streaming && srv.recordsBlocks(tr, rng) {
+		defer func() {
+			if err != nil && !discarded {
+				if err := srv.saveBlocks(tr, rng, startMsg.Name); err != nil {
+					srv.logger.Logf("Couldn't record the blocks of %s: %v", startMsg.Name, err)
+				}
+			}
+		}()
+	}
+
+	// A decoder leaves alone the fields a message doesn't set, so dataMsg
+	// is cleared for each block, but keeps its buffer for the next one's
+	// data. The size of a stream is what arrives before its end, and
+	// streamed counts it.
+	//
+	// Each block is written where its SeqNum puts it. rng.next only moves
+	// past a block once every block before it is in, and rng.ahead holds
+	// the blocks that came early. A block the range already has is acked
+	// again but not written.
+	numBlocks := getNumBlocks(tr.length())
+	comp := newBlockCompressor(ackMsg.Capabilities)
+	var streamed int64
+	var dataMsg dataMessage
+	for rng.next < rng.end {
+		dataMsg = dataMessage{Data: dataMsg.Data[:0]}
+		if err := dec.Decode(&dataMsg); err != nil {
+			return err
+		}
+
+		seqNum := dataMsg.SeqNum
+		if streaming && seqNum != rng.next {
+			return fmt.Errorf("Client sent block %d of %s out of order, want block %d of the stream",
+				seqNum, startMsg.Name, rng.next)
+		}
+		if streaming && dataMsg.End {
+			numBlocks = seqNum
+			break
+		}
+		if seqNum < rng.first || seqNum >= rng.end {
+			return fmt.Errorf("Client sent block %d of %s, outside of [%d, %d)",
+				seqNum, startMsg.Name, rng.first, rng.end)
+		}
+		if seqNum < rng.next || rng.ahead[seqNum] {
+			if err := enc.Encode(dataAckMessage{SeqNum: seqNum}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data := dataMsg.Data
+		if comp != nil && !dataMsg.Copy && !dataMsg.End {
+			if data, err = comp.decompress(data); err != nil {
+				return fmt.Errorf("Client sent a block of %s that doesn't decompress: %v", startMsg.Name, err)
+			}
+		}
+
+		if streaming {
+			if streamed != getFilePos(seqNum) || dataMsg.Copy {
+				return fmt.Errorf("Client sent a short block of %s before the end of the stream", startMsg.Name)
+			}
+			if srv.maxSize > 0 && streamed+int64(len(data)) > srv.maxSize {
+				return fmt.Errorf("Client streamed more of %s than the limit of %d bytes", startMsg.Name, srv.maxSize)
+			}
+			streamed += int64(len(data))
+		}
+
+		if dataMsg.Copy {
+			if data, err = copyBlock(basis, dataMsg.Offset, seqNum, tr.length()); err != nil {
+				return err
+			}
+		}
+
+		if _, err := f.WriteAt(data, tr.offset+getFilePos(seqNum)); err != nil {
+			return err
+		}
+		tr.hash.add(tr.offset+getFilePos(seqNum), data)
+		tr.sink.add(tr.offset+getFilePos(seqNum), data)
+
+		// The block is on disk, so a client that reconnects after losing
+		// the ack doesn't send it again.
+		tr.mu.Lock()
+		if seqNum == rng.next {
+			for rng.next++; rng.ahead[rng.next]; rng.next++ {
+				delete(rng.ahead, rng.next)
+				tr.received++
+			}
+			tr.received++
+		} else {
+			if rng.ahead == nil {
+				rng.ahead = make(map[int64]bool)
+			}
+			rng.ahead[seqNum] = true
+		}
+		tr.stats.Bytes += int64(len(dataMsg.Data))
+		tr.stats.Blocks++
+		received := tr.received
+		prefix := tr.prefix()
+		tr.mu.Unlock()
+
+		// Blocks that came early, over this connection or another, are
+		// taken from the file once the ones before them are in, so that
+		// the digests are done by the time the last block is acked. If
+		// they can't be, the file is read back for them after all.
+		if !streaming && readable {
+			end := getFilePos(prefix)
+			if end > tr.length() {
+				end = tr.length()
+			}
+			if err := tr.hash.catchUp(r, tr.offset+end); err != nil {
+				srv.logger.Logf("Couldn't read back blocks of %s: %v", startMsg.Name, err)
+			}
+			if err := tr.sink.catchUp(r, tr.offset+end); err != nil {
+				srv.logger.Logf("Couldn't pass blocks of %s on to the sink: %v", startMsg.Name, err)
+			}
+		}
+
+		// With a QuarantineDir, a file sent whole is checked against the
+		// hash the client gave before its last block is acked. One that
+		// arrived corrupt is set aside, and the client, finding the
+		// connection closed without the ack, sends it again.
+		if received == numBlocks && srv.quarantine != "" && !streaming && rng.first == 0 && rng.end == numBlocks {
+			if err := srv.checkHash(tr, f, startMsg, client); err != nil {
+				discarded = true
+				return err
+			}
+		}
+
+		if err := enc.Encode(dataAckMessage{SeqNum: seqNum}); err != nil {
+			return err
+		}
+
+		if createNotifier != nil {
+			if streaming {
+				notifier.UpdateProgress(streamed, UnknownSize)
+			} else {
+				numBytes := getFilePos(received)
+				if numBytes > tr.length() {
+					numBytes = tr.length()
+				}
+				notifier.UpdateProgress(numBytes, tr.length())
+			}
+		}
+	}
+
+	size := tr.size
+	if streaming {
+		size = streamed
+	}
+
+	// When a file comes in over several connections, the one that sees the
+	// last block arrive stores it. An empty file has no blocks, so the
+	// connection that opened it stores it straight away.
+	tr.mu.Lock()
+	last := tr.received == numBlocks && !tr.finishing
+	if last {
+		tr.finishing = true
+	}
+	tr.mu.Unlock()
+	if !last {
+		if ackMsg.Capabilities&capResult != 0 {
+			return enc.Encode(resultMessage{})
+		}
+		return nil
+	}
+
+	// The digests are finished with the blocks they missed, such as those
+	// of other ranges or an earlier server, and so is the sink.
+	if readable {
+		if err := tr.hash.catchUp(r, size); err != nil {
+			srv.logger.Logf("Couldn't read back blocks of %s: %v", startMsg.Name, err)
+		}
+		tr.sink.catchUp(r, size)
+	}
+	if err := tr.sink.close(size - tr.offset); err != nil {
+		srv.logger.Logf("Couldn't pass %s on to the sink: %v", startMsg.Name, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// An append writes to the file itself, which is done once it is as
+	// long as the client said.
+	switch {
+	case srv.store != nil:
+		if err = tr.w.Close(); err == nil {
+			err = srv.store.Finalize(fpath)
+		}
+	case tr.offset > 0:
+		if err = checkSize(fpath, startMsg.Name, size); err == nil {
+			srv.removeBlocks(fpath)
+		}
+	default:
+		if err = srv.storeFile(partPath, fpath, startMsg.Name, size); err == nil {
+			srv.removeBlocks(fpath)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if !srv.noMetadata && srv.store == nil {
+		if err := applyMetadata(fpath, startMsg); err != nil {
+			srv.logger.Logf("Couldn't restore the metadata of %s: %v", startMsg.Name, err)
+		}
+	}
+	srv.applyOwner(fpath, startMsg)
+
+	srv.mu.Lock()
+	delete(srv.transfers, startMsg.Name)
+	if srv.dedup && srv.store == nil {
+		hash := startMsg.Hash
+		if hash == nil && tr.offset == 0 {
+			hash = tr.hash.sum(HashSHA256, size)
+		}
+		if len(hash) == sha256.Size {
+			srv.contents[string(hash)] = fpath
 		}
+	}
+	srv.mu.Unlock()
+	srv.remember(srv.recordOf(startMsg, tr.root, fpath, size, tr.hash))
+
+	if srv.statsFunc != nil {
+		tr.mu.Lock()
+		stats := tr.stats
+		tr.mu.Unlock()
+		stats.Elapsed = time.Since(tr.started)
+		srv.statsFunc(startMsg.Name, stats)
+	}
 
-		if _, err := f.WriteAt(dataMsg.Data, getFilePos(srv.seqNum)); err != nil {
+	if streaming {
+		if err := enc.Encode(dataAckMessage{SeqNum: numBlocks}); err != nil {
 			return err
 		}
+	}
 
-		if err := enc.Encode(dataAckMessage{srv.seqNum}); err != nil {
+	if ackMsg.Capabilities&capResult != 0 {
+		result, err := srv.result(tr.root, fpath, size, startMsg.HashAlgo, tr.hash)
+		if err != nil {
 			return err
 		}
+		return enc.Encode(result)
+	}
+	return nil
+}
 
-		srv.seqNum++
+// result describes the file stored at fpath in root, as destPath returns
+// it, for a client that asked for capResult, with the digest algo names. h,
+// which may be nil, has normally taken that digest as the blocks arrived,
+// and the file is only read for it if h couldn't.
+func (srv *server) result(root, fpath string, size int64, algo HashAlgo, h *runningHash) (resultMessage, error) {
+	if srv.store != nil {
+		return resultMessage{StoredPath: fpath, Size: size}, nil
+	}
 
-		if createNotifier != nil {
-			numBytes := getFilePos(srv.seqNum)
-			if numBytes > srv.size {
-				numBytes = srv.size
+	rel, err := filepath.Rel(root, fpath)
+	if err != nil {
+		return resultMessage{}, err
+	}
+	if algo == HashNone {
+		return resultMessage{StoredPath: filepath.ToSlash(rel), Size: size}, nil
+	}
+	if hash := h.sum(algo, size); hash != nil {
+		return resultMessage{StoredPath: filepath.ToSlash(rel), Size: size, Hash: hash}, nil
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return resultMessage{}, err
+	}
+	defer f.Close()
+	hash, err := algo.digest(f)
+	if err != nil {
+		return resultMessage{}, err
+	}
+	return resultMessage{StoredPath: filepath.ToSlash(rel), Size: size, Hash: hash}, nil
+}
+
+// root returns the archive directory the file the client calls name, of size
+// bytes, is stored in, as the Router picks it. An error from the Router is
+// the reason to turn the file away.
+func (srv *server) root(name string, size int64) (string, error) {
+	if srv.router == nil {
+		return srv.archiveDir, nil
+	}
+	root, err := srv.router(name, size)
+	if err != nil || root == "" {
+		return srv.archiveDir, err
+	}
+	return root, nil
+}
+
+// destPath returns where the file the client calls name is stored if it
+// starts arriving at recvTime: its path in root, as root returns it, or its
+// name in the Store.
+func (srv *server) destPath(root, name string, recvTime time.Time) (string, error) {
+	rel := name
+	if srv.pathFunc != nil {
+		rel = srv.pathFunc(name, recvTime)
+		if !isLocalName(rel) {
+			return "", fmt.Errorf("PathFunc put %s at %q, outside the archive directory", name, rel)
+		}
+	}
+	if srv.store != nil {
+		return path.Clean(rel), nil
+	}
+	return path.Join(root, rel), nil
+}
+
+// exists reports whether there is a file at fpath, as destPath returns it.
+func (srv *server) exists(fpath string) bool {
+	if srv.store != nil {
+		return srv.store.Exists(fpath)
+	}
+	return fileExists(fpath)
+}
+
+// newDecoder returns a decoder for the messages a client sends, read from r,
+// held to the server's message size limit.
+func (srv *server) newDecoder(r io.Reader) Decoder {
+	limit := srv.maxMsg
+	if limit <= 0 {
+		limit = defaultMaxMessageSize
+	}
+	return newLimitedDecoder(srv.codec, r, limit)
+}
+
+// capabilities returns the capabilities the server supports.
+func (srv *server) capabilities() capability {
+	if srv.store != nil {
+		return serverCapabilities &^ storeUnsupported
+	}
+	return serverCapabilities
+}
+
+// adoptable returns how many of the blocks before the one the client that
+// sent startMsg proposes to resume from the partial file at partPath is long
+// enough to hold. The client checks that they match before going on.
+func adoptable(partPath string, startMsg startMessage) int64 {
+	if startMsg.ResumeFrom <= 0 || startMsg.RangeEnd != 0 || startMsg.AppendFrom != 0 ||
+		startMsg.ResumeFrom > getNumBlocks(startMsg.Size) {
+		return 0
+	}
+
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return 0
+	}
+	have := info.Size() / payloadSize
+	if info.Size() >= startMsg.Size {
+		have = getNumBlocks(startMsg.Size)
+	}
+	if have < startMsg.ResumeFrom {
+		return have
+	}
+	return startMsg.ResumeFrom
+}
+
+// storeFile moves the complete partial file at partPath to fpath, once it has
+// checked that the file, which the client called name, has size bytes. A
+// partial file on another filesystem, in the TempDir, is copied over.
+func (srv *server) storeFile(partPath, fpath, name string, size int64) error {
+	if err := checkSize(partPath, name, size); err != nil {
+		return err
+	}
+	err := os.Rename(partPath, fpath)
+	if !errors.Is(err, errCrossDevice) {
+		return err
+	}
+	srv.logger.Logf("%s is on another filesystem from the archive, copying it to %s", partPath, fpath)
+	return srv.moveAcross(partPath, fpath)
+}
+
+// checkSize returns an error unless the file at fpath, which the client
+// called name, has size bytes.
+func checkSize(fpath, name string, size int64) error {
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf("Received %d bytes of %s, but expected %d",
+			info.Size(), name, size)
+	}
+	return nil
+}
+
+// openTransfer finds or starts the transfer of the file startMsg describes,
+// to be stored in root unless it is resumed, claims the range of blocks the
+// connection sends, and opens the partial file. On failure, errType is what
+// to tell the client. For a dry run it only makes the checks, and returns a
+// nil transfer once they pass.
+func (srv *server) openTransfer(startMsg startMessage, root string) (tr *transfer, rng *blockRange, f blockFile, errType ErrCode, err error) {
+	srv.openMu.Lock()
+	defer srv.openMu.Unlock()
+
+	// A stream goes on until the client ends it, and its length is
+	// UnknownSize until then.
+	length := startMsg.Size - startMsg.AppendFrom
+	appending := startMsg.AppendFrom > 0
+	streaming := startMsg.Size == UnknownSize
+	dryRun := startMsg.Capabilities&capCancel != 0
+	numBlocks := getNumBlocks(length)
+	first, end := int64(0), numBlocks
+	if streaming {
+		end = math.MaxInt64
+	} else if startMsg.RangeEnd != 0 {
+		first, end = startMsg.RangeStart, startMsg.RangeEnd
+		if first < 0 || first >= end || end > numBlocks {
+			return nil, nil, nil, ErrInvalidRange,
+				fmt.Errorf("Client asked for blocks [%d, %d) of %s, which has %d",
+					first, end, startMsg.Name, numBlocks)
+		}
+	}
+
+	srv.mu.Lock()
+	tr, resuming := srv.transfers[startMsg.Name]
+	srv.mu.Unlock()
+
+	if resuming && streaming {
+		srv.logger.Logf("Client started streaming %s again, starting it over", startMsg.Name)
+		resuming = false
+	} else if resuming && (tr.size != startMsg.Size || tr.offset != startMsg.AppendFrom ||
+		!tr.modTime.Equal(startMsg.ModTime)) {
+		if !startMsg.Restart {
+			return nil, nil, nil, ErrWrongFile,
+				fmt.Errorf("Client wants to send %s with %d bytes, but I'm waiting for %d",
+					startMsg.Name, startMsg.Size, tr.size)
+		}
+		srv.logger.Logf("Client changed %s, starting it over", startMsg.Name)
+		resuming = false
+	}
+
+	// A transfer being resumed stays where it started, even if PathFunc
+	// would put it elsewhere now.
+	var fpath string
+	if resuming {
+		fpath = tr.path
+	} else if fpath, err = srv.destPath(root, startMsg.Name, time.Now()); err != nil {
+		return nil, nil, nil, ErrOpen, err
+	}
+
+	if appending && srv.store != nil {
+		return nil, nil, nil, ErrUnsupportedFeature,
+			fmt.Errorf("Client tried to append to %s, but a Store can't be appended to", startMsg.Name)
+	}
+
+	// A file longer than the client thinks may hold part of an append that
+	// was cut short, which the client picks up after.
+	var appended int64
+	if appending && !resuming {
+		info, err := os.Stat(fpath)
+		picking := false
+		if err == nil && info.Size() != startMsg.AppendFrom {
+			appended, picking = srv.appended(fpath, startMsg, info.Size())
+		}
+		if err != nil || (info.Size() != startMsg.AppendFrom && !picking) {
+			return nil, nil, nil, ErrAppendMismatch,
+				fmt.Errorf("Client tried to append to %s at %d, but it doesn't have that many bytes",
+					startMsg.Name, startMsg.AppendFrom)
+		}
+	} else if srv.exists(fpath) && !resuming {
+		// A file in a Store can't be read to compare it, so it is taken to
+		// be different.
+		replace := startMsg.Force && srv.allowForce
+		if !replace && srv.store != nil {
+			replace = srv.overwrite != OverwriteReject
+		} else if !replace {
+			if replace, err = srv.overwrite.allows(fpath, startMsg); err != nil {
+				return nil, nil, nil, ErrOpen, err
+			}
+		}
+		if !replace {
+			return nil, nil, nil, ErrAlreadyExists,
+				fmt.Errorf("Client tried to send a file (%s) that already exists", startMsg.Name)
+		}
+		srv.logger.Logf("Replacing existing file %s", startMsg.Name)
+	}
+
+	if resuming {
+		tr.mu.Lock()
+		rng = tr.ranges[first]
+		if rng != nil && rng.end != end {
+			rng = nil
+		}
+		overlaps := false
+		for _, other := range tr.ranges {
+			if other != rng && other.overlaps(first, end) {
+				overlaps = true
+			}
+		}
+		need := length - getFilePos(tr.received)
+		tr.mu.Unlock()
+
+		if overlaps {
+			return nil, nil, nil, ErrInvalidRange,
+				fmt.Errorf("Client asked for blocks [%d, %d) of %s, which overlap another range",
+					first, end, startMsg.Name)
+		}
+		if srv.store == nil {
+			if err := srv.checkSpace(srv.spacePath(fpath, appending), need); err != nil {
+				return nil, nil, nil, ErrNoSpace, err
+			}
+		}
+	} else if srv.store == nil {
+		if !dryRun {
+			if err := os.MkdirAll(path.Dir(fpath), srv.dirMode); err != nil {
+				return nil, nil, nil, ErrOpen, err
+			}
+		}
+		if !streaming {
+			if err := srv.checkSpace(srv.spacePath(fpath, appending), length); err != nil {
+				return nil, nil, nil, ErrNoSpace, err
+			}
+		}
+	}
+
+	// A dry run stops once the checks pass, leaving the file and any
+	// partial one as they are.
+	if dryRun {
+		return nil, nil, nil, ErrSuccess, nil
+	}
+
+	// Only one connection at a time writes a range of the file.
+	key := heldKey{fpath, first}
+	if err := srv.hold(key, startMsg.Name); err != nil {
+		return nil, nil, nil, ErrBusy, err
+	}
+	defer func() {
+		if err != nil {
+			srv.letGo(key)
+		}
+	}()
+
+	// A new transfer truncates any partial file left behind by an earlier
+	// server, while a resumed one keeps the blocks it already has. So does
+	// a new one whose client recorded an earlier server acking them, or
+	// that the earlier server recorded having, since the client checks
+	// them before going on. An append goes straight into the file, with a
+	// record of where it started, so that one cut short can be picked up
+	// even by a later server. A Store starts a new file over whatever it
+	// has.
+	var w WriterAtCloser
+	var resumeFrom int64
+	var recorded []blockRun
+	adopt := false
+	if srv.store != nil {
+		if !resuming {
+			if tr != nil {
+				tr.w.Close()
+			}
+			if w, err = srv.store.Create(fpath, length); err != nil {
+				return nil, nil, nil, ErrOpen, err
+			}
+		}
+	} else {
+		if !resuming && !appending && !streaming && startMsg.RangeEnd == 0 {
+			resumeFrom = adoptable(srv.partPath(fpath), startMsg)
+			if resumeFrom < startMsg.ResumeFrom {
+				srv.logger.Logf("Client proposed resuming %s at block %d, but I only have %d",
+					startMsg.Name, startMsg.ResumeFrom, resumeFrom)
+			}
+			recorded = srv.loadBlocks(fpath, startMsg)
+		} else if appending && !resuming {
+			resumeFrom = appended
+		}
+		adopt = resumeFrom > 0 || recorded != nil
+		target := srv.partPath(fpath)
+		flags := os.O_CREATE | os.O_RDWR
+		if appending {
+			target = fpath
+		} else if !resuming && !adopt {
+			flags |= os.O_TRUNC
+			srv.removeBlocks(fpath)
+		}
+
+		file, err := os.OpenFile(target, flags, srv.fileMode)
+		if err != nil {
+			return nil, nil, nil, ErrOpen, err
+		}
+		f = file
+		if appending && !resuming {
+			if err := srv.markAppend(fpath, startMsg); err != nil {
+				f.Close()
+				return nil, nil, nil, ErrOpen, err
+			}
+		}
+
+		if srv.prealloc && !resuming && !adopt && !streaming {
+			if err := preallocate(file, startMsg.Size); err != nil {
+				f.Close()
+				if errors.Is(err, syscall.ENOSPC) {
+					return nil, nil, nil, ErrNoSpace, err
+				}
+				return nil, nil, nil, ErrOpen, err
+			}
+		}
+	}
+
+	// A transfer started over won't finish what its sink was given.
+	if !resuming && tr != nil {
+		tr.sink.abort(fmt.Errorf("Client started %s over", startMsg.Name))
+	}
+
+	if !resuming {
+		tr = &transfer{
+			root:    root,
+			path:    fpath,
+			size:    startMsg.Size,
+			modTime: startMsg.ModTime,
+			started: time.Now(),
+			offset:  startMsg.AppendFrom,
+			ranges:  make(map[int64]*blockRange),
+			w:       w,
+		}
+		if srv.store == nil {
+			algos := []HashAlgo{HashSHA256}
+			if startMsg.Capabilities&capResult != 0 {
+				algos = append(algos, startMsg.HashAlgo)
+			}
+			if tr.hash, err = newRunningHash(algos...); err != nil {
+				f.Close()
+				return nil, nil, nil, ErrUnsupportedFeature, err
+			}
+		}
+		if srv.sink != nil {
+			w, err := srv.sink(startMsg.Name, tr.length())
+			if err != nil {
+				f.Close()
+				return nil, nil, nil, ErrOpen, err
+			}
+			tr.sink = newBlockSink(w, tr.offset)
+		}
+		if startMsg.Capabilities&capDelta != 0 && !appending && srv.store == nil && fileExists(fpath) {
+			if tr.signatures, err = signaturesOf(fpath); err != nil {
+				f.Close()
+				return nil, nil, nil, ErrOpen, err
+			}
+		}
+		srv.mu.Lock()
+		srv.transfers[startMsg.Name] = tr
+		srv.mu.Unlock()
+	}
+
+	// A connection that picks up the transfer may want a digest for its
+	// result that the one that started it didn't.
+	if resuming && startMsg.Capabilities&capResult != 0 {
+		if err := tr.hash.take(startMsg.HashAlgo); err != nil {
+			f.Close()
+			return nil, nil, nil, ErrUnsupportedFeature, err
+		}
+	}
+
+	tr.mu.Lock()
+	if rng != nil {
+		tr.stats.Reconnects++
+		if startMsg.Rewind {
+			srv.logger.Logf("Client found blocks [%d, %d) of %s corrupt, taking them again",
+				rng.first, rng.next, startMsg.Name)
+			tr.received -= rng.next - rng.first
+			rng.next = rng.first
+			rng.ahead = nil
+			tr.hash.reset()
+			if tr.sink.passed() > tr.offset+getFilePos(rng.first) {
+				err := fmt.Errorf("The sink of %s already has blocks the client found corrupt", startMsg.Name)
+				srv.logger.Logf("%v", err)
+				tr.sink.abort(err)
 			}
-			notifier.UpdateProgress(numBytes, srv.size)
+		}
+	} else {
+		rng = &blockRange{first: first, next: first, end: end}
+		tr.ranges[first] = rng
+		if adopt {
+			tr.received = rng.adopt(append([]blockRun{{0, resumeFrom}}, recorded...))
+			srv.logger.Logf("Picking up %s at block %d from an earlier server, with %d blocks after it",
+				startMsg.Name, rng.next, len(rng.ahead))
+		}
+	}
+	tr.mu.Unlock()
+
+	if srv.store != nil {
+		f = sharedFile{tr.w}
+	}
+	return tr, rng, f, ErrSuccess, nil
+}
+
+// copyBlock reads block seqNum of a file of size bytes out of basis,
+// starting at offset.
+func copyBlock(basis *os.File, offset, seqNum, size int64) ([]byte, error) {
+	if basis == nil {
+		return nil, fmt.Errorf("Client asked to copy block %d, but there is nothing to copy from", seqNum)
+	}
+
+	n := size - getFilePos(seqNum)
+	if n > payloadSize {
+		n = payloadSize
+	}
+	data := make([]byte, n)
+	if _, err := basis.ReadAt(data, offset); err != nil {
+		return nil, fmt.Errorf("Couldn't copy block %d from offset %d: %v", seqNum, offset, err)
+	}
+	return data, nil
+}
+
+// checkSpace returns an error if fewer than need bytes are free next to
+// fpath.
+func (srv *server) checkSpace(fpath string, need int64) error {
+	free, err := freeSpace(path.Dir(fpath))
+	switch {
+	case err == errFreeSpaceUnknown:
+	case err != nil:
+		srv.logger.Logf("Couldn't check free space for %s: %v", fpath, err)
+	case need > free:
+		return fmt.Errorf("Client tried to send %s with %d bytes, but only %d are free",
+			fpath, need, free)
+	}
+	return nil
+}
+
+// applyMetadata gives the file at fpath the mode and modification time in
+// startMsg, skipping any the client left unset.
+func applyMetadata(fpath string, startMsg startMessage) error {
+	if startMsg.Mode != 0 {
+		if err := os.Chmod(fpath, startMsg.Mode.Perm()); err != nil {
+			return err
 		}
 	}
 
-	srv.name = ""
-	srv.size = 0
-	srv.seqNum = 0
+	if !startMsg.ModTime.IsZero() {
+		if err := os.Chtimes(fpath, time.Now(), startMsg.ModTime); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (srv *server) Serve(createNotifier func() RecvNotifier) error {
+// applyOwner gives the file at fpath the owner startMsg carries, if the
+// server preserves owners and there is one.
+func (srv *server) applyOwner(fpath string, startMsg startMessage) {
+	if !srv.chown || !startMsg.HasOwner || srv.store != nil {
+		return
+	}
+	if err := os.Chown(fpath, startMsg.Uid, startMsg.Gid); err != nil {
+		srv.logger.Logf("Couldn't give %s its owner: %v", startMsg.Name, err)
+	}
+}
+
+// recvDir creates the directory name under the archive directory. Directories
+// carry no data, so the exchange ends with the ack. A Store has no
+// directories of its own, so there is nothing to create in one.
+func (srv *server) recvDir(enc Encoder, name string) error {
+	if srv.store == nil {
+		if err := os.MkdirAll(path.Join(srv.archiveDir, name), srv.dirMode); err != nil {
+			return sendClientErr(enc, ErrOpen, err)
+		}
+	}
+
+	return enc.Encode(ackMessage{Version: protocolVersion, Name: name, ErrType: ErrSuccess})
+}
+
+// recvLink creates the symbolic link startMsg describes.
+func (srv *server) recvLink(enc Encoder, startMsg startMessage) error {
+	fpath, err := srv.destPath(srv.archiveDir, startMsg.Name, time.Now())
+	if err != nil {
+		return sendClientErr(enc, ErrOpen, err)
+	}
+	if err := os.MkdirAll(path.Dir(fpath), srv.dirMode); err != nil {
+		return sendClientErr(enc, ErrOpen, err)
+	}
+
+	// The target is followed from where the link really is, which a link
+	// sent earlier may have moved.
+	dir, err := srv.realRel(path.Dir(fpath))
+	if err != nil {
+		return sendClientErr(enc, ErrOpen, err)
+	}
+	target := startMsg.LinkTarget
+	if !linkStaysInside(dir, target) {
+		return sendClientErr(enc, ErrInvalidName,
+			fmt.Errorf("Client tried to link %s to %s, outside the archive", startMsg.Name, target))
+	}
+
+	// A link left by an earlier attempt is the one being sent.
+	if existing, err := os.Readlink(fpath); err == nil && filepath.ToSlash(existing) == target {
+		srv.logger.Logf("Link %s is already in place", startMsg.Name)
+	} else if _, err := os.Lstat(fpath); err == nil {
+		return sendClientErr(enc, ErrAlreadyExists,
+			fmt.Errorf("Client tried to send a link (%s) where a file already exists", startMsg.Name))
+	} else if err := os.Symlink(filepath.FromSlash(target), fpath); err != nil {
+		return sendClientErr(enc, ErrOpen, err)
+	}
+
+	return enc.Encode(ackMessage{
+		Version:      protocolVersion,
+		Capabilities: startMsg.Capabilities & serverCapabilities,
+		Name:         startMsg.Name,
+		ErrType:      ErrSuccess,
+	})
+}
+
+// realRel returns the slash-separated path of the directory dir relative to
+// the archive directory, once every symbolic link in both is resolved.
+func (srv *server) realRel(dir string) (string, error) {
+	root, err := filepath.EvalSymlinks(srv.archiveDir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel != "." && !isLocalName(rel) {
+		return "", fmt.Errorf("%s resolves to %s, outside the archive directory", dir, resolved)
+	}
+	return rel, nil
+}
+
+// linkStaysInside reports whether a symbolic link in the archive's directory
+// dir that points to target leads somewhere inside the archive. Only leading
+// ".." elements are allowed, as one after a link would climb from wherever
+// that link leads.
+func linkStaysInside(dir, target string) bool {
+	if path.IsAbs(target) || filepath.IsAbs(target) || strings.Contains(target, `\`) {
+		return false
+	}
+
+	depth := 0
+	if dir != "." {
+		depth = len(strings.Split(dir, "/"))
+	}
+	climbing := true
+	for _, elem := range strings.Split(target, "/") {
+		switch {
+		case elem == "..":
+			if !climbing {
+				return false
+			}
+			depth--
+		case elem != "." && elem != "":
+			climbing = false
+		}
+	}
+	return depth >= 0
+}
+
+// acquire waits for a free connection slot, if they are limited.
+func (srv *server) acquire() {
+	if srv.slots == nil {
+		return
+	}
+
+	select {
+	case srv.slots <- true:
+	default:
+		srv.logger.Logf("Handling the limit of %d connections, waiting for one to finish", cap(srv.slots))
+		srv.slots <- true
+	}
+}
+
+// release gives back a slot taken by acquire.
+func (srv *server) release() {
+	if srv.slots != nil {
+		<-srv.slots
+	}
+}
+
+func (srv *server) Serve(createNotifier func(name string) RecvNotifier) error {
+	if srv.err != nil {
+		return srv.err
+	}
+	if srv.healthAddr != "" {
+		stop, err := srv.serveHealth(srv.healthAddr)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
 	for {
+		srv.acquire()
 		conn, err := srv.listener.Accept()
 		if err != nil {
+			srv.release()
 			return err
 		}
+		conn = withIdleTimeout(conn, srv.idle)
+		if srv.proxied {
+			conn = &proxyConn{Conn: conn}
+		}
 
-		if err := srv.recv(conn, createNotifier); err != nil {
-			logf("recv returned an error: %v", err)
+		srv.mu.Lock()
+		if srv.shutdown {
+			srv.mu.Unlock()
+			conn.Close()
+			srv.release()
 			continue
 		}
+		srv.active[conn] = ""
+		srv.wg.Add(1)
+		srv.mu.Unlock()
+
+		go func() {
+			defer srv.wg.Done()
+			defer srv.release()
+			defer conn.Close()
+			if err := srv.recv(conn, createNotifier); err != nil {
+				srv.logger.Logf("recv returned an error: %v", err)
+			}
+
+			srv.mu.Lock()
+			delete(srv.active, conn)
+			delete(srv.waiting, conn)
+			srv.mu.Unlock()
+		}()
 	}
 	return fmt.Errorf("Not implemented")
 }
 
+func (srv *server) ServeContext(ctx context.Context, createNotifier func(name string) RecvNotifier) error {
+	drained := make(chan error, 1)
+	served := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			drained <- srv.ShutdownContext(context.Background())
+		case <-served:
+			drained <- nil
+		}
+	}()
+
+	// Shutting down closes the listener, which ends Serve with an error
+	// that is of no interest once ctx is done.
+	err := srv.Serve(createNotifier)
+	close(served)
+	if drainErr := <-drained; ctx.Err() != nil {
+		return drainErr
+	}
+	return err
+}
+
+// Stop closes the listener without waiting for transfers in progress. Use
+// ShutdownContext to let them finish.
 func (srv *server) Stop() {
-	// TODO: Wait for outstanding connections to finish
 	srv.listener.Close()
 }
+
+func (srv *server) ShutdownContext(ctx context.Context) error {
+	// Connections waiting for another file have nothing in progress.
+	srv.mu.Lock()
+	srv.shutdown = true
+	for conn := range srv.waiting {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+
+	srv.listener.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	srv.mu.Lock()
+	var names []string
+	for conn, name := range srv.active {
+		if name == "" {
+			name = conn.RemoteAddr().String()
+		}
+		names = append(names, name)
+	}
+	srv.mu.Unlock()
+	sort.Strings(names)
+
+	return fmt.Errorf("Shutdown gave up with %d transfers still active (%s): %w",
+		len(names), strings.Join(names, ", "), ctx.Err())
+}
@@ -0,0 +1,164 @@
+package rtransfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestAppend(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+
+	received := make(chan Stats, 1)
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{
+		StatsFunc: func(name string, stats Stats) { received <- stats },
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// The log doesn't end on a block boundary before or after it grows.
+	fpath := path.Join(dpath, "app.log")
+	first := bytes.Repeat([]byte("first line\n"), 1000)
+	if err := os.WriteFile(fpath, first, 0666); err != nil {
+		t.Fatalf("Couldn't write %s: %v", fpath, err)
+	}
+	dialer := newTestDialer(testSrvHostport)
+	if err := Send(dialer, fpath, &logSendNotifier{t}); err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+	<-received
+
+	more := bytes.Repeat([]byte("later line\n"), 2000)
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Couldn't open %s: %v", fpath, err)
+	}
+	_, err = f.Write(more)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Couldn't append to %s: %v", fpath, err)
+	}
+
+	// An offset that doesn't match the server's copy is refused.
+	opts := &SendOptions{
+		Retry:      RetryPolicy{MaxAttempts: 1},
+		AppendFrom: int64(len(first)) - 1,
+	}
+	if _, err := SendContext(context.Background(), dialer, fpath, nil, opts); !errors.Is(err, ErrAppendMismatch) {
+		t.Errorf("Appending at the wrong offset returned %v, want %v", err, ErrAppendMismatch)
+	}
+
+	opts.AppendFrom = int64(len(first))
+	if _, err := SendContext(context.Background(), dialer, fpath, &logSendNotifier{t}, opts); err != nil {
+		t.Fatalf("Error while appending to %s: %v", fpath, err)
+	}
+	if got := (<-received).Bytes; got != int64(len(more)) {
+		t.Errorf("Server received %d bytes, want only the %d appended", got, len(more))
+	}
+
+	stored, err := os.ReadFile(path.Join(serverDir, "app.log"))
+	if err != nil {
+		t.Fatalf("Couldn't read the stored file: %v", err)
+	}
+	if !bytes.Equal(stored, append(first, more...)) {
+		t.Errorf("Stored file has %d bytes and isn't the original with the appended lines", len(stored))
+	}
+}
+
+func TestAppendInterrupted(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+	serve := func() Server {
+		listener, err := net.Listen("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+		}
+		srv := NewServer(listener, serverDir)
+		go srv.Serve(newLogRecvNotifierFactory(t))
+		return srv
+	}
+	srv := serve()
+
+	fpath := path.Join(dpath, "app.log")
+	first := bytes.Repeat([]byte("first line\n"), 1000)
+	if err := os.WriteFile(fpath, first, 0666); err != nil {
+		t.Fatalf("Couldn't write %s: %v", fpath, err)
+	}
+	dialer := newTestDialer(testSrvHostport)
+	if _, err := SendWithResult(context.Background(), dialer, fpath, &logSendNotifier{t}, nil); err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	more := bytes.Repeat([]byte("later line\n"), 8000)
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Couldn't open %s: %v", fpath, err)
+	}
+	_, err = f.Write(more)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Couldn't append to %s: %v", fpath, err)
+	}
+
+	// The server goes away partway through the append, leaving its copy
+	// longer than the client thinks, and the next server picks the append
+	// up where it stopped.
+	notifier := &stallSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		stallAfter:      5,
+		stalled:         make(chan bool),
+		release:         make(chan bool),
+	}
+	sent := make(chan error)
+	go func() {
+		_, err := SendContext(context.Background(), dialer, fpath, notifier, &SendOptions{AppendFrom: int64(len(first))})
+		sent <- err
+	}()
+	<-notifier.stalled
+	srv.Stop()
+	dialer.Close()
+	srv = serve()
+	defer srv.Stop()
+	close(notifier.release)
+
+	if err := <-sent; err != nil {
+		t.Fatalf("Error while appending to %s: %v", fpath, err)
+	}
+	stored, err := os.ReadFile(path.Join(serverDir, "app.log"))
+	if err != nil {
+		t.Fatalf("Couldn't read the stored file: %v", err)
+	}
+	if !bytes.Equal(stored, append(first, more...)) {
+		t.Errorf("Stored file has %d bytes and isn't the original with the appended lines", len(stored))
+	}
+	if fileExists(path.Join(serverDir, "app.log"+blocksSuffix)) {
+		t.Errorf("The record of the append was left behind")
+	}
+}
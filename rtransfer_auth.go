@@ -0,0 +1,160 @@
+package rtransfer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+)
+
+// When the server has an identity or a secret, each connection opens with a
+// handshake that comes before any messages, so it is the same whatever the
+// codec.
+//
+// With an identity, the client sends identityRequest and a random nonce of
+// nonceSize bytes, and the server answers with its ed25519 signature of the
+// nonce. A client that can't verify the signature hangs up with
+// ErrServerIdentity. A client that doesn't know the server has an identity
+// goes on without asking, and the server reads its start message and acks
+// it with ErrIdentityRequired. The signature covers nothing but the nonce,
+// so someone who relays the handshake to the real server passes it on
+// intact; only TLS stops them.
+//
+// Then, with a secret, the client asks for a challenge with
+// challengeRequest, the server sends a nonce, and the client answers with
+// the HMAC-SHA256 of it keyed with the secret. If the answer is wrong, the
+// server reads the start message and acks it with ErrUnauthorized. A client
+// that doesn't know the server has a secret sends the start message without
+// asking, and gets the same ack.
+//
+// The client checks the server first, so it never answers a challenge from
+// a server it doesn't trust. Neither step hides the data sent afterwards.
+const nonceSize = 32
+
+// identityRequest opens the handshake of a client that expects the server to
+// have an identity. No codec's first message starts with it, nor does
+// challengeRequest.
+var identityRequest = []byte("RTIDENTY")
+
+// challengeRequest opens the handshake of a client with a secret. No codec's
+// first message starts with it.
+var challengeRequest = []byte("RTSECRET")
+
+// handshake proves, on a new connection, what opts asks of the server and
+// the client.
+func handshake(conn io.ReadWriter, opts *SendOptions) error {
+	if id := opts.serverID(); id != nil {
+		if err := verifyIdentity(conn, id); err != nil {
+			return err
+		}
+	}
+	if secret := opts.secret(); secret != nil {
+		return answerChallenge(conn, secret)
+	}
+	return nil
+}
+
+// verifyIdentity challenges the server on conn to show that it holds the
+// private key of the public key id.
+func verifyIdentity(conn io.ReadWriter, id []byte) error {
+	if len(id) != ed25519.PublicKeySize {
+		return ErrServerIdentity
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(append([]byte{}, identityRequest...), nonce...)); err != nil {
+		return err
+	}
+
+	sig := make([]byte, ed25519.SignatureSize)
+	if _, err := io.ReadFull(conn, sig); err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(id), nonce, sig) {
+		return ErrServerIdentity
+	}
+	return nil
+}
+
+// proveIdentity signs the nonce of the client on conn with key, and reports
+// whether the client asked for it. A client that doesn't ask is sent
+// nothing, and the bytes read in place of its request are returned, since
+// they start what it sends next.
+func proveIdentity(conn io.ReadWriter, key ed25519.PrivateKey) (ok bool, unread []byte, err error) {
+	request := make([]byte, len(identityRequest))
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return false, nil, err
+	}
+	if !bytes.Equal(request, identityRequest) {
+		return false, request, nil
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return false, nil, err
+	}
+	if _, err := conn.Write(ed25519.Sign(key, nonce)); err != nil {
+		return false, nil, err
+	}
+	return true, nil, nil
+}
+
+// challenge sends the client on conn a nonce and reports whether its answer
+// shows that it knows secret. A client that doesn't ask for the challenge
+// is sent none, and the bytes read in place of its request are returned,
+// since they start its first message.
+func challenge(conn io.ReadWriter, secret []byte) (ok bool, unread []byte, err error) {
+	request := make([]byte, len(challengeRequest))
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return false, nil, err
+	}
+	if !bytes.Equal(request, challengeRequest) {
+		return false, request, nil
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return false, nil, err
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return false, nil, err
+	}
+
+	answer := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return false, nil, err
+	}
+	return hmac.Equal(answer, signNonce(secret, nonce)), nil, nil
+}
+
+// answerChallenge asks the server on conn for a challenge and answers it
+// using secret.
+func answerChallenge(conn io.ReadWriter, secret []byte) error {
+	if _, err := conn.Write(challengeRequest); err != nil {
+		return err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return err
+	}
+	_, err := conn.Write(signNonce(secret, nonce))
+	return err
+}
+
+// readWriter reads from one place and writes to another, such as a
+// connection with bytes already read from it put back in front.
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+func signNonce(secret, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
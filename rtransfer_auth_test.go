@@ -0,0 +1,141 @@
+package rtransfer
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestSharedSecret(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{Secret: []byte("open sesame")})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	tests := []struct {
+		name   string
+		secret string
+		err    error
+	}{
+		{"accepted", "open sesame", nil},
+		{"rejected", "open barley", ErrUnauthorized},
+		{"unknown", "", ErrUnauthorized},
+	}
+	for _, test := range tests {
+		fpath := path.Join(dpath, test.name)
+		if err := testutil.GenRandFile(fpath, 3*payloadSize); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+
+		// A client without the secret is turned away for good, rather
+		// than retrying.
+		opts := &SendOptions{}
+		if test.secret != "" {
+			opts.Retry = RetryPolicy{MaxAttempts: 1}
+			opts.Secret = []byte(test.secret)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := SendContext(ctx, newTestDialer(testSrvHostport), fpath, nil, opts)
+		cancel()
+		if !errors.Is(err, test.err) {
+			t.Errorf("Sending with secret %q returned %v, want %v", test.secret, err, test.err)
+		}
+
+		stored := fileExists(path.Join(serverDir, test.name))
+		if stored != (test.err == nil) {
+			t.Errorf("Sending with secret %q stored the file: %v", test.secret, stored)
+		}
+	}
+}
+
+func TestServerIdentity(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+
+	srvPub, srvKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+
+	secret := []byte("open sesame")
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{
+		Secret:   secret,
+		Identity: srvKey,
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// A client that doesn't expect the identity is told so, whether or not
+	// it asks for the challenge.
+	tests := []struct {
+		name   string
+		id     []byte
+		secret []byte
+		err    error
+	}{
+		{"pinned", srvPub, secret, nil},
+		{"impostor", otherPub, secret, ErrServerIdentity},
+		{"unpinned", nil, secret, ErrIdentityRequired},
+		{"unpinned without secret", nil, nil, ErrIdentityRequired},
+	}
+	for _, test := range tests {
+		fpath := path.Join(dpath, test.name)
+		if err := testutil.GenRandFile(fpath, 3*payloadSize); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+
+		opts := &SendOptions{
+			Retry:          RetryPolicy{MaxAttempts: 1},
+			Secret:         test.secret,
+			ExpectServerID: test.id,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := SendContext(ctx, newTestDialer(testSrvHostport), fpath, nil, opts)
+		cancel()
+		if !errors.Is(err, test.err) {
+			t.Errorf("Sending to a server expected to be %s returned %v, want %v", test.name, err, test.err)
+		}
+
+		stored := fileExists(path.Join(serverDir, test.name))
+		if stored != (test.err == nil) {
+			t.Errorf("Sending to a server expected to be %s stored the file: %v", test.name, stored)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package rtransfer
+
+import (
+	"fmt"
+	"time"
+)
+
+// busyWait is how long a connection for blocks another connection still
+// holds waits for it to let go before the client is told ErrBusy. A client
+// that reconnects straight after its connection died usually only has to
+// wait for the server to notice.
+const busyWait = 2 * time.Second
+
+// heldKey names the range of blocks starting at first of the file stored at
+// path.
+type heldKey struct {
+	path  string
+	first int64
+}
+
+// busyError is the error openTransfer returns for a range another connection
+// holds. released is closed when it lets go.
+type busyError struct {
+	name     string
+	first    int64
+	released chan struct{}
+}
+
+func (err *busyError) Error() string {
+	return fmt.Sprintf("Client wants blocks of %s from %d, which another connection is still receiving",
+		err.name, err.first)
+}
+
+// hold claims key for the connection, or returns a busyError naming name if
+// another connection holds it.
+func (srv *server) hold(key heldKey, name string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if released, ok := srv.held[key]; ok {
+		return &busyError{name, key.first, released}
+	}
+	srv.held[key] = make(chan struct{})
+	return nil
+}
+
+// letGo lets go of key, letting in a connection waiting for it.
+func (srv *server) letGo(key heldKey) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if released, ok := srv.held[key]; ok {
+		close(released)
+		delete(srv.held, key)
+	}
+}
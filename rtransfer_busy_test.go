@@ -0,0 +1,121 @@
+package rtransfer
+
+import (
+	"context"
+	"encoding/gob"
+	"net"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// countSendNotifier counts the blocks sent.
+type countSendNotifier struct {
+	logSendNotifier
+	sent int64
+}
+
+func (sn *countSendNotifier) UpdateProgress(numBytes, totBytes int64) {
+	atomic.AddInt64(&sn.sent, 1)
+	sn.logSendNotifier.UpdateProgress(numBytes, totBytes)
+}
+
+func TestOverlappingReconnect(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	fpath := path.Join(dpath, "file")
+	const numBlocks = 16
+	if err := testutil.GenRandFile(fpath, numBlocks*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	contents, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", fpath, err)
+	}
+	info, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't stat %s: %v", fpath, err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// The first connection sends a few blocks and then goes quiet, as one
+	// whose client lost it without the server noticing would.
+	conn, err := net.Dial("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("Couldn't connect to the server: %v", err)
+	}
+	defer conn.Close()
+	enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+	startMsg := startMessage{
+		Version: protocolVersion,
+		Name:    "file",
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := enc.Encode(startMsg); err != nil {
+		t.Fatalf("Couldn't send the start message: %v", err)
+	}
+	var ack ackMessage
+	if err := dec.Decode(&ack); err != nil || ack.err() != nil {
+		t.Fatalf("Server didn't take the file: %v, %v", err, ack.err())
+	}
+	send := func(seqNum int64, data []byte) {
+		if err := enc.Encode(dataMessage{SeqNum: seqNum, Data: data}); err != nil {
+			t.Fatalf("Couldn't send block %d: %v", seqNum, err)
+		}
+		var dataAckMsg dataAckMessage
+		if err := dec.Decode(&dataAckMsg); err != nil {
+			t.Fatalf("Server didn't ack block %d: %v", seqNum, err)
+		}
+	}
+	for seqNum := int64(0); seqNum < 4; seqNum++ {
+		send(seqNum, contents[getFilePos(seqNum):getFilePos(seqNum+1)])
+	}
+
+	// The client reconnects, and waits for the server to let go of the
+	// first connection rather than writing the same blocks beside it.
+	notifier := &countSendNotifier{logSendNotifier: logSendNotifier{t}}
+	sent := make(chan error, 1)
+	go func() {
+		_, err := SendContext(context.Background(), netDialer{"tcp", testSrvHostport}, fpath, notifier, nil)
+		sent <- err
+	}()
+	time.Sleep(busyWait / 4)
+	if n := atomic.LoadInt64(&notifier.sent); n != 0 {
+		t.Errorf("Client sent %d blocks while another connection held the file", n)
+	}
+
+	// What the first connection writes last is caught once the client
+	// gets in.
+	send(4, make([]byte, payloadSize))
+	conn.Close()
+
+	if err := <-sent; err != nil {
+		t.Fatalf("Error while sending %s: %v", fpath, err)
+	}
+	got, err := os.ReadFile(path.Join(serverDir, "file"))
+	if err != nil || string(got) != string(contents) {
+		t.Errorf("The server's file doesn't have the contents it was sent (%v)", err)
+	}
+
+	// A client told the server is busy tries again.
+	if permanent(ErrBusy) {
+		t.Errorf("ErrBusy ends a send for good")
+	}
+}
@@ -0,0 +1,106 @@
+package rtransfer
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// checkpoint is what a client records in SendOptions.Checkpoint about a
+// transfer in progress: the file, and that the server acked the blocks
+// before SeqNum.
+type checkpoint struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	SeqNum  int64
+}
+
+// checkpointEvery is how many blocks go by between checkpoints.
+const checkpointEvery = 64
+
+// loadCheckpoint returns the number of blocks the checkpoint says the server
+// acked, or zero if there is no checkpoint for the file startMsg describes.
+func (src *fileSource) loadCheckpoint(startMsg startMessage) int64 {
+	data, err := os.ReadFile(src.checkpoint)
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		src.logger.Logf("Couldn't read checkpoint %s: %v", src.checkpoint, err)
+		return 0
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		src.logger.Logf("Couldn't read checkpoint %s: %v", src.checkpoint, err)
+		return 0
+	}
+
+	if cp.Name != startMsg.Name || cp.Size != startMsg.Size || !cp.ModTime.Equal(startMsg.ModTime) {
+		src.logger.Logf("Ignoring checkpoint %s, %s has changed since", src.checkpoint, src.fpath)
+		return 0
+	}
+	return cp.SeqNum
+}
+
+// saveCheckpoint replaces the checkpoint at fpath with cp, in a way that
+// leaves either the old one or the new one if the process dies.
+func saveCheckpoint(fpath string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp := fpath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fpath)
+}
+
+// checkpointNotifier saves a checkpoint every checkpointEvery blocks, and
+// passes everything on to notifier, which may be nil.
+type checkpointNotifier struct {
+	fpath    string
+	cp       checkpoint
+	notifier SendNotifier
+	logger   Logger
+}
+
+func newCheckpointNotifier(fpath string, startMsg startMessage, notifier SendNotifier, logger Logger) *checkpointNotifier {
+	return &checkpointNotifier{
+		fpath: fpath,
+		cp: checkpoint{
+			Name:    startMsg.Name,
+			Size:    startMsg.Size,
+			ModTime: startMsg.ModTime,
+		},
+		notifier: notifier,
+		logger:   logger,
+	}
+}
+
+func (c *checkpointNotifier) SendStart() {
+	if c.notifier != nil {
+		c.notifier.SendStart()
+	}
+}
+
+func (c *checkpointNotifier) RecvAck() {
+	if c.notifier != nil {
+		c.notifier.RecvAck()
+	}
+}
+
+func (c *checkpointNotifier) UpdateProgress(numBytes, totBytes int64) {
+	if seqNum := numBytes / payloadSize; seqNum-c.cp.SeqNum >= checkpointEvery {
+		c.cp.SeqNum = seqNum
+		if err := saveCheckpoint(c.fpath, c.cp); err != nil {
+			c.logger.Logf("Couldn't save checkpoint %s: %v", c.fpath, err)
+		}
+	}
+
+	if c.notifier != nil {
+		c.notifier.UpdateProgress(numBytes, totBytes)
+	}
+}
@@ -0,0 +1,179 @@
+package rtransfer
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestCheckpointAfterRestart(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+
+	const numBlocks = 3 * checkpointEvery
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, numBlocks*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+	opts := &SendOptions{Checkpoint: path.Join(dpath, "checkpoint")}
+
+	// The first client and server both go away partway through the file.
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+
+	notifier := &stallSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		stallAfter:      checkpointEvery + 10,
+		stalled:         make(chan bool),
+		release:         make(chan bool),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sent := make(chan error)
+	go func() {
+		_, err := SendContext(ctx, newTestDialer(testSrvHostport), fpath, notifier, opts)
+		sent <- err
+	}()
+	<-notifier.stalled
+	cancel()
+	close(notifier.release)
+	if err := <-sent; err != context.Canceled {
+		t.Fatalf("Cancelled send returned %v, want %v", err, context.Canceled)
+	}
+	srv.Stop()
+	if err := srv.ShutdownContext(context.Background()); err != nil {
+		t.Fatalf("First server didn't shut down: %v", err)
+	}
+
+	if !fileExists(opts.Checkpoint) {
+		t.Fatalf("No checkpoint was saved")
+	}
+
+	// The server's own record of the blocks it has would let it pick up
+	// more of them than the checkpoint does.
+	if err := os.Remove(path.Join(serverDir, "file"+blocksSuffix)); err != nil {
+		t.Fatalf("Couldn't remove the server's record of its blocks: %v", err)
+	}
+
+	// A new server knows nothing of the transfer, but the new client's
+	// checkpoint lets it pick up the partial file.
+	received := make(chan Stats, 1)
+	listener, err = net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv = NewServerWithOptions(listener, serverDir, &ServerOptions{
+		StatsFunc: func(name string, stats Stats) { received <- stats },
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	if _, err := SendContext(context.Background(), newTestDialer(testSrvHostport), fpath, nil, opts); err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	if got := (<-received).Blocks; got != numBlocks-checkpointEvery {
+		t.Errorf("Second server received %d blocks, want %d", got, numBlocks-checkpointEvery)
+	}
+	if fileExists(opts.Checkpoint) {
+		t.Errorf("Checkpoint was left behind")
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash %s: %v", fpath, err)
+	}
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "file"))
+	if err != nil {
+		t.Fatalf("Couldn't hash the received file: %v", err)
+	}
+	if srcHash != dstHash {
+		t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+	}
+}
+
+func TestResumeFrom(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+
+	received := make(chan Stats, 1)
+	listener := NewPipeListener()
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{
+		StatsFunc: func(name string, stats Stats) { received <- stats },
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// The server picks up its partial file from where the client proposes
+	// if it has that much of it, and from where it ends otherwise.
+	const numBlocks = 16
+	for _, tc := range []struct {
+		name     string
+		have     int64
+		proposed int64
+		want     int64
+	}{
+		{"valid", 10, 6, 6},
+		{"stale", 8, 12, 8},
+		{"nothing", 0, 5, 0},
+	} {
+		fpath := path.Join(dpath, tc.name)
+		if err := testutil.GenRandFile(fpath, numBlocks*payloadSize+7); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+		if tc.have > 0 {
+			data, err := os.ReadFile(fpath)
+			if err != nil {
+				t.Fatalf("Couldn't read %s: %v", fpath, err)
+			}
+			partPath := path.Join(serverDir, tc.name+partSuffix)
+			if err := os.WriteFile(partPath, data[:getFilePos(tc.have)], 0666); err != nil {
+				t.Fatalf("Couldn't write %s: %v", partPath, err)
+			}
+		}
+
+		opts := &SendOptions{ResumeFrom: getFilePos(tc.proposed) + 100}
+		if _, err := SendContext(context.Background(), listener, fpath, nil, opts); err != nil {
+			t.Fatalf("Error while sending file %s: %v", fpath, err)
+		}
+		if got, want := (<-received).Blocks, numBlocks+1-tc.want; got != want {
+			t.Errorf("Proposing block %d with %d on the server, it received %d blocks, want %d",
+				tc.proposed, tc.have, got, want)
+		}
+
+		srcHash, err := testutil.HashFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't hash %s: %v", fpath, err)
+		}
+		dstHash, err := testutil.HashFile(path.Join(serverDir, tc.name))
+		if err != nil {
+			t.Fatalf("Couldn't hash the received file: %v", err)
+		}
+		if srcHash != dstHash {
+			t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package rtransfer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Encoder writes protocol messages to a stream.
+type Encoder interface {
+	Encode(msg interface{}) error
+}
+
+// Decoder reads protocol messages from a stream into msg, which must be a
+// pointer to the message expected next.
+type Decoder interface {
+	Decode(msg interface{}) error
+}
+
+// MessageCodec decides how protocol messages look on the wire. Both ends of
+// a transfer must use the same one.
+type MessageCodec interface {
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+// GobCodec encodes messages with encoding/gob. It is the default.
+var GobCodec MessageCodec = gobCodec{}
+
+// BinaryCodec frames each message with a fixed header so that peers not
+// written in Go can speak the protocol. See binaryCodec for the layout.
+var BinaryCodec MessageCodec = binaryCodec{}
+
+// JSONCodec writes each message as a line of JSON, with the bytes of a block
+// in base64, so that the protocol can be read off the wire with tcpdump or
+// Wireshark. It is slower and bulkier than the others, and meant only for
+// debugging.
+var JSONCodec MessageCodec = jsonCodec{}
+
+// orDefaultCodec returns c, or GobCodec if c is nil.
+func orDefaultCodec(c MessageCodec) MessageCodec {
+	if c == nil {
+		return GobCodec
+	}
+	return c
+}
+
+type gobCodec struct{}
+
+func (gobCodec) NewEncoder(w io.Writer) Encoder {
+	return gob.NewEncoder(w)
+}
+
+func (gobCodec) NewDecoder(r io.Reader) Decoder {
+	return gob.NewDecoder(r)
+}
+
+type jsonCodec struct{}
+
+// maxJSONMessageSize bounds the line a JSON decoder will read. It leaves
+// room for a frame's worth of data in base64.
+const maxJSONMessageSize = 2 * maxFrameSize
+
+func (jsonCodec) NewEncoder(w io.Writer) Encoder {
+	// Encode writes each message, with its newline, in one write.
+	return json.NewEncoder(w)
+}
+
+func (jsonCodec) NewDecoder(r io.Reader) Decoder {
+	return &jsonDecoder{r: bufio.NewReader(r), limit: maxJSONMessageSize}
+}
+
+// jsonDecoder reads messages a line at a time, so that it can refuse one of
+// more than limit bytes before reading all of it.
+type jsonDecoder struct {
+	r     *bufio.Reader
+	limit int
+}
+
+func (d *jsonDecoder) Decode(msg interface{}) error {
+	var line []byte
+	for {
+		chunk, err := d.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > d.limit {
+			return fmt.Errorf("Message of more than %d bytes is over the limit", d.limit)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(line) > 0:
+			return io.ErrUnexpectedEOF
+		case err != nil:
+			return err
+		}
+		return json.Unmarshal(line, msg)
+	}
+}
+
+// binaryCodec writes every message as a 13 byte header followed by a
+// payload:
+//
+//	type    1 byte, one of the frame* constants
+//	seqNum  8 bytes, big-endian
+//	length  4 bytes, big-endian, the size of the payload
+//
+// Data messages carry their bytes as the payload, unless they copy a block,
+// in which case they are copy frames with the 8 byte big-endian offset as
+// the payload, or end frames with none if they end a stream. Data acks have
+// none. Start, ack and result messages carry their fields as a JSON object.
+// seqNum is the message's SeqNum, or zero for a start or result message.
+type binaryCodec struct{}
+
+const (
+	frameStart = byte(iota + 1)
+	frameAck
+	frameData
+	frameDataAck
+	frameCopy
+	frameResult
+	frameEnd
+)
+
+const frameHeaderSize = 13
+
+// maxFrameSize bounds the payload a decoder will allocate for. The largest
+// frames are acks carrying block signatures.
+const maxFrameSize = 64 << 20
+
+func (binaryCodec) NewEncoder(w io.Writer) Encoder {
+	return &binaryEncoder{w}
+}
+
+func (binaryCodec) NewDecoder(r io.Reader) Decoder {
+	return &binaryDecoder{r: r, limit: maxFrameSize}
+}
+
+type binaryEncoder struct {
+	w io.Writer
+}
+
+func (e *binaryEncoder) Encode(msg interface{}) error {
+	var frameType byte
+	var seqNum int64
+	var payload []byte
+	var err error
+
+	switch m := msg.(type) {
+	case startMessage:
+		frameType = frameStart
+		payload, err = json.Marshal(m)
+	case ackMessage:
+		frameType, seqNum = frameAck, m.SeqNum
+		payload, err = json.Marshal(m)
+	case dataMessage:
+		if m.End {
+			frameType, seqNum = frameEnd, m.SeqNum
+		} else if m.Copy {
+			frameType, seqNum = frameCopy, m.SeqNum
+			payload = make([]byte, 8)
+			binary.BigEndian.PutUint64(payload, uint64(m.Offset))
+		} else {
+			frameType, seqNum, payload = frameData, m.SeqNum, m.Data
+		}
+	case dataAckMessage:
+		frameType, seqNum = frameDataAck, m.SeqNum
+	case resultMessage:
+		frameType = frameResult
+		payload, err = json.Marshal(m)
+	default:
+		return fmt.Errorf("Can't encode a %T as a binary frame", msg)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(payload) > maxFrameSize {
+		return fmt.Errorf("Frame payload of %d bytes is too large", len(payload))
+	}
+
+	// The frame goes out in one write so that it can't be interleaved with
+	// anything else on the connection.
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint64(frame[1:9], uint64(seqNum))
+	binary.BigEndian.PutUint32(frame[9:13], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	_, err = e.w.Write(frame)
+	return err
+}
+
+type binaryDecoder struct {
+	r     io.Reader
+	limit uint32
+}
+
+func (d *binaryDecoder) Decode(msg interface{}) error {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return err
+	}
+
+	frameType := header[0]
+	seqNum := int64(binary.BigEndian.Uint64(header[1:9]))
+	length := binary.BigEndian.Uint32(header[9:13])
+	if length > d.limit {
+		return fmt.Errorf("Frame payload of %d bytes is too large", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(d.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	var want byte
+	switch m := msg.(type) {
+	case *startMessage:
+		want = frameStart
+		if frameType == want {
+			return json.Unmarshal(payload, m)
+		}
+	case *ackMessage:
+		want = frameAck
+		if frameType == want {
+			if err := json.Unmarshal(payload, m); err != nil {
+				return err
+			}
+			m.SeqNum = seqNum
+			return nil
+		}
+	case *dataMessage:
+		want = frameData
+		if frameType == want {
+			m.SeqNum, m.Data = seqNum, payload
+			return nil
+		}
+		if frameType == frameCopy && len(payload) == 8 {
+			m.SeqNum, m.Copy = seqNum, true
+			m.Offset = int64(binary.BigEndian.Uint64(payload))
+			return nil
+		}
+		if frameType == frameEnd {
+			m.SeqNum, m.End = seqNum, true
+			return nil
+		}
+	case *dataAckMessage:
+		want = frameDataAck
+		if frameType == want {
+			m.SeqNum = seqNum
+			return nil
+		}
+	case *resultMessage:
+		want = frameResult
+		if frameType == want {
+			return json.Unmarshal(payload, m)
+		}
+	default:
+		return fmt.Errorf("Can't decode a binary frame into a %T", msg)
+	}
+
+	return fmt.Errorf("Expected a frame of type %d, got %d", want, frameType)
+}
+
+// defaultMaxMessageSize is the largest message a server takes from a client
+// when ServerOptions.MaxMessageSize isn't set: a full block, with room for
+// the fields around it. A start message with the longest name a file system
+// allows fits too.
+const defaultMaxMessageSize = payloadSize + 4096
+
+// newLimitedDecoder returns a decoder for r that fails on a message of more
+// than limit bytes before it makes room for it, if codec is one it knows how
+// to limit, and otherwise codec's decoder.
+func newLimitedDecoder(codec MessageCodec, r io.Reader, limit int) Decoder {
+	switch codec.(type) {
+	case gobCodec:
+		return gob.NewDecoder(&gobLimitReader{r: r, limit: uint64(limit)})
+	case binaryCodec:
+		if limit > maxFrameSize {
+			limit = maxFrameSize
+		}
+		return &binaryDecoder{r: r, limit: uint32(limit)}
+	case jsonCodec:
+		// A block takes a third more room in base64.
+		return &jsonDecoder{r: bufio.NewReader(r), limit: 2 * limit}
+	default:
+		return codec.NewDecoder(r)
+	}
+}
+
+// gobLimitReader passes on a gob stream read from r, checking the length
+// each message starts with. A gob decoder allocates as much as a message
+// says it holds before reading it, so a client could otherwise make the
+// server allocate up to a gigabyte with a few bytes.
+type gobLimitReader struct {
+	r     io.Reader
+	limit uint64
+
+	// left is how much of the current message is still to be read, and
+	// header holds the length of the next one while it is passed on, in
+	// buf.
+	left   uint64
+	header []byte
+	buf    [9]byte
+}
+
+func (g *gobLimitReader) Read(p []byte) (int, error) {
+	if len(g.header) == 0 && g.left == 0 {
+		if err := g.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(g.header) > 0 {
+		n := copy(p, g.header)
+		g.header = g.header[n:]
+		return n, nil
+	}
+
+	if uint64(len(p)) > g.left {
+		p = p[:g.left]
+	}
+	n, err := g.r.Read(p)
+	g.left -= uint64(n)
+	return n, err
+}
+
+// readHeader reads the length of the next message. Gob writes it as an
+// unsigned integer: a single byte below 128, or else a byte holding minus
+// the number of bytes that follow, big-endian.
+func (g *gobLimitReader) readHeader() error {
+	if _, err := io.ReadFull(g.r, g.buf[:1]); err != nil {
+		return err
+	}
+
+	header := g.buf[:1]
+	length := uint64(g.buf[0])
+	if g.buf[0] >= 0x80 {
+		n := int(-int8(g.buf[0]))
+		if n > 8 {
+			return fmt.Errorf("Invalid gob message length prefix %#x", g.buf[0])
+		}
+		header = g.buf[:1+n]
+		if _, err := io.ReadFull(g.r, header[1:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		length = 0
+		for _, b := range header[1:] {
+			length = length<<8 | uint64(b)
+		}
+	}
+
+	if length > g.limit {
+		return fmt.Errorf("Message of %d bytes is over the limit of %d", length, g.limit)
+	}
+	g.left = length
+	g.header = header
+	return nil
+}
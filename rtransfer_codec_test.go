@@ -0,0 +1,216 @@
+package rtransfer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// roundTrip encodes msgs with codec and decodes them back into values of the
+// same types.
+func roundTrip(t *testing.T, codec MessageCodec, msgs []interface{}) []interface{} {
+	var buf bytes.Buffer
+	enc := codec.NewEncoder(&buf)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatalf("Couldn't encode %#v: %v", msg, err)
+		}
+	}
+
+	dec := codec.NewDecoder(&buf)
+	var got []interface{}
+	for _, msg := range msgs {
+		ptr := reflect.New(reflect.TypeOf(msg))
+		if err := dec.Decode(ptr.Interface()); err != nil {
+			t.Fatalf("Couldn't decode a %T: %v", msg, err)
+		}
+		got = append(got, ptr.Elem().Interface())
+	}
+	return got
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	modTime := time.Date(2014, 3, 1, 12, 30, 0, 0, time.UTC)
+	msgs := []interface{}{
+		startMessage{Version: protocolVersion, Name: "dir/file", Size: 3*payloadSize + 1, ModTime: modTime, Restart: true},
+		startMessage{Name: "dir", IsDir: true},
+		ackMessage{Version: protocolVersion, Name: "dir/file", SeqNum: 2, Size: 3*payloadSize + 1},
+		ackMessage{ErrType: ErrInvalidName},
+		ackMessage{Capabilities: capDelta, Signatures: []blockSignature{{0x12345678, []byte{1, 2, 3}}}},
+		dataMessage{SeqNum: 2, Data: bytes.Repeat([]byte{0xab}, payloadSize)},
+		dataMessage{SeqNum: maxSize / payloadSize, Data: []byte{1}},
+		dataMessage{SeqNum: 4, Copy: true, Offset: 3*payloadSize + 17},
+		dataAckMessage{SeqNum: 3},
+	}
+
+	gobMsgs := roundTrip(t, GobCodec, msgs)
+	binMsgs := roundTrip(t, BinaryCodec, msgs)
+	jsonMsgs := roundTrip(t, JSONCodec, msgs)
+
+	for i := range msgs {
+		if !reflect.DeepEqual(jsonMsgs[i], gobMsgs[i]) {
+			t.Errorf("Codecs disagree: gob gave %#v, JSON gave %#v", gobMsgs[i], jsonMsgs[i])
+		}
+		if !reflect.DeepEqual(binMsgs[i], msgs[i]) {
+			t.Errorf("Binary codec turned %#v into %#v", msgs[i], binMsgs[i])
+		}
+		if !reflect.DeepEqual(binMsgs[i], gobMsgs[i]) {
+			t.Errorf("Codecs disagree: gob gave %#v, binary gave %#v", gobMsgs[i], binMsgs[i])
+		}
+	}
+}
+
+func TestBinaryCodecRejectsWrongFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := BinaryCodec.NewEncoder(&buf).Encode(dataAckMessage{SeqNum: 1}); err != nil {
+		t.Fatalf("Couldn't encode data ack: %v", err)
+	}
+
+	var msg dataMessage
+	if err := BinaryCodec.NewDecoder(&buf).Decode(&msg); err == nil {
+		t.Errorf("Decoding a data ack as a data message succeeded")
+	}
+}
+
+func TestJSONCodecFrame(t *testing.T) {
+	// A data message as it shows up in a capture.
+	const frame = `{"Stream":0,"SeqNum":7,"Data":"AQID/w==","Copy":false,"Offset":0,"Cancel":false,"End":false}` + "\n"
+	want := dataMessage{SeqNum: 7, Data: []byte{1, 2, 3, 0xff}}
+
+	var got dataMessage
+	if err := JSONCodec.NewDecoder(strings.NewReader(frame)).Decode(&got); err != nil {
+		t.Fatalf("Couldn't decode %q: %v", frame, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decoded %q as %#v, want %#v", frame, got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := JSONCodec.NewEncoder(&buf).Encode(want); err != nil {
+		t.Fatalf("Couldn't encode %#v: %v", want, err)
+	}
+	if buf.String() != frame {
+		t.Errorf("Encoded %#v as %q, want %q", want, buf.String(), frame)
+	}
+
+	// A message cut off mid-line is an error, not the end of the stream.
+	err := JSONCodec.NewDecoder(strings.NewReader(frame[:20])).Decode(&got)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Decoding a truncated message returned %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestBinaryCodecTransfer(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	fpath := path.Join(clientDir, "framed")
+	if err := testutil.GenRandFile(fpath, 10*payloadSize+7); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{Codec: BinaryCodec})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	notifier := &midCrashSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		dialer:          dialer,
+		crashAfter:      4,
+	}
+	opts := &SendOptions{Codec: BinaryCodec}
+	if _, err := SendContext(context.Background(), dialer, fpath, notifier, opts); err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"%s\"", fpath)
+	}
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "framed"))
+	if err != nil {
+		t.Fatalf("Couldn't hash received file")
+	}
+	if srcHash != dstHash {
+		t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	// Each header declares a message far bigger than the server takes: half
+	// a gigabyte for gob, and just under the frame limit for the binary
+	// codec.
+	tests := []struct {
+		codec  MessageCodec
+		header []byte
+	}{
+		{GobCodec, []byte{0xfc, 0x20, 0, 0, 0}},
+		{BinaryCodec, []byte{frameStart, 0, 0, 0, 0, 0, 0, 0, 0, 0x03, 0xc0, 0, 0}},
+	}
+	for _, test := range tests {
+		listener, err := net.Listen("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+		}
+		srv := NewServerWithOptions(listener, dpath, &ServerOptions{Codec: test.codec})
+		go srv.Serve(newLogRecvNotifierFactory(t))
+
+		conn, err := net.Dial("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("Couldn't connect to the server: %v", err)
+		}
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := conn.Write(test.header); err != nil {
+			t.Fatalf("Couldn't write the header: %v", err)
+		}
+
+		// The server hangs up rather than wait for the rest.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%T: Server answered an oversized message", test.codec)
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Errorf("%T: Server is still waiting for an oversized message", test.codec)
+		}
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 32<<20 {
+			t.Errorf("%T: Server allocated %d bytes for an oversized message", test.codec, alloc)
+		}
+
+		conn.Close()
+		srv.Stop()
+	}
+}
@@ -0,0 +1,176 @@
+package rtransfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is how a client has the blocks of a file compressed on the
+// wire.
+type Compression int
+
+const (
+	// CompressionNone sends blocks as they are.
+	CompressionNone = Compression(iota)
+
+	// CompressionGzip compresses each block with gzip.
+	CompressionGzip
+
+	// CompressionZstd compresses each block with zstd, which is faster than
+	// gzip and usually compresses better. A server that doesn't support
+	// zstd gets gzip instead, and one that supports neither gets the
+	// blocks as they are.
+	CompressionZstd
+)
+
+// compressionCaps is every capability that picks a compression.
+const compressionCaps = capGzip | capZstd
+
+// capabilities returns the capabilities a start message asks for to get c,
+// along with the ones to fall back to.
+func (c Compression) capabilities() capability {
+	switch c {
+	case CompressionZstd:
+		return capZstd | capGzip
+	case CompressionGzip:
+		return capGzip
+	default:
+		return 0
+	}
+}
+
+// pickCompression returns caps, a server's answer to the capabilities a
+// client asked for, with only the best compression among them left.
+func pickCompression(caps capability) capability {
+	if caps&capZstd != 0 {
+		return caps &^ capGzip
+	}
+	return caps
+}
+
+// blockCompressor compresses and decompresses the data of blocks. Each block
+// is compressed on its own, so that any one of them can be sent again after
+// a reconnect. The slices it returns are only good until the next call.
+type blockCompressor interface {
+	compress(block []byte) ([]byte, error)
+
+	// decompress fails if data holds more than a block.
+	decompress(data []byte) ([]byte, error)
+}
+
+// newBlockCompressor returns a compressor for the compression caps picks,
+// or nil if it picks none.
+func newBlockCompressor(caps capability) blockCompressor {
+	switch {
+	case caps&capZstd != 0:
+		return &zstdCompressor{}
+	case caps&capGzip != 0:
+		return &gzipCompressor{}
+	default:
+		return nil
+	}
+}
+
+// errBlockTooLarge is returned by a blockCompressor for data that holds more
+// than a block.
+var errBlockTooLarge = fmt.Errorf("Compressed block holds more than %d bytes", payloadSize)
+
+type gzipCompressor struct {
+	w   *gzip.Writer
+	r   *gzip.Reader
+	in  bytes.Reader
+	out bytes.Buffer
+}
+
+func (c *gzipCompressor) compress(block []byte) ([]byte, error) {
+	c.out.Reset()
+	if c.w == nil {
+		c.w = gzip.NewWriter(&c.out)
+	} else {
+		c.w.Reset(&c.out)
+	}
+	if _, err := c.w.Write(block); err != nil {
+		return nil, err
+	}
+	if err := c.w.Close(); err != nil {
+		return nil, err
+	}
+	return c.out.Bytes(), nil
+}
+
+func (c *gzipCompressor) decompress(data []byte) ([]byte, error) {
+	c.in.Reset(data)
+	if c.r == nil {
+		r, err := gzip.NewReader(&c.in)
+		if err != nil {
+			return nil, err
+		}
+		c.r = r
+	} else if err := c.r.Reset(&c.in); err != nil {
+		return nil, err
+	}
+
+	c.out.Reset()
+	n, err := c.out.ReadFrom(io.LimitReader(c.r, payloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > payloadSize {
+		return nil, errBlockTooLarge
+	}
+	return c.out.Bytes(), nil
+}
+
+// zstdEncoder and zstdDecoder are shared by every transfer, since they are
+// costly to set up and safe to use from several goroutines at once. They
+// are made the first time they are needed.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(payloadSize))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+type zstdCompressor struct {
+	out []byte
+}
+
+func (c *zstdCompressor) compress(block []byte) ([]byte, error) {
+	enc, _, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	c.out = enc.EncodeAll(block, c.out[:0])
+	return c.out, nil
+}
+
+func (c *zstdCompressor) decompress(data []byte) ([]byte, error) {
+	_, dec, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	out, err := dec.DecodeAll(data, c.out[:0])
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || len(out) > payloadSize {
+		return nil, errBlockTooLarge
+	} else if err != nil {
+		return nil, err
+	}
+	c.out = out
+	return out, nil
+}
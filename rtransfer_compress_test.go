@@ -0,0 +1,229 @@
+package rtransfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// genTextFile writes size bytes of text that compresses well to fpath.
+func genTextFile(fpath string, size int) error {
+	line := []byte("2014-03-01 12:30:00 INFO transfer of backup.tar resumed at block 42\n")
+	return os.WriteFile(fpath, bytes.Repeat(line, size/len(line)+1)[:size], 0644)
+}
+
+func TestCompression(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	fpath := path.Join(dpath, "log")
+	const size = 64*payloadSize + 100
+	if err := genTextFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create text file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{Overwrite: OverwriteAlways})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		opts := &SendOptions{Compression: c}
+		stats, err := SendContext(context.Background(), newTestDialer(testSrvHostport), fpath, nil, opts)
+		if err != nil {
+			t.Fatalf("Error while sending %s with compression %d: %v", fpath, c, err)
+		}
+
+		srcHash, err := testutil.HashFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fpath)
+		}
+		dstHash, err := testutil.HashFile(path.Join(serverDir, "log"))
+		if err != nil {
+			t.Fatalf("Couldn't hash received copy of \"%s\"", fpath)
+		}
+		if srcHash != dstHash {
+			t.Errorf("Compression %d: hashes don't match. Got %s, wanted %s", c, dstHash, srcHash)
+		}
+
+		if c == CompressionNone && stats.Bytes != size {
+			t.Errorf("Sending %d bytes uncompressed put %d on the wire", size, stats.Bytes)
+		} else if c != CompressionNone && stats.Bytes > size/4 {
+			t.Errorf("Compression %d put %d bytes of text on the wire, want at most %d", c, stats.Bytes, size/4)
+		}
+	}
+}
+
+func TestCompressionFallback(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "log")
+	const size = 3*payloadSize + 100
+	if err := genTextFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create text file: %v", err)
+	}
+	want, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", fpath, err)
+	}
+
+	// Each server knows only some of the compressions, as an older one
+	// would, and acks those of the ones the client asked for.
+	for _, supported := range []capability{capGzip, 0} {
+		listener, err := net.Listen("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+		}
+		received := make(chan []byte, 1)
+		go func() {
+			var got []byte
+			defer func() { received <- got }()
+
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+
+			var startMsg startMessage
+			if err := dec.Decode(&startMsg); err != nil {
+				return
+			}
+			if want := capZstd | capGzip; startMsg.Capabilities&compressionCaps != want {
+				t.Errorf("Client asked for compressions %b, want %b", startMsg.Capabilities&compressionCaps, want)
+			}
+			caps := startMsg.Capabilities & supported
+			enc.Encode(ackMessage{Version: protocolVersion, Capabilities: caps, Name: startMsg.Name, Size: startMsg.Size})
+
+			for seqNum := int64(0); seqNum < getNumBlocks(startMsg.Size); seqNum++ {
+				var dataMsg dataMessage
+				if err := dec.Decode(&dataMsg); err != nil {
+					return
+				}
+				data := dataMsg.Data
+				if caps&capGzip != 0 {
+					r, err := gzip.NewReader(bytes.NewReader(data))
+					if err != nil {
+						t.Errorf("Block %d isn't gzip: %v", seqNum, err)
+						return
+					}
+					if data, err = io.ReadAll(r); err != nil {
+						t.Errorf("Block %d doesn't decompress: %v", seqNum, err)
+						return
+					}
+				}
+				got = append(got, data...)
+				enc.Encode(dataAckMessage{SeqNum: seqNum})
+			}
+		}()
+
+		opts := &SendOptions{Compression: CompressionZstd}
+		_, err = SendContext(context.Background(), newTestDialer(testSrvHostport), fpath, nil, opts)
+		listener.Close()
+		if err != nil {
+			t.Fatalf("Error while sending %s to a server supporting %b: %v", fpath, supported, err)
+		}
+		if got := <-received; !bytes.Equal(got, want) {
+			t.Errorf("Server supporting %b received %d bytes that don't match the file", supported, len(got))
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// A block that inflates to more than a block is refused rather than
+	// decompressed in full.
+	huge := make([]byte, 16*payloadSize)
+	for _, caps := range []capability{capGzip, capZstd} {
+		data, err := newBlockCompressor(caps).compress(huge)
+		if err != nil {
+			t.Fatalf("Couldn't compress with %b: %v", caps, err)
+		}
+		if _, err := newBlockCompressor(caps).decompress(data); err != errBlockTooLarge {
+			t.Errorf("Decompressing %d bytes with %b returned %v, want %v", len(huge), caps, err, errBlockTooLarge)
+		}
+	}
+}
+
+func BenchmarkCompression(b *testing.B) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		b.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	// Half the blocks are text and half are random, as in a backup of
+	// logs alongside already compressed archives.
+	const size = 100 << 20
+	fpath := path.Join(dpath, "mixed")
+	if err := genTextFile(fpath, size); err != nil {
+		b.Fatalf("Couldn't create text file: %v", err)
+	}
+	f, err := os.OpenFile(fpath, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatalf("Couldn't open %s: %v", fpath, err)
+	}
+	random := make([]byte, payloadSize)
+	rng := rand.New(rand.NewSource(1))
+	for off := int64(0); off < size; off += 2 * payloadSize {
+		rng.Read(random)
+		if _, err := f.WriteAt(random, off); err != nil {
+			b.Fatalf("Couldn't write %s: %v", fpath, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		b.Fatalf("Couldn't write %s: %v", fpath, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("couldn't listen: %s", err)
+	}
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{Overwrite: OverwriteAlways})
+	go srv.Serve(nil)
+	defer srv.Stop()
+	dialer := newTestDialer(listener.Addr().String())
+
+	for _, c := range []struct {
+		name        string
+		compression Compression
+	}{
+		{"none", CompressionNone},
+		{"gzip", CompressionGzip},
+		{"zstd", CompressionZstd},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(size)
+			opts := &SendOptions{Compression: c.compression}
+			var wire int64
+			for i := 0; i < b.N; i++ {
+				stats, err := SendContext(context.Background(), dialer, fpath, nil, opts)
+				if err != nil {
+					b.Fatalf("Error while sending: %v", err)
+				}
+				wire = stats.Bytes
+			}
+			b.ReportMetric(float64(wire)/size, "wire/byte")
+		})
+	}
+}
@@ -2,133 +2,946 @@ package rtransfer
 
 import (
 	"container/list"
+	"context"
+	"crypto/sha256"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
-type simpleDialer string
+// netDialer dials address on network, as net.Dial does.
+type netDialer struct {
+	network string
+	address string
+}
+
+func (d netDialer) Dial() (net.Conn, error) {
+	return net.Dial(d.network, d.address)
+}
+
+// UnixDialer dials a server listening on the Unix domain socket at the path
+// it holds.
+type UnixDialer string
 
-func (s simpleDialer) Dial() (net.Conn, error) {
-	return net.Dial("tcp", string(s))
+func (u UnixDialer) Dial() (net.Conn, error) {
+	return net.Dial("unix", string(u))
 }
 
+// Daemon queues files sent to it by clients and sends them on to a server.
+// Stop may be called at any time, including before Serve, and returns once
+// the daemon's goroutines have all exited. Close is Stop, for use as an
+// io.Closer.
 type Daemon interface {
 	Serve() error
 	Stop()
+	Close() error
+}
+
+// Drainer is a Daemon that can stop gracefully. The daemons NewDaemon and
+// its variants return are all Drainers. It is kept apart from Daemon so that
+// other implementations of Daemon needn't have Drain.
+type Drainer interface {
+	Daemon
+
+	// Drain stops the daemon as Stop does, but first gives the files in
+	// flight up to timeout to finish. Meanwhile it takes no new files and
+	// starts none of those queued. It returns how many files it left
+	// unsent, which the QueueFile keeps for the next daemon, along with
+	// the checkpoints of those it cut off.
+	Drain(timeout time.Duration) int
+}
+
+// DaemonOptions holds optional settings for a daemon. A nil *DaemonOptions
+// means the defaults.
+type DaemonOptions struct {
+	// QueueFile, if set, is where the daemon keeps the paths it has yet to
+	// send. A daemon started with the same QueueFile resumes sending them.
+	QueueFile string
+
+	// Workers is how many files the daemon sends at once. Zero means one.
+	Workers int
+
+	// Logger receives the daemon's diagnostic messages, including those
+	// from the transfers it makes.
+	Logger Logger
+
+	// Network is the network the daemon listens on, and ServerNetwork the
+	// one it reaches the server over, such as "tcp" or "unix". Empty means
+	// "tcp". With "unix", the daemon's hostports are socket paths.
+	Network       string
+	ServerNetwork string
+
+	// Multiplex sends the files the workers have in flight over one
+	// connection, taking turns block by block, rather than a connection
+	// each. A large file then doesn't hold up the small ones sent beside
+	// it. It needs Workers above one to make a difference.
+	Multiplex bool
+
+	// CheckpointDir, if set, is a directory in which the daemon records
+	// how far along each file it is sending is, as SendOptions.Checkpoint
+	// does. Along with QueueFile, it lets a restarted daemon pick up a
+	// file it was sending where it left off, even if the server restarted
+	// too. The directory must exist.
+	CheckpointDir string
+
+	// MaxQueue, if positive, is how many files the daemon holds waiting to
+	// be sent, not counting those in flight. A request to send another is
+	// refused with ErrQueueFull until one is taken. Files resumed from
+	// QueueFile count towards it, but are all kept. Zero means no limit.
+	MaxQueue int
+
+	// SendOptions, if set, are the options the daemon sends each file
+	// with, such as a Secret, Compression or MaxRetransmits. Each of them
+	// applies to every file, so Deadline, ResumeFrom and AppendFrom, which
+	// only make sense for one, must be left unset, or Serve returns an
+	// error. The daemon sets their Logger and Checkpoint itself. With or
+	// without them, a transfer that drops is resumed as a direct Send's
+	// is, once the server's digest of the blocks it already has matches
+	// the file's.
+	SendOptions *SendOptions
 }
 
 type daemon struct {
 	dmnHostport string
 	srvHostport string
-	newFiles    chan string
-	stop        chan bool
-	stopped     bool
-	listener    net.Listener
+	newFiles    chan enqueueRequest
+	cancels     chan cancelRequest
+	drains      chan time.Duration
+	statusReqs  chan chan DaemonStatusReport
+	network     string
+	srvNetwork  string
+	multiplex   bool
+	queue       *queueFile
+	checkpoints string
+	workers     int
+	maxQueue    int
+	logger      Logger
+	sendOpts    *SendOptions
+
+	// stop is closed when the daemon is stopped, and finished when the
+	// director has exited, leaving undone files unsent. mu guards the
+	// rest: listener is set once Serve listens, conns holds the
+	// connections being handled, which wg counts.
+	stop     chan struct{}
+	finished chan struct{}
+	undone   int
+	mu       sync.Mutex
+	stopped  bool
+	listener net.Listener
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+
+	// err is what is wrong with the daemon's settings, if anything. Serve
+	// returns it rather than start.
+	err error
 }
 
 func NewDaemon(dmnHostport, srvHostport string) Daemon {
-	return &daemon{
+	return NewDaemonWithOptions(dmnHostport, srvHostport, nil)
+}
+
+// NewDaemonN returns a daemon that sends up to workers files at once.
+func NewDaemonN(dmnHostport, srvHostport string, workers int) Daemon {
+	return NewDaemonWithOptions(dmnHostport, srvHostport, &DaemonOptions{Workers: workers})
+}
+
+// NewDaemonWithOptions returns a daemon that listens on dmnHostport and
+// sends to the server at srvHostport. Over TCP, both must be a host, which
+// may be empty or an IPv6 literal in brackets, and a port, as in ":9000" or
+// "[::1]:9000". An address that isn't is logged, and Serve returns the error
+// straight away.
+func NewDaemonWithOptions(dmnHostport, srvHostport string, opts *DaemonOptions) Daemon {
+	if opts == nil {
+		opts = &DaemonOptions{}
+	}
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	d := &daemon{
 		dmnHostport: dmnHostport,
 		srvHostport: srvHostport,
-		newFiles:    make(chan string),
-		stop:        make(chan bool),
+		newFiles:    make(chan enqueueRequest),
+		cancels:     make(chan cancelRequest),
+		drains:      make(chan time.Duration),
+		statusReqs:  make(chan chan DaemonStatusReport),
+		stop:        make(chan struct{}),
+		finished:    make(chan struct{}),
+		conns:       make(map[net.Conn]bool),
+		network:     orTCP(opts.Network),
+		srvNetwork:  orTCP(opts.ServerNetwork),
+		multiplex:   opts.Multiplex,
+		queue:       newQueueFile(opts.QueueFile),
+		checkpoints: opts.CheckpointDir,
+		workers:     workers,
+		maxQueue:    opts.MaxQueue,
+		logger:      orDefault(opts.Logger),
+		sendOpts:    opts.SendOptions,
 	}
+
+	if err := checkAddr(d.network, dmnHostport); err != nil {
+		d.err = fmt.Errorf("Invalid daemon address: %v", err)
+	} else if err := checkAddr(d.srvNetwork, srvHostport); err != nil {
+		d.err = fmt.Errorf("Invalid server address: %v", err)
+	} else if field := perFileOption(d.sendOpts); field != "" {
+		d.err = fmt.Errorf("Invalid SendOptions: %s only applies to one file, and the daemon sends many", field)
+	}
+	if d.err != nil {
+		d.logger.Logf("%v", d.err)
+	}
+	return d
+}
+
+func orTCP(network string) string {
+	if network == "" {
+		return "tcp"
+	}
+	return network
+}
+
+// checkAddr returns an error if addr isn't an address on network that can be
+// listened on or dialed. Only TCP addresses are checked.
+func checkAddr(network, addr string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort(network, port); err != nil {
+		return err
+	}
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return fmt.Errorf("address %s: %q is not an IPv6 address", addr, host)
+	}
+	return nil
+}
+
+// ErrNotQueued is returned by CancelDaemonFile when the daemon is neither
+// sending nor waiting to send the path.
+var ErrNotQueued = errors.New("the path is not queued on the daemon")
+
+// ErrQueueFull is returned by SendToDaemon and the like when the daemon
+// already holds DaemonOptions.MaxQueue files waiting to be sent.
+var ErrQueueFull = errors.New("the daemon's queue is full")
+
+type daemonRequestType int
+
+const (
+	daemonEnqueue = daemonRequestType(iota)
+	daemonCancel
+	daemonStatus
+)
+
+// daemonRequest is what clients send the daemon, one per connection. Wait
+// asks the daemon not to answer an enqueue request until the file is sent.
+type daemonRequest struct {
+	Type daemonRequestType
+	Path string
+	Wait bool
+}
+
+type daemonResultCode int
+
+const (
+	daemonOK = daemonResultCode(iota)
+	daemonNotQueued
+	daemonFailed
+	daemonQueueFull
+)
+
+// daemonResponse is the daemon's answer to a daemonRequest. Err holds the
+// error message when Code is daemonFailed, and Status answers a daemonStatus
+// request.
+type daemonResponse struct {
+	Code   daemonResultCode
+	Err    string
+	Status DaemonStatusReport
+}
+
+// DaemonStatusReport describes what a daemon is doing.
+type DaemonStatusReport struct {
+	// InFlight lists the files being sent, in no particular order.
+	InFlight []FileProgress
+
+	// Pending lists the files waiting to be sent, in the order they will be
+	// started.
+	Pending []string
+}
+
+// FileProgress is how far along the transfer of one file is. Total is zero
+// until the server has acked the first block.
+type FileProgress struct {
+	Path  string
+	Bytes int64
+	Total int64
+}
+
+// daemonProgress is the SendNotifier the daemon wires into each send so that
+// status requests can report on it.
+type daemonProgress struct {
+	mu       sync.Mutex
+	numBytes int64
+	totBytes int64
+}
+
+func (p *daemonProgress) SendStart() {}
+
+func (p *daemonProgress) RecvAck() {}
+
+func (p *daemonProgress) UpdateProgress(numBytes, totBytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.numBytes = numBytes
+	p.totBytes = totBytes
+}
+
+func (p *daemonProgress) get() (numBytes, totBytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.numBytes, p.totBytes
+}
+
+// enqueueRequest asks the director to send fpath. Whether it was queued is
+// sent on queued, and if done is set, the outcome on it.
+type enqueueRequest struct {
+	fpath  string
+	queued chan error
+	done   chan error
+}
+
+// errDaemonStopped is the outcome of files the daemon stopped before sending.
+var errDaemonStopped = errors.New("the daemon stopped before sending the file")
+
+// cancelRequest asks the director to drop fpath. found reports whether it was
+// queued or in flight.
+type cancelRequest struct {
+	fpath string
+	found chan bool
 }
 
 func (d *daemon) handleConn(conn net.Conn) error {
 	defer conn.Close()
 
+	enc := gob.NewEncoder(conn)
 	dec := gob.NewDecoder(conn)
 
-	var fpath string
-	if err := dec.Decode(&fpath); err != nil {
+	var req daemonRequest
+	if err := dec.Decode(&req); err != nil {
 		return err
 	}
 
-	logf("Received request to send file %s", fpath)
+	var resp daemonResponse
+	var err error
+	switch req.Type {
+	case daemonEnqueue:
+		var done chan error
+		if req.Wait {
+			done = make(chan error, 1)
+		}
+		if err = d.enqueue(req.Path, done); err == nil && done != nil {
+			err = <-done
+		}
+	case daemonCancel:
+		err = d.cancel(req.Path)
+	case daemonStatus:
+		reply := make(chan DaemonStatusReport)
+		select {
+		case d.statusReqs <- reply:
+			resp.Status = <-reply
+		case <-d.stop:
+			err = errDaemonStopped
+		}
+	default:
+		err = fmt.Errorf("Unknown daemon request type %d", req.Type)
+	}
 
-	d.newFiles <- fpath
+	if err == ErrNotQueued {
+		resp.Code = daemonNotQueued
+	} else if err == ErrQueueFull {
+		resp.Code = daemonQueueFull
+	} else if err != nil {
+		resp.Code = daemonFailed
+		resp.Err = err.Error()
+	}
+
+	if err := enc.Encode(resp); err != nil {
+		return err
+	}
+
+	return err
+}
+
+func (d *daemon) enqueue(fpath string, done chan error) error {
+	d.logger.Logf("Received request to send file %s", fpath)
+
+	if strings.ContainsAny(fpath, "\r\n") {
+		return fmt.Errorf("Can't queue a path containing a line break: %q", fpath)
+	}
+
+	// The director answers as soon as it takes the request, so the client
+	// hears straight away if the queue is full.
+	queued := make(chan error, 1)
+	select {
+	case d.newFiles <- enqueueRequest{fpath, queued, done}:
+		return <-queued
+	case <-d.stop:
+		return errDaemonStopped
+	}
+}
+
+func (d *daemon) cancel(fpath string) error {
+	d.logger.Logf("Received request to cancel file %s", fpath)
+
+	found := make(chan bool)
+	select {
+	case d.cancels <- cancelRequest{fpath, found}:
+	case <-d.stop:
+		return errDaemonStopped
+	}
+	if !<-found {
+		return ErrNotQueued
+	}
 
 	return nil
 }
 
 func (d *daemon) Serve() error {
-	go d.director()
+	if d.err != nil {
+		return d.err
+	}
 
-	var err error
-	d.listener, err = net.Listen("tcp", d.dmnHostport)
+	pending, err := d.loadQueue()
 	if err != nil {
 		return err
 	}
 
+	listener, err := net.Listen(d.network, d.dmnHostport)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	if d.stopped || d.listener != nil {
+		d.mu.Unlock()
+		listener.Close()
+		return errors.New("Serve called on a daemon that is stopped or already serving")
+	}
+	d.listener = listener
+	d.mu.Unlock()
+
+	go func() {
+		defer close(d.finished)
+		d.undone = d.director(pending)
+	}()
+
 	for {
-		conn, err := d.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
 
-		if err := d.handleConn(conn); err != nil {
-			logf("error handling connection: %v", err)
+		d.mu.Lock()
+		if d.stopped {
+			d.mu.Unlock()
+			conn.Close()
+			continue
 		}
+		d.conns[conn] = true
+		d.wg.Add(1)
+		d.mu.Unlock()
+
+		// A client waiting for its file holds its connection until the
+		// file is sent, so connections are handled concurrently.
+		go func() {
+			defer d.wg.Done()
+			if err := d.handleConn(conn); err != nil {
+				d.logger.Logf("error handling connection: %v", err)
+			}
+			d.mu.Lock()
+			delete(d.conns, conn)
+			d.mu.Unlock()
+		}()
 	}
+}
 
-	return nil
+// loadQueue reads back the paths a previous daemon left in the queue file,
+// dropping any whose files have since disappeared.
+func (d *daemon) loadQueue() ([]string, error) {
+	paths, err := d.queue.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, fpath := range paths {
+		if !fileExists(fpath) {
+			d.logger.Logf("Skipping queued file %s, it no longer exists", fpath)
+			continue
+		}
+		pending = append(pending, fpath)
+	}
+
+	if len(pending) != len(paths) {
+		if err := d.queue.replace(pending); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(pending) > 0 {
+		d.logger.Logf("Resuming %d queued files", len(pending))
+	}
+
+	return pending, nil
+}
+
+// checkpoint returns the file in which to record the progress of sending
+// fpath, or "" if the daemon doesn't record it.
+func (d *daemon) checkpoint(fpath string) string {
+	if d.checkpoints == "" {
+		return ""
+	}
+	return filepath.Join(d.checkpoints, fmt.Sprintf("%x", sha256.Sum256([]byte(fpath))))
+}
+
+// perFileOption returns the name of the first field set in opts that only
+// applies to a single send, or "" if there is none.
+func perFileOption(opts *SendOptions) string {
+	switch {
+	case opts == nil:
+		return ""
+	case !opts.Deadline.IsZero():
+		return "Deadline"
+	case opts.ResumeFrom != 0:
+		return "ResumeFrom"
+	case opts.AppendFrom != 0:
+		return "AppendFrom"
+	}
+	return ""
+}
+
+// sendOptions returns the options with which to send fpath.
+func (d *daemon) sendOptions(fpath string) *SendOptions {
+	var opts SendOptions
+	if d.sendOpts != nil {
+		opts = *d.sendOpts
+	}
+	opts.Logger = d.logger
+	opts.Checkpoint = d.checkpoint(fpath)
+	return &opts
+}
+
+// queuedFile is a request to send fpath, waiting in the director's queue.
+// A path can be queued more than once, and seq tells the requests apart.
+type queuedFile struct {
+	seq   uint64
+	fpath string
+}
+
+// sendResult reports the outcome of sending one queued file.
+type sendResult struct {
+	queuedFile
+	err error
 }
 
-func (d *daemon) director() {
+// director sends the files queued with the daemon until it is stopped, or
+// has drained, and returns how many it left unsent.
+func (d *daemon) director(pending []string) int {
 	queue := list.New()
-	done := make(chan error)
-	dialer := simpleDialer(d.srvHostport)
 
-	send := func(fpath string) {
-		logf("Sending file %s", fpath)
-		done <- Send(dialer, fpath, nil)
+	// No more than d.workers files are in flight, so the sends that finish
+	// after the director has stopped don't block.
+	done := make(chan sendResult, d.workers)
+
+	// The workers share one connection to the server when multiplexing,
+	// and otherwise each keep theirs between files.
+	var dialer Dialer
+	srvDialer := netDialer{d.srvNetwork, d.srvHostport}
+	if d.multiplex {
+		mux := NewMux(srvDialer, d.sendOptions(""))
+		defer mux.Close()
+		dialer = mux
+	} else {
+		pool := NewConnPool(srvDialer, d.workers)
+		defer pool.Close()
+		dialer = pool
+	}
+
+	// active holds the remote names of the files being sent. The server
+	// resumes transfers by name, so two files that share one must not be
+	// sent at the same time.
+	active := make(map[string]bool)
+
+	// inFlight maps the path of each file being sent to the function that
+	// aborts it, and progress to how far along it is.
+	inFlight := make(map[string]context.CancelFunc)
+	progress := make(map[string]*daemonProgress)
+
+	// waiters maps the requests clients are waiting on to the channels
+	// they hear how sending the file went on. Each waits for its own
+	// request, not for whichever send of the same path ends first.
+	waiters := make(map[uint64]chan error)
+	notify := func(seq uint64, err error) {
+		if done, ok := waiters[seq]; ok {
+			done <- err
+			delete(waiters, seq)
+		}
 	}
 
+	// push queues a request to send fpath and returns its number.
+	var nextSeq uint64
+	push := func(fpath string) uint64 {
+		nextSeq++
+		queue.PushBack(queuedFile{nextSeq, fpath})
+		return nextSeq
+	}
+
+	send := func(ctx context.Context, qf queuedFile, notifier SendNotifier) {
+		d.logger.Logf("Sending file %s", qf.fpath)
+		_, err := SendContext(ctx, dialer, qf.fpath, notifier, d.sendOptions(qf.fpath))
+		done <- sendResult{qf, err}
+	}
+
+	// draining is set once Drain is called, and drainTimeout fires when
+	// it has waited long enough for the files in flight.
+	draining := false
+	var drainTimeout <-chan time.Time
+
+	dispatch := func() {
+		if draining {
+			return
+		}
+		for e := queue.Front(); e != nil && len(active) < d.workers; {
+			next := e.Next()
+			qf := e.Value.(queuedFile)
+			if name := filepath.Base(qf.fpath); !active[name] {
+				ctx, cancel := context.WithCancel(context.Background())
+				active[name] = true
+				inFlight[qf.fpath] = cancel
+				progress[qf.fpath] = &daemonProgress{}
+				queue.Remove(e)
+				go send(ctx, qf, progress[qf.fpath])
+			}
+			e = next
+		}
+	}
+
+	// cancel aborts fpath if it is being sent, or otherwise removes it from
+	// the queue.
+	cancel := func(fpath string) bool {
+		if abort, ok := inFlight[fpath]; ok {
+			abort()
+			return true
+		}
+
+		for e := queue.Front(); e != nil; e = e.Next() {
+			if qf := e.Value.(queuedFile); qf.fpath == fpath {
+				queue.Remove(e)
+				if err := d.queue.remove(fpath); err != nil {
+					d.logger.Logf("Couldn't remove %s from the queue file: %v", fpath, err)
+				}
+				notify(qf.seq, context.Canceled)
+				return true
+			}
+		}
+
+		return false
+	}
+
+	status := func() DaemonStatusReport {
+		var report DaemonStatusReport
+		for fpath, p := range progress {
+			numBytes, totBytes := p.get()
+			report.InFlight = append(report.InFlight, FileProgress{fpath, numBytes, totBytes})
+		}
+		for e := queue.Front(); e != nil; e = e.Next() {
+			report.Pending = append(report.Pending, e.Value.(queuedFile).fpath)
+		}
+		return report
+	}
+
+	for _, fpath := range pending {
+		push(fpath)
+	}
+	dispatch()
+
 Loop:
 	for {
 		select {
 		case <-d.stop:
 			break Loop
-		case fpath := <-d.newFiles:
-			queue.PushBack(fpath)
-
-			if queue.Len() == 1 {
-				go send(fpath)
+		case timeout := <-d.drains:
+			d.logger.Logf("Draining, with %d files in flight and %d queued", len(inFlight), queue.Len())
+			draining = true
+			if len(inFlight) == 0 {
+				break Loop
+			}
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			drainTimeout = timer.C
+		case <-drainTimeout:
+			d.logger.Logf("Gave up draining, with %d files in flight", len(inFlight))
+			break Loop
+		case req := <-d.newFiles:
+			if draining {
+				req.queued <- errDaemonStopped
+				continue
+			}
+			if d.maxQueue > 0 && queue.Len() >= d.maxQueue {
+				d.logger.Logf("Refusing to queue file %s, %d files are already waiting", req.fpath, queue.Len())
+				req.queued <- ErrQueueFull
+				continue
+			}
+			if err := d.queue.append(req.fpath); err != nil {
+				req.queued <- err
+				continue
+			}
+			req.queued <- nil
+			seq := push(req.fpath)
+			if req.done != nil {
+				waiters[seq] = req.done
+			}
+			dispatch()
+		case req := <-d.cancels:
+			req.found <- cancel(req.fpath)
+		case reply := <-d.statusReqs:
+			reply <- status()
+		case res := <-done:
+			if res.err == context.Canceled {
+				d.logger.Logf("Cancelled sending file %s", res.fpath)
+			} else if res.err != nil {
+				d.logger.Logf("An error occurred sending file %s: %v", res.fpath, res.err)
 			}
-		case err := <-done:
-			oldFpath := queue.Front().Value.(string)
-			if err != nil {
-				logf("An error occurred sending file %s: %v", oldFpath, err)
-				// We might want to communicate this failure to the user
+			notify(res.seq, res.err)
+
+			inFlight[res.fpath]()
+			delete(inFlight, res.fpath)
+			delete(progress, res.fpath)
+			delete(active, filepath.Base(res.fpath))
+			if err := d.queue.remove(res.fpath); err != nil {
+				d.logger.Logf("Couldn't remove %s from the queue file: %v", res.fpath, err)
 			}
 
-			queue.Remove(queue.Front())
+			// A file that was sent has had its checkpoint removed
+			// already, but one that was given up on still has it.
+			if cp := d.checkpoint(res.fpath); cp != "" {
+				if err := os.Remove(cp); err != nil && !os.IsNotExist(err) {
+					d.logger.Logf("Couldn't remove checkpoint %s: %v", cp, err)
+				}
+			}
 
-			if queue.Len() > 0 {
-				go send(queue.Front().Value.(string))
+			if draining && len(inFlight) == 0 {
+				break Loop
 			}
+			dispatch()
 		}
 	}
+
+	// The files in flight stay in the queue file, and their checkpoints
+	// with them, for the next daemon to resume.
+	undone := queue.Len() + len(inFlight)
+	for _, abort := range inFlight {
+		abort()
+	}
+	for seq := range waiters {
+		notify(seq, errDaemonStopped)
+	}
+
+	// The sends must be done with the dialer before it is closed.
+	for range inFlight {
+		<-done
+	}
+	return undone
 }
 
 func (d *daemon) Stop() {
+	d.mu.Lock()
 	if !d.stopped {
-		d.listener.Close()
-		d.stop <- true
 		d.stopped = true
+		close(d.stop)
+		if d.listener != nil {
+			d.listener.Close()
+		}
+	}
+	listener := d.listener
+	d.mu.Unlock()
+
+	if listener == nil {
+		return
+	}
+	<-d.finished
+
+	// The clients waiting for their files have been told the daemon
+	// stopped. Any other connection is waiting on its client's request.
+	d.mu.Lock()
+	for conn := range d.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+func (d *daemon) Drain(timeout time.Duration) int {
+	d.mu.Lock()
+	serving := d.listener != nil && !d.stopped
+	d.mu.Unlock()
+
+	if serving {
+		select {
+		case d.drains <- timeout:
+			<-d.finished
+		case <-d.stop:
+		}
+	}
+	d.Stop()
+	return d.undone
+}
+
+func (d *daemon) Close() error {
+	d.Stop()
+	return nil
+}
+
+// DaemonRetries is the policy a DaemonClient reaches the daemon under when
+// it has none of its own. It rides out a daemon restarting, but gives up on
+// one that isn't running at all after ten seconds.
+var DaemonRetries = RetryPolicy{
+	InitialBackoff: time.Millisecond * 100,
+	MaxBackoff:     time.Second * 2,
+	MaxDuration:    time.Second * 10,
+}
+
+// DaemonClient talks to the daemon listening on Address over Network.
+type DaemonClient struct {
+	Network string
+	Address string
+
+	// Retry controls how long the client keeps dialing a daemon it can't
+	// reach. Only dialing is retried, so a request the daemon received is
+	// never made twice. Zero fields take their values from DaemonRetries,
+	// so the client gives up in the end whatever is set, and
+	// RetryPolicy{MaxAttempts: 1} dials once.
+	Retry RetryPolicy
+}
+
+// Send asks the daemon to send fpath. It returns ErrQueueFull if the daemon
+// has no room for it, and ErrEmptyFilename, without asking, if fpath leaves
+// the file no name to be sent under.
+func (c DaemonClient) Send(fpath string) error {
+	if _, err := sendName(fpath); err != nil {
+		return err
 	}
+	_, err := c.call(daemonRequest{Type: daemonEnqueue, Path: fpath})
+	return err
+}
+
+// SendAndWait asks the daemon to send fpath and waits until it has, returning
+// the outcome. A file that is cancelled fails with the error of a cancelled
+// context.
+func (c DaemonClient) SendAndWait(fpath string) error {
+	if _, err := sendName(fpath); err != nil {
+		return err
+	}
+	_, err := c.call(daemonRequest{Type: daemonEnqueue, Path: fpath, Wait: true})
+	return err
+}
+
+// Cancel asks the daemon not to send fpath. A transfer of fpath already in
+// progress is aborted. It returns ErrNotQueued if the daemon had nothing to
+// cancel.
+func (c DaemonClient) Cancel(fpath string) error {
+	_, err := c.call(daemonRequest{Type: daemonCancel, Path: fpath})
+	return err
 }
 
+// Status asks the daemon what it is sending and what it has queued.
+func (c DaemonClient) Status() (DaemonStatusReport, error) {
+	resp, err := c.call(daemonRequest{Type: daemonStatus})
+	return resp.Status, err
+}
+
+// SendToDaemon asks the daemon at hostport to send fpath. See
+// DaemonClient.Send.
 func SendToDaemon(fpath, hostport string) error {
-	conn, err := net.Dial("tcp", hostport)
+	return DaemonClient{Network: "tcp", Address: hostport}.Send(fpath)
+}
+
+// SendToDaemonAndWait asks the daemon at hostport to send fpath and returns
+// once it has. See DaemonClient.SendAndWait.
+func SendToDaemonAndWait(fpath, hostport string) error {
+	return DaemonClient{Network: "tcp", Address: hostport}.SendAndWait(fpath)
+}
+
+// CancelDaemonFile asks the daemon at hostport not to send fpath. See
+// DaemonClient.Cancel.
+func CancelDaemonFile(fpath, hostport string) error {
+	return DaemonClient{Network: "tcp", Address: hostport}.Cancel(fpath)
+}
+
+// DaemonStatus asks the daemon at hostport what it is sending and what it
+// has queued.
+func DaemonStatus(hostport string) (DaemonStatusReport, error) {
+	return DaemonClient{Network: "tcp", Address: hostport}.Status()
+}
+
+func (c DaemonClient) call(req daemonRequest) (daemonResponse, error) {
+	var resp daemonResponse
+
+	conn, err := c.dial()
 	if err != nil {
-		return err
+		return resp, err
 	}
+	defer conn.Close()
 
 	enc := gob.NewEncoder(conn)
-	if err := enc.Encode(fpath); err != nil {
-		return err
+	dec := gob.NewDecoder(conn)
+
+	if err := enc.Encode(req); err != nil {
+		return resp, err
+	}
+
+	if err := dec.Decode(&resp); err != nil {
+		return resp, err
+	}
+
+	switch resp.Code {
+	case daemonOK:
+		return resp, nil
+	case daemonNotQueued:
+		return resp, ErrNotQueued
+	case daemonQueueFull:
+		return resp, ErrQueueFull
+	default:
+		return resp, errors.New(resp.Err)
+	}
+}
+
+// dial connects to the daemon, retrying under c.Retry while it can't.
+func (c DaemonClient) dial() (net.Conn, error) {
+	budget := newRetryBudget(c.Retry.or(DaemonRetries), rand.Int63n)
+	for {
+		conn, err := net.Dial(orTCP(c.Network), c.Address)
+		if err == nil {
+			return conn, nil
+		}
+
+		wait, err := budget.fail(err)
+		if err != nil {
+			return nil, err
+		}
+		time.Sleep(wait)
 	}
-	return nil
 }
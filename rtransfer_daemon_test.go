@@ -1,10 +1,17 @@
 package rtransfer
 
 import (
+	"encoding/gob"
+	"errors"
+	"io"
 	"net"
 	"os"
 	"path"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/shaladdle/goaaw/testutil"
 )
@@ -113,6 +120,1264 @@ func daemonTest(sizes []int64, srvHostport string, dialer Dialer, t *testing.T,
 }
 
 func TestDaemonSimple(t *testing.T) {
-	dialer := newTestDialer(testSrvHostport)
-	transferTest([]int64{1024 * 1024}, testSrvHostport, dialer, t, &logSendNotifier{t})
+	t.Parallel()
+	transferTest([]int64{1024 * 1024}, t, &logSendNotifier{t})
+}
+
+// waitFor polls cond until it returns true or timeout passes.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestDaemonQueuePersist(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	files := make([]string, 4)
+	for i := range files {
+		fname, err := testutil.GenRandName(12)
+		if err != nil {
+			t.Fatalf("Couldn'generate random name: %s", err)
+		}
+		files[i] = fname
+
+		if err := testutil.GenRandFile(path.Join(clientDir, fname), 64*1024); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+	}
+
+	queuePath := path.Join(dpath, "queue")
+	opts := &DaemonOptions{QueueFile: queuePath}
+	queue := newQueueFile(queuePath)
+
+	// With no server listening yet, nothing can leave the queue.
+	dmn := NewDaemonWithOptions(dmnHostport, srvHostport, opts)
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	for i, fname := range files {
+		fpath := path.Join(clientDir, fname)
+
+		// The first enqueue waits for the daemon to start listening.
+		var err error
+		if i == 0 {
+			waitFor(5*time.Second, func() bool {
+				err = SendToDaemon(fpath, dmnHostport)
+				return err == nil
+			})
+		} else {
+			err = SendToDaemon(fpath, dmnHostport)
+		}
+		if err != nil {
+			t.Fatalf("Error while sending file to daemon %s: %v", fpath, err)
+		}
+	}
+
+	if !waitFor(5*time.Second, func() bool {
+		paths, _ := queue.load()
+		return len(paths) == len(files)
+	}) {
+		t.Fatalf("Queue file never held all %d files", len(files))
+	}
+	dmn.Stop()
+
+	// A file deleted while the daemon was down is skipped on restart.
+	deleted := files[len(files)-1]
+	files = files[:len(files)-1]
+	if err := os.Remove(path.Join(clientDir, deleted)); err != nil {
+		t.Fatalf("Couldn't remove %s: %v", deleted, err)
+	}
+
+	listener, err := net.Listen("tcp", srvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", srvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dmn = NewDaemonWithOptions(dmnHostport, srvHostport, opts)
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	if !waitFor(10*time.Second, func() bool {
+		paths, _ := queue.load()
+		return len(paths) == 0
+	}) {
+		t.Fatalf("Restarted daemon never drained the queue")
+	}
+
+	for _, fname := range files {
+		srcHash, err := testutil.HashFile(path.Join(clientDir, fname))
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fname)
+		}
+
+		dstHash, err := testutil.HashFile(path.Join(serverDir, fname))
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fname)
+		}
+
+		if srcHash != dstHash {
+			t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+		}
+	}
+
+	if fileExists(path.Join(serverDir, deleted)) {
+		t.Errorf("File deleted before the restart was still sent")
+	}
+}
+
+// concurrencyRecvNotifier counts the transfers a server has in progress and
+// remembers the most it saw at once.
+type concurrencyRecvNotifier struct {
+	logRecvNotifier
+	mu     *sync.Mutex
+	active *int
+	most   *int
+}
+
+func (cn *concurrencyRecvNotifier) SendAck() {
+	cn.logRecvNotifier.SendAck()
+
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	*cn.active++
+	if *cn.active > *cn.most {
+		*cn.most = *cn.active
+	}
+}
+
+func (cn *concurrencyRecvNotifier) UpdateProgress(numBytes, totBytes int64) {
+	if numBytes == totBytes {
+		cn.mu.Lock()
+		*cn.active--
+		cn.mu.Unlock()
+	}
+}
+
+func TestDaemonWorkers(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	files := make([]string, 6)
+	for i := range files {
+		fname, err := testutil.GenRandName(12)
+		if err != nil {
+			t.Fatalf("Couldn'generate random name: %s", err)
+		}
+		files[i] = fname
+
+		if err := testutil.GenRandFile(path.Join(clientDir, fname), 2*1024*1024); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+	}
+
+	var mu sync.Mutex
+	var active, most int
+	listener, err := net.Listen("tcp", srvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", srvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(func(name string) RecvNotifier {
+		return &concurrencyRecvNotifier{logRecvNotifier{t}, &mu, &active, &most}
+	})
+	defer srv.Stop()
+
+	dmn := NewDaemonN(dmnHostport, srvHostport, 3)
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	for i, fname := range files {
+		fpath := path.Join(clientDir, fname)
+
+		var err error
+		if i == 0 {
+			waitFor(5*time.Second, func() bool {
+				err = SendToDaemon(fpath, dmnHostport)
+				return err == nil
+			})
+		} else {
+			err = SendToDaemon(fpath, dmnHostport)
+		}
+		if err != nil {
+			t.Fatalf("Error while sending file to daemon %s: %v", fpath, err)
+		}
+	}
+
+	if !waitFor(20*time.Second, func() bool {
+		for _, fname := range files {
+			if !fileExists(path.Join(serverDir, fname)) {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatalf("Not every file reached the server")
+	}
+
+	for _, fname := range files {
+		srcHash, err := testutil.HashFile(path.Join(clientDir, fname))
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fname)
+		}
+
+		dstHash, err := testutil.HashFile(path.Join(serverDir, fname))
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fname)
+		}
+
+		if srcHash != dstHash {
+			t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if most < 2 {
+		t.Errorf("Server never saw more than %d transfer at once", most)
+	} else if most > 3 {
+		t.Errorf("Server saw %d transfers at once with 3 workers", most)
+	}
+}
+
+func TestCancelDaemonFile(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	inFlight := path.Join(dpath, "inflight")
+	queued := path.Join(dpath, "queued")
+	for _, fpath := range []string{inFlight, queued} {
+		if err := testutil.GenRandFile(fpath, 1024); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+	}
+
+	// No server is listening, so the first file stays in flight retrying
+	// while the second waits behind it.
+	queuePath := path.Join(dpath, "queue")
+	dmn := NewDaemonWithOptions(dmnHostport, srvHostport, &DaemonOptions{QueueFile: queuePath})
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	if !waitFor(5*time.Second, func() bool {
+		err = SendToDaemon(inFlight, dmnHostport)
+		return err == nil
+	}) {
+		t.Fatalf("Error while sending file to daemon %s: %v", inFlight, err)
+	}
+	if err := SendToDaemon(queued, dmnHostport); err != nil {
+		t.Fatalf("Error while sending file to daemon %s: %v", queued, err)
+	}
+
+	if err := CancelDaemonFile(path.Join(dpath, "missing"), dmnHostport); err != ErrNotQueued {
+		t.Errorf("Cancelling an unknown path returned %v, want %v", err, ErrNotQueued)
+	}
+
+	for _, fpath := range []string{queued, inFlight} {
+		if err := CancelDaemonFile(fpath, dmnHostport); err != nil {
+			t.Errorf("Couldn't cancel %s: %v", fpath, err)
+		}
+	}
+
+	queue := newQueueFile(queuePath)
+	if !waitFor(5*time.Second, func() bool {
+		paths, _ := queue.load()
+		return len(paths) == 0
+	}) {
+		t.Fatalf("Cancelled files were left in the queue")
+	}
+
+	if err := CancelDaemonFile(queued, dmnHostport); err != ErrNotQueued {
+		t.Errorf("Cancelling a cancelled path returned %v, want %v", err, ErrNotQueued)
+	}
+}
+
+func TestDaemonMaxQueue(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	var files []string
+	for _, name := range []string{"inflight", "first", "second", "third"} {
+		fpath := path.Join(dpath, name)
+		if err := testutil.GenRandFile(fpath, 1024); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+		files = append(files, fpath)
+	}
+
+	// No server is listening, so the first file stays in flight retrying
+	// while the rest wait behind it.
+	queuePath := path.Join(dpath, "queue")
+	dmn := NewDaemonWithOptions(dmnHostport, srvHostport, &DaemonOptions{QueueFile: queuePath, MaxQueue: 2})
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	if !waitFor(5*time.Second, func() bool {
+		err = SendToDaemon(files[0], dmnHostport)
+		return err == nil
+	}) {
+		t.Fatalf("Error while sending file to daemon %s: %v", files[0], err)
+	}
+	for _, fpath := range files[1:3] {
+		if err := SendToDaemon(fpath, dmnHostport); err != nil {
+			t.Fatalf("Error while sending file to daemon %s: %v", fpath, err)
+		}
+	}
+
+	if err := SendToDaemon(files[3], dmnHostport); err != ErrQueueFull {
+		t.Errorf("Sending to a full daemon returned %v, want %v", err, ErrQueueFull)
+	}
+	if err := SendToDaemonAndWait(files[3], dmnHostport); err != ErrQueueFull {
+		t.Errorf("Sending to a full daemon and waiting returned %v, want %v", err, ErrQueueFull)
+	}
+	paths, err := newQueueFile(queuePath).load()
+	if err != nil || len(paths) != 3 {
+		t.Errorf("Queue file holds %v (%v), want the three files taken", paths, err)
+	}
+
+	// A file taken off the queue makes room for another.
+	if err := CancelDaemonFile(files[1], dmnHostport); err != nil {
+		t.Fatalf("Couldn't cancel %s: %v", files[1], err)
+	}
+	if err := SendToDaemon(files[3], dmnHostport); err != nil {
+		t.Errorf("Error while sending file to daemon %s after making room: %v", files[3], err)
+	}
+}
+
+func TestDaemonStatus(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	const size = 10 * payloadSize
+	first := path.Join(dpath, "first")
+	second := path.Join(dpath, "second")
+	for _, fpath := range []string{first, second} {
+		if err := testutil.GenRandFile(fpath, size); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+	}
+
+	// This server acks the first two blocks of a transfer and then stalls.
+	listener, err := net.Listen("tcp", srvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", srvHostport, err)
+	}
+	defer listener.Close()
+	stalled := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		enc := gob.NewEncoder(conn)
+		dec := gob.NewDecoder(conn)
+
+		var startMsg startMessage
+		dec.Decode(&startMsg)
+		enc.Encode(ackMessage{Name: startMsg.Name, Size: startMsg.Size})
+		for i := 0; i < 2; i++ {
+			var dataMsg dataMessage
+			dec.Decode(&dataMsg)
+			enc.Encode(dataAckMessage{SeqNum: dataMsg.SeqNum})
+		}
+		stalled <- conn
+	}()
+
+	dmn := NewDaemon(dmnHostport, srvHostport)
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	if !waitFor(5*time.Second, func() bool {
+		err = SendToDaemon(first, dmnHostport)
+		return err == nil
+	}) {
+		t.Fatalf("Error while sending file to daemon %s: %v", first, err)
+	}
+	if err := SendToDaemon(second, dmnHostport); err != nil {
+		t.Fatalf("Error while sending file to daemon %s: %v", second, err)
+	}
+
+	conn := <-stalled
+	defer conn.Close()
+
+	var report DaemonStatusReport
+	if !waitFor(5*time.Second, func() bool {
+		report, err = DaemonStatus(dmnHostport)
+		return err == nil && len(report.InFlight) == 1 && report.InFlight[0].Bytes == 2*payloadSize
+	}) {
+		t.Fatalf("Status never showed two blocks sent, got %+v, %v", report, err)
+	}
+
+	if got := report.InFlight[0]; got.Path != first || got.Total != size {
+		t.Errorf("In-flight file is %+v, want %s with %d bytes total", got, first, size)
+	}
+	if len(report.Pending) != 1 || report.Pending[0] != second {
+		t.Errorf("Pending files are %v, want [%s]", report.Pending, second)
+	}
+
+	for _, fpath := range []string{first, second} {
+		if err := CancelDaemonFile(fpath, dmnHostport); err != nil {
+			t.Errorf("Couldn't cancel %s: %v", fpath, err)
+		}
+	}
+}
+
+func TestDaemonResume(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	checkpointDir := path.Join(dpath, "checkpoints")
+	for _, dir := range []string{serverDir, checkpointDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	const numBlocks = 200
+	fpath := path.Join(dpath, "big")
+	if err := testutil.GenRandFile(fpath, numBlocks*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+
+	// This server keeps the first hundred blocks of the transfer in a
+	// partial file, as a real one would, and then stalls.
+	listener, err := net.Listen("tcp", srvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", srvHostport, err)
+	}
+	stalled := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		enc := gob.NewEncoder(conn)
+		dec := gob.NewDecoder(conn)
+
+		var startMsg startMessage
+		dec.Decode(&startMsg)
+		f, err := os.Create(path.Join(serverDir, startMsg.Name+partSuffix))
+		if err != nil {
+			t.Errorf("Couldn't create partial file: %v", err)
+			conn.Close()
+			return
+		}
+		defer f.Close()
+
+		enc.Encode(ackMessage{Name: startMsg.Name, Size: startMsg.Size})
+		for i := 0; i < 100; i++ {
+			var dataMsg dataMessage
+			dec.Decode(&dataMsg)
+			f.WriteAt(dataMsg.Data, getFilePos(dataMsg.SeqNum))
+			enc.Encode(dataAckMessage{SeqNum: dataMsg.SeqNum})
+		}
+		stalled <- conn
+	}()
+
+	opts := &DaemonOptions{QueueFile: path.Join(dpath, "queue"), CheckpointDir: checkpointDir}
+	dmn := NewDaemonWithOptions(dmnHostport, srvHostport, opts)
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	if !waitFor(5*time.Second, func() bool {
+		err = SendToDaemon(fpath, dmnHostport)
+		return err == nil
+	}) {
+		t.Fatalf("Error while sending file to daemon %s: %v", fpath, err)
+	}
+
+	conn := <-stalled
+	dmn.Stop()
+	conn.Close()
+	listener.Close()
+
+	// The restarted daemon sends to a server that has only the partial
+	// file to go on, so it can only resume from the checkpoint.
+	received := make(chan Stats, 1)
+	listener, err = net.Listen("tcp", srvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", srvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{
+		StatsFunc: func(name string, stats Stats) { received <- stats },
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dmn = NewDaemonWithOptions(dmnHostport, srvHostport, opts)
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	var stats Stats
+	select {
+	case stats = <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Restarted daemon never sent the file")
+	}
+	if want := int64(numBlocks - checkpointEvery); stats.Blocks != want {
+		t.Errorf("Restarted daemon sent %d blocks, want the %d after the checkpoint", stats.Blocks, want)
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"%s\"", fpath)
+	}
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "big"))
+	if err != nil {
+		t.Fatalf("Couldn't hash received file")
+	}
+	if srcHash != dstHash {
+		t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+	}
+
+	if !waitFor(5*time.Second, func() bool {
+		entries, err := os.ReadDir(checkpointDir)
+		return err == nil && len(entries) == 0
+	}) {
+		t.Errorf("Checkpoint was left behind once the file was sent")
+	}
+}
+
+func TestDaemonAddrs(t *testing.T) {
+	for _, addr := range []string{":9000", "127.0.0.1:9000", "[::1]:9000", "localhost:http"} {
+		if err := checkAddr("tcp", addr); err != nil {
+			t.Errorf("Address %s was rejected: %v", addr, err)
+		}
+	}
+
+	for _, addr := range []string{"127.0.0.1", "::1:9000", "[::1]", "[nope:]:9000", "localhost:99999", ""} {
+		for _, dmn := range []Daemon{NewDaemon(addr, srvHostport), NewDaemon(dmnHostport, addr)} {
+			if err := dmn.Serve(); err == nil || !strings.HasPrefix(err.Error(), "Invalid") {
+				t.Errorf("Serving with address %q returned %v, want it rejected", addr, err)
+			}
+		}
+	}
+
+	// Options that only make sense for one file aren't applied to all of
+	// them.
+	for _, opts := range []SendOptions{
+		{Deadline: time.Now().Add(time.Hour)},
+		{ResumeFrom: 3},
+		{AppendFrom: payloadSize},
+	} {
+		opts := opts
+		dmn := NewDaemonWithOptions(dmnHostport, srvHostport, &DaemonOptions{SendOptions: &opts})
+		if err := dmn.Serve(); err == nil || !strings.HasPrefix(err.Error(), "Invalid") {
+			t.Errorf("Serving with %+v returned %v, want it rejected", opts, err)
+		}
+	}
+
+	// Unix socket paths aren't host and port pairs.
+	if err := checkAddr("unix", "/tmp/rtransfer.sock"); err != nil {
+		t.Errorf("Socket path was rejected: %v", err)
+	}
+}
+
+func TestDaemonIPv6(t *testing.T) {
+	const (
+		srvHostport = "[::1]:9001"
+		dmnHostport = "[::1]:9000"
+	)
+
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 3*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", srvHostport)
+	if err != nil {
+		t.Skipf("IPv6 loopback isn't available: %v", err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dmn := NewDaemon(dmnHostport, srvHostport)
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	if !waitFor(5*time.Second, func() bool {
+		err = SendToDaemonAndWait(fpath, dmnHostport)
+		return !isDialError(err)
+	}) || err != nil {
+		t.Fatalf("Waiting for %s returned %v", fpath, err)
+	}
+	if !fileExists(path.Join(serverDir, "file")) {
+		t.Errorf("%s wasn't stored over IPv6", fpath)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+	srvSock := path.Join(dpath, "srv.sock")
+	dmnSock := path.Join(dpath, "dmn.sock")
+
+	listener, err := net.Listen("unix", srvSock)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", srvSock, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	direct := path.Join(dpath, "direct")
+	if err := testutil.GenRandFile(direct, 64*1024); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+	if err := Send(UnixDialer(srvSock), direct, nil); err != nil {
+		t.Fatalf("Couldn't send over a unix socket: %v", err)
+	}
+
+	viaDaemon := path.Join(dpath, "daemon")
+	if err := testutil.GenRandFile(viaDaemon, 64*1024); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+	dmn := NewDaemonWithOptions(dmnSock, srvSock, &DaemonOptions{
+		Network:       "unix",
+		ServerNetwork: "unix",
+	})
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	client := DaemonClient{Network: "unix", Address: dmnSock}
+	if !waitFor(5*time.Second, func() bool {
+		err = client.Send(viaDaemon)
+		return err == nil
+	}) {
+		t.Fatalf("Error while sending file to daemon %s: %v", viaDaemon, err)
+	}
+
+	for _, fpath := range []string{direct, viaDaemon} {
+		dst := path.Join(serverDir, path.Base(fpath))
+		if !waitFor(5*time.Second, func() bool {
+			_, err := os.Stat(dst)
+			return err == nil
+		}) {
+			t.Fatalf("%s never arrived", dst)
+		}
+
+		srcHash, err := testutil.HashFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't hash %s: %v", fpath, err)
+		}
+		dstHash, err := testutil.HashFile(dst)
+		if err != nil {
+			t.Fatalf("Couldn't hash %s: %v", dst, err)
+		}
+		if srcHash != dstHash {
+			t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+		}
+	}
+}
+
+func TestSendToDaemonAndWait(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+	small := path.Join(dpath, "small")
+	large := path.Join(dpath, "large")
+	for fpath, size := range map[string]int64{small: 100, large: 10 * payloadSize} {
+		if err := testutil.GenRandFile(fpath, size); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+	}
+
+	// The server refuses the large file, which fails the send for good.
+	listener, err := net.Listen("tcp", srvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", srvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{MaxFileSize: payloadSize})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dmn := NewDaemon(dmnHostport, srvHostport)
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	if !waitFor(5*time.Second, func() bool {
+		err = SendToDaemonAndWait(small, dmnHostport)
+		return !isDialError(err)
+	}) || err != nil {
+		t.Fatalf("Waiting for %s returned %v", small, err)
+	}
+	if !fileExists(path.Join(serverDir, "small")) {
+		t.Errorf("%s wasn't stored by the time the daemon answered", small)
+	}
+
+	err = SendToDaemonAndWait(large, dmnHostport)
+	if err == nil || err.Error() != ErrTooLarge.Error() {
+		t.Errorf("Waiting for %s returned %v, want %v", large, err, ErrTooLarge)
+	}
+}
+
+func TestSendToDaemonAndWaitTwice(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 1024); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+
+	// No server is listening yet, so the first request stays in flight
+	// while the second for the same file waits behind it.
+	dmn := NewDaemon(dmnHostport, srvHostport)
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	if !waitFor(5*time.Second, func() bool {
+		_, err := DaemonStatus(dmnHostport)
+		return err == nil
+	}) {
+		t.Fatalf("The daemon never answered")
+	}
+	first := make(chan error, 1)
+	go func() {
+		first <- SendToDaemonAndWait(fpath, dmnHostport)
+	}()
+	if !waitFor(5*time.Second, func() bool {
+		report, err := DaemonStatus(dmnHostport)
+		return err == nil && len(report.InFlight) == 1
+	}) {
+		t.Fatalf("%s was never sent", fpath)
+	}
+	second := make(chan error, 1)
+	go func() {
+		second <- SendToDaemonAndWait(fpath, dmnHostport)
+	}()
+	if !waitFor(5*time.Second, func() bool {
+		report, err := DaemonStatus(dmnHostport)
+		return err == nil && len(report.Pending) == 1
+	}) {
+		t.Fatalf("%s was never queued again", fpath)
+	}
+
+	// The server stores the first and turns the second away, and each
+	// client hears about its own.
+	listener, err := net.Listen("tcp", srvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", srvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	if err := <-first; err != nil {
+		t.Errorf("Waiting for the first send returned %v", err)
+	}
+	if err := <-second; err == nil || err.Error() != ErrAlreadyExists.Error() {
+		t.Errorf("Waiting for the second send returned %v, want %v", err, ErrAlreadyExists)
+	}
+}
+
+func TestSendToDaemonRetries(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 100); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+
+	// A client that dials once fails while the daemon is down.
+	once := DaemonClient{Address: dmnHostport, Retry: RetryPolicy{MaxAttempts: 1}}
+	if err := once.Send(fpath); !isDialError(err) {
+		t.Fatalf("Sending to a missing daemon returned %v, want a dial error", err)
+	}
+
+	// The daemon comes up a second after the file is sent to it.
+	dmn := NewDaemon(dmnHostport, srvHostport)
+	defer dmn.Stop()
+	time.AfterFunc(time.Second, func() { go dmn.Serve() })
+
+	if err := SendToDaemon(fpath, dmnHostport); err != nil {
+		t.Fatalf("Error while sending file to daemon %s: %v", fpath, err)
+	}
+
+	// A daemon that never comes up fails the send once the policy runs out.
+	absent := DaemonClient{
+		Address: unusedHostport(t),
+		Retry:   RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxDuration: 200 * time.Millisecond},
+	}
+	start := time.Now()
+	if err := absent.Send(fpath); !isDialError(err) {
+		t.Errorf("Sending to an absent daemon returned %v, want a dial error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Giving up on an absent daemon took %v", elapsed)
+	}
+}
+
+func TestDaemonMultiplex(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+	fpaths := []string{path.Join(dpath, "first"), path.Join(dpath, "second")}
+	for _, fpath := range fpaths {
+		if err := testutil.GenRandFile(fpath, 10*payloadSize); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", srvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", srvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dmn := NewDaemonWithOptions(dmnHostport, srvHostport, &DaemonOptions{Workers: 2, Multiplex: true})
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	errs := make(chan error, len(fpaths))
+	for _, fpath := range fpaths {
+		go func(fpath string) {
+			var err error
+			waitFor(5*time.Second, func() bool {
+				err = SendToDaemonAndWait(fpath, dmnHostport)
+				return !isDialError(err)
+			})
+			errs <- err
+		}(fpath)
+	}
+	for range fpaths {
+		if err := <-errs; err != nil {
+			t.Fatalf("Sending through a multiplexing daemon failed: %v", err)
+		}
+	}
+
+	for _, fpath := range fpaths {
+		srcHash, err := testutil.HashFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fpath)
+		}
+		dstHash, err := testutil.HashFile(path.Join(serverDir, path.Base(fpath)))
+		if err != nil {
+			t.Fatalf("Couldn't hash received copy of \"%s\"", fpath)
+		}
+		if srcHash != dstHash {
+			t.Errorf("Hashes of %s don't match. Got %s, wanted %s", fpath, dstHash, srcHash)
+		}
+	}
+}
+
+func TestDaemonStopLeaks(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	inFlight := path.Join(dpath, "inflight")
+	queued := path.Join(dpath, "queued")
+	for _, fpath := range []string{inFlight, queued} {
+		if err := testutil.GenRandFile(fpath, 1024); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+	}
+
+	// A daemon stopped before it serves never listens.
+	dmn := NewDaemon(dmnHostport, srvHostport)
+	dmn.Stop()
+	if err := dmn.Serve(); err == nil {
+		t.Fatalf("Serve on a stopped daemon returned no error")
+	}
+	dmn.Stop()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		// No server is listening, so the first file stays in flight
+		// retrying while the second waits behind it, with a client
+		// waiting on it. Another client connects and says nothing.
+		dmn := NewDaemon(dmnHostport, srvHostport)
+		served := make(chan error, 1)
+		go func() {
+			served <- dmn.Serve()
+		}()
+
+		if !waitFor(5*time.Second, func() bool {
+			err = SendToDaemon(inFlight, dmnHostport)
+			return err == nil
+		}) {
+			t.Fatalf("Error while sending file to daemon %s: %v", inFlight, err)
+		}
+		waited := make(chan error, 1)
+		go func() {
+			waited <- SendToDaemonAndWait(queued, dmnHostport)
+		}()
+		if !waitFor(5*time.Second, func() bool {
+			report, err := DaemonStatus(dmnHostport)
+			return err == nil && len(report.Pending) == 1
+		}) {
+			t.Fatalf("%s was never queued", queued)
+		}
+		idle, err := net.Dial("tcp", dmnHostport)
+		if err != nil {
+			t.Fatalf("Couldn't connect to the daemon: %v", err)
+		}
+
+		dmn.Stop()
+		if err := <-waited; err == nil || err.Error() != errDaemonStopped.Error() {
+			t.Errorf("Waiting for %s returned %v, want %v", queued, err, errDaemonStopped)
+		}
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Serve didn't return once the daemon stopped")
+		}
+		idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := idle.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+			t.Errorf("The daemon left a connection open: %v", err)
+		}
+		idle.Close()
+		dmn.Stop()
+	}
+
+	var after int
+	if !waitFor(5*time.Second, func() bool {
+		after = runtime.NumGoroutine()
+		return after <= before
+	}) {
+		buf := make([]byte, 1<<20)
+		t.Errorf("%d goroutines before starting and stopping daemons, %d after:\n%s",
+			before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+// isDialError reports whether err came from failing to reach the daemon.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// cutProxy relays the connections it accepts to hostport, cutting the first
+// one once limit bytes of it have come in, as if the link had died.
+type cutProxy struct {
+	listener net.Listener
+	hostport string
+	limit    int
+}
+
+func (p *cutProxy) serve() {
+	first := true
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", p.hostport)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		w := io.Writer(upstream)
+		if first {
+			w = &lossyConn{Conn: upstream, limit: p.limit}
+			first = false
+		}
+		go func() {
+			io.Copy(w, conn)
+			upstream.Close()
+		}()
+		go func() {
+			io.Copy(conn, upstream)
+			conn.Close()
+		}()
+	}
+}
+
+func TestDaemonResumesDroppedSend(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+	const size = 64 * payloadSize
+	fpath := path.Join(dpath, "large")
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+
+	srvStats := make(chan Stats, 1)
+	listener, err := net.Listen("tcp", srvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", srvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{
+		StatsFunc: func(name string, stats Stats) {
+			srvStats <- stats
+		},
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// The daemon reaches the server through a proxy that drops its first
+	// connection halfway through the file.
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer proxyListener.Close()
+	proxy := &cutProxy{proxyListener, srvHostport, size / 2}
+	go proxy.serve()
+
+	dmn := NewDaemonWithOptions(dmnHostport, proxyListener.Addr().String(), &DaemonOptions{
+		SendOptions: &SendOptions{MaxRetransmits: 2},
+	})
+	go dmn.Serve()
+	defer dmn.Stop()
+
+	if !waitFor(5*time.Second, func() bool {
+		err = SendToDaemonAndWait(fpath, dmnHostport)
+		return !isDialError(err)
+	}) || err != nil {
+		t.Fatalf("Waiting for %s returned %v", fpath, err)
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"%s\"", fpath)
+	}
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "large"))
+	if err != nil || srcHash != dstHash {
+		t.Errorf("The server doesn't have %s as it was sent (%v)", fpath, err)
+	}
+
+	// The second connection picked up the transfer the first one left.
+	if got := <-srvStats; got.Reconnects != 1 {
+		t.Errorf("Server saw %d reconnects, want 1", got.Reconnects)
+	}
+}
+
+// gateRecvNotifier holds up the transfer it is told of at the first block,
+// until gate is closed.
+type gateRecvNotifier struct {
+	RecvNotifier
+	gate chan bool
+}
+
+func (n gateRecvNotifier) UpdateProgress(numBytes, totBytes int64) {
+	<-n.gate
+	n.RecvNotifier.UpdateProgress(numBytes, totBytes)
+}
+
+// drainTest starts a server that holds up transfers until gate is closed,
+// and a daemon sending first and queueing second, and returns the daemon
+// once first is in flight.
+func drainTest(t *testing.T, serverDir, first, second string, gate chan bool) (Drainer, Server) {
+	listener, err := net.Listen("tcp", srvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", srvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	createNotifier := newLogRecvNotifierFactory(t)
+	go srv.Serve(func(name string) RecvNotifier {
+		return gateRecvNotifier{createNotifier(name), gate}
+	})
+
+	dmn := NewDaemon(dmnHostport, srvHostport)
+	go dmn.Serve()
+
+	if !waitFor(5*time.Second, func() bool {
+		err = SendToDaemon(first, dmnHostport)
+		return err == nil
+	}) {
+		t.Fatalf("Error while sending file to daemon %s: %v", first, err)
+	}
+	if err := SendToDaemon(second, dmnHostport); err != nil {
+		t.Fatalf("Error while sending file to daemon %s: %v", second, err)
+	}
+
+	var report DaemonStatusReport
+	if !waitFor(5*time.Second, func() bool {
+		report, err = DaemonStatus(dmnHostport)
+		return err == nil && len(report.InFlight) == 1 && len(report.Pending) == 1
+	}) {
+		t.Fatalf("Status never showed one file in flight and one queued, got %+v, %v", report, err)
+	}
+	return dmn.(Drainer), srv
+}
+
+func TestDaemonDrain(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+	first := path.Join(dpath, "first")
+	second := path.Join(dpath, "second")
+	for _, fpath := range []string{first, second} {
+		if err := testutil.GenRandFile(fpath, 10*payloadSize); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+	}
+
+	gate := make(chan bool)
+	dmn, srv := drainTest(t, serverDir, first, second, gate)
+	defer srv.Stop()
+	defer dmn.Stop()
+
+	const window = 10 * time.Second
+	start := time.Now()
+	undone := make(chan int)
+	go func() { undone <- dmn.Drain(window) }()
+
+	// The daemon takes no new files while it drains.
+	if !waitFor(5*time.Second, func() bool {
+		return SendToDaemon(first, dmnHostport) != nil
+	}) {
+		t.Errorf("Daemon kept taking files while draining")
+	}
+	close(gate)
+
+	if n := <-undone; n != 1 {
+		t.Errorf("Drain left %d files unsent, want 1", n)
+	}
+	if elapsed := time.Since(start); elapsed >= window {
+		t.Errorf("Drain took %v, the whole window", elapsed)
+	}
+
+	srcHash, err := testutil.HashFile(first)
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"%s\"", first)
+	}
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "first"))
+	if err != nil || srcHash != dstHash {
+		t.Errorf("The file in flight wasn't sent in full before Drain returned (%v)", err)
+	}
+	if fileExists(path.Join(serverDir, "second")) {
+		t.Errorf("Daemon sent the queued file while draining")
+	}
+}
+
+func TestDaemonDrainTimeout(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+	first := path.Join(dpath, "first")
+	second := path.Join(dpath, "second")
+	for _, fpath := range []string{first, second} {
+		if err := testutil.GenRandFile(fpath, 10*payloadSize); err != nil {
+			t.Fatalf("Couldn't create random file: %s", err)
+		}
+	}
+
+	gate := make(chan bool)
+	dmn, srv := drainTest(t, serverDir, first, second, gate)
+	defer srv.Stop()
+	defer close(gate)
+
+	// The file in flight never finishes, so it is cut off.
+	const window = 200 * time.Millisecond
+	start := time.Now()
+	if n := dmn.Drain(window); n != 2 {
+		t.Errorf("Drain left %d files unsent, want 2", n)
+	}
+	if elapsed := time.Since(start); elapsed < window || elapsed > window+5*time.Second {
+		t.Errorf("Drain took %v with a window of %v", elapsed, window)
+	}
 }
@@ -0,0 +1,126 @@
+package rtransfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// recvKnown stores the file startMsg describes as a copy of a file the server
+// already has with the same contents, if Dedup is on and it has one, and acks
+// every block of it at once. It reports whether it did. A copy that can't be
+// made is logged, and the file is then sent as usual.
+func (srv *server) recvKnown(enc Encoder, startMsg startMessage, root string) (bool, error) {
+	if !srv.dedup || srv.store != nil || startMsg.Capabilities&capDedup == 0 ||
+		len(startMsg.Hash) != sha256.Size || startMsg.AppendFrom != 0 || startMsg.RangeEnd != 0 ||
+		startMsg.Size <= 0 {
+		return false, nil
+	}
+
+	srv.mu.Lock()
+	known := srv.contents[string(startMsg.Hash)]
+	_, pending := srv.transfers[startMsg.Name]
+	srv.mu.Unlock()
+	if known == "" || pending {
+		return false, nil
+	}
+
+	// A file that is already there is left to the overwrite policy.
+	fpath, err := srv.destPath(root, startMsg.Name, time.Now())
+	if err != nil || fpath == known || srv.exists(fpath) {
+		return false, nil
+	}
+
+	if err := srv.copyKnown(known, fpath, startMsg); err != nil {
+		srv.logger.Logf("Couldn't store %s as a copy of %s, receiving it: %v", startMsg.Name, known, err)
+		return false, nil
+	}
+	srv.logger.Logf("Stored %s as a copy of %s, which has the same contents", startMsg.Name, known)
+
+	if !srv.noMetadata {
+		if err := applyMetadata(fpath, startMsg); err != nil {
+			srv.logger.Logf("Couldn't restore the metadata of %s: %v", startMsg.Name, err)
+		}
+	}
+	srv.applyOwner(fpath, startMsg)
+	srv.remember(srv.recordOf(startMsg, root, fpath, startMsg.Size, nil))
+	if srv.statsFunc != nil {
+		srv.statsFunc(startMsg.Name, Stats{})
+	}
+
+	// The client checks the hash of the blocks it is told the server has,
+	// which here is the whole file.
+	ackMsg := ackMessage{
+		Version:      protocolVersion,
+		Capabilities: pickCompression(startMsg.Capabilities & srv.capabilities()),
+		Name:         startMsg.Name,
+		Size:         startMsg.Size,
+		SeqNum:       getNumBlocks(startMsg.Size),
+		ErrType:      ErrSuccess,
+		PrefixHash:   startMsg.Hash,
+	}
+	if err := enc.Encode(ackMsg); err != nil {
+		return true, err
+	}
+
+	if ackMsg.Capabilities&capResult != 0 {
+		result, err := srv.result(root, fpath, startMsg.Size, startMsg.HashAlgo, nil)
+		if err != nil {
+			return true, err
+		}
+		return true, enc.Encode(result)
+	}
+	return true, nil
+}
+
+// copyKnown copies the file at known to fpath, as long as it still has the
+// size and hash in startMsg. Like a transfer, the copy only appears at fpath
+// once it is complete.
+func (srv *server) copyKnown(known, fpath string, startMsg startMessage) error {
+	src, err := os.Open(known)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(path.Dir(fpath), srv.dirMode); err != nil {
+		return err
+	}
+
+	// A transfer of the same name may start using fpath+partSuffix, so
+	// the copy gets a partial file of its own.
+	var unique [8]byte
+	if _, err := rand.Read(unique[:]); err != nil {
+		return err
+	}
+	partPath := fmt.Sprintf("%s.%x%s", fpath, unique, partSuffix)
+	f, err := os.OpenFile(partPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, srv.fileMode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partPath)
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if n != startMsg.Size || !bytes.Equal(h.Sum(nil), startMsg.Hash) {
+		srv.mu.Lock()
+		if srv.contents[string(startMsg.Hash)] == known {
+			delete(srv.contents, string(startMsg.Hash))
+		}
+		srv.mu.Unlock()
+		return fmt.Errorf("%s has changed", known)
+	}
+	return srv.storeFile(partPath, fpath, startMsg.Name, startMsg.Size)
+}
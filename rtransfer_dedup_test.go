@@ -0,0 +1,126 @@
+package rtransfer
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestDedup(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+	fpath := path.Join(clientDir, "a")
+	if err := testutil.GenRandFile(fpath, 20*payloadSize+3); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	contents, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", fpath, err)
+	}
+
+	var mu sync.Mutex
+	blocks := make(map[string]int64)
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{
+		Dedup: true,
+		StatsFunc: func(name string, stats Stats) {
+			mu.Lock()
+			defer mu.Unlock()
+			blocks[name] = stats.Blocks
+		},
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+	dialer := newTestDialer(testSrvHostport)
+
+	// received returns how many blocks the server took for name, once it
+	// has stored it.
+	received := func(name string) int64 {
+		var n int64
+		ok := waitFor(5*time.Second, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			var ok bool
+			n, ok = blocks[name]
+			return ok
+		})
+		if !ok {
+			t.Fatalf("Server never stored %s", name)
+		}
+		return n
+	}
+
+	if err := Send(dialer, fpath, nil); err != nil {
+		t.Fatalf("Error while sending %s: %v", fpath, err)
+	}
+	if n := received("a"); n != 21 {
+		t.Errorf("Server took %d blocks of a, want 21", n)
+	}
+
+	// The same contents under another name ship no blocks, whether sent
+	// with SendAs or from another file.
+	if err := SendAs(dialer, fpath, "b", nil); err != nil {
+		t.Fatalf("Error while sending %s as b: %v", fpath, err)
+	}
+	if n := received("b"); n != 0 {
+		t.Errorf("Server took %d blocks of b, which it had the contents of", n)
+	}
+
+	moved := path.Join(clientDir, "c")
+	if err := os.WriteFile(moved, contents, 0644); err != nil {
+		t.Fatalf("Couldn't write %s: %v", moved, err)
+	}
+	stats, err := SendContext(context.Background(), dialer, moved, nil, nil)
+	if err != nil {
+		t.Fatalf("Error while sending %s: %v", moved, err)
+	}
+	if stats.Blocks != 0 {
+		t.Errorf("Sending a moved file shipped %d blocks, want 0", stats.Blocks)
+	}
+
+	for _, name := range []string{"b", "c"} {
+		got, err := os.ReadFile(path.Join(serverDir, name))
+		if err != nil {
+			t.Fatalf("Couldn't read the server's %s: %v", name, err)
+		}
+		if string(got) != string(contents) {
+			t.Errorf("The server's %s doesn't have the contents it was sent", name)
+		}
+	}
+
+	// Once the server's copies no longer have the contents, they are sent
+	// in full again.
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(path.Join(serverDir, name), make([]byte, len(contents)), 0644); err != nil {
+			t.Fatalf("Couldn't overwrite the server's %s: %v", name, err)
+		}
+	}
+	if err := SendAs(dialer, fpath, "d", nil); err != nil {
+		t.Fatalf("Error while sending %s as d: %v", fpath, err)
+	}
+	if n := received("d"); n != 21 {
+		t.Errorf("Server took %d blocks of d after its copies changed, want 21", n)
+	}
+	got, err := os.ReadFile(path.Join(serverDir, "d"))
+	if err != nil || string(got) != string(contents) {
+		t.Errorf("The server's d doesn't have the contents it was sent (%v)", err)
+	}
+}
@@ -0,0 +1,177 @@
+package rtransfer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// blockSignature describes one full block of a file the server already has,
+// so that a client sending a new version can tell which of its blocks the
+// server can copy instead of receiving. Weak is cheap to roll along a file
+// a byte at a time, and Strong confirms a match.
+type blockSignature struct {
+	Weak   uint32
+	Strong []byte
+}
+
+// weakSum is the rsync rolling checksum of p.
+func weakSum(p []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(p))
+	for i, c := range p {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+// rollSum moves the window summed by sum, which is n bytes long, forward by
+// one byte, dropping out and taking in.
+func rollSum(sum uint32, n int, out, in byte) uint32 {
+	a := sum & 0xffff
+	b := sum >> 16
+	a = (a - uint32(out) + uint32(in)) & 0xffff
+	b = (b - uint32(n)*uint32(out) + a) & 0xffff
+	return a | b<<16
+}
+
+// signaturesOf returns the signatures of the full blocks of the file at
+// fpath. A partial last block is left out.
+func signaturesOf(fpath string) ([]blockSignature, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sigs []blockSignature
+	block := make([]byte, payloadSize)
+	for {
+		if _, err := io.ReadFull(f, block); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sigs, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		strong := sha256.Sum256(block)
+		sigs = append(sigs, blockSignature{weakSum(block), strong[:]})
+	}
+}
+
+// findCopies works out which blocks of the size bytes in r the server can
+// copy from the file sigs describe. It returns, for each such block, the
+// offset in the server's file to copy it from. r is left at an unspecified
+// position.
+//
+// Like rsync, it rolls a window along r looking for the server's blocks at
+// any offset, so data that moved still matches. A block of r can be copied
+// when it lies entirely within a run of matches that are contiguous in both
+// files.
+func findCopies(r io.ReadSeeker, size int64, sigs []blockSignature) (map[int64]int64, error) {
+	copies := make(map[int64]int64)
+	if len(sigs) == 0 || size < payloadSize {
+		return copies, nil
+	}
+
+	table := make(map[uint32][]int64)
+	for i, sig := range sigs {
+		table[sig.Weak] = append(table[sig.Weak], int64(i))
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	// window is a ring buffer holding the payloadSize bytes of r starting
+	// at offset, with the first of them at head.
+	window := make([]byte, payloadSize)
+	head := 0
+	var offset int64
+
+	// Each run maps [start, end) of r to the server's file from basis on.
+	type run struct{ start, end, basis int64 }
+	var runs []run
+
+	fill := func() bool {
+		head = 0
+		_, err := io.ReadFull(br, window)
+		return err == nil
+	}
+
+	if !fill() {
+		return copies, nil
+	}
+	sum := weakSum(window)
+
+	for {
+		if match, ok := lookup(table, sigs, sum, window, head); ok {
+			basis := match * payloadSize
+			if n := len(runs); n > 0 && runs[n-1].end == offset && runs[n-1].basis+(offset-runs[n-1].start) == basis {
+				runs[n-1].end += payloadSize
+			} else {
+				runs = append(runs, run{offset, offset + payloadSize, basis})
+			}
+
+			offset += payloadSize
+			if !fill() {
+				break
+			}
+			sum = weakSum(window)
+			continue
+		}
+
+		in, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		out := window[head]
+		window[head] = in
+		head = (head + 1) % payloadSize
+		sum = rollSum(sum, payloadSize, out, in)
+		offset++
+	}
+
+	for _, run := range runs {
+		first := (run.start + payloadSize - 1) / payloadSize
+		for seqNum := first; ; seqNum++ {
+			pos := getFilePos(seqNum)
+			end := pos + payloadSize
+			if end > size {
+				end = size
+			}
+			if pos >= size || end > run.end {
+				break
+			}
+			copies[seqNum] = run.basis + pos - run.start
+		}
+	}
+
+	return copies, nil
+}
+
+// lookup returns the index of the server block matching the window, whose
+// weak checksum is sum.
+func lookup(table map[uint32][]int64, sigs []blockSignature, sum uint32, window []byte, head int) (int64, bool) {
+	candidates := table[sum]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	h := sha256.New()
+	h.Write(window[head:])
+	h.Write(window[:head])
+	strong := h.Sum(nil)
+
+	for _, i := range candidates {
+		if bytes.Equal(sigs[i].Strong, strong) {
+			return i, true
+		}
+	}
+	return 0, false
+}
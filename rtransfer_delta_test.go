@@ -0,0 +1,181 @@
+package rtransfer
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestRollSum(t *testing.T) {
+	data := make([]byte, 3*payloadSize)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	sum := weakSum(data[:payloadSize])
+	for i := 1; i <= 2*payloadSize; i++ {
+		sum = rollSum(sum, payloadSize, data[i-1], data[i+payloadSize-1])
+		if want := weakSum(data[i : i+payloadSize]); sum != want {
+			t.Fatalf("Rolled checksum at offset %d is %x, want %x", i, sum, want)
+		}
+	}
+}
+
+func TestFindCopiesShifted(t *testing.T) {
+	old := make([]byte, 20*payloadSize)
+	rand.New(rand.NewSource(2)).Read(old)
+
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+	oldPath := path.Join(dpath, "old")
+	if err := os.WriteFile(oldPath, old, 0666); err != nil {
+		t.Fatalf("Couldn't write %s: %v", oldPath, err)
+	}
+	sigs, err := signaturesOf(oldPath)
+	if err != nil {
+		t.Fatalf("Couldn't compute signatures: %v", err)
+	}
+
+	// Everything after the insertion is shifted off the block boundaries.
+	inserted := append(append(append([]byte{}, old[:5*payloadSize+10]...), "inserted"...), old[5*payloadSize+10:]...)
+	copies, err := findCopies(bytes.NewReader(inserted), int64(len(inserted)), sigs)
+	if err != nil {
+		t.Fatalf("Couldn't find copies: %v", err)
+	}
+
+	numBlocks := getNumBlocks(int64(len(inserted)))
+	if int64(len(copies)) < numBlocks-3 {
+		t.Errorf("Found %d of %d blocks to copy, want all but the few near the insertion", len(copies), numBlocks)
+	}
+	for seqNum, offset := range copies {
+		pos := getFilePos(seqNum)
+		end := pos + payloadSize
+		if end > int64(len(inserted)) {
+			end = int64(len(inserted))
+		}
+		if !bytes.Equal(inserted[pos:end], old[offset:offset+end-pos]) {
+			t.Errorf("Block %d doesn't match the old file at %d", seqNum, offset)
+		}
+	}
+}
+
+// countingConn counts the bytes written to it.
+type countingConn struct {
+	net.Conn
+	mu      *sync.Mutex
+	written *int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.mu.Lock()
+	*c.written += int64(n)
+	c.mu.Unlock()
+	return n, err
+}
+
+type countingDialer struct {
+	hostport string
+	mu       sync.Mutex
+	written  int64
+}
+
+func (d *countingDialer) Dial() (net.Conn, error) {
+	conn, err := net.Dial("tcp", d.hostport)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{conn, &d.mu, &d.written}, nil
+}
+
+// deltaTest stores old on the server, sends updated in its place with
+// delta enabled, and returns how many bytes the client wrote.
+func deltaTest(t *testing.T, old, updated []byte) int64 {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	if err := os.WriteFile(path.Join(serverDir, "image"), old, 0666); err != nil {
+		t.Fatalf("Couldn't create the server's copy: %v", err)
+	}
+	fpath := path.Join(clientDir, "image")
+	if err := os.WriteFile(fpath, updated, 0666); err != nil {
+		t.Fatalf("Couldn't create the updated file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{Overwrite: OverwriteAlways})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := &countingDialer{hostport: testSrvHostport}
+	opts := &SendOptions{Delta: true}
+	if _, err := SendContext(context.Background(), dialer, fpath, nil, opts); err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	stored, err := os.ReadFile(path.Join(serverDir, "image"))
+	if err != nil {
+		t.Fatalf("Couldn't read the stored file: %v", err)
+	}
+	if !bytes.Equal(stored, updated) {
+		t.Errorf("The stored file doesn't match the updated one")
+	}
+
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	return dialer.written
+}
+
+func TestDeltaMutated(t *testing.T) {
+	const size = 10 << 20
+	rnd := rand.New(rand.NewSource(3))
+	old := make([]byte, size)
+	rnd.Read(old)
+
+	// Change 1% of the file in scattered patches.
+	updated := append([]byte{}, old...)
+	for i := 0; i < 100; i++ {
+		patch := updated[rnd.Intn(size-size/10000):][:size/10000]
+		rnd.Read(patch)
+	}
+
+	written := deltaTest(t, old, updated)
+	if written > size/10 {
+		t.Errorf("Client wrote %d bytes to update a %d byte file by 1%%", written, size)
+	}
+}
+
+func TestDeltaInserted(t *testing.T) {
+	const size = 1 << 20
+	old := make([]byte, size)
+	rand.New(rand.NewSource(4)).Read(old)
+
+	updated := append(append([]byte("a new header\n"), old[:size/2]...), old[size/2+100:]...)
+
+	written := deltaTest(t, old, updated)
+	if written > size/10 {
+		t.Errorf("Client wrote %d bytes to update a %d byte file by a few bytes", written, size)
+	}
+}
@@ -0,0 +1,132 @@
+package rtransfer
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// SendDir sends every regular file under root, naming each one on the server
+// by its path relative to root. Directories are recreated on the server, so
+// empty ones survive the transfer. Symbolic links are skipped.
+func SendDir(dialer Dialer, root string, notifier SendNotifier) error {
+	return SendDirWithOptions(dialer, root, notifier, nil)
+}
+
+// SendDirWithOptions is like SendDir, but lets the caller choose to follow
+// or preserve symbolic links through opts.
+func SendDirWithOptions(dialer Dialer, root string, notifier SendNotifier, opts *SendOptions) error {
+	notifier = guardSendNotifier(notifier, opts.logger())
+	calls, wait := opts.wrapNotifier(notifier)
+	err := sendTree(dialer, root, "", calls, opts, make(map[string]bool))
+	wait()
+	return sendDone(notifier, err)
+}
+
+// sendTree walks dir, sending its contents under the remote name prefix.
+// visited holds the real paths of the directories already walked, so that
+// following a symlink cycle terminates.
+func sendTree(dialer Dialer, dir, prefix string, notifier SendNotifier, opts *SendOptions, visited map[string]bool) error {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if visited[realDir] {
+		opts.logger().Logf("Skipping %s, it was already sent", dir)
+		return nil
+	}
+	visited[realDir] = true
+
+	return filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		name := prefix
+		if rel != "." {
+			name = path.Join(prefix, filepath.ToSlash(rel))
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if opts != nil && opts.PreserveSymlinks && !opts.FollowSymlinks {
+				target, err := os.Readlink(fpath)
+				if err != nil {
+					return err
+				}
+				startMsg := startMessage{
+					Capabilities: capSymlink,
+					Name:         name,
+					LinkTarget:   filepath.ToSlash(target),
+				}
+				return retry(context.Background(), dialer, opts, nil, func(conn net.Conn) error {
+					return sendEntry(conn, opts.codec(), startMsg)
+				})
+			}
+			if opts == nil || !opts.FollowSymlinks {
+				opts.logger().Logf("Skipping symlink %s", fpath)
+				return nil
+			}
+
+			info, err = os.Stat(fpath)
+			if err != nil {
+				opts.logger().Logf("Skipping broken symlink %s: %v", fpath, err)
+				return nil
+			}
+
+			if info.IsDir() {
+				return sendTree(dialer, fpath, name, notifier, opts, visited)
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			if name == "" {
+				return nil
+			}
+			startMsg := startMessage{Name: name, IsDir: true}
+			return retry(context.Background(), dialer, opts, nil, func(conn net.Conn) error {
+				return sendEntry(conn, opts.codec(), startMsg)
+			})
+		case info.Mode().IsRegular():
+			src := newFileSource(fpath, opts)
+			return retry(context.Background(), dialer, opts, nil, func(conn net.Conn) error {
+				return send(conn, src, name, notifier, nil)
+			})
+		default:
+			opts.logger().Logf("Skipping %s, it is not a regular file or directory", fpath)
+			return nil
+		}
+	})
+}
+
+// sendEntry sends startMsg for a directory or link, which carries no data.
+func sendEntry(conn net.Conn, codec MessageCodec, startMsg startMessage) error {
+	enc, dec := streams(conn, codec)
+
+	startMsg.Version = protocolVersion
+	if err := enc.Encode(startMsg); err != nil {
+		return err
+	}
+
+	var ack ackMessage
+	if err := dec.Decode(&ack); err != nil {
+		return err
+	}
+
+	if err := ack.err(); err != nil {
+		return err
+	}
+
+	// A server that doesn't know links would have stored an empty file.
+	if startMsg.Capabilities&^ack.Capabilities != 0 {
+		return ErrUnsupportedFeature
+	}
+
+	return nil
+}
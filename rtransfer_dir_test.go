@@ -0,0 +1,172 @@
+package rtransfer
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func dirTest(t *testing.T, opts *SendOptions) (clientDir, serverDir string) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+
+	clientDir = path.Join(dpath, "client")
+	serverDir = path.Join(dpath, "server")
+	for _, dir := range []string{
+		clientDir,
+		serverDir,
+		path.Join(clientDir, "a"),
+		path.Join(clientDir, "a", "b"),
+		path.Join(clientDir, "empty"),
+	} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	files := map[string]int64{
+		"top":      1024,
+		"a/middle": 5000,
+		"a/b/leaf": 12,
+	}
+	for name, size := range files {
+		if err := testutil.GenRandFile(path.Join(clientDir, name), size); err != nil {
+			t.Fatalf("Couldn't create random file of size %d: %s", size, err)
+		}
+	}
+
+	for name, target := range map[string]string{"link": "top", "a/b/up": "../../top"} {
+		if err := os.Symlink(target, path.Join(clientDir, name)); err != nil {
+			t.Fatalf("Couldn't create symlink: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	if err := SendDirWithOptions(dialer, clientDir, &logSendNotifier{t}, opts); err != nil {
+		t.Fatalf("Error while sending directory %s: %v", clientDir, err)
+	}
+
+	for name := range files {
+		srcHash, err := testutil.HashFile(path.Join(clientDir, name))
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", name)
+		}
+
+		dstHash, err := testutil.HashFile(path.Join(serverDir, name))
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", name)
+		}
+
+		if srcHash != dstHash {
+			t.Errorf("Hashes don't match for %s. Got %s, wanted %s", name, dstHash, srcHash)
+		}
+	}
+
+	if info, err := os.Stat(path.Join(serverDir, "empty")); err != nil || !info.IsDir() {
+		t.Errorf("Empty directory wasn't recreated on the server: %v", err)
+	}
+
+	return clientDir, serverDir
+}
+
+func TestSendDir(t *testing.T) {
+	_, serverDir := dirTest(t, nil)
+	defer os.RemoveAll(path.Dir(serverDir))
+
+	if _, err := os.Lstat(path.Join(serverDir, "link")); !os.IsNotExist(err) {
+		t.Errorf("Symlink should have been skipped, got %v", err)
+	}
+}
+
+func TestSendDirFollowSymlinks(t *testing.T) {
+	clientDir, serverDir := dirTest(t, &SendOptions{FollowSymlinks: true})
+	defer os.RemoveAll(path.Dir(serverDir))
+
+	srcHash, err := testutil.HashFile(path.Join(clientDir, "top"))
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"top\"")
+	}
+
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "link"))
+	if err != nil {
+		t.Fatalf("Followed symlink wasn't sent: %v", err)
+	}
+
+	if srcHash != dstHash {
+		t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+	}
+}
+
+func TestSendDirPreserveSymlinks(t *testing.T) {
+	_, serverDir := dirTest(t, &SendOptions{PreserveSymlinks: true})
+	defer os.RemoveAll(path.Dir(serverDir))
+
+	for name, want := range map[string]string{"link": "top", "a/b/up": "../../top"} {
+		target, err := os.Readlink(path.Join(serverDir, name))
+		if err != nil {
+			t.Errorf("Symlink %s wasn't recreated as a link: %v", name, err)
+			continue
+		}
+		if target != want {
+			t.Errorf("Symlink %s points to %s, want %s", name, target, want)
+		}
+	}
+}
+
+func TestRejectEscapingSymlink(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	sendLink := func(name, target string) error {
+		conn, err := dialer.Dial()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return sendEntry(conn, GobCodec, startMessage{Capabilities: capSymlink, Name: name, LinkTarget: target})
+	}
+
+	// "a/up" is allowed, but puts anything under it a level higher than
+	// its name says.
+	if err := sendLink("a/up", ".."); err != nil {
+		t.Fatalf("Sending a link inside the archive failed: %v", err)
+	}
+	for name, target := range map[string]string{
+		"abs":       "/etc/passwd",
+		"parent":    "../outside",
+		"a/deep":    "../../outside",
+		"late":      "a/up/..",
+		"a/up/trap": "../outside",
+	} {
+		if err := sendLink(name, target); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Linking %s to %s returned %v, want %v", name, target, err, ErrInvalidName)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package rtransfer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// FailureKind says what went wrong with an attempt at a send, so that a
+// server that isn't running can be told from one that drops connections
+// partway through.
+type FailureKind int
+
+const (
+	FailureNone = FailureKind(iota)
+
+	// FailureRefused is a connection the server's host turned away,
+	// usually because nothing is listening yet.
+	FailureRefused
+
+	// FailureReset is a connection that broke off, as it does when the
+	// server crashes mid-transfer.
+	FailureReset
+
+	// FailureClosed is a connection the server hung up on in the middle
+	// of a message.
+	FailureClosed
+
+	// FailureTimeout is a connection that went quiet for too long.
+	FailureTimeout
+
+	// FailureUnreachable is a server whose name doesn't resolve or whose
+	// host can't be reached.
+	FailureUnreachable
+
+	// FailureProtocol is a server that broke the protocol or speaks
+	// another version of it.
+	FailureProtocol
+
+	// FailureOther is an error that fits none of the kinds above, such as
+	// a file that can't be read or that the server turned away.
+	FailureOther
+)
+
+var failureKindMessages = []string{
+	FailureNone:        "no failure",
+	FailureRefused:     "connection refused, the server may not be running",
+	FailureReset:       "connection reset, the server may have crashed",
+	FailureClosed:      "connection closed by the server",
+	FailureTimeout:     "connection timed out",
+	FailureUnreachable: "server unreachable",
+	FailureProtocol:    "protocol error",
+	FailureOther:       "other error",
+}
+
+func (k FailureKind) String() string {
+	if k < 0 || int(k) >= len(failureKindMessages) {
+		return "unknown failure"
+	}
+	return failureKindMessages[k]
+}
+
+// classify returns the kind of failure err is, or FailureNone for nil.
+func classify(err error) FailureKind {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return FailureNone
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FailureRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE):
+		return FailureReset
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH):
+		return FailureUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return FailureTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return FailureClosed
+	case errors.Is(err, ErrProtocol), errors.Is(err, ErrUnsupportedVersion):
+		return FailureProtocol
+	default:
+		return FailureOther
+	}
+}
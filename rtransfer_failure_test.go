@@ -0,0 +1,69 @@
+package rtransfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestClassifyRefused(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 1024); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	opts := &SendOptions{
+		Retry: RetryPolicy{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			MaxAttempts:    2,
+		},
+	}
+	stats, err := SendContext(context.Background(), netDialer{"tcp", unusedHostport(t)}, fpath, nil, opts)
+	if err == nil {
+		t.Fatalf("Send to a dead port succeeded")
+	}
+	if stats.LastFailure != FailureRefused {
+		t.Errorf("Send to a dead port failed with %v, want %v", stats.LastFailure, FailureRefused)
+	}
+	if !strings.Contains(err.Error(), FailureRefused.String()) {
+		t.Errorf("Send to a dead port returned %q, which doesn't say the connection was refused", err)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want FailureKind
+	}{
+		{nil, FailureNone},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, FailureReset},
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, FailureReset},
+		{fmt.Errorf("reading the ack: %w", io.ErrUnexpectedEOF), FailureClosed},
+		{io.EOF, FailureClosed},
+		{os.ErrDeadlineExceeded, FailureTimeout},
+		{&net.DNSError{Err: "no such host", Name: "nowhere.invalid"}, FailureUnreachable},
+		{fmt.Errorf("%w: bad ack", ErrProtocol), FailureProtocol},
+		{errors.New("something else"), FailureOther},
+	} {
+		if got := classify(tc.err); got != tc.want {
+			t.Errorf("classify(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package rtransfer
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// HashAlgo names the digest the server takes of a file it has stored, for
+// SendWithResult.
+type HashAlgo string
+
+const (
+	HashSHA256 = HashAlgo("sha256")
+	HashSHA1   = HashAlgo("sha1")
+
+	// HashMD5 is the digest S3 and similar stores give as the ETag of an
+	// object uploaded in one part.
+	HashMD5 = HashAlgo("md5")
+
+	// HashNone takes no digest, which spares the server reading the file
+	// back.
+	HashNone = HashAlgo("none")
+)
+
+// newHash returns a hash taking the digest a names, or nil for HashNone. The
+// empty HashAlgo means HashSHA256.
+func (a HashAlgo) newHash() (hash.Hash, error) {
+	switch a {
+	case "", HashSHA256:
+		return sha256.New(), nil
+	case HashSHA1:
+		return sha1.New(), nil
+	case HashMD5:
+		return md5.New(), nil
+	case HashNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unknown hash algorithm %q", string(a))
+	}
+}
+
+// fileHash returns the SHA-256 of the file, reading it the first time a
+// server asks for it.
+func (src *fileSource) fileHash() ([]byte, error) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.hash != nil {
+		return src.hash, nil
+	}
+
+	f, err := os.Open(src.fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if src.hash, err = hashReader(f); err != nil {
+		return nil, err
+	}
+	return src.hash, nil
+}
+
+// finishDigest sets src.digest to the digest src.running took as the file
+// was sent, reading the blocks it missed from the file.
+func (src *fileSource) finishDigest() error {
+	f, err := os.Open(src.fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size := src.info.Size()
+	if err := src.running.catchUp(f, size); err != nil {
+		return err
+	}
+	src.digest = src.running.sum(src.hashAlgo, size)
+	return nil
+}
+
+// digest returns the digest a names of what r reads, or nil for HashNone.
+func (a HashAlgo) digest(r io.Reader) ([]byte, error) {
+	h, err := a.newHash()
+	if err != nil || h == nil {
+		return nil, err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// runningHash takes digests of a file as its bytes go past in order, so that
+// they needn't be read again for it. The bytes it misses, because they came
+// out of order or before it started, are read back from the file when it
+// catches up. pos is how many bytes of the file it has taken. A nil
+// runningHash takes nothing.
+type runningHash struct {
+	mu     sync.Mutex
+	algos  []HashAlgo
+	hashes []hash.Hash
+	w      io.Writer
+	pos    int64
+}
+
+// newRunningHash returns a runningHash taking the digests algos name. It
+// skips HashNone and those it already takes.
+func newRunningHash(algos ...HashAlgo) (*runningHash, error) {
+	h := &runningHash{}
+	for _, algo := range algos {
+		if algo == "" {
+			algo = HashSHA256
+		}
+		if algo == HashNone || h.index(algo) >= 0 {
+			continue
+		}
+		hh, err := algo.newHash()
+		if err != nil {
+			return nil, err
+		}
+		h.algos = append(h.algos, algo)
+		h.hashes = append(h.hashes, hh)
+	}
+	h.reset()
+	return h, nil
+}
+
+func (h *runningHash) index(algo HashAlgo) int {
+	for i, a := range h.algos {
+		if a == algo {
+			return i
+		}
+	}
+	return -1
+}
+
+// take makes h take the digest algo names too, if it doesn't already, and
+// then starts the digests over.
+func (h *runningHash) take(algo HashAlgo) error {
+	if h == nil {
+		return nil
+	}
+	if algo == "" {
+		algo = HashSHA256
+	}
+	h.mu.Lock()
+	if algo == HashNone || h.index(algo) >= 0 {
+		h.mu.Unlock()
+		return nil
+	}
+	hh, err := algo.newHash()
+	if err != nil {
+		h.mu.Unlock()
+		return err
+	}
+	h.algos = append(h.algos, algo)
+	h.hashes = append(h.hashes, hh)
+	h.mu.Unlock()
+	h.reset()
+	return nil
+}
+
+// reset starts the digests over, for when bytes they have taken change.
+func (h *runningHash) reset() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writers := make([]io.Writer, len(h.hashes))
+	for i, hh := range h.hashes {
+		hh.Reset()
+		writers[i] = hh
+	}
+	h.w = io.MultiWriter(writers...)
+	h.pos = 0
+}
+
+// add takes data, found at pos in the file, if it is next.
+func (h *runningHash) add(pos int64, data []byte) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if pos == h.pos {
+		h.w.Write(data)
+		h.pos += int64(len(data))
+	}
+}
+
+// catchUp reads what it hasn't taken of the first end bytes of the file from
+// r.
+func (h *runningHash) catchUp(r io.ReaderAt, end int64) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if end <= h.pos {
+		return nil
+	}
+	n, err := io.Copy(h.w, io.NewSectionReader(r, h.pos, end-h.pos))
+	h.pos += n
+	return err
+}
+
+// sum returns the digest algo names of a file of size bytes, or nil if it
+// doesn't take that digest or hasn't taken exactly size bytes.
+func (h *runningHash) sum(algo HashAlgo, size int64) []byte {
+	if h == nil {
+		return nil
+	}
+	if algo == "" {
+		algo = HashSHA256
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := h.index(algo)
+	if i < 0 || h.pos != size {
+		return nil
+	}
+	return h.hashes[i].Sum(nil)
+}
+
+// hashingReader passes what is read from the ReadSeeker, which starts base
+// bytes into the file, to h.
+type hashingReader struct {
+	io.ReadSeeker
+	h    *runningHash
+	base int64
+	pos  int64
+}
+
+func newHashingReader(r io.ReadSeeker, h *runningHash, base int64) (*hashingReader, error) {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return &hashingReader{r, h, base, pos}, nil
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.h.add(r.base+r.pos, p[:n])
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *hashingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+// needsHash reports whether the server needs the SHA-256 of the file
+// startMsg describes, which its client didn't give, to decide what to do
+// with it: because it would replace a file only if their contents differ,
+// could store it as a copy of a file it has (ServerOptions.Dedup), or
+// checks the file before storing it (ServerOptions.QuarantineDir).
+func (srv *server) needsHash(startMsg startMessage, root string) bool {
+	if srv.store != nil || !validSize(startMsg.Size) || startMsg.AppendFrom != 0 {
+		return false
+	}
+	whole := startMsg.RangeEnd == 0 && startMsg.Size > 0
+	checked := srv.quarantine != "" && whole
+
+	srv.mu.Lock()
+	known := len(srv.contents) > 0
+	_, pending := srv.transfers[startMsg.Name]
+	srv.mu.Unlock()
+	if pending {
+		return checked
+	}
+
+	fpath, err := srv.destPath(root, startMsg.Name, time.Now())
+	if err != nil {
+		return false
+	}
+	if srv.exists(fpath) {
+		forced := startMsg.Force && srv.allowForce
+		replaceable := srv.overwrite != OverwriteReject || forced
+		return checked && replaceable || srv.overwrite == OverwriteIfDifferent && !forced
+	}
+	return checked || srv.dedup && known && startMsg.Capabilities&capDedup != 0 && whole
+}
+
+// askHash asks the client for the SHA-256 of the file startMsg describes,
+// and returns startMsg with it.
+func askHash(enc Encoder, dec Decoder, startMsg startMessage) (startMessage, error) {
+	if err := enc.Encode(ackMessage{Version: protocolVersion, NeedHash: true}); err != nil {
+		return startMsg, err
+	}
+	var hashed startMessage
+	if err := dec.Decode(&hashed); err != nil {
+		return startMsg, err
+	}
+	if hashed.Name != startMsg.Name || len(hashed.Hash) != sha256.Size {
+		return startMsg, fmt.Errorf("Client answered the request for the hash of %s with %d bytes for %s",
+			startMsg.Name, len(hashed.Hash), hashed.Name)
+	}
+	startMsg.Hash = hashed.Hash
+	return startMsg, nil
+}
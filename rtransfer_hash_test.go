@@ -0,0 +1,424 @@
+package rtransfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestHashAlgo(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+	dialer := netDialer{"tcp", testSrvHostport}
+
+	sum := func(algo HashAlgo, data []byte) []byte {
+		switch algo {
+		case HashSHA1:
+			hash := sha1.Sum(data)
+			return hash[:]
+		case HashMD5:
+			hash := md5.Sum(data)
+			return hash[:]
+		case HashNone:
+			return nil
+		default:
+			hash := sha256.Sum256(data)
+			return hash[:]
+		}
+	}
+
+	for _, tc := range []struct {
+		algo        HashAlgo
+		parallelism int
+	}{
+		{"", 0},
+		{HashSHA256, 0},
+		{HashSHA1, 0},
+		{HashMD5, 0},
+		{HashMD5, 4},
+		{HashNone, 0},
+	} {
+		fpath := path.Join(clientDir, "file-"+string(tc.algo))
+		if tc.parallelism > 0 {
+			fpath += "-parallel"
+		}
+		if err := testutil.GenRandFile(fpath, 20*payloadSize+7); err != nil {
+			t.Fatalf("Couldn't create random file: %v", err)
+		}
+
+		opts := &SendOptions{HashAlgo: tc.algo, Parallelism: tc.parallelism}
+		result, err := SendWithResult(context.Background(), dialer, fpath, nil, opts)
+		if err != nil {
+			t.Fatalf("Error while sending %s: %v", fpath, err)
+		}
+
+		want := tc.algo
+		if want == "" {
+			want = HashSHA256
+		}
+		if result.HashAlgo != want {
+			t.Errorf("Sending %s returned HashAlgo %q, want %q", fpath, result.HashAlgo, want)
+		}
+		data, err := os.ReadFile(path.Join(serverDir, result.StoredPath))
+		if err != nil {
+			t.Fatalf("Couldn't read the file at StoredPath: %v", err)
+		}
+		if hash := sum(tc.algo, data); !bytes.Equal(result.Hash, hash) {
+			t.Errorf("Sending %s with %q returned Hash %x, want %x", fpath, tc.algo, result.Hash, hash)
+		}
+	}
+
+	// An algorithm nobody knows is refused by the client before it sends
+	// anything, and by the server if the client sends it anyway.
+	fpath := path.Join(clientDir, "unknown")
+	if err := testutil.GenRandFile(fpath, payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	if _, err := SendWithResult(context.Background(), dialer, fpath, nil, &SendOptions{HashAlgo: "crc"}); err == nil {
+		t.Errorf("Sending with an unknown HashAlgo succeeded")
+	}
+
+	conn, err := net.Dial("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("Couldn't connect to the server: %v", err)
+	}
+	defer conn.Close()
+	startMsg := startMessage{
+		Version:      protocolVersion,
+		Capabilities: capResult | capHashAlgo,
+		Name:         "unknown",
+		Size:         payloadSize,
+		HashAlgo:     "crc",
+	}
+	if err := gob.NewEncoder(conn).Encode(startMsg); err != nil {
+		t.Fatalf("Couldn't send the start message: %v", err)
+	}
+	var ack ackMessage
+	if err := gob.NewDecoder(conn).Decode(&ack); err != nil {
+		t.Fatalf("Couldn't read the ack: %v", err)
+	}
+	if !errors.Is(ack.err(), ErrUnsupportedFeature) {
+		t.Errorf("Server acked an unknown HashAlgo with %v, want %v", ack.err(), ErrUnsupportedFeature)
+	}
+	if fileExists(path.Join(serverDir, "unknown")) {
+		t.Errorf("A file sent with an unknown HashAlgo was stored")
+	}
+}
+
+func TestHashWhileSending(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{ReceivedIndex: path.Join(dpath, "received")})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// The client and server take their digests as the blocks go past, and
+	// read back only what they missed: the blocks acked before a
+	// reconnect, and those of the other ranges of a parallel send.
+	for i, tc := range []struct {
+		algo        HashAlgo
+		parallelism int
+		lossy       bool
+	}{
+		{HashSHA256, 0, false},
+		{HashMD5, 0, false},
+		{HashSHA256, 0, true},
+		{HashSHA1, 4, false},
+	} {
+		fpath := path.Join(clientDir, fmt.Sprintf("file%d", i))
+		if err := testutil.GenRandFile(fpath, 20*payloadSize+7); err != nil {
+			t.Fatalf("Couldn't create random file: %v", err)
+		}
+		var dialer Dialer = netDialer{"tcp", testSrvHostport}
+		if tc.lossy {
+			dialer = &lossyDialer{hostport: testSrvHostport, limit: 4 * payloadSize}
+		}
+
+		opts := &SendOptions{HashAlgo: tc.algo, Parallelism: tc.parallelism, HashWhileSending: true}
+		result, err := SendWithResult(context.Background(), dialer, fpath, nil, opts)
+		if err != nil {
+			t.Fatalf("Error while sending %s: %v", fpath, err)
+		}
+		if !result.Verified {
+			t.Errorf("Sending %s with %q wasn't verified", fpath, tc.algo)
+		}
+
+		// The server records the SHA-256 it took, since the client sent
+		// none.
+		data, err := os.ReadFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't read %s: %v", fpath, err)
+		}
+		record, err := LastReceived(path.Base(fpath), testSrvHostport)
+		if err != nil || record == nil {
+			t.Fatalf("Couldn't get the record of %s: %v", fpath, err)
+		}
+		if hash := sha256.Sum256(data); !bytes.Equal(record.Hash, hash[:]) {
+			t.Errorf("Server recorded %s with hash %x, want %x", fpath, record.Hash, hash)
+		}
+	}
+}
+
+func TestHashRequest(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, dpath, &ServerOptions{Overwrite: OverwriteIfDifferent})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	data := []byte("contents")
+	if err := os.WriteFile(path.Join(dpath, "existing"), data, 0644); err != nil {
+		t.Fatalf("Couldn't write the server's file: %v", err)
+	}
+	hash := sha256.Sum256(data)
+
+	// The server asks for the hash of a file only when it would replace one,
+	// and then takes the start message sent again with it.
+	for _, tc := range []struct {
+		name     string
+		needHash bool
+	}{
+		{"new", false},
+		{"existing", true},
+	} {
+		conn, err := net.Dial("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("Couldn't connect to the server: %v", err)
+		}
+		enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+		startMsg := startMessage{
+			Version:      protocolVersion,
+			Capabilities: capHashRequest,
+			Name:         tc.name,
+			Size:         int64(len(data)),
+		}
+		if err := enc.Encode(startMsg); err != nil {
+			t.Fatalf("Couldn't send the start message: %v", err)
+		}
+		var ack ackMessage
+		if err := dec.Decode(&ack); err != nil {
+			t.Fatalf("Couldn't read the ack: %v", err)
+		}
+		if ack.NeedHash != tc.needHash {
+			t.Errorf("Server asked for the hash of %s: %v, want %v", tc.name, ack.NeedHash, tc.needHash)
+		}
+
+		if ack.NeedHash {
+			startMsg.Hash = hash[:]
+			if err := enc.Encode(startMsg); err != nil {
+				t.Fatalf("Couldn't send the start message again: %v", err)
+			}
+			ack = ackMessage{}
+			// The file is the same, so the server turns it away.
+			if err := dec.Decode(&ack); err != nil || ack.ErrType != ErrAlreadyExists {
+				t.Errorf("Server answered the hash with %+v (%v), want %v", ack, err, ErrAlreadyExists)
+			}
+		}
+		conn.Close()
+	}
+}
+
+// BenchmarkHashPasses compares sending a file to a server that asks for its
+// hash, which reads it twice, with sending it to one that doesn't.
+func BenchmarkHashPasses(b *testing.B) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		b.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	const size = 64 << 20
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		b.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("couldn't listen: %s", err)
+	}
+	serverDir := path.Join(dpath, "server")
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{Overwrite: OverwriteIfDifferent})
+	go srv.Serve(nil)
+	defer srv.Stop()
+	dialer := newTestDialer(listener.Addr().String())
+
+	// The server asks for the hash of a file that would replace another.
+	stored := path.Join(serverDir, "file")
+	for _, c := range []struct {
+		name  string
+		asked bool
+	}{
+		{"double", true},
+		{"single", false},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				os.Remove(stored)
+				if c.asked {
+					if err := os.WriteFile(stored, []byte("old"), 0644); err != nil {
+						b.Fatalf("Couldn't write %s: %v", stored, err)
+					}
+				}
+				b.StartTimer()
+				if _, err := SendWithResult(context.Background(), dialer, fpath, nil, nil); err != nil {
+					b.Fatalf("Error while sending: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHashRanges(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	data := make([]byte, 4*payloadSize)
+	for i := range data {
+		data[i] = byte(i / payloadSize)
+	}
+
+	// The server stops once it has acked the last block, until the test
+	// has looked at its digests.
+	release := make(chan bool)
+	createNotifier := newLogRecvNotifierFactory(t)
+	srv := NewServer(listener, dpath)
+	go srv.Serve(func(name string) RecvNotifier {
+		return &heldRecvNotifier{createNotifier(name), int64(len(data)), release}
+	})
+	defer srv.Stop()
+	defer close(release)
+
+	// The second half of the file arrives first, over its own connection.
+	// The server has taken the digests of the whole file by the time it
+	// acks the last block, so the result needn't read it back.
+	var tr *transfer
+	for _, first := range []int64{2, 0} {
+		conn, err := net.Dial("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("Couldn't connect to the server: %v", err)
+		}
+		defer conn.Close()
+		enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+		startMsg := startMessage{
+			Version:      protocolVersion,
+			Capabilities: capRanges | capResult,
+			Name:         "halves",
+			Size:         int64(len(data)),
+			RangeStart:   first,
+			RangeEnd:     first + 2,
+			HashAlgo:     HashMD5,
+		}
+		if err := enc.Encode(startMsg); err != nil {
+			t.Fatalf("Couldn't send the start message: %v", err)
+		}
+		var ack ackMessage
+		if err := dec.Decode(&ack); err != nil || ack.ErrType != ErrSuccess {
+			t.Fatalf("Server didn't take blocks [%d, %d): %v, %v", first, first+2, err, ack.ErrType)
+		}
+		if tr == nil {
+			s := srv.(*server)
+			s.mu.Lock()
+			tr = s.transfers["halves"]
+			s.mu.Unlock()
+		}
+
+		for seqNum := first; seqNum < first+2; seqNum++ {
+			block := data[getFilePos(seqNum) : getFilePos(seqNum)+payloadSize]
+			if err := enc.Encode(dataMessage{SeqNum: seqNum, Data: block}); err != nil {
+				t.Fatalf("Couldn't send block %d: %v", seqNum, err)
+			}
+			var dataAck dataAckMessage
+			if err := dec.Decode(&dataAck); err != nil || dataAck.SeqNum != seqNum {
+				t.Fatalf("Server acked block %d as %d: %v", seqNum, dataAck.SeqNum, err)
+			}
+		}
+		if first == 0 {
+			sum := md5.Sum(data)
+			if got := tr.hash.sum(HashMD5, int64(len(data))); !bytes.Equal(got, sum[:]) {
+				t.Errorf("Server acked the last block with an MD5 of %x, want %x", got, sum)
+			}
+		}
+
+		if first == 2 {
+			var result resultMessage
+			if err := dec.Decode(&result); err != nil {
+				t.Fatalf("Couldn't read the result of blocks [%d, %d): %v", first, first+2, err)
+			}
+		}
+	}
+}
+
+// heldRecvNotifier holds up the server once it has received size bytes of
+// a file, until release is closed.
+type heldRecvNotifier struct {
+	RecvNotifier
+	size    int64
+	release chan bool
+}
+
+func (n *heldRecvNotifier) UpdateProgress(numBytes, totBytes int64) {
+	n.RecvNotifier.UpdateProgress(numBytes, totBytes)
+	if numBytes == n.size {
+		<-n.release
+	}
+}
@@ -0,0 +1,63 @@
+package rtransfer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// healthHandler answers readiness probes for a server. See
+// ServerOptions.HealthAddr.
+type healthHandler struct {
+	srv *server
+}
+
+func (h healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.srv.ready(); err != nil {
+		http.Error(w, "NotReady: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// ready returns nil if the server is taking connections and can write to its
+// archive directory and TempDir, and otherwise why not.
+func (srv *server) ready() error {
+	srv.mu.Lock()
+	shutdown := srv.shutdown
+	srv.mu.Unlock()
+	if shutdown {
+		return fmt.Errorf("The server is shutting down")
+	}
+
+	if srv.store != nil {
+		return nil
+	}
+	f, err := os.CreateTemp(srv.archiveDir, ".rthealth")
+	if err != nil {
+		return fmt.Errorf("Can't write to the archive directory: %v", err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil || srv.tempDir == "" {
+		return err
+	}
+
+	if f, err = os.CreateTemp(srv.tempDir, ".rthealth"); err != nil {
+		return fmt.Errorf("Can't write to the temporary directory: %v", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// serveHealth starts answering readiness probes on addr, and returns a
+// function that stops it.
+func (srv *server) serveHealth(addr string) (stop func(), err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	hs := &http.Server{Handler: healthHandler{srv}}
+	go hs.Serve(listener)
+	return func() { hs.Close() }, nil
+}
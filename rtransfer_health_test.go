@@ -0,0 +1,71 @@
+package rtransfer
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestHealth(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+	archiveDir := path.Join(dpath, "archive")
+
+	const healthAddr = "localhost:9002"
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, archiveDir, &ServerOptions{HealthAddr: healthAddr})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	probe := func() (int, string) {
+		resp, err := http.Get("http://" + healthAddr + "/healthz")
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	var status int
+	var body string
+	if !waitFor(5*time.Second, func() bool {
+		status, body = probe()
+		return status == http.StatusOK
+	}) {
+		t.Fatalf("Probe of a working server got %d %q, want %d", status, body, http.StatusOK)
+	}
+
+	// Without its archive directory the server can't store anything.
+	if err := os.Remove(archiveDir); err != nil {
+		t.Fatalf("Couldn't remove the archive directory: %v", err)
+	}
+	if status, body = probe(); status != http.StatusServiceUnavailable || !strings.HasPrefix(body, "NotReady") {
+		t.Errorf("Probe with no archive directory got %d %q, want %d NotReady", status, body, http.StatusServiceUnavailable)
+	}
+
+	if err := os.Mkdir(archiveDir, 0555); err != nil {
+		t.Fatalf("Couldn't recreate the archive directory: %v", err)
+	}
+	defer os.Chmod(archiveDir, 0777)
+	if f, err := os.CreateTemp(archiveDir, ""); err == nil {
+		f.Close()
+		t.Skip("A read-only directory is still writable for this user")
+	}
+	if status, body = probe(); status != http.StatusServiceUnavailable || !strings.HasPrefix(body, "NotReady") {
+		t.Errorf("Probe with a read-only archive directory got %d %q, want %d NotReady", status, body, http.StatusServiceUnavailable)
+	}
+}
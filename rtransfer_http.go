@@ -0,0 +1,222 @@
+package rtransfer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// httpFilesPrefix is the path under which the HTTP gateway takes uploads.
+const httpFilesPrefix = "/files/"
+
+// NewHTTPHandler returns a handler that stores files uploaded to it under
+// archiveDir, for clients that can't speak the native protocol. See
+// NewHTTPHandlerWithOptions.
+func NewHTTPHandler(archiveDir string) http.Handler {
+	return NewHTTPHandlerWithOptions(archiveDir, nil)
+}
+
+// NewHTTPHandlerWithOptions is like NewHTTPHandler, but applies the
+// overwrite policy, size limit and logger in opts as a server would.
+//
+// A file is uploaded with PUT /files/{name}. The request must give the size
+// in Content-Length, and may give the SHA-256 of the contents in hex in
+// X-Content-SHA256, in which case a file that doesn't match is discarded.
+// Like a transfer, an upload only appears under its name once it is
+// complete. An interrupted upload starts over.
+//
+// With opts.Secret, a request must carry the secret in hex as a bearer
+// token, "Authorization: Bearer <secret>", or is refused with 401. The
+// secret then crosses the wire as it is, so serve the handler over TLS. An
+// opts.Identity can't be proven over HTTP, so a handler given one refuses
+// every request; TLS is the way to prove the gateway's identity.
+func NewHTTPHandlerWithOptions(archiveDir string, opts *ServerOptions) http.Handler {
+	srv := newServer(nil, archiveDir, opts)
+	if srv.identity != nil && srv.err == nil {
+		srv.err = errors.New("The HTTP gateway can't prove an Identity")
+		srv.logger.Logf("%v", srv.err)
+	}
+	return &httpHandler{srv}
+}
+
+type httpHandler struct {
+	srv *server
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv := h.srv
+
+	if srv.err != nil {
+		http.Error(w, srv.err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if srv.secret != nil && !authorized(r, srv.secret) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "The secret is missing or wrong", http.StatusUnauthorized)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, httpFilesPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", http.MethodPut)
+		http.Error(w, "Only PUT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, httpFilesPrefix)
+	if !isLocalName(name) || (srv.flat && isSubpath(name)) {
+		http.Error(w, fmt.Sprintf("Invalid name %q", name), http.StatusBadRequest)
+		return
+	}
+
+	size := r.ContentLength
+	if size < 0 {
+		http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+		return
+	}
+	if srv.maxSize > 0 && size > srv.maxSize {
+		http.Error(w, fmt.Sprintf("The limit is %d bytes", srv.maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if srv.accept != nil {
+		if reason := srv.accept(name, size); reason != nil {
+			http.Error(w, reason.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	root, reason := srv.root(name, size)
+	if reason != nil {
+		http.Error(w, reason.Error(), http.StatusForbidden)
+		return
+	}
+
+	var want []byte
+	if hexHash := r.Header.Get("X-Content-SHA256"); hexHash != "" {
+		var err error
+		if want, err = hex.DecodeString(hexHash); err != nil || len(want) != sha256.Size {
+			http.Error(w, "X-Content-SHA256 is not a hex SHA-256", http.StatusBadRequest)
+			return
+		}
+	}
+
+	fpath, err := srv.destPath(root, name, time.Now())
+	if err != nil {
+		srv.logger.Logf("HTTP upload of %s failed: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status, err := srv.storeUpload(r.Body, name, fpath, size, want, r.RemoteAddr)
+	if err != nil {
+		srv.logger.Logf("HTTP upload of %s failed: %v", name, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	srv.remember(srv.recordOf(startMessage{Name: name, Hash: want}, root, fpath, size, nil))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// authorized reports whether r carries secret as its bearer token.
+func authorized(r *http.Request, secret []byte) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(auth, "Bearer "))
+	return err == nil && hmac.Equal(got, secret)
+}
+
+// storeUpload writes the size bytes of body, from the client at client, to
+// fpath, checking them against want if it is set. On failure it returns the
+// status to answer with.
+func (srv *server) storeUpload(body io.Reader, name, fpath string, size int64, want []byte, client string) (int, error) {
+	srv.openMu.Lock()
+	if srv.exists(fpath) {
+		replace := srv.store != nil && srv.overwrite != OverwriteReject
+		if srv.store == nil {
+			var err error
+			if replace, err = srv.overwrite.allows(fpath, startMessage{Name: name, Size: size, Hash: want}); err != nil {
+				srv.openMu.Unlock()
+				return http.StatusInternalServerError, err
+			}
+		}
+		if !replace {
+			srv.openMu.Unlock()
+			return http.StatusConflict, fmt.Errorf("%s already exists", name)
+		}
+		srv.logger.Logf("Replacing existing file %s", name)
+	}
+	srv.openMu.Unlock()
+
+	if srv.store != nil {
+		return srv.storeUploadIn(body, name, fpath, size, want)
+	}
+
+	if err := os.MkdirAll(path.Dir(fpath), srv.dirMode); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := srv.checkSpace(fpath, size); err != nil {
+		return http.StatusInsufficientStorage, err
+	}
+
+	// A native transfer of the same name may be using fpath+partSuffix, so
+	// the upload gets a partial file of its own.
+	var unique [8]byte
+	if _, err := rand.Read(unique[:]); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	partPath := fmt.Sprintf("%s.%x%s", fpath, unique, partSuffix)
+	f, err := os.OpenFile(partPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, srv.fileMode)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer os.Remove(partPath)
+
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	var sink *blockSink
+	if srv.sink != nil {
+		sw, err := srv.sink(name, size)
+		if err != nil {
+			f.Close()
+			return http.StatusInternalServerError, err
+		}
+		sink = newBlockSink(sw, 0)
+		w = io.MultiWriter(f, h, sink)
+	}
+	_, err = io.CopyN(w, body, size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		sink.abort(err)
+		return http.StatusBadRequest, err
+	}
+
+	if got := h.Sum(nil); want != nil && !bytes.Equal(got, want) {
+		err := fmt.Errorf("The contents of %s don't match X-Content-SHA256", name)
+		sink.abort(err)
+		srv.discard(partPath, newQuarantineRecord(name, size, client, want, got, err))
+		return http.StatusBadRequest, err
+	}
+	if err := sink.close(size); err != nil {
+		srv.logger.Logf("Couldn't pass %s on to the sink: %v", name, err)
+	}
+
+	if err := srv.storeFile(partPath, fpath, name, size); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusCreated, nil
+}
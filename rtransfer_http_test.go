@@ -0,0 +1,167 @@
+package rtransfer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestHTTPUpload(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	ts := httptest.NewServer(NewHTTPHandler(dpath))
+	defer ts.Close()
+
+	data := make([]byte, 3*payloadSize+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Couldn't generate data: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	goodHash := hex.EncodeToString(sum[:])
+	badHash := hex.EncodeToString(make([]byte, sha256.Size))
+
+	put := func(name, hash string) int {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/files/"+name, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Couldn't make request: %v", err)
+		}
+		if hash != "" {
+			req.Header.Set("X-Content-SHA256", hash)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT %s failed: %v", name, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		desc   string
+		name   string
+		hash   string
+		status int
+		stored bool
+	}{
+		{"new file", "upload", "", http.StatusCreated, true},
+		{"existing file", "upload", "", http.StatusConflict, true},
+		{"verified file", "sub/verified", goodHash, http.StatusCreated, true},
+		{"hash mismatch", "mismatch", badHash, http.StatusBadRequest, false},
+		{"escaping name", "..%2Fescape", "", http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		if got := put(test.name, test.hash); got != test.status {
+			t.Errorf("%s: PUT returned %d, want %d", test.desc, got, test.status)
+		}
+		if !test.stored {
+			if fileExists(path.Join(dpath, test.name)) {
+				t.Errorf("%s: the file was stored", test.desc)
+			}
+			continue
+		}
+
+		stored, err := os.ReadFile(path.Join(dpath, test.name))
+		if err != nil {
+			t.Errorf("%s: couldn't read the stored file: %v", test.desc, err)
+		} else if !bytes.Equal(stored, data) {
+			t.Errorf("%s: the stored file doesn't match what was uploaded", test.desc)
+		}
+	}
+
+	entries, err := os.ReadDir(dpath)
+	if err != nil {
+		t.Fatalf("Couldn't list %s: %v", dpath, err)
+	}
+	for _, entry := range entries {
+		if path.Ext(entry.Name()) == partSuffix {
+			t.Errorf("Partial file %s was left behind", entry.Name())
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/files/upload")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET returned %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	secret := []byte("shared secret")
+	ts := httptest.NewServer(NewHTTPHandlerWithOptions(dpath, &ServerOptions{Secret: secret}))
+	defer ts.Close()
+
+	tests := []struct {
+		desc   string
+		auth   string
+		status int
+	}{
+		{"no secret", "", http.StatusUnauthorized},
+		{"wrong secret", "Bearer " + hex.EncodeToString([]byte("guess")), http.StatusUnauthorized},
+		{"unencoded secret", "Bearer " + string(secret), http.StatusUnauthorized},
+		{"secret", "Bearer " + hex.EncodeToString(secret), http.StatusCreated},
+	}
+	for i, test := range tests {
+		name := fmt.Sprintf("file%d", i)
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/files/"+name, bytes.NewReader([]byte("contents")))
+		if err != nil {
+			t.Fatalf("Couldn't make request: %v", err)
+		}
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT %s failed: %v", name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: PUT returned %d, want %d", test.desc, resp.StatusCode, test.status)
+		}
+		if stored := fileExists(path.Join(dpath, name)); stored != (test.status == http.StatusCreated) {
+			t.Errorf("%s: stored the file: %v", test.desc, stored)
+		}
+	}
+
+	// The gateway can't prove an identity, so it takes nothing.
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Couldn't generate a key: %v", err)
+	}
+	ts2 := httptest.NewServer(NewHTTPHandlerWithOptions(dpath, &ServerOptions{Identity: key}))
+	defer ts2.Close()
+	req, err := http.NewRequest(http.MethodPut, ts2.URL+"/files/identity", bytes.NewReader([]byte("contents")))
+	if err != nil {
+		t.Fatalf("Couldn't make request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || fileExists(path.Join(dpath, "identity")) {
+		t.Errorf("A gateway with an identity answered %d", resp.StatusCode)
+	}
+}
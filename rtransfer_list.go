@@ -0,0 +1,130 @@
+package rtransfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileInfo describes a file in a server's archive directory.
+type FileInfo struct {
+	// Name is the file's slash-separated path relative to the archive
+	// directory.
+	Name string
+
+	// Size is the number of bytes stored, which for a partial file is how
+	// much of it has arrived.
+	Size int64
+
+	// Partial is set for a file that hasn't arrived in full. Total is the
+	// size it will have, if the server is still receiving it, and zero if
+	// it was left behind by an earlier server.
+	Partial bool
+	Total   int64
+}
+
+// listMessage answers a start message that asks for capList. Its fields
+// line up with ackMessage's, so that a server that doesn't know capList
+// turns the request down with an ack the client can read.
+type listMessage struct {
+	Version int
+	ErrType ErrCode
+	Files   []FileInfo
+}
+
+func (srv *server) ArchiveDir() string {
+	return srv.archiveDir
+}
+
+func (srv *server) ListFiles() ([]FileInfo, error) {
+	if srv.store != nil {
+		return nil, fmt.Errorf("The server keeps its files in a Store, which can't be listed")
+	}
+
+	srv.mu.Lock()
+	totals := make(map[string]int64)
+	for _, tr := range srv.transfers {
+		totals[tr.path] = tr.size
+	}
+	srv.mu.Unlock()
+
+	var files []FileInfo
+	err := filepath.Walk(srv.archiveDir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(fpath, blocksSuffix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(srv.archiveDir, fpath)
+		if err != nil {
+			return err
+		}
+		file := FileInfo{Name: filepath.ToSlash(rel), Size: info.Size()}
+		if strings.HasSuffix(file.Name, partSuffix) {
+			file.Name = strings.TrimSuffix(file.Name, partSuffix)
+			file.Partial = true
+			file.Total = totals[strings.TrimSuffix(fpath, partSuffix)]
+		}
+		files = append(files, file)
+		return nil
+	})
+
+	// The archive directory is made when the first file arrives.
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err == nil && srv.tempDir != "" {
+		return srv.listTemp(files, totals)
+	}
+	return files, err
+}
+
+// sendList answers a request for a listing of the archive.
+func (srv *server) sendList(enc Encoder) error {
+	files, err := srv.ListFiles()
+	if err != nil {
+		return sendClientErr(enc, ErrOpen, err)
+	}
+	return enc.Encode(listMessage{Version: protocolVersion, Files: files})
+}
+
+// ListRemote asks the server at the other end of dialer for the files in its
+// archive directory, using the handshake and codec in opts. It makes a
+// single attempt.
+func ListRemote(dialer Dialer, opts *SendOptions) ([]FileInfo, error) {
+	conn, err := dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	conn = withIdleTimeout(conn, opts.idleTimeout())
+	defer conn.Close()
+
+	if err := handshake(conn, opts); err != nil {
+		return nil, err
+	}
+
+	codec := opts.codec()
+	enc, dec := codec.NewEncoder(conn), codec.NewDecoder(conn)
+	if err := enc.Encode(startMessage{Version: protocolVersion, Capabilities: capList}); err != nil {
+		return nil, err
+	}
+
+	var list listMessage
+	if err := dec.Decode(&list); err != nil {
+		return nil, err
+	}
+	switch list.ErrType {
+	case ErrSuccess:
+	case ErrEmptyFilename:
+		return nil, ErrUnsupportedFeature
+	default:
+		return nil, list.ErrType
+	}
+	if !compatibleVersion(list.Version) {
+		return nil, ErrUnsupportedVersion
+	}
+	return list.Files, nil
+}
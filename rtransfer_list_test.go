@@ -0,0 +1,91 @@
+package rtransfer
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestListFiles(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+	sizes := map[string]int64{"one": 100, "two": 3 * payloadSize, "big": 10 * payloadSize}
+	for name, size := range sizes {
+		if err := testutil.GenRandFile(path.Join(clientDir, name), size); err != nil {
+			t.Fatalf("Couldn't create random file: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	if srv.ArchiveDir() != serverDir {
+		t.Errorf("ArchiveDir returned %s, want %s", srv.ArchiveDir(), serverDir)
+	}
+
+	dialer := newTestDialer(testSrvHostport)
+	for _, name := range []string{"one", "two"} {
+		if err := Send(dialer, path.Join(clientDir, name), nil); err != nil {
+			t.Fatalf("Error while sending %s: %v", name, err)
+		}
+	}
+
+	// Leave "big" partway through while the files are listed.
+	notifier := &stallSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		stallAfter:      4,
+		stalled:         make(chan bool),
+		release:         make(chan bool),
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := SendContext(context.Background(), dialer, path.Join(clientDir, "big"), notifier, nil)
+		done <- err
+	}()
+	<-notifier.stalled
+
+	want := []FileInfo{
+		{Name: "big", Size: 4 * payloadSize, Partial: true, Total: sizes["big"]},
+		{Name: "one", Size: sizes["one"]},
+		{Name: "two", Size: sizes["two"]},
+	}
+	files, err := srv.ListFiles()
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("ListFiles returned %+v, want %+v", files, want)
+	}
+
+	remote, err := ListRemote(dialer, nil)
+	if err != nil {
+		t.Fatalf("ListRemote failed: %v", err)
+	}
+	if !reflect.DeepEqual(remote, want) {
+		t.Errorf("ListRemote returned %+v, want %+v", remote, want)
+	}
+
+	close(notifier.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Error while sending big: %v", err)
+	}
+}
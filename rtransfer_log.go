@@ -6,6 +6,27 @@ import (
 
 var loggingEnabled = false
 
+// Logger receives diagnostic messages from a server, daemon or sender. The
+// default Logger writes to the standard log package when SetLogging has
+// turned logging on.
+type Logger interface {
+	Logf(format string, params ...interface{})
+}
+
+type globalLogger struct{}
+
+func (globalLogger) Logf(format string, params ...interface{}) {
+	logf(format, params...)
+}
+
+// orDefault returns l, or the default Logger if l is nil.
+func orDefault(l Logger) Logger {
+	if l == nil {
+		return globalLogger{}
+	}
+	return l
+}
+
 func SetLogging(enabled bool) {
 	loggingEnabled = enabled
 }
@@ -0,0 +1,86 @@
+package rtransfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// bufLogger keeps every message logged to it.
+type bufLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *bufLogger) Logf(format string, params ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, params...))
+}
+
+func (l *bufLogger) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.msgs)
+}
+
+func TestServerLoggers(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	loggers := []*bufLogger{{}, {}}
+	hostports := make([]string, len(loggers))
+	for i, logger := range loggers {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("couldn't listen: %s", err)
+		}
+		hostports[i] = listener.Addr().String()
+
+		srv := NewServerWithOptions(listener, dpath, &ServerOptions{Logger: logger})
+		go srv.Serve(nil)
+		defer srv.Stop()
+	}
+
+	// Only the first server sees a rejected transfer, which it logs.
+	data := []byte("data")
+	err = SendReader(newTestDialer(hostports[0]), "../escape", int64(len(data)), bytes.NewReader(data), nil)
+	if !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Sending an invalid name returned %v, want %v", err, ErrInvalidName)
+	}
+
+	if !waitFor(time.Second, func() bool { return loggers[0].count() > 0 }) {
+		t.Errorf("First server logged nothing")
+	}
+	if n := loggers[1].count(); n != 0 {
+		t.Errorf("Second server logged %d messages about the first server's transfer", n)
+	}
+}
+
+func TestSendLogger(t *testing.T) {
+	deadHostport := unusedHostport(t)
+
+	logger := &bufLogger{}
+	opts := &SendOptions{
+		Retry:  RetryPolicy{MaxAttempts: 1},
+		Logger: logger,
+	}
+	if _, err := SendContext(context.Background(), newTestDialer(deadHostport), "unused", nil, opts); err == nil {
+		t.Fatalf("Send to a dead port succeeded")
+	}
+
+	if logger.count() == 0 {
+		t.Errorf("The failed dial wasn't logged")
+	}
+}
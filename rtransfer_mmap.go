@@ -0,0 +1,122 @@
+package rtransfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// errMmapUnsupported is returned by mapFile on platforms that can't map
+// files.
+var errMmapUnsupported = errors.New("memory mapping isn't supported on this platform")
+
+// mappedFile is a read-only memory mapping of the first size bytes of a file
+// being sent, for SendOptions.Mmap.
+type mappedFile struct {
+	data []byte
+}
+
+// mapFile maps the size bytes of f. An empty file has nothing to map, and
+// gets an empty mapping without asking the platform for one.
+func mapFile(f *os.File, size int64) (*mappedFile, error) {
+	if size == 0 {
+		return &mappedFile{}, nil
+	}
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("%d bytes don't fit in the address space", size)
+	}
+	data, err := mmapFile(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{data}, nil
+}
+
+func (m *mappedFile) unmap() {
+	if m.data != nil {
+		munmapFile(m.data)
+		m.data = nil
+	}
+}
+
+// readerFrom returns a reader of the mapping from offset on.
+func (m *mappedFile) readerFrom(offset int64) *mappedReader {
+	return &mappedReader{data: m.data[offset:], base: offset}
+}
+
+// catchFault is deferred, with debug.SetPanicOnFault set, around reads of the
+// mapping of fpath. If the file shrank since it was mapped, reading the pages
+// past its new end faults, and catchFault turns the panic that raises into an
+// error in *err. The error isn't permanent, so the next attempt finds the file
+// changed. Other panics go on.
+func (m *mappedFile) catchFault(fpath string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	fault, ok := r.(interface{ Addr() uintptr })
+	if !ok || len(m.data) == 0 {
+		panic(r)
+	}
+	start := uintptr(unsafe.Pointer(&m.data[0]))
+	if addr := fault.Addr(); addr < start || addr-start >= uintptr(len(m.data)) {
+		panic(r)
+	}
+	*err = fmt.Errorf("%s shrank while it was being sent: %v", fpath, r)
+}
+
+// mappedReader reads a mapping as an io.ReadSeeker, and hands out its blocks
+// without copying them with next. What it reads is passed to h, if set, as
+// a hashingReader would, the mapping starting base bytes into the file.
+type mappedReader struct {
+	data []byte
+	pos  int64
+	h    *runningHash
+	base int64
+}
+
+func (r *mappedReader) Read(p []byte) (int, error) {
+	if r.pos >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.pos:])
+	r.h.add(r.base+r.pos, p[:n])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *mappedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += int64(len(r.data))
+	default:
+		return 0, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative position %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// next returns the n bytes from the current position on, as io.ReadFull
+// would read them, but as a slice of the mapping, which must not be written
+// to.
+func (r *mappedReader) next(n int) ([]byte, error) {
+	if r.pos >= int64(len(r.data)) {
+		return nil, io.EOF
+	}
+	if int64(len(r.data))-r.pos < int64(n) {
+		r.pos = int64(len(r.data))
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := r.data[r.pos : r.pos+int64(n)]
+	r.h.add(r.base+r.pos, b)
+	r.pos += int64(n)
+	return b, nil
+}
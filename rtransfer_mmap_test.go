@@ -0,0 +1,175 @@
+package rtransfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestMmap(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// Whatever reads the mapping, the server ends up with the file. A Mux
+	// reads the file instead.
+	mux := NewMux(netDialer{"tcp", testSrvHostport}, nil)
+	defer mux.Close()
+	for i, tc := range []struct {
+		size  int64
+		opts  SendOptions
+		lossy bool
+		mux   bool
+	}{
+		{20*payloadSize + 7, SendOptions{}, false, false},
+		{0, SendOptions{}, false, false},
+		{20 * payloadSize, SendOptions{Compression: CompressionGzip}, false, false},
+		{20*payloadSize + 7, SendOptions{HashWhileSending: true}, false, false},
+		{20*payloadSize + 7, SendOptions{Parallelism: 4}, false, false},
+		{20*payloadSize + 7, SendOptions{}, true, false},
+		{20*payloadSize + 7, SendOptions{}, false, true},
+	} {
+		fpath := path.Join(clientDir, fmt.Sprintf("file%d", i))
+		if err := testutil.GenRandFile(fpath, tc.size); err != nil {
+			t.Fatalf("Couldn't create random file: %v", err)
+		}
+		var dialer Dialer = netDialer{"tcp", testSrvHostport}
+		if tc.lossy {
+			dialer = &lossyDialer{hostport: testSrvHostport, limit: 4 * payloadSize}
+		} else if tc.mux {
+			dialer = mux
+		}
+
+		opts := tc.opts
+		opts.Mmap = true
+		result, err := SendWithResult(context.Background(), dialer, fpath, &logSendNotifier{t}, &opts)
+		if err != nil {
+			t.Fatalf("Error while sending %s: %v", fpath, err)
+		}
+		if !result.Verified {
+			t.Errorf("Sending %s from a mapping wasn't verified", fpath)
+		}
+	}
+}
+
+func TestMmapShrink(t *testing.T) {
+	if _, err := mmapFile(nil, 0); errors.Is(err, errMmapUnsupported) {
+		t.Skip(err)
+	}
+
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "shrinking")
+	if err := testutil.GenRandFile(fpath, 10*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, path.Join(dpath, "server"))
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// The blocks past the file's new end are gone from the mapping, which
+	// fails the attempt rather than the process, and the next attempt finds
+	// the file changed.
+	notifier := &stallSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		stallAfter:      3,
+		stalled:         make(chan bool),
+		release:         make(chan bool),
+	}
+	logger := &bufLogger{}
+	sent := make(chan error)
+	go func() {
+		opts := &SendOptions{Mmap: true, Logger: logger}
+		_, err := SendContext(context.Background(), newTestDialer(testSrvHostport), fpath, notifier, opts)
+		sent <- err
+	}()
+	<-notifier.stalled
+	if err := os.Truncate(fpath, payloadSize); err != nil {
+		t.Fatalf("Couldn't truncate %s: %v", fpath, err)
+	}
+	close(notifier.release)
+
+	if err := <-sent; !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("Sending a file that shrank returned %v, want %v", err, ErrSourceChanged)
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if !strings.Contains(strings.Join(logger.msgs, "\n"), "shrank while it was being sent") {
+		t.Errorf("Sender didn't say the mapped file shrank, logged %q", logger.msgs)
+	}
+}
+
+// BenchmarkMmap compares reading each block of a large file to send it with
+// sending it from a mapping of the file.
+func BenchmarkMmap(b *testing.B) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		b.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	const size = 64 << 20
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		b.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("couldn't listen: %s", err)
+	}
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{Overwrite: OverwriteAlways})
+	go srv.Serve(nil)
+	defer srv.Stop()
+	dialer := newTestDialer(listener.Addr().String())
+
+	for _, c := range []struct {
+		name string
+		mmap bool
+	}{
+		{"read", false},
+		{"mmap", true},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(size)
+			opts := &SendOptions{Mmap: c.mmap, HashWhileSending: true}
+			for i := 0; i < b.N; i++ {
+				if _, err := SendContext(context.Background(), dialer, fpath, nil, opts); err != nil {
+					b.Fatalf("Error while sending: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package rtransfer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MultiOptions holds optional settings for SendMultiWithOptions. A nil
+// *MultiOptions means the defaults.
+type MultiOptions struct {
+	// Quorum is how many destinations must receive the file for the send
+	// to succeed. Zero means all of them.
+	Quorum int
+
+	// NewNotifier, if set, is called with the index of each destination to
+	// get the notifier for its transfer, so progress can be told apart.
+	NewNotifier func(target int) SendNotifier
+
+	// Send holds the options used for each destination.
+	Send *SendOptions
+}
+
+// MultiError is returned by SendMulti when too few destinations received
+// the file. Errs is indexed like the dialers, with nil for the destinations
+// that succeeded, and context.Canceled for those whose sends were cancelled
+// once too many others had failed.
+type MultiError struct {
+	Errs []error
+}
+
+func (e *MultiError) Error() string {
+	var msgs []string
+	for i, err := range e.Errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("destination %d: %v", i, err))
+		}
+	}
+	return fmt.Sprintf("Sending failed for %d of %d destinations: %s",
+		len(msgs), len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// SendMulti sends fpath to every server the dialers reach, at the same time,
+// and succeeds only if all of them receive it. Calls to notifier are made one
+// at a time but mix the progress of every destination; see
+// SendMultiWithOptions to tell them apart.
+func SendMulti(dialers []Dialer, fpath string, notifier SendNotifier) error {
+	// The destinations share a notifier that doesn't hear when each one
+	// is done, so that it hears the outcome of them all once.
+	notifier = guardSendNotifier(notifier, orDefault(nil))
+	var shared SendNotifier
+	if notifier != nil {
+		shared = &lockedNotifier{notifier: notifier}
+	}
+
+	return sendDone(notifier, SendMultiWithOptions(dialers, fpath, &MultiOptions{
+		NewNotifier: func(int) SendNotifier { return shared },
+	}))
+}
+
+// SendMultiWithOptions is like SendMulti, but can settle for a quorum of
+// destinations and give each its own notifier. It returns as soon as a
+// quorum has received the file, or so many destinations have given up under
+// the retry policy in opts.Send that none can, and cancels the sends still
+// going.
+func SendMultiWithOptions(dialers []Dialer, fpath string, opts *MultiOptions) error {
+	if opts == nil {
+		opts = &MultiOptions{}
+	}
+
+	quorum := opts.Quorum
+	if quorum <= 0 || quorum > len(dialers) {
+		quorum = len(dialers)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		target int
+		err    error
+	}
+	results := make(chan result, len(dialers))
+	for i, dialer := range dialers {
+		var notifier SendNotifier
+		if opts.NewNotifier != nil {
+			notifier = opts.NewNotifier(i)
+		}
+
+		go func(i int, dialer Dialer) {
+			_, err := SendContext(ctx, dialer, fpath, notifier, opts.Send)
+			results <- result{i, err}
+		}(i, dialer)
+	}
+
+	// The sends that haven't finished when the outcome is known are
+	// cancelled.
+	errs := make([]error, len(dialers))
+	for i := range errs {
+		errs[i] = context.Canceled
+	}
+	succeeded, failed := 0, 0
+	for succeeded < quorum && len(dialers)-failed >= quorum {
+		res := <-results
+		errs[res.target] = res.err
+		if res.err == nil {
+			succeeded++
+		} else {
+			failed++
+		}
+	}
+	if succeeded < quorum {
+		return &MultiError{errs}
+	}
+	return nil
+}
+
+// lockedNotifier lets several transfers share one SendNotifier.
+type lockedNotifier struct {
+	mu       sync.Mutex
+	notifier SendNotifier
+}
+
+func (ln *lockedNotifier) SendStart() {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.notifier.SendStart()
+}
+
+func (ln *lockedNotifier) RecvAck() {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.notifier.RecvAck()
+}
+
+func (ln *lockedNotifier) UpdateProgress(numBytes, totBytes int64) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.notifier.UpdateProgress(numBytes, totBytes)
+}
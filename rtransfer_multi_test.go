@@ -0,0 +1,169 @@
+package rtransfer
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// progressSendNotifier remembers the last progress it was told about.
+type progressSendNotifier struct {
+	logSendNotifier
+	numBytes int64
+}
+
+func (sn *progressSendNotifier) UpdateProgress(numBytes, totBytes int64) {
+	sn.logSendNotifier.UpdateProgress(numBytes, totBytes)
+	sn.numBytes = numBytes
+}
+
+// multiTest starts a server on each hostport, each with its own directory,
+// and sends one file to all of them through dialers, which may include
+// others. It returns the file sent, the server directories and the result.
+func multiTest(t *testing.T, hostports []string, dialers []Dialer, opts *MultiOptions) (string, []string, error) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	t.Cleanup(func() { os.RemoveAll(dpath) })
+
+	fpath := path.Join(dpath, "replicated")
+	if err := testutil.GenRandFile(fpath, 5*payloadSize+3); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	var dirs []string
+	for i, hostport := range hostports {
+		dir := path.Join(dpath, "server", string(rune('a'+i)))
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+		dirs = append(dirs, dir)
+
+		listener, err := net.Listen("tcp", hostport)
+		if err != nil {
+			t.Fatalf("couldn't listen on %s: %s", hostport, err)
+		}
+		srv := NewServer(listener, dir)
+		go srv.Serve(newLogRecvNotifierFactory(t))
+		t.Cleanup(srv.Stop)
+	}
+
+	return fpath, dirs, SendMultiWithOptions(dialers, fpath, opts)
+}
+
+func TestSendMulti(t *testing.T) {
+	hostports := []string{":9000", ":9001"}
+	dialers := []Dialer{newTestDialer(hostports[0]), newTestDialer(hostports[1])}
+	notifiers := []*progressSendNotifier{{logSendNotifier: logSendNotifier{t}}, {logSendNotifier: logSendNotifier{t}}}
+	opts := &MultiOptions{
+		NewNotifier: func(target int) SendNotifier { return notifiers[target] },
+	}
+
+	fpath, dirs, err := multiTest(t, hostports, dialers, opts)
+	if err != nil {
+		t.Fatalf("Error while sending to two servers: %v", err)
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"%s\"", fpath)
+	}
+	for i, dir := range dirs {
+		dstHash, err := testutil.HashFile(path.Join(dir, "replicated"))
+		if err != nil {
+			t.Errorf("Server %d has no copy: %v", i, err)
+		} else if srcHash != dstHash {
+			t.Errorf("Hashes don't match on server %d. Got %s, wanted %s", i, dstHash, srcHash)
+		}
+
+		if notifiers[i].numBytes != 5*payloadSize+3 {
+			t.Errorf("Notifier for server %d saw %d bytes", i, notifiers[i].numBytes)
+		}
+	}
+}
+
+func TestSendMultiQuorum(t *testing.T) {
+	hostports := []string{":9000"}
+	// A send cancelled in one subtest may still be dialing in the next, so
+	// the dialers keep no state.
+	dialers := []Dialer{netDialer{"tcp", hostports[0]}, netDialer{"tcp", unusedHostport(t)}}
+	send := &SendOptions{Retry: RetryPolicy{MaxAttempts: 1}}
+
+	t.Run("all", func(t *testing.T) {
+		_, _, err := multiTest(t, hostports, dialers, &MultiOptions{Send: send})
+		multiErr, ok := err.(*MultiError)
+		if !ok {
+			t.Fatalf("Sending with a dead destination returned %v, want a *MultiError", err)
+		}
+		// The live destination may not have finished when the dead one
+		// gave up, and is then cancelled.
+		if (multiErr.Errs[0] != nil && multiErr.Errs[0] != context.Canceled) || multiErr.Errs[1] == nil {
+			t.Errorf("Got errors %v, want one for the dead destination only", multiErr.Errs)
+		}
+	})
+
+	t.Run("quorum", func(t *testing.T) {
+		_, _, err := multiTest(t, hostports, dialers, &MultiOptions{Quorum: 1, Send: send})
+		if err != nil {
+			t.Errorf("Sending with a quorum of one returned %v", err)
+		}
+	})
+}
+
+func TestSendMultiSilent(t *testing.T) {
+	// A destination that accepts connections but never answers holds up
+	// neither a quorum the others make, nor the failure of one they can't.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	silentDialer := netDialer{"tcp", silent.Addr().String()}
+
+	for _, tc := range []struct {
+		name    string
+		dialers []Dialer
+		quorum  int
+		failed  bool
+	}{
+		{"quorum", []Dialer{netDialer{"tcp", ":9000"}, silentDialer}, 1, false},
+		{"failed", []Dialer{silentDialer, netDialer{"tcp", unusedHostport(t)}}, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &MultiOptions{Quorum: tc.quorum, Send: &SendOptions{Retry: RetryPolicy{MaxAttempts: 1}}}
+			done := make(chan error, 1)
+			go func() {
+				_, _, err := multiTest(t, []string{":9000"}, tc.dialers, opts)
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				multiErr, _ := err.(*MultiError)
+				if (multiErr != nil) != tc.failed {
+					t.Fatalf("Sending returned %v, want a *MultiError: %v", err, tc.failed)
+				}
+				if multiErr != nil && multiErr.Errs[0] != context.Canceled {
+					t.Errorf("Silent destination ended with %v, want %v", multiErr.Errs[0], context.Canceled)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Sending waited on the silent destination")
+			}
+		})
+	}
+}
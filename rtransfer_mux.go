@@ -0,0 +1,598 @@
+package rtransfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// muxMessage carries one message of a multiplexed connection, which holds
+// the transfers of several files at once. The client opens one with a start
+// message that asks for capMux and names no file. Once the server acks it
+// with capMux, every message either way is a muxMessage with one field set,
+// and each transfer's messages carry the Stream the client gave it in its
+// start message. A transfer otherwise goes as it would on a connection of
+// its own, with one block in flight at a time.
+//
+// The client sends messages in the order its streams have them ready. As no
+// stream has more than one waiting, every stream that is sending gets a turn
+// before any gets another, so a large file can't hold up a small one.
+type muxMessage struct {
+	Start   *startMessage
+	Ack     *ackMessage
+	Data    *dataMessage
+	DataAck *dataAckMessage
+	Result  *resultMessage
+
+	// Abort, if set, is a stream one end has finished with. From the
+	// client, the server drops any transfer still going on it. From the
+	// server, the transfer on it failed, and the client's waiting for it
+	// fails too.
+	Abort uint32
+}
+
+var (
+	// errStreamClosed is returned by the encoder and decoder of a stream
+	// that has ended.
+	errStreamClosed = errors.New("the multiplexed stream is closed")
+
+	// errStreamAborted is returned by those of a stream the server gave
+	// up on.
+	errStreamAborted = errors.New("the server gave up on the multiplexed stream")
+)
+
+// Mux is a Dialer whose connections are streams of one connection to the
+// server, so that the files sent through it at the same time share the
+// connection block by block. It dials the connection when it is first
+// needed, and again after it fails, using the handshake, codec and idle
+// timeout in the options it was made with. The codec must be able to encode
+// every message type, as GobCodec does.
+type Mux struct {
+	dialer Dialer
+	opts   *SendOptions
+
+	mu     sync.Mutex
+	conn   *muxConn
+	closed bool
+}
+
+// NewMux returns a Mux that reaches the server with dialer.
+func NewMux(dialer Dialer, opts *SendOptions) *Mux {
+	return &Mux{dialer: dialer, opts: opts}
+}
+
+// Dial opens a new stream on the shared connection.
+func (m *Mux) Dial() (net.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, net.ErrClosed
+	}
+	if m.conn == nil || m.conn.failed() {
+		c, err := dialMux(m.dialer, m.opts)
+		if err != nil {
+			return nil, err
+		}
+		m.conn = c
+	}
+	return m.conn.open()
+}
+
+// Close closes the shared connection, which fails the transfers still on it.
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	if m.conn != nil {
+		m.conn.fail(net.ErrClosed)
+	}
+	return nil
+}
+
+// dialMux dials a connection and asks the server to multiplex it.
+func dialMux(dialer Dialer, opts *SendOptions) (*muxConn, error) {
+	conn, err := dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	conn = withIdleTimeout(conn, opts.idleTimeout())
+
+	if err := handshake(conn, opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	codec := opts.codec()
+	enc, dec := codec.NewEncoder(conn), codec.NewDecoder(conn)
+	if err := enc.Encode(startMessage{Version: protocolVersion, Capabilities: capMux}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var ack ackMessage
+	if err := dec.Decode(&ack); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack.ErrType != ErrSuccess || ack.Capabilities&capMux == 0 {
+		conn.Close()
+		return nil, ErrUnsupportedFeature
+	}
+
+	c := newMuxConn(conn, enc, opts.idleTimeout())
+	go c.readAcks(dec)
+	return c, nil
+}
+
+// muxConn is either end of a multiplexed connection.
+type muxConn struct {
+	conn net.Conn
+	enc  Encoder
+
+	// out takes the messages of every stream to the one goroutine that
+	// writes them, in the order they are sent.
+	out chan muxMessage
+
+	// idle is how long a stream waits for a message to go or come before
+	// failing, or zero for no limit.
+	idle time.Duration
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	next    uint32
+
+	// dead is closed when the connection fails, with err set to why.
+	dead chan struct{}
+	err  error
+}
+
+func newMuxConn(conn net.Conn, enc Encoder, idle time.Duration) *muxConn {
+	c := &muxConn{
+		conn:    conn,
+		enc:     enc,
+		idle:    idle,
+		out:     make(chan muxMessage),
+		streams: make(map[uint32]*muxStream),
+		dead:    make(chan struct{}),
+	}
+	go c.write()
+	return c
+}
+
+func (c *muxConn) write() {
+	for {
+		select {
+		case m := <-c.out:
+			if err := c.enc.Encode(m); err != nil {
+				c.fail(err)
+				return
+			}
+		case <-c.dead:
+			return
+		}
+	}
+}
+
+// readAcks hands the messages the server sends to their streams.
+func (c *muxConn) readAcks(dec Decoder) {
+	for {
+		var m muxMessage
+		if err := dec.Decode(&m); err != nil {
+			c.fail(err)
+			return
+		}
+
+		switch {
+		case m.Ack != nil:
+			c.route(m.Ack.Stream, m)
+		case m.DataAck != nil:
+			c.route(m.DataAck.Stream, m)
+		case m.Result != nil:
+			c.route(m.Result.Stream, m)
+		case m.Abort != 0:
+			c.end(m.Abort, errStreamAborted)
+		}
+	}
+}
+
+// fail closes the connection, which ends every stream on it.
+func (c *muxConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.dead:
+		return
+	default:
+	}
+	c.err = err
+	close(c.dead)
+	c.conn.Close()
+}
+
+func (c *muxConn) failed() bool {
+	select {
+	case <-c.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+// open starts a stream with the next unused ID.
+func (c *muxConn) open() (*muxStream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failed() {
+		return nil, c.err
+	}
+	c.next++
+	s := newMuxStream(c, c.next)
+	c.streams[s.id] = s
+	return s, nil
+}
+
+// accept starts the stream with the ID the client picked, or returns nil if
+// it is already in use.
+func (c *muxConn) accept(id uint32) *muxStream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.streams[id]; ok || id == 0 {
+		return nil
+	}
+	s := newMuxStream(c, id)
+	c.streams[id] = s
+	return s
+}
+
+// route hands m to stream id, if it is still open.
+func (c *muxConn) route(id uint32, m muxMessage) {
+	c.mu.Lock()
+	s := c.streams[id]
+	c.mu.Unlock()
+
+	if s != nil {
+		select {
+		case s.in <- m:
+		case <-s.done:
+		}
+	}
+}
+
+// end ends stream id, if it is still open, failing what waits on it with
+// err.
+func (c *muxConn) end(id uint32, err error) {
+	c.mu.Lock()
+	s := c.streams[id]
+	c.mu.Unlock()
+
+	if s != nil {
+		s.end(err)
+	}
+}
+
+// muxStream is one transfer on a multiplexed connection. It is a net.Conn
+// so that it can go wherever a connection does, but it is only read and
+// written through the encoder and decoder streams returns for it.
+type muxStream struct {
+	net.Conn
+	c    *muxConn
+	id   uint32
+	in   chan muxMessage
+	done chan struct{}
+	err  error
+	once sync.Once
+
+	// mu guards the deadlines, and reset, which is closed when they
+	// change so that a message waiting on the old ones looks again.
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	reset         chan struct{}
+}
+
+func newMuxStream(c *muxConn, id uint32) *muxStream {
+	return &muxStream{
+		Conn:  c.conn,
+		c:     c,
+		id:    id,
+		in:    make(chan muxMessage, 1),
+		done:  make(chan struct{}),
+		reset: make(chan struct{}),
+	}
+}
+
+// end stops the stream and forgets it. Its encoder and decoder fail with
+// err from then on.
+func (s *muxStream) end(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+		s.c.mu.Lock()
+		delete(s.c.streams, s.id)
+		s.c.mu.Unlock()
+	})
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("Can't read a multiplexed stream directly")
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("Can't write a multiplexed stream directly")
+}
+
+// Close ends the stream and tells the other end, leaving the connection open
+// for the others.
+func (s *muxStream) Close() error {
+	s.end(errStreamClosed)
+	select {
+	case s.c.out <- muxMessage{Abort: s.id}:
+	case <-s.c.dead:
+	}
+	return nil
+}
+
+// The deadlines of a stream hold its own messages, and leave the shared
+// connection alone.
+func (s *muxStream) SetDeadline(t time.Time) error {
+	return s.setDeadlines(&t, &t)
+}
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	return s.setDeadlines(&t, nil)
+}
+
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	return s.setDeadlines(nil, &t)
+}
+
+func (s *muxStream) setDeadlines(read, write *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if read != nil {
+		s.readDeadline = *read
+	}
+	if write != nil {
+		s.writeDeadline = *write
+	}
+	close(s.reset)
+	s.reset = make(chan struct{})
+	return nil
+}
+
+// expiry returns a channel that fires once a read, or a write, of the stream
+// that starts now has gone on past its deadline or the connection's idle
+// timeout, a function that stops it, and the channel that is closed if the
+// deadlines change first.
+func (s *muxStream) expiry(write bool) (<-chan time.Time, func() bool, chan struct{}) {
+	s.mu.Lock()
+	deadline, reset := s.readDeadline, s.reset
+	if write {
+		deadline = s.writeDeadline
+	}
+	s.mu.Unlock()
+
+	if s.c.idle > 0 {
+		if idle := time.Now().Add(s.c.idle); deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	if deadline.IsZero() {
+		return nil, func() bool { return false }, reset
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, timer.Stop, reset
+}
+
+// Encode tags msg with the stream and queues it for the connection.
+func (s *muxStream) Encode(msg interface{}) error {
+	var m muxMessage
+	switch msg := msg.(type) {
+	case startMessage:
+		msg.Stream = s.id
+		m.Start = &msg
+	case ackMessage:
+		msg.Stream = s.id
+		m.Ack = &msg
+	case dataMessage:
+		msg.Stream = s.id
+		m.Data = &msg
+	case dataAckMessage:
+		msg.Stream = s.id
+		m.DataAck = &msg
+	case resultMessage:
+		msg.Stream = s.id
+		m.Result = &msg
+	default:
+		return fmt.Errorf("Can't send a %T on a multiplexed stream", msg)
+	}
+
+	for {
+		expired, stop, reset := s.expiry(true)
+		select {
+		case s.c.out <- m:
+			stop()
+			return nil
+		case <-s.done:
+			stop()
+			return s.err
+		case <-s.c.dead:
+			stop()
+			return s.c.err
+		case <-expired:
+			return os.ErrDeadlineExceeded
+		case <-reset:
+			stop()
+		}
+	}
+}
+
+// Decode waits for the stream's next message, which must be the kind msg
+// points to.
+func (s *muxStream) Decode(msg interface{}) error {
+	var m muxMessage
+	for received := false; !received; {
+		expired, stop, reset := s.expiry(false)
+		select {
+		case m = <-s.in:
+			stop()
+			received = true
+		case <-s.done:
+			stop()
+			return s.err
+		case <-s.c.dead:
+			stop()
+			return s.c.err
+		case <-expired:
+			return os.ErrDeadlineExceeded
+		case <-reset:
+			stop()
+		}
+	}
+
+	ok := false
+	switch msg := msg.(type) {
+	case *startMessage:
+		if ok = m.Start != nil; ok {
+			*msg = *m.Start
+		}
+	case *ackMessage:
+		if ok = m.Ack != nil; ok {
+			*msg = *m.Ack
+		}
+	case *dataMessage:
+		if ok = m.Data != nil; ok {
+			*msg = *m.Data
+		}
+	case *dataAckMessage:
+		if ok = m.DataAck != nil; ok {
+			*msg = *m.DataAck
+		}
+	case *resultMessage:
+		if ok = m.Result != nil; ok {
+			*msg = *m.Result
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%w: Expected a %T on stream %d", ErrProtocol, msg, s.id)
+	}
+	return nil
+}
+
+// asMuxStream returns the muxStream under conn, if there is one.
+func asMuxStream(conn net.Conn) (*muxStream, bool) {
+	if ic, ok := conn.(*idleConn); ok {
+		conn = ic.Conn
+	}
+	s, ok := conn.(*muxStream)
+	return s, ok
+}
+
+// recvMux acks the start message that opened a multiplexed connection, then
+// receives the files on its streams until the client hangs up. Each stream
+// counts as a connection of its own against MaxConcurrent, apart from one at
+// a time, which has the slot the connection took, and fails on its own
+// after the idle timeout. A stream whose transfer fails is aborted, so that
+// the client hears of it.
+func (srv *server) recvMux(conn net.Conn, enc Encoder, dec Decoder, createNotifier func(name string) RecvNotifier) error {
+	if err := enc.Encode(ackMessage{Version: protocolVersion, Capabilities: capMux}); err != nil {
+		return err
+	}
+
+	c := newMuxConn(conn, enc, srv.idle)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	own := make(chan bool, 1)
+	own <- true
+
+	for {
+		var m muxMessage
+		if err := dec.Decode(&m); err != nil {
+			c.fail(err)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch {
+		case m.Start != nil:
+			s := c.accept(m.Start.Stream)
+			if s == nil {
+				srv.logger.Logf("Client reused stream %d while it was open", m.Start.Stream)
+				continue
+			}
+
+			wg.Add(1)
+			go func(startMsg startMessage) {
+				defer wg.Done()
+				defer srv.acquireStream(own)()
+
+				// Like a connection waiting for another file, the
+				// stream turns away a new one once the server is
+				// shutting down.
+				srv.mu.Lock()
+				refused := srv.shutdown
+				if !refused {
+					srv.active[s] = startMsg.Name
+				}
+				srv.mu.Unlock()
+				if refused {
+					s.Close()
+					return
+				}
+				defer func() {
+					srv.mu.Lock()
+					delete(srv.active, s)
+					srv.mu.Unlock()
+				}()
+
+				if err := srv.recvFile(s, s, startMsg, conn.RemoteAddr(), createNotifier); err != nil {
+					srv.logger.Logf("recv on stream %d returned an error: %v", s.id, err)
+					s.Close()
+				}
+				s.end(errStreamClosed)
+			}(*m.Start)
+		case m.Data != nil:
+			c.route(m.Data.Stream, m)
+		case m.Abort != 0:
+			c.end(m.Abort, errStreamClosed)
+		}
+	}
+}
+
+// acquireStream waits for a connection slot for a stream of a multiplexed
+// connection, if they are limited: the one the connection took, in own, if
+// no other stream has it, or one of its own. It returns the function that
+// gives the slot back.
+func (srv *server) acquireStream(own chan bool) (release func()) {
+	if srv.slots == nil {
+		return func() {}
+	}
+
+	select {
+	case <-own:
+		return func() { own <- true }
+	case srv.slots <- true:
+		return srv.release
+	default:
+	}
+
+	srv.logger.Logf("Handling the limit of %d connections, waiting for one to finish", cap(srv.slots))
+	select {
+	case <-own:
+		return func() { own <- true }
+	case srv.slots <- true:
+		return srv.release
+	}
+}
@@ -0,0 +1,215 @@
+package rtransfer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestMux(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+
+	const bigSize = 8 << 20
+	bigPath := path.Join(clientDir, "big")
+	smallPath := path.Join(clientDir, "small")
+	if err := testutil.GenRandFile(bigPath, bigSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	if err := testutil.GenRandFile(smallPath, 100); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := &dialCounter{Dialer: newTestDialer(testSrvHostport)}
+	mux := NewMux(dialer, nil)
+	defer mux.Close()
+
+	// The large file stalls partway, and the small one goes past it on
+	// the same connection.
+	notifier := &stallSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		stallAfter:      10,
+		stalled:         make(chan bool),
+		release:         make(chan bool),
+	}
+	bigDone := make(chan error, 1)
+	go func() {
+		_, err := SendContext(context.Background(), mux, bigPath, notifier, nil)
+		bigDone <- err
+	}()
+	<-notifier.stalled
+
+	if _, err := SendContext(context.Background(), mux, smallPath, nil, nil); err != nil {
+		t.Fatalf("Error while sending %s: %v", smallPath, err)
+	}
+	close(notifier.release)
+
+	if err := <-bigDone; err != nil {
+		t.Fatalf("Error while sending %s: %v", bigPath, err)
+	}
+
+	for _, fpath := range []string{bigPath, smallPath} {
+		srcHash, err := testutil.HashFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fpath)
+		}
+		dstHash, err := testutil.HashFile(path.Join(serverDir, path.Base(fpath)))
+		if err != nil {
+			t.Fatalf("Couldn't hash received copy of \"%s\"", fpath)
+		}
+		if srcHash != dstHash {
+			t.Errorf("Hashes of %s don't match. Got %s, wanted %s", fpath, dstHash, srcHash)
+		}
+	}
+
+	if n := dialer.count(); n != 1 {
+		t.Errorf("Sending two files dialed %d connections, want 1", n)
+	}
+}
+
+func TestMuxStreamFailure(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, dpath)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	c, err := dialMux(newTestDialer(testSrvHostport), nil)
+	if err != nil {
+		t.Fatalf("Couldn't open a multiplexed connection: %v", err)
+	}
+	defer c.fail(net.ErrClosed)
+
+	start := func(name string) *muxStream {
+		s, err := c.open()
+		if err != nil {
+			t.Fatalf("Couldn't open a stream: %v", err)
+		}
+		if err := s.Encode(startMessage{Version: protocolVersion, Name: name, Size: 2 * payloadSize}); err != nil {
+			t.Fatalf("Couldn't send the start message of %s: %v", name, err)
+		}
+		var ack ackMessage
+		if err := s.Decode(&ack); err != nil || ack.ErrType != ErrSuccess {
+			t.Fatalf("Server didn't take %s: %v, %v", name, err, ack.ErrType)
+		}
+		return s
+	}
+
+	// A stream whose transfer fails on the server is aborted, rather than
+	// left waiting for an ack that never comes.
+	s := start("bad")
+	if err := s.Encode(dataMessage{SeqNum: 5, Data: make([]byte, payloadSize)}); err != nil {
+		t.Fatalf("Couldn't send a block: %v", err)
+	}
+	var dataAck dataAckMessage
+	if err := s.Decode(&dataAck); err != errStreamAborted {
+		t.Errorf("Waiting on a stream the server failed returned %v, want %v", err, errStreamAborted)
+	}
+
+	// A stream's deadline holds its messages alone.
+	s = start("slow")
+	s.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := s.Decode(&dataAck); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Waiting past a stream's deadline returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if c.failed() {
+		t.Errorf("A stream's deadline failed the connection")
+	}
+}
+
+func TestMuxMaxConcurrent(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+	bigPath := path.Join(clientDir, "big")
+	smallPath := path.Join(clientDir, "small")
+	if err := testutil.GenRandFile(bigPath, 20*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	if err := testutil.GenRandFile(smallPath, 100); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{MaxConcurrent: 1})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	mux := NewMux(newTestDialer(testSrvHostport), nil)
+	defer mux.Close()
+
+	// The streams of one connection count against the limit, so the small
+	// file waits for the stalled one.
+	notifier := &stallSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		stallAfter:      3,
+		stalled:         make(chan bool),
+		release:         make(chan bool),
+	}
+	bigDone := make(chan error, 1)
+	go func() {
+		_, err := SendContext(context.Background(), mux, bigPath, notifier, nil)
+		bigDone <- err
+	}()
+	<-notifier.stalled
+
+	smallDone := make(chan error, 1)
+	go func() {
+		_, err := SendContext(context.Background(), mux, smallPath, nil, nil)
+		smallDone <- err
+	}()
+	select {
+	case err := <-smallDone:
+		t.Fatalf("A second stream went past the limit of one: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(notifier.release)
+	for _, done := range []chan error{bigDone, smallDone} {
+		if err := <-done; err != nil {
+			t.Fatalf("Error while sending: %v", err)
+		}
+	}
+}
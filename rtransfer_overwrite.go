@@ -0,0 +1,77 @@
+package rtransfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// OverwritePolicy is what a server does when a client sends a file it
+// already has.
+type OverwritePolicy int
+
+const (
+	// OverwriteReject refuses the transfer with ErrAlreadyExists.
+	OverwriteReject = OverwritePolicy(iota)
+
+	// OverwriteAlways replaces the existing file.
+	OverwriteAlways
+
+	// OverwriteIfDifferent replaces the existing file unless it has the
+	// size and hash the client declared, in which case the transfer is
+	// refused with ErrAlreadyExists.
+	OverwriteIfDifferent
+)
+
+// allows reports whether a transfer described by startMsg may replace the
+// existing file at fpath.
+func (p OverwritePolicy) allows(fpath string, startMsg startMessage) (bool, error) {
+	switch p {
+	case OverwriteAlways:
+		return true, nil
+	case OverwriteIfDifferent:
+		same, err := sameContents(fpath, startMsg)
+		return !same, err
+	default:
+		return false, nil
+	}
+}
+
+// sameContents reports whether the file at fpath has the size and hash in
+// startMsg. A start message without a hash never matches, since there's no
+// telling whether the contents are the same.
+func sameContents(fpath string, startMsg startMessage) (bool, error) {
+	if startMsg.Hash == nil {
+		return false, nil
+	}
+
+	f, err := os.Open(fpath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != startMsg.Size {
+		return false, nil
+	}
+
+	hash, err := hashReader(f)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hash, startMsg.Hash), nil
+}
+
+// hashReader returns the SHA-256 of everything left in r.
+func hashReader(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,133 @@
+package rtransfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// overwriteTest puts existing on a server with the given policy, sends sent
+// under the same name, and returns what the server ends up storing and the
+// send's error.
+func overwriteTest(t *testing.T, policy OverwritePolicy, existing, sent []byte) ([]byte, error) {
+	return overwriteTestWithOptions(t, &ServerOptions{Overwrite: policy}, nil, existing, sent)
+}
+
+// overwriteTestWithOptions is like overwriteTest, but takes the options of
+// both sides.
+func overwriteTestWithOptions(t *testing.T, srvOpts *ServerOptions, sendOpts *SendOptions, existing, sent []byte) ([]byte, error) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	if err := os.WriteFile(path.Join(serverDir, "report"), existing, 0666); err != nil {
+		t.Fatalf("Couldn't create the existing file: %v", err)
+	}
+	fpath := path.Join(clientDir, "report")
+	if err := os.WriteFile(fpath, sent, 0666); err != nil {
+		t.Fatalf("Couldn't create the file to send: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, srvOpts)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	_, sendErr := SendContext(context.Background(), newTestDialer(testSrvHostport), fpath, &logSendNotifier{t}, sendOpts)
+
+	stored, err := os.ReadFile(path.Join(serverDir, "report"))
+	if err != nil {
+		t.Fatalf("Couldn't read the stored file: %v", err)
+	}
+	return stored, sendErr
+}
+
+var (
+	oldReport = bytes.Repeat([]byte("old report\n"), 1000)
+	newReport = bytes.Repeat([]byte("new report\n"), 1000)
+)
+
+func TestOverwriteReject(t *testing.T) {
+	stored, err := overwriteTest(t, OverwriteReject, oldReport, newReport)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Sending over an existing file returned %v, want %v", err, ErrAlreadyExists)
+	}
+	if !bytes.Equal(stored, oldReport) {
+		t.Errorf("The existing file was replaced")
+	}
+}
+
+func TestOverwriteAlways(t *testing.T) {
+	stored, err := overwriteTest(t, OverwriteAlways, oldReport, newReport)
+	if err != nil {
+		t.Errorf("Sending over an existing file returned %v", err)
+	}
+	if !bytes.Equal(stored, newReport) {
+		t.Errorf("The existing file wasn't replaced")
+	}
+}
+
+func TestOverwriteIfDifferent(t *testing.T) {
+	stored, err := overwriteTest(t, OverwriteIfDifferent, oldReport, newReport)
+	if err != nil {
+		t.Errorf("Sending a changed file returned %v", err)
+	}
+	if !bytes.Equal(stored, newReport) {
+		t.Errorf("The changed file wasn't replaced")
+	}
+
+	stored, err = overwriteTest(t, OverwriteIfDifferent, oldReport, oldReport)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Sending an identical file returned %v, want %v", err, ErrAlreadyExists)
+	}
+	if !bytes.Equal(stored, oldReport) {
+		t.Errorf("The identical file was disturbed")
+	}
+}
+
+func TestForceOverwrite(t *testing.T) {
+	force := &SendOptions{Force: true}
+
+	stored, err := overwriteTestWithOptions(t, &ServerOptions{AllowForce: true}, force, oldReport, newReport)
+	if err != nil {
+		t.Errorf("Forcing a send over an existing file returned %v", err)
+	}
+	if !bytes.Equal(stored, newReport) {
+		t.Errorf("The existing file wasn't replaced by a forced send")
+	}
+
+	stored, err = overwriteTestWithOptions(t, &ServerOptions{}, force, oldReport, newReport)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Forcing a send on a server that forbids it returned %v, want %v", err, ErrAlreadyExists)
+	}
+	if !bytes.Equal(stored, oldReport) {
+		t.Errorf("The existing file was replaced by a forbidden forced send")
+	}
+
+	stored, err = overwriteTestWithOptions(t, &ServerOptions{AllowForce: true}, nil, oldReport, newReport)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Sending over an existing file without forcing returned %v, want %v", err, ErrAlreadyExists)
+	}
+	if !bytes.Equal(stored, oldReport) {
+		t.Errorf("The existing file was replaced by a send that didn't force it")
+	}
+}
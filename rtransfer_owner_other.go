@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package rtransfer
+
+import "os"
+
+func ownerOf(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+func canChown() bool {
+	return false
+}
@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package rtransfer
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownerOf returns the user and group that own the file info describes.
+func ownerOf(info os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// canChown reports whether the process may give files away, which only
+// root can.
+func canChown() bool {
+	return os.Geteuid() == 0
+}
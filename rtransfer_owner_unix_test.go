@@ -0,0 +1,73 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package rtransfer
+
+import (
+	"net"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestPreserveOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Only root can give files away")
+	}
+
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	const uid, gid = 1234, 5678
+	fpath := path.Join(dpath, "owned")
+	if err := testutil.GenRandFile(fpath, 3*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	if err := os.Chown(fpath, uid, gid); err != nil {
+		t.Fatalf("Couldn't give %s away: %v", fpath, err)
+	}
+
+	owner := func(fpath string) (int, int) {
+		info, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't stat %s: %v", fpath, err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		return int(st.Uid), int(st.Gid)
+	}
+
+	// Only a server that preserves owners gives the file the client's.
+	for _, preserve := range []bool{false, true} {
+		serverDir := path.Join(dpath, "server")
+		if preserve {
+			serverDir += "-preserve"
+		}
+		listener, err := net.Listen("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+		}
+		srv := NewServerWithOptions(listener, serverDir, &ServerOptions{PreserveOwner: preserve})
+		go srv.Serve(newLogRecvNotifierFactory(t))
+
+		err = Send(netDialer{"tcp", testSrvHostport}, fpath, &logSendNotifier{t})
+		srv.Stop()
+		if err != nil {
+			t.Fatalf("Error while sending %s: %v", fpath, err)
+		}
+
+		wantUID, wantGID := os.Geteuid(), os.Getegid()
+		if preserve {
+			wantUID, wantGID = uid, gid
+		}
+		if gotUID, gotGID := owner(path.Join(serverDir, "owned")); gotUID != wantUID || gotGID != wantGID {
+			t.Errorf("With PreserveOwner %v, the file is owned by %d:%d, want %d:%d",
+				preserve, gotUID, gotGID, wantUID, wantGID)
+		}
+	}
+}
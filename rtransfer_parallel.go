@@ -0,0 +1,158 @@
+package rtransfer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// sendParallel sends the file in src as name, splitting its blocks into
+// opts.Parallelism ranges that go over connections of their own. The server
+// writes each block where it belongs, so the ranges don't wait on each
+// other.
+func sendParallel(ctx context.Context, dialer Dialer, src *fileSource, name string, notifier SendNotifier, opts *SendOptions, st *sendStats) error {
+	start := time.Now()
+	defer func() { st.Elapsed = time.Since(start) }()
+
+	// Describe the file once up front so that every range sends the same
+	// version of it. Ranges can't start over independently, so a change
+	// fails the transfer, and they can't share one delta or checkpoint.
+	src.restartOnChange = false
+	src.delta = false
+	src.checkpoint = ""
+	f, startMsg, err := src.open(name)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	numBlocks := getNumBlocks(startMsg.Size)
+	n := int64(opts.Parallelism)
+	if n > numBlocks {
+		n = numBlocks
+	}
+	if n < 2 {
+		return retry(ctx, dialer, opts, st, func(conn net.Conn) error {
+			return send(conn, src, name, notifier, st)
+		})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress := newParallelProgress(notifier, startMsg.Size)
+	errs := make(chan error, n)
+	var mu sync.Mutex
+
+	for i := int64(0); i < n; i++ {
+		first, end := i*numBlocks/n, (i+1)*numBlocks/n
+		go func() {
+			rangeStats := &sendStats{maxRetransmits: opts.maxRetransmits()}
+			rangeNotifier := progress.forRange(first)
+			err := retry(ctx, dialer, opts, rangeStats, func(conn net.Conn) error {
+				return sendRange(conn, src, name, first, end, rangeNotifier, rangeStats)
+			})
+			if err != nil {
+				cancel()
+			}
+
+			mu.Lock()
+			st.Bytes += rangeStats.Bytes
+			st.Blocks += rangeStats.Blocks
+			st.Retransmissions += rangeStats.Retransmissions
+			st.Reconnects += rangeStats.Reconnects
+			if rangeStats.LastFailure != FailureNone {
+				st.LastFailure = rangeStats.LastFailure
+			}
+			if rangeStats.MaxBlockRetransmissions > st.MaxBlockRetransmissions {
+				st.MaxBlockRetransmissions = rangeStats.MaxBlockRetransmissions
+			}
+			st.resultReceived(rangeStats.result)
+			mu.Unlock()
+
+			errs <- err
+		}()
+	}
+
+	// Report the error that stopped the transfer rather than the
+	// cancellations it caused.
+	var firstErr error
+	for i := int64(0); i < n; i++ {
+		if err := <-errs; err != nil && (firstErr == nil || firstErr == context.Canceled) {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// sendRange runs one attempt at sending blocks [first, end) of the file in
+// src.
+func sendRange(conn net.Conn, src *fileSource, name string, first, end int64, notifier SendNotifier, st *sendStats) error {
+	f, startMsg, err := src.open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	startMsg.Capabilities |= capRanges
+	startMsg.RangeStart = first
+	startMsg.RangeEnd = end
+	return src.sendBlocks(conn, startMsg, f, notifier, st)
+}
+
+// parallelProgress adds up the progress of the ranges of a parallel
+// transfer for the caller's notifier, which it calls one at a time.
+type parallelProgress struct {
+	mu       sync.Mutex
+	notifier SendNotifier
+	size     int64
+	done     map[int64]int64
+}
+
+func newParallelProgress(notifier SendNotifier, size int64) *parallelProgress {
+	return &parallelProgress{
+		notifier: notifier,
+		size:     size,
+		done:     make(map[int64]int64),
+	}
+}
+
+// forRange returns the notifier for the range starting at block first.
+func (p *parallelProgress) forRange(first int64) SendNotifier {
+	if p.notifier == nil {
+		return nil
+	}
+	return &rangeProgress{p, first}
+}
+
+type rangeProgress struct {
+	parent *parallelProgress
+	first  int64
+}
+
+func (r *rangeProgress) SendStart() {
+	r.parent.mu.Lock()
+	defer r.parent.mu.Unlock()
+	r.parent.notifier.SendStart()
+}
+
+func (r *rangeProgress) RecvAck() {
+	r.parent.mu.Lock()
+	defer r.parent.mu.Unlock()
+	r.parent.notifier.RecvAck()
+}
+
+// UpdateProgress is given how far into the file the range has got.
+func (r *rangeProgress) UpdateProgress(numBytes, totBytes int64) {
+	p := r.parent
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done[r.first] = numBytes - getFilePos(r.first)
+	var sum int64
+	for _, n := range p.done {
+		sum += n
+	}
+	p.notifier.UpdateProgress(sum, p.size)
+}
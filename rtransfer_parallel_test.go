@@ -0,0 +1,176 @@
+package rtransfer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestSendParallel(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	const size = 37*payloadSize + 100
+	fpath := path.Join(clientDir, "striped")
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	var mu sync.Mutex
+	var active, most int
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(func(name string) RecvNotifier {
+		return &concurrencyRecvNotifier{logRecvNotifier{t}, &mu, &active, &most}
+	})
+	defer srv.Stop()
+
+	// One of the connections loses a block partway through its range.
+	dialer := &lossyDialer{hostport: testSrvHostport, limit: 4 * payloadSize}
+	notifier := &slowSendNotifier{logSendNotifier{t}, time.Millisecond}
+	opts := &SendOptions{Parallelism: 4}
+	stats, err := SendContext(context.Background(), dialer, fpath, notifier, opts)
+	if err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"%s\"", fpath)
+	}
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "striped"))
+	if err != nil {
+		t.Fatalf("Couldn't hash received file")
+	}
+	if srcHash != dstHash {
+		t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+	}
+
+	if stats.Reconnects != 1 {
+		t.Errorf("Parallel send saw %d reconnects, want 1", stats.Reconnects)
+	}
+	if want := getNumBlocks(size) + stats.Retransmissions; stats.Blocks != want {
+		t.Errorf("Parallel send sent %d blocks, want %d", stats.Blocks, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if most < 2 {
+		t.Errorf("Server received at most %d ranges at once", most)
+	}
+}
+
+func TestRejectOverlappingRange(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, dpath)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	handshake := func(first, end int64) (ackMessage, net.Conn) {
+		conn, err := newTestDialer(testSrvHostport).Dial()
+		if err != nil {
+			t.Fatalf("Couldn't dial the server: %v", err)
+		}
+		startMsg := startMessage{
+			Version:      protocolVersion,
+			Capabilities: capRanges,
+			Name:         "ranged",
+			Size:         10 * payloadSize,
+			RangeStart:   first,
+			RangeEnd:     end,
+		}
+		if err := GobCodec.NewEncoder(conn).Encode(startMsg); err != nil {
+			t.Fatalf("Couldn't send start message: %v", err)
+		}
+		var ack ackMessage
+		if err := GobCodec.NewDecoder(conn).Decode(&ack); err != nil {
+			t.Fatalf("Couldn't receive ack: %v", err)
+		}
+		return ack, conn
+	}
+
+	ack, conn := handshake(0, 5)
+	defer conn.Close()
+	if ack.ErrType != ErrSuccess || ack.Capabilities&capRanges == 0 {
+		t.Fatalf("Server answered a range with %v and capabilities %b", ack.ErrType, ack.Capabilities)
+	}
+
+	for _, r := range [][2]int64{{3, 8}, {0, 4}, {5, 11}, {6, 6}} {
+		ack, conn := handshake(r[0], r[1])
+		conn.Close()
+		if ack.ErrType != ErrInvalidRange {
+			t.Errorf("Server answered blocks [%d, %d) with %v, want %v", r[0], r[1], ack.ErrType, ErrInvalidRange)
+		}
+	}
+
+	ack, conn = handshake(5, 10)
+	defer conn.Close()
+	if ack.ErrType != ErrSuccess || ack.SeqNum != 5 {
+		t.Errorf("Server answered the other half with %v at block %d", ack.ErrType, ack.SeqNum)
+	}
+}
+
+func BenchmarkSendParallel(b *testing.B) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		b.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	const size = 8 << 20
+	fpath := path.Join(dpath, "bench")
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		b.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("couldn't listen: %s", err)
+	}
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{Overwrite: OverwriteAlways})
+	go srv.Serve(nil)
+	defer srv.Stop()
+	dialer := newTestDialer(listener.Addr().String())
+
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("conns=%d", n), func(b *testing.B) {
+			b.SetBytes(size)
+			opts := &SendOptions{Parallelism: n}
+			for i := 0; i < b.N; i++ {
+				if _, err := SendContext(context.Background(), dialer, fpath, nil, opts); err != nil {
+					b.Fatalf("Error while sending: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package rtransfer
+
+import (
+	"net"
+	"sync"
+)
+
+// PipeListener is a net.Listener whose connections are made in memory, with
+// net.Pipe, by its own Dial. It is a Dialer too, so a client and server in
+// the same process, as in a test, can talk through it without taking a port
+// or touching the network. Dial waits for the server to accept the
+// connection.
+type PipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewPipeListener returns a PipeListener ready to be served and dialed.
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Dial connects to the listener, returning the client's end of a new pipe
+// once Accept has taken the server's. It fails once the listener is closed.
+func (l *PipeListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Err: net.ErrClosed}
+	}
+}
+
+// Accept waits for Dial and returns the server's end of the pipe it made.
+// It fails once the listener is closed.
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Err: net.ErrClosed}
+	}
+}
+
+// Close stops the listener, failing Accept and Dial calls waiting on it and
+// those made after. Connections already made stay open. It may be called
+// more than once.
+func (l *PipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr returns the address of the listener, which is the same for every
+// PipeListener.
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// pipeAddr is the address of both ends of a PipeListener's connections.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,150 @@
+package rtransfer
+
+import (
+	"net"
+	"sync"
+)
+
+// ConnPool is a Dialer that keeps the connections of finished transfers open
+// and hands them out again, so that a run of small files doesn't pay for a
+// new connection and handshake each. A connection that fails is closed, and
+// the transfer on it carries on over a new one.
+//
+// A connection keeps the codec, secret and idle timeout of the transfer that
+// opened it, so the transfers that share a pool should use the same
+// SendOptions for those.
+type ConnPool struct {
+	dialer Dialer
+	size   int
+
+	mu     sync.Mutex
+	idle   []*session
+	closed bool
+}
+
+// NewConnPool returns a pool that dials new connections with dialer and
+// keeps up to size of them open while they are idle. A size below one
+// means one.
+func NewConnPool(dialer Dialer, size int) *ConnPool {
+	if size < 1 {
+		size = 1
+	}
+	return &ConnPool{dialer: dialer, size: size}
+}
+
+// Dial returns an idle connection if the pool has one, and dials a new one
+// otherwise.
+func (p *ConnPool) Dial() (net.Conn, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		s := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return &pooledConn{Conn: s.conn, pool: p, session: s}, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := p.dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{Conn: conn, pool: p, session: &session{conn: conn}}, nil
+}
+
+// Close closes the idle connections, and those handed back from then on.
+func (p *ConnPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, s := range p.idle {
+		s.conn.Close()
+	}
+	p.idle = nil
+	return nil
+}
+
+// put keeps s for a later Dial, and reports whether there was room for it.
+func (p *ConnPool) put(s *session) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle) >= p.size {
+		return false
+	}
+	p.idle = append(p.idle, s)
+	return true
+}
+
+// session is a connection in a pool, with what outlives the transfers over
+// it. The encoder and decoder are kept because a decoder may read ahead of
+// the message it decodes.
+type session struct {
+	conn    net.Conn
+	started bool
+	enc     Encoder
+	dec     Decoder
+}
+
+// pooledConn is a connection handed out by a ConnPool. Closing it gives the
+// connection back to the pool if its transfer ended with the server ready
+// for another, and closes it otherwise.
+type pooledConn struct {
+	net.Conn
+	pool    *ConnPool
+	session *session
+
+	mu     sync.Mutex
+	keep   bool
+	closed bool
+}
+
+// reusable marks the connection as ready for another transfer.
+func (pc *pooledConn) reusable() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.keep = true
+}
+
+func (pc *pooledConn) Close() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.closed {
+		return nil
+	}
+	pc.closed = true
+	if pc.keep && pc.pool.put(pc.session) {
+		return nil
+	}
+	return pc.Conn.Close()
+}
+
+// asPooled returns the pooledConn under conn, if there is one.
+func asPooled(conn net.Conn) (*pooledConn, bool) {
+	if ic, ok := conn.(*idleConn); ok {
+		conn = ic.Conn
+	}
+	pc, ok := conn.(*pooledConn)
+	return pc, ok
+}
+
+// streams returns the encoder and decoder for a transfer over conn. A pooled
+// connection makes them for its first transfer and keeps them for the rest,
+// and a Mux stream is its own.
+func streams(conn net.Conn, codec MessageCodec) (Encoder, Decoder) {
+	if s, ok := asMuxStream(conn); ok {
+		return s, s
+	}
+
+	pc, ok := asPooled(conn)
+	if !ok {
+		return codec.NewEncoder(conn), codec.NewDecoder(conn)
+	}
+
+	s := pc.session
+	if s.enc == nil {
+		s.enc, s.dec = codec.NewEncoder(conn), codec.NewDecoder(conn)
+	}
+	return s.enc, s.dec
+}
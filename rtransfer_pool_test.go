@@ -0,0 +1,235 @@
+package rtransfer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// dialCounter counts the connections it dials.
+type dialCounter struct {
+	Dialer
+	mu sync.Mutex
+	n  int
+}
+
+func (d *dialCounter) Dial() (net.Conn, error) {
+	d.mu.Lock()
+	d.n++
+	d.mu.Unlock()
+	return d.Dialer.Dial()
+}
+
+func (d *dialCounter) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.n
+}
+
+// genFiles creates n small files in dir and returns their paths.
+func genFiles(dir string, n int) ([]string, error) {
+	fpaths := make([]string, n)
+	for i := range fpaths {
+		fpaths[i] = path.Join(dir, fmt.Sprintf("file%d", i))
+		if err := testutil.GenRandFile(fpaths[i], 100); err != nil {
+			return nil, err
+		}
+	}
+	return fpaths, nil
+}
+
+func TestConnPool(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+	fpaths, err := genFiles(clientDir, 10)
+	if err != nil {
+		t.Fatalf("Couldn't create test files: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := &dialCounter{Dialer: newTestDialer(testSrvHostport)}
+	pool := NewConnPool(dialer, 1)
+	defer pool.Close()
+
+	for _, fpath := range fpaths {
+		if _, err := SendContext(context.Background(), pool, fpath, nil, nil); err != nil {
+			t.Fatalf("Error while sending %s: %v", fpath, err)
+		}
+	}
+
+	for _, fpath := range fpaths {
+		srcHash, err := testutil.HashFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fpath)
+		}
+		dstHash, err := testutil.HashFile(path.Join(serverDir, path.Base(fpath)))
+		if err != nil {
+			t.Fatalf("Couldn't hash received copy of \"%s\"", fpath)
+		}
+		if srcHash != dstHash {
+			t.Errorf("Hashes of %s don't match. Got %s, wanted %s", fpath, dstHash, srcHash)
+		}
+	}
+
+	if n := dialer.count(); n != 1 {
+		t.Errorf("Sending %d files dialed %d connections, want 1", len(fpaths), n)
+	}
+
+	// The pooled connection is idle, so it doesn't hold up a shutdown.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.ShutdownContext(ctx); err != nil {
+		t.Errorf("Shutdown with an idle pooled connection failed: %v", err)
+	}
+}
+
+func TestConnPoolRedial(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+	fpaths, err := genFiles(clientDir, 2)
+	if err != nil {
+		t.Fatalf("Couldn't create test files: %v", err)
+	}
+
+	// The server hangs up on the pooled connection while it sits idle.
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{IdleTimeout: 50 * time.Millisecond})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := &dialCounter{Dialer: newTestDialer(testSrvHostport)}
+	pool := NewConnPool(dialer, 1)
+	defer pool.Close()
+
+	// A failed reused connection is replaced without waiting out a backoff.
+	opts := &SendOptions{Retry: RetryPolicy{MaxAttempts: 1}}
+	for i, fpath := range fpaths {
+		if i > 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if _, err := SendContext(context.Background(), pool, fpath, nil, opts); err != nil {
+			t.Fatalf("Error while sending %s: %v", fpath, err)
+		}
+	}
+
+	if n := dialer.count(); n != 2 {
+		t.Errorf("Dialed %d connections, want 2", n)
+	}
+}
+
+// staleDialer hands out connections that look like they have carried a
+// transfer already, but that the server has hung up on.
+type staleDialer struct {
+	pool *ConnPool
+}
+
+func (d staleDialer) Dial() (net.Conn, error) {
+	conn, far := net.Pipe()
+	far.Close()
+	return &pooledConn{Conn: conn, pool: d.pool, session: &session{conn: conn, started: true}}, nil
+}
+
+func TestConnPoolRedialCounts(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 1024); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	// Only the first failed reused connection is replaced for free. The
+	// rest use up attempts, so the send gives up rather than redial
+	// forever.
+	pool := NewConnPool(nil, 1)
+	dialer := &dialCounter{Dialer: staleDialer{pool}}
+	opts := &SendOptions{
+		Retry: RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxAttempts: 2},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := SendContext(ctx, dialer, fpath, nil, opts); err == nil || ctx.Err() != nil {
+		t.Fatalf("Sending over stale connections returned %v, want it to give up", err)
+	}
+	if n := dialer.count(); n != 3 {
+		t.Errorf("Dialed %d connections, want 3", n)
+	}
+}
+
+func BenchmarkTinyFiles(b *testing.B) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		b.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpaths, err := genFiles(dpath, 1000)
+	if err != nil {
+		b.Fatalf("Couldn't create test files: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("couldn't listen: %s", err)
+	}
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{Overwrite: OverwriteAlways})
+	go srv.Serve(nil)
+	defer srv.Stop()
+	dialer := newTestDialer(listener.Addr().String())
+
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reuse=%v", reuse), func(b *testing.B) {
+			var d Dialer = dialer
+			if reuse {
+				pool := NewConnPool(dialer, 1)
+				defer pool.Close()
+				d = pool
+			}
+
+			for i := 0; i < b.N; i++ {
+				for _, fpath := range fpaths {
+					if _, err := SendContext(context.Background(), d, fpath, nil, nil); err != nil {
+						b.Fatalf("Error while sending: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
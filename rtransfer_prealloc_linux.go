@@ -0,0 +1,20 @@
+package rtransfer
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves size bytes of disk for f, extending it to size, so
+// that blocks written out of order don't fragment it.
+func preallocate(f *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return f.Truncate(size)
+	}
+	return err
+}
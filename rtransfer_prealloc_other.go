@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package rtransfer
+
+import (
+	"os"
+)
+
+// preallocate extends f to size bytes. Unlike on Linux, the filesystem may
+// leave the file sparse and find out it is full only when the blocks arrive.
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
@@ -0,0 +1,358 @@
+package rtransfer
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Progress is how far a transfer has got: Bytes of the Total bytes in the
+// file have been sent.
+type Progress struct {
+	Bytes int64
+	Total int64
+}
+
+// SendWithProgress sends fpath in the background. Progress updates arrive on
+// the first channel, which is closed when the transfer finishes; after that
+// the result is delivered once on the second.
+//
+// The transfer doesn't wait for the caller to read progress. Updates the
+// caller hasn't read yet are replaced by newer ones, so the channel always
+// holds the latest.
+func SendWithProgress(dialer Dialer, fpath string) (<-chan Progress, <-chan error) {
+	progress := make(chan Progress, 1)
+	errc := make(chan error, 1)
+
+	go func() {
+		_, err := SendContext(context.Background(), dialer, fpath, progressNotifier(progress), nil)
+		close(progress)
+		errc <- err
+	}()
+
+	return progress, errc
+}
+
+// progressNotifier publishes progress to a channel with room for one
+// update, dropping the update waiting there if the reader has fallen behind.
+type progressNotifier chan Progress
+
+func (p progressNotifier) SendStart() {}
+func (p progressNotifier) RecvAck()   {}
+
+func (p progressNotifier) UpdateProgress(numBytes, totBytes int64) {
+	update := Progress{numBytes, totBytes}
+	for {
+		select {
+		case p <- update:
+			return
+		default:
+		}
+
+		select {
+		case <-p:
+		default:
+		}
+	}
+}
+
+// notifyQueue makes a notifier's calls from a goroutine of its own, in the
+// order they were asked for, so that a slow notifier doesn't hold up the
+// transfer. Progress updates that pile up behind a slow call are merged
+// into the latest.
+type notifyQueue struct {
+	mu      sync.Mutex
+	pending []notifyCall
+	closed  bool
+	wake    chan bool
+	done    chan bool
+}
+
+type notifyCall struct {
+	progress bool
+	call     func()
+}
+
+func newNotifyQueue() *notifyQueue {
+	q := &notifyQueue{
+		wake: make(chan bool, 1),
+		done: make(chan bool),
+	}
+	go q.run()
+	return q
+}
+
+// push queues call. A progress update replaces one queued just before it.
+func (q *notifyQueue) push(progress bool, call func()) {
+	q.mu.Lock()
+	if n := len(q.pending); progress && n > 0 && q.pending[n-1].progress {
+		q.pending[n-1].call = call
+	} else {
+		q.pending = append(q.pending, notifyCall{progress, call})
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// close waits for the queued calls to be made.
+func (q *notifyQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- true:
+	default:
+	}
+	<-q.done
+}
+
+func (q *notifyQueue) run() {
+	defer close(q.done)
+	for range q.wake {
+		q.mu.Lock()
+		calls, closed := q.pending, q.closed
+		q.pending = nil
+		q.mu.Unlock()
+
+		for _, c := range calls {
+			c.call()
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// asyncSendNotifier passes calls on to notifier through a notifyQueue.
+type asyncSendNotifier struct {
+	q        *notifyQueue
+	notifier SendNotifier
+}
+
+func (an *asyncSendNotifier) SendStart() {
+	an.q.push(false, an.notifier.SendStart)
+}
+
+func (an *asyncSendNotifier) RecvAck() {
+	an.q.push(false, an.notifier.RecvAck)
+}
+
+func (an *asyncSendNotifier) UpdateProgress(numBytes, totBytes int64) {
+	an.q.push(true, func() { an.notifier.UpdateProgress(numBytes, totBytes) })
+}
+
+// asyncRecvNotifier passes calls on to notifier through a notifyQueue, which
+// it closes once RecvDone is made.
+type asyncRecvNotifier struct {
+	q        *notifyQueue
+	notifier RecvNotifier
+}
+
+func (an *asyncRecvNotifier) SendAck() {
+	an.q.push(false, an.notifier.SendAck)
+}
+
+func (an *asyncRecvNotifier) RecvStart() {
+	an.q.push(false, an.notifier.RecvStart)
+}
+
+func (an *asyncRecvNotifier) UpdateProgress(numBytes, totBytes int64) {
+	an.q.push(true, func() { an.notifier.UpdateProgress(numBytes, totBytes) })
+}
+
+func (an *asyncRecvNotifier) RecvDone(name string, err error) {
+	an.q.push(false, func() { an.notifier.RecvDone(name, err) })
+	an.q.close()
+}
+
+// progressThrottle holds progress updates back to one every interval, or
+// every bytes bytes, whichever comes first, keeping the last one it held
+// back. An update that finishes the file, or goes back, as when a file is
+// sent over, is never held back. Zero for either disables it.
+type progressThrottle struct {
+	interval time.Duration
+	bytes    int64
+
+	// mu is held while an update is made, so that they stay in order.
+	mu       sync.Mutex
+	last     time.Time
+	lastSent int64
+	held     *Progress
+}
+
+// update makes the update with f unless it is held back.
+func (t *progressThrottle) update(numBytes, totBytes int64, f func(numBytes, totBytes int64)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	due := numBytes == totBytes || numBytes < t.lastSent ||
+		(t.interval > 0 && now.Sub(t.last) >= t.interval) ||
+		(t.bytes > 0 && numBytes-t.lastSent >= t.bytes)
+	if !due {
+		t.held = &Progress{numBytes, totBytes}
+		return
+	}
+	t.last, t.lastSent, t.held = now, numBytes, nil
+	f(numBytes, totBytes)
+}
+
+// flush makes the last update held back, if any, with f.
+func (t *progressThrottle) flush(f func(numBytes, totBytes int64)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.held != nil {
+		f(t.held.Bytes, t.held.Total)
+		t.lastSent, t.held = t.held.Bytes, nil
+	}
+}
+
+// throttledSendNotifier passes calls on to notifier, holding progress
+// updates back with throttle.
+type throttledSendNotifier struct {
+	notifier SendNotifier
+	throttle progressThrottle
+}
+
+func (tn *throttledSendNotifier) SendStart() {
+	tn.notifier.SendStart()
+}
+
+func (tn *throttledSendNotifier) RecvAck() {
+	tn.notifier.RecvAck()
+}
+
+func (tn *throttledSendNotifier) UpdateProgress(numBytes, totBytes int64) {
+	tn.throttle.update(numBytes, totBytes, tn.notifier.UpdateProgress)
+}
+
+// throttledRecvNotifier passes calls on to notifier, holding progress
+// updates back with throttle until RecvDone.
+type throttledRecvNotifier struct {
+	notifier RecvNotifier
+	throttle progressThrottle
+}
+
+func (tn *throttledRecvNotifier) SendAck() {
+	tn.notifier.SendAck()
+}
+
+func (tn *throttledRecvNotifier) RecvStart() {
+	tn.notifier.RecvStart()
+}
+
+func (tn *throttledRecvNotifier) UpdateProgress(numBytes, totBytes int64) {
+	tn.throttle.update(numBytes, totBytes, tn.notifier.UpdateProgress)
+}
+
+func (tn *throttledRecvNotifier) RecvDone(name string, err error) {
+	tn.throttle.flush(tn.notifier.UpdateProgress)
+	tn.notifier.RecvDone(name, err)
+}
+
+// notifierGuard disables a notifier once one of its calls panics. The panic is
+// logged and the transfer carries on without the notifier, since a bug in a
+// progress display shouldn't cost the file.
+type notifierGuard struct {
+	mu     sync.Mutex
+	failed bool
+	logger Logger
+}
+
+// call makes the call to method that f makes, unless an earlier call
+// panicked.
+func (g *notifierGuard) call(method string, f func()) {
+	g.mu.Lock()
+	failed := g.failed
+	g.mu.Unlock()
+	if failed {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			g.mu.Lock()
+			g.failed = true
+			g.mu.Unlock()
+			g.logger.Logf("Notifier panicked in %s, not calling it again: %v\n%s", method, r, debug.Stack())
+		}
+	}()
+	f()
+}
+
+// guardedSendNotifier passes calls on to notifier through a notifierGuard.
+type guardedSendNotifier struct {
+	guard    notifierGuard
+	notifier SendNotifier
+}
+
+// guardSendNotifier returns notifier, guarded against its calls panicking,
+// or nil if it is nil.
+func guardSendNotifier(notifier SendNotifier, logger Logger) SendNotifier {
+	if notifier == nil {
+		return nil
+	}
+	if _, ok := notifier.(*guardedSendNotifier); ok {
+		return notifier
+	}
+	return &guardedSendNotifier{guard: notifierGuard{logger: logger}, notifier: notifier}
+}
+
+func (gn *guardedSendNotifier) SendStart() {
+	gn.guard.call("SendStart", func() { gn.notifier.SendStart() })
+}
+
+func (gn *guardedSendNotifier) RecvAck() {
+	gn.guard.call("RecvAck", func() { gn.notifier.RecvAck() })
+}
+
+func (gn *guardedSendNotifier) UpdateProgress(numBytes, totBytes int64) {
+	gn.guard.call("UpdateProgress", func() { gn.notifier.UpdateProgress(numBytes, totBytes) })
+}
+
+func (gn *guardedSendNotifier) SendDone(err error) {
+	if dn, ok := gn.notifier.(SendDoneNotifier); ok {
+		gn.guard.call("SendDone", func() { dn.SendDone(err) })
+	}
+}
+
+// guardedRecvNotifier passes calls on to notifier through a notifierGuard.
+type guardedRecvNotifier struct {
+	guard    notifierGuard
+	notifier RecvNotifier
+}
+
+// newGuardedRecvNotifier returns the notifier createNotifier makes for name,
+// guarded against its calls panicking. If createNotifier itself panics, the
+// notifier it returns does nothing.
+func newGuardedRecvNotifier(createNotifier func(name string) RecvNotifier, name string, logger Logger) RecvNotifier {
+	gn := &guardedRecvNotifier{guard: notifierGuard{logger: logger}}
+	gn.guard.call("the RecvNotifier factory", func() { gn.notifier = createNotifier(name) })
+	if gn.notifier == nil {
+		gn.guard.failed = true
+	}
+	return gn
+}
+
+func (gn *guardedRecvNotifier) SendAck() {
+	gn.guard.call("SendAck", func() { gn.notifier.SendAck() })
+}
+
+func (gn *guardedRecvNotifier) RecvStart() {
+	gn.guard.call("RecvStart", func() { gn.notifier.RecvStart() })
+}
+
+func (gn *guardedRecvNotifier) UpdateProgress(numBytes, totBytes int64) {
+	gn.guard.call("UpdateProgress", func() { gn.notifier.UpdateProgress(numBytes, totBytes) })
+}
+
+func (gn *guardedRecvNotifier) RecvDone(name string, err error) {
+	gn.guard.call("RecvDone", func() { gn.notifier.RecvDone(name, err) })
+}
@@ -0,0 +1,341 @@
+package rtransfer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestSendWithProgress(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	const size = 1024 * 1024
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+
+	progress, errc := SendWithProgress(newTestDialer(testSrvHostport), fpath)
+
+	var last Progress
+	for p := range progress {
+		if p.Total != size {
+			t.Errorf("Progress total is %d, want %d", p.Total, size)
+		}
+		if p.Bytes < last.Bytes {
+			t.Errorf("Progress went backwards from %d to %d bytes", last.Bytes, p.Bytes)
+		}
+		last = p
+	}
+	if last.Bytes != size {
+		t.Errorf("Last progress was %d bytes, want %d", last.Bytes, size)
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("A second result was delivered: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash %s: %v", fpath, err)
+	}
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "file"))
+	if err != nil {
+		t.Fatalf("Couldn't hash the received file: %v", err)
+	}
+	if srcHash != dstHash {
+		t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+	}
+}
+
+// slowNotifier takes a while over each progress update, and records the
+// updates it gets on either side of a transfer.
+type slowNotifier struct {
+	logSendNotifier
+	mu    sync.Mutex
+	calls int
+	last  int64
+	done  chan bool
+}
+
+func (sn *slowNotifier) UpdateProgress(numBytes, totBytes int64) {
+	time.Sleep(10 * time.Millisecond)
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.calls++
+	sn.last = numBytes
+}
+
+func (sn *slowNotifier) SendAck()   {}
+func (sn *slowNotifier) RecvStart() {}
+
+func (sn *slowNotifier) RecvDone(name string, err error) {
+	close(sn.done)
+}
+
+func (sn *slowNotifier) progress() (calls int, last int64) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	return sn.calls, sn.last
+}
+
+func TestAsyncProgress(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	const size = 1024 * 1024
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+
+	recvNotifier := &slowNotifier{logSendNotifier: logSendNotifier{t}, done: make(chan bool)}
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{AsyncProgress: true})
+	go srv.Serve(func(name string) RecvNotifier { return recvNotifier })
+	defer srv.Stop()
+
+	// Called in line, the notifiers would hold the transfer up for at least
+	// 10ms a block.
+	sendNotifier := &slowNotifier{logSendNotifier: logSendNotifier{t}}
+	opts := &SendOptions{AsyncProgress: true}
+	start := time.Now()
+	if _, err := SendContext(context.Background(), newTestDialer(testSrvHostport), fpath, sendNotifier, opts); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if d := time.Since(start); d >= time.Duration(BlockCount(size, BlockSize))*10*time.Millisecond {
+		t.Errorf("Send took %v, as long as the notifier calls would in line", d)
+	}
+
+	// Every update is in by the time the send returns.
+	calls, last := sendNotifier.progress()
+	if last != size {
+		t.Errorf("Sender's last progress update was %d bytes, want %d", last, size)
+	}
+	if calls >= int(BlockCount(size, BlockSize)) {
+		t.Errorf("Sender's notifier got %d updates, want fewer than one a block", calls)
+	}
+
+	select {
+	case <-recvNotifier.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server never called RecvDone")
+	}
+	if _, last := recvNotifier.progress(); last != size {
+		t.Errorf("Server's last progress update was %d bytes, want %d", last, size)
+	}
+}
+
+// panicNotifier panics on its third progress update, on either side of a
+// transfer, and counts the updates it gets.
+type panicNotifier struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (pn *panicNotifier) SendStart() {}
+func (pn *panicNotifier) RecvAck()   {}
+func (pn *panicNotifier) SendAck()   {}
+func (pn *panicNotifier) RecvStart() {}
+
+func (pn *panicNotifier) UpdateProgress(numBytes, totBytes int64) {
+	pn.mu.Lock()
+	pn.calls++
+	calls := pn.calls
+	pn.mu.Unlock()
+	if calls == 3 {
+		panic("bad progress display")
+	}
+}
+
+func (pn *panicNotifier) RecvDone(name string, err error) {}
+
+func (pn *panicNotifier) count() int {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	return pn.calls
+}
+
+func TestNotifierPanic(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 20*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash %s: %v", fpath, err)
+	}
+
+	for _, async := range []bool{false, true} {
+		serverDir := path.Join(dpath, fmt.Sprintf("server-%v", async))
+		srvLogger := &bufLogger{}
+		recvNotifier := &panicNotifier{}
+		listener, err := net.Listen("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+		}
+		srv := NewServerWithOptions(listener, serverDir, &ServerOptions{Logger: srvLogger, AsyncProgress: async})
+		go srv.Serve(func(name string) RecvNotifier { return recvNotifier })
+
+		// A notifier panicking doesn't stop the file, but isn't called
+		// again.
+		cliLogger := &bufLogger{}
+		sendNotifier := &panicNotifier{}
+		opts := &SendOptions{Logger: cliLogger, AsyncProgress: async}
+		if _, err := SendContext(context.Background(), newTestDialer(testSrvHostport), fpath, sendNotifier, opts); err != nil {
+			t.Fatalf("Send with async %v failed: %v", async, err)
+		}
+		srv.Stop()
+
+		dstHash, err := testutil.HashFile(path.Join(serverDir, "file"))
+		if err != nil {
+			t.Fatalf("Couldn't hash the received file: %v", err)
+		}
+		if srcHash != dstHash {
+			t.Errorf("With async %v, hashes don't match. Got %s, wanted %s", async, dstHash, srcHash)
+		}
+
+		for _, side := range []struct {
+			name     string
+			notifier *panicNotifier
+			logger   *bufLogger
+		}{
+			{"Sender", sendNotifier, cliLogger},
+			{"Server", recvNotifier, srvLogger},
+		} {
+			// The server may make its last calls just after the sender
+			// is done.
+			logged := waitFor(5*time.Second, func() bool {
+				side.logger.mu.Lock()
+				defer side.logger.mu.Unlock()
+				for _, msg := range side.logger.msgs {
+					if strings.Contains(msg, "panicked in UpdateProgress") && strings.Contains(msg, "bad progress display") {
+						return true
+					}
+				}
+				return false
+			})
+			if !logged {
+				t.Errorf("With async %v, %s didn't log its notifier panicking", async, side.name)
+			}
+			if calls := side.notifier.count(); calls != 3 {
+				t.Errorf("With async %v, %s's notifier got %d updates, want 3", async, side.name, calls)
+			}
+		}
+	}
+}
+
+func TestProgressRate(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	const size = 1024 * payloadSize
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+
+	// An update every quarter of the file, as an hour won't go by.
+	const every = size / 4
+	const most = size/every + 2
+
+	recvNotifier := &slowNotifier{logSendNotifier: logSendNotifier{t}, done: make(chan bool)}
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{
+		ProgressInterval: time.Hour,
+		ProgressBytes:    every,
+	})
+	go srv.Serve(func(name string) RecvNotifier { return recvNotifier })
+	defer srv.Stop()
+
+	sendNotifier := &slowNotifier{logSendNotifier: logSendNotifier{t}}
+	opts := &SendOptions{ProgressInterval: time.Hour, ProgressBytes: every}
+	if _, err := SendContext(context.Background(), newTestDialer(testSrvHostport), fpath, sendNotifier, opts); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	select {
+	case <-recvNotifier.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server never called RecvDone")
+	}
+	for side, notifier := range map[string]*slowNotifier{"Sender": sendNotifier, "Server": recvNotifier} {
+		calls, last := notifier.progress()
+		if calls > most {
+			t.Errorf("%s's notifier got %d updates for %d blocks, want at most %d",
+				side, calls, BlockCount(size, BlockSize), most)
+		}
+		if last != size {
+			t.Errorf("%s's last progress update was %d bytes, want %d", side, last, size)
+		}
+	}
+}
+
+func TestProgressThrottle(t *testing.T) {
+	var got []int64
+	record := func(numBytes, totBytes int64) { got = append(got, numBytes) }
+
+	throttle := progressThrottle{interval: time.Hour}
+	for n := int64(1); n < 10; n++ {
+		throttle.update(n, 10, record)
+	}
+	throttle.flush(record)
+	throttle.flush(record)
+	throttle.update(3, 10, record)
+	throttle.update(10, 10, record)
+
+	// Only the first update goes out before the hour is up. Flushing makes
+	// the last one held back, once, and going back or finishing the file
+	// goes out at once.
+	if want := []int64{1, 9, 3, 10}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Throttled updates came out as %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,137 @@
+package rtransfer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// proxyV2Signature starts a version 2 PROXY protocol header. A version 1
+// header starts with "PROXY " instead.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Header is the longest a version 1 header can be, with its CRLF.
+const maxProxyV1Header = 107
+
+// proxyConn is a connection accepted from a load balancer that starts with
+// a PROXY protocol header giving the address of the client it relays.
+// RemoteAddr gives the balancer's address until the header is read.
+type proxyConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the PROXY protocol header off the connection, one byte at
+// a time past the first few so as not to read into what the client sends
+// after it. A connection without one is refused, as it may come from
+// somewhere other than the balancer. A header for a connection the balancer
+// made itself, such as a health check, or for something other than TCP
+// leaves RemoteAddr alone.
+func (c *proxyConn) readHeader() error {
+	// Both versions of the header are at least this long.
+	start := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(c.Conn, start); err != nil {
+		return fmt.Errorf("Couldn't read the PROXY header from %s: %v", c.Conn.RemoteAddr(), err)
+	}
+
+	var remote net.Addr
+	var err error
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		remote, err = c.readV2()
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		remote, err = c.readV1(start)
+	default:
+		err = fmt.Errorf("Connection from %s doesn't start with a PROXY header", c.Conn.RemoteAddr())
+	}
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.remote = remote
+	c.mu.Unlock()
+	return nil
+}
+
+// readV1 reads the rest of a version 1 header, whose first bytes are line.
+func (c *proxyConn) readV1(line []byte) (net.Addr, error) {
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyV1Header {
+			return nil, fmt.Errorf("PROXY header from %s is too long", c.Conn.RemoteAddr())
+		}
+		if _, err := io.ReadFull(c.Conn, b); err != nil {
+			return nil, fmt.Errorf("Couldn't read the PROXY header from %s: %v", c.Conn.RemoteAddr(), err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Invalid PROXY header from %s: %q", c.Conn.RemoteAddr(), line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Invalid PROXY header from %s: %q", c.Conn.RemoteAddr(), line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 reads the rest of a version 2 header, after its signature.
+func (c *proxyConn) readV2() (net.Addr, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(c.Conn, head[:]); err != nil {
+		return nil, fmt.Errorf("Couldn't read the PROXY header from %s: %v", c.Conn.RemoteAddr(), err)
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(c.Conn, addrs); err != nil {
+		return nil, fmt.Errorf("Couldn't read the PROXY header from %s: %v", c.Conn.RemoteAddr(), err)
+	}
+
+	version, command := head[0]>>4, head[0]&0xf
+	if version != 2 || command > 1 {
+		return nil, fmt.Errorf("Invalid PROXY header from %s", c.Conn.RemoteAddr())
+	}
+	if command == 0 {
+		return nil, nil
+	}
+
+	// The source address comes first, then the destination's, then the
+	// source port and the destination's.
+	var ipLen int
+	switch head[1] {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(addrs) < 2*ipLen+4 {
+		return nil, fmt.Errorf("Invalid PROXY header from %s", c.Conn.RemoteAddr())
+	}
+	ip := net.IP(addrs[:ipLen])
+	port := binary.BigEndian.Uint16(addrs[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,116 @@
+package rtransfer
+
+import (
+	"encoding/gob"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// proxyDialer connects to hostport and sends header first, as a load
+// balancer speaking the PROXY protocol would.
+type proxyDialer struct {
+	hostport string
+	header   []byte
+}
+
+func (d proxyDialer) Dial() (net.Conn, error) {
+	conn, err := net.Dial("tcp", d.hostport)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(d.header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestProxyProtocol(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := newServer(listener, serverDir, &ServerOptions{ProxyProtocol: true})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	v2 := append([]byte(nil), proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12,
+		198, 51, 100, 7, 127, 0, 0, 1, 0xc8, 0x8a, 0x23, 0x28)
+
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"v1", []byte("PROXY TCP4 192.0.2.10 127.0.0.1 51234 9000\r\n"), "192.0.2.10:51234"},
+		{"v2", v2, "198.51.100.7:51338"},
+	} {
+		fpath := path.Join(dpath, tc.name)
+		if err := testutil.GenRandFile(fpath, 10*payloadSize); err != nil {
+			t.Fatalf("Couldn't create random file: %v", err)
+		}
+
+		// The server sees the client's address while the file arrives.
+		notifier := &stallSendNotifier{
+			logSendNotifier: logSendNotifier{t},
+			stallAfter:      3,
+			stalled:         make(chan bool),
+			release:         make(chan bool),
+		}
+		sent := make(chan error)
+		go func() {
+			sent <- Send(proxyDialer{testSrvHostport, tc.header}, fpath, notifier)
+		}()
+		<-notifier.stalled
+
+		var addrs []string
+		srv.mu.Lock()
+		for conn := range srv.active {
+			addrs = append(addrs, conn.RemoteAddr().String())
+		}
+		srv.mu.Unlock()
+		if len(addrs) != 1 || addrs[0] != tc.want {
+			t.Errorf("Server has connections from %v, want %s", addrs, tc.want)
+		}
+
+		close(notifier.release)
+		if err := <-sent; err != nil {
+			t.Fatalf("Error while sending %s: %v", fpath, err)
+		}
+		srcHash, err := testutil.HashFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fpath)
+		}
+		dstHash, err := testutil.HashFile(path.Join(serverDir, tc.name))
+		if err != nil || srcHash != dstHash {
+			t.Errorf("The server doesn't have %s as it was sent (%v)", tc.name, err)
+		}
+	}
+
+	// A client that doesn't go through the balancer is dropped.
+	conn, err := net.Dial("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("Couldn't connect to the server: %v", err)
+	}
+	defer conn.Close()
+	startMsg := startMessage{Version: protocolVersion, Name: "direct", Size: payloadSize}
+	if err := gob.NewEncoder(conn).Encode(startMsg); err != nil {
+		t.Fatalf("Couldn't send the start message: %v", err)
+	}
+	var ack ackMessage
+	if err := gob.NewDecoder(conn).Decode(&ack); err == nil {
+		t.Errorf("Server answered a client that sent no PROXY header")
+	}
+}
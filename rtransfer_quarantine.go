@@ -0,0 +1,113 @@
+package rtransfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"time"
+)
+
+// quarantineRecord is what the server writes beside a file it moved to the
+// QuarantineDir, as JSON, to say why. The hashes are hex SHA-256s.
+type quarantineRecord struct {
+	Name     string
+	Reason   string
+	Expected string `json:",omitempty"`
+	Actual   string `json:",omitempty"`
+	Bytes    int64
+	Client   string `json:",omitempty"`
+	Time     time.Time
+}
+
+// newQuarantineRecord describes the file the client at client sent as name,
+// of which size bytes arrived, that failed for reason. want and got are the
+// hashes it should have had and had, if it failed a hash check.
+func newQuarantineRecord(name string, size int64, client string, want, got []byte, reason error) quarantineRecord {
+	return quarantineRecord{
+		Name:     name,
+		Reason:   reason.Error(),
+		Expected: hex.EncodeToString(want),
+		Actual:   hex.EncodeToString(got),
+		Bytes:    size,
+		Client:   client,
+		Time:     time.Now(),
+	}
+}
+
+// checkHash returns an error if tr, whose blocks are all in over the
+// connection that has f open, doesn't match the hash the client gave in
+// startMsg, if it gave one. It then drops the transfer and moves the partial
+// file to the QuarantineDir, so that the file starts over when the client
+// sends it again.
+func (srv *server) checkHash(tr *transfer, f blockFile, startMsg startMessage, client net.Addr) error {
+	got := tr.hash.sum(HashSHA256, tr.size)
+	if tr.offset != 0 || len(startMsg.Hash) != sha256.Size || got == nil || bytes.Equal(got, startMsg.Hash) {
+		return nil
+	}
+
+	srv.mu.Lock()
+	if srv.transfers[startMsg.Name] == tr {
+		delete(srv.transfers, startMsg.Name)
+	}
+	srv.mu.Unlock()
+	srv.removeBlocks(tr.path)
+	f.Close()
+
+	err := fmt.Errorf("%w: %s arrived with SHA-256 %x, but the client gave %x",
+		ErrHashMismatch, startMsg.Name, got, startMsg.Hash)
+	tr.sink.abort(err)
+	srv.discard(srv.partPath(tr.path), newQuarantineRecord(startMsg.Name, tr.size, client.String(), startMsg.Hash, got, err))
+	return err
+}
+
+// discard gets rid of partPath, the partial file of a transfer that failed
+// as record says: it is moved to the QuarantineDir, with the record beside
+// it, if there is one, and otherwise removed. A file that can't be moved
+// is removed all the same.
+func (srv *server) discard(partPath string, record quarantineRecord) {
+	if srv.quarantine != "" {
+		qpath, err := srv.quarantineFile(partPath, record)
+		if err == nil {
+			srv.logger.Logf("Moved the partial file of %s to %s", record.Name, qpath)
+			return
+		}
+		srv.logger.Logf("Couldn't quarantine the partial file of %s: %v", record.Name, err)
+	}
+	if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+		srv.logger.Logf("Couldn't remove the partial file of %s: %v", record.Name, err)
+	}
+}
+
+// quarantineFile moves partPath into the QuarantineDir, under the name it
+// was sent as and the time it failed, and writes record beside it with a
+// .json suffix. It returns where the file went.
+func (srv *server) quarantineFile(partPath string, record quarantineRecord) (string, error) {
+	qpath := path.Join(srv.quarantine, fmt.Sprintf("%s.%d", record.Name, record.Time.UnixNano()))
+	if err := os.MkdirAll(path.Dir(qpath), srv.dirMode); err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(record, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(qpath+".json", data, srv.fileMode); err != nil {
+		return "", err
+	}
+
+	err = os.Rename(partPath, qpath)
+	if errors.Is(err, errCrossDevice) {
+		err = srv.moveAcross(partPath, qpath)
+	}
+	if err != nil {
+		os.Remove(qpath + ".json")
+		return "", err
+	}
+	return qpath, nil
+}
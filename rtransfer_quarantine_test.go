@@ -0,0 +1,233 @@
+package rtransfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// errRecvNotifier passes on how each file it's told of ended.
+type errRecvNotifier struct {
+	logRecvNotifier
+	done chan error
+}
+
+func (en *errRecvNotifier) RecvDone(name string, err error) {
+	en.done <- err
+}
+
+// sendCorrupt sends name to the server at hostport with data, claiming a
+// hash that doesn't match it, and returns the error reading the ack of the
+// last block, if the server didn't send it.
+func sendCorrupt(t *testing.T, hostport, name string, data []byte) error {
+	conn, err := net.Dial("tcp", hostport)
+	if err != nil {
+		t.Fatalf("Couldn't connect to the server: %v", err)
+	}
+	defer conn.Close()
+	enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+
+	startMsg := startMessage{
+		Version: protocolVersion,
+		Name:    name,
+		Size:    int64(len(data)),
+		Hash:    bytes.Repeat([]byte{0xab}, 32),
+	}
+	if err := enc.Encode(startMsg); err != nil {
+		t.Fatalf("Couldn't send the start message: %v", err)
+	}
+	var ack ackMessage
+	if err := dec.Decode(&ack); err != nil || ack.ErrType != ErrSuccess {
+		t.Fatalf("Server didn't take %s: %v, %v", name, err, ack.ErrType)
+	}
+	if err := enc.Encode(dataMessage{SeqNum: 0, Data: data}); err != nil {
+		t.Fatalf("Couldn't send the block: %v", err)
+	}
+	var dataAck dataAckMessage
+	return dec.Decode(&dataAck)
+}
+
+func TestQuarantine(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	quarantineDir := path.Join(dpath, "quarantine")
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	done := make(chan error, 2)
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{QuarantineDir: quarantineDir})
+	go srv.Serve(func(name string) RecvNotifier {
+		return &errRecvNotifier{logRecvNotifier{t}, done}
+	})
+	defer srv.Stop()
+
+	// The last block isn't acked, so the client knows to send the file
+	// again.
+	data := []byte("not what the hash says")
+	if err := sendCorrupt(t, testSrvHostport, "sub/corrupt", data); err == nil {
+		t.Errorf("Server acked the last block of a file that didn't match its hash")
+	}
+	if err := <-done; err == nil {
+		t.Fatalf("Server stored a file that didn't match its hash")
+	}
+
+	for _, name := range []string{"sub/corrupt", "sub/corrupt" + partSuffix} {
+		if fileExists(path.Join(serverDir, name)) {
+			t.Errorf("Corrupt file left %s in the archive", name)
+		}
+	}
+
+	matches, err := filepath.Glob(path.Join(quarantineDir, "sub", "corrupt.*.json"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("Quarantine holds records %v, want one (%v)", matches, err)
+	}
+	qpath := matches[0][:len(matches[0])-len(".json")]
+	if got, err := os.ReadFile(qpath); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Quarantined file holds %q, want %q (%v)", got, data, err)
+	}
+
+	var record quarantineRecord
+	recordData, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatalf("Couldn't read the quarantine record: %v", err)
+	}
+	if err := json.Unmarshal(recordData, &record); err != nil {
+		t.Fatalf("Couldn't parse the quarantine record %s: %v", recordData, err)
+	}
+	if record.Name != "sub/corrupt" || record.Bytes != int64(len(data)) ||
+		record.Expected != hex.EncodeToString(bytes.Repeat([]byte{0xab}, 32)) ||
+		record.Actual == "" || record.Actual == record.Expected || record.Client == "" {
+		t.Errorf("Quarantine record is %+v", record)
+	}
+}
+
+func TestCorruptStoredByDefault(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	done := make(chan error, 2)
+	srv := NewServer(listener, dpath)
+	go srv.Serve(func(name string) RecvNotifier {
+		return &errRecvNotifier{logRecvNotifier{t}, done}
+	})
+	defer srv.Stop()
+
+	// Without a QuarantineDir, the server doesn't check the file.
+	data := []byte("data")
+	if err := sendCorrupt(t, testSrvHostport, "corrupt", data); err != nil {
+		t.Fatalf("Server didn't ack the block: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Server failed to store the file: %v", err)
+	}
+	if got, err := os.ReadFile(path.Join(dpath, "corrupt")); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Server stored %q, want %q (%v)", got, data, err)
+	}
+}
+
+// corruptDialer dials hostport. The first connection it makes changes the
+// first copy of marker the client writes, as a bad link might.
+type corruptDialer struct {
+	hostport string
+	marker   []byte
+
+	mu     sync.Mutex
+	dialed bool
+}
+
+func (d *corruptDialer) Dial() (net.Conn, error) {
+	conn, err := net.Dial("tcp", d.hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dialed {
+		return conn, nil
+	}
+	d.dialed = true
+	return &corruptConn{Conn: conn, marker: d.marker}, nil
+}
+
+type corruptConn struct {
+	net.Conn
+	marker []byte
+	done   bool
+}
+
+func (c *corruptConn) Write(p []byte) (int, error) {
+	if i := bytes.Index(p, c.marker); i >= 0 && !c.done {
+		c.done = true
+		p = append([]byte(nil), p...)
+		p[i] ^= 0xff
+	}
+	return c.Conn.Write(p)
+}
+
+func TestQuarantineSend(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	quarantineDir := path.Join(dpath, "quarantine")
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{QuarantineDir: quarantineDir})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	marker := []byte("corrupted on the way")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*payloadSize/16)
+	copy(data[2*payloadSize+100:], marker)
+	fpath := path.Join(dpath, "file")
+	if err := os.WriteFile(fpath, data, 0644); err != nil {
+		t.Fatalf("Couldn't create %s: %v", fpath, err)
+	}
+
+	// A block is corrupted on its way to the server, which sets the file
+	// aside rather than acking it, and the client sends it again.
+	dialer := &corruptDialer{hostport: testSrvHostport, marker: marker}
+	st, err := SendContext(context.Background(), dialer, fpath, &logSendNotifier{t}, nil)
+	if err != nil {
+		t.Fatalf("Error while sending %s: %v", fpath, err)
+	}
+	if st.Reconnects == 0 {
+		t.Errorf("Client didn't send the file again")
+	}
+	if got, err := os.ReadFile(path.Join(serverDir, "file")); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Server doesn't have the file as it was sent (%v)", err)
+	}
+	matches, err := filepath.Glob(path.Join(quarantineDir, "file.*.json"))
+	if err != nil || len(matches) != 1 {
+		t.Errorf("Quarantine holds records %v, want one (%v)", matches, err)
+	}
+}
@@ -0,0 +1,134 @@
+package rtransfer
+
+import (
+	"bufio"
+	"os"
+	"sync"
+)
+
+// queueFile keeps the daemon's pending file paths on disk, one per line, so
+// that they survive a restart. A nil *queueFile does nothing, which is what a
+// daemon without a QueueFile uses.
+type queueFile struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newQueueFile(fpath string) *queueFile {
+	if fpath == "" {
+		return nil
+	}
+	return &queueFile{path: fpath}
+}
+
+// load returns the paths in the queue file, in the order they were added.
+func (q *queueFile) load() ([]string, error) {
+	if q == nil {
+		return nil, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.read()
+}
+
+func (q *queueFile) read() ([]string, error) {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// write replaces the contents of the queue file with paths. The new contents
+// are written to a temporary file first so a crash can't leave half a queue.
+func (q *queueFile) write(paths []string) error {
+	tmpPath := q.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, fpath := range paths {
+		w.WriteString(fpath + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, q.path)
+}
+
+// append adds fpath to the end of the queue file.
+func (q *queueFile) append(fpath string) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	f, err := os.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(fpath + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// remove drops the first occurrence of fpath from the queue file.
+func (q *queueFile) remove(fpath string) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	paths, err := q.read()
+	if err != nil {
+		return err
+	}
+
+	for i, p := range paths {
+		if p == fpath {
+			paths = append(paths[:i], paths[i+1:]...)
+			break
+		}
+	}
+
+	return q.write(paths)
+}
+
+// replace overwrites the queue file with paths.
+func (q *queueFile) replace(paths []string) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.write(paths)
+}
@@ -0,0 +1,200 @@
+package rtransfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ReceiveRecord is what a server remembers of the last time it received a
+// file in full.
+type ReceiveRecord struct {
+	// Name is the name the file was sent under, and StoredPath where the
+	// server stored it, as SendResult.StoredPath gives it.
+	Name       string
+	StoredPath string
+	Size       int64
+
+	// Hash is the SHA-256 of the file's contents as the server took it
+	// while receiving the file, or else as the client gave it. It is nil if
+	// there was neither, as for a stream into a Store.
+	Hash []byte
+
+	// Completed is when the server had the whole file.
+	Completed time.Time
+}
+
+// recordMessage answers a start message that asks for capRecord. Record is
+// nil if the server has no record of the file. Its fields line up with
+// ackMessage's, so that a server that doesn't know capRecord turns the
+// request down with an ack the client can read.
+type recordMessage struct {
+	Version int
+	ErrType ErrCode
+	Record  *ReceiveRecord
+}
+
+// recordOf returns the record of the file startMsg describes, stored in full
+// at fpath in root with size bytes, whose digests h, which may be nil, took.
+func (srv *server) recordOf(startMsg startMessage, root, fpath string, size int64, h *runningHash) ReceiveRecord {
+	storedPath := fpath
+	if srv.store == nil {
+		if rel, err := filepath.Rel(root, fpath); err == nil {
+			storedPath = filepath.ToSlash(rel)
+		}
+	}
+	hash := h.sum(HashSHA256, size)
+	if hash == nil {
+		hash = startMsg.Hash
+	}
+	return ReceiveRecord{
+		Name:       startMsg.Name,
+		StoredPath: storedPath,
+		Size:       size,
+		Hash:       hash,
+		Completed:  time.Now(),
+	}
+}
+
+// loadRecords reads back the records earlier servers appended to the
+// ReceivedIndex, one per line, the last of each file's winning. Records it
+// can't read, such as one cut short when a process died, are logged and
+// dropped, since the worst that comes of it is that a client sends a file
+// again. If it finds any such, or any records later ones replace, it writes
+// the index over with the records it kept, so that it doesn't keep growing.
+func (srv *server) loadRecords() {
+	if srv.recordsPath == "" {
+		return
+	}
+	data, err := os.ReadFile(srv.recordsPath)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		srv.logger.Logf("Couldn't read %s: %v", srv.recordsPath, err)
+		return
+	}
+
+	lines := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		lines++
+		var record ReceiveRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			srv.logger.Logf("Couldn't read a record in %s: %v", srv.recordsPath, err)
+			continue
+		}
+		srv.records[record.Name] = record
+	}
+	if lines == len(srv.records) {
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, record := range srv.records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			srv.logger.Logf("Couldn't rewrite %s: %v", srv.recordsPath, err)
+			return
+		}
+		buf.Write(append(line, '\n'))
+	}
+	tmp := srv.recordsPath + ".tmp"
+	if err = os.WriteFile(tmp, buf.Bytes(), srv.fileMode); err == nil {
+		err = os.Rename(tmp, srv.recordsPath)
+	}
+	if err != nil {
+		srv.logger.Logf("Couldn't rewrite %s: %v", srv.recordsPath, err)
+	}
+}
+
+// remember records that the server has received a file in full, if it keeps
+// a ReceivedIndex, by appending the record to it. A record cut short if the
+// process dies is dropped by the next server that reads the index.
+func (srv *server) remember(record ReceiveRecord) {
+	if srv.recordsPath == "" {
+		return
+	}
+	srv.recordsMu.Lock()
+	defer srv.recordsMu.Unlock()
+
+	srv.mu.Lock()
+	srv.records[record.Name] = record
+	srv.mu.Unlock()
+
+	line, err := json.Marshal(record)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(srv.recordsPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, srv.fileMode); err == nil {
+			_, err = f.Write(append(line, '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		srv.logger.Logf("Couldn't save the record of %s: %v", record.Name, err)
+	}
+}
+
+// sendRecord answers a request for the record of name.
+func (srv *server) sendRecord(enc Encoder, name string) error {
+	srv.mu.Lock()
+	record, ok := srv.records[name]
+	srv.mu.Unlock()
+
+	msg := recordMessage{Version: protocolVersion}
+	if ok {
+		msg.Record = &record
+	}
+	return enc.Encode(msg)
+}
+
+// LastReceivedRemote asks the server at the other end of dialer when it last
+// received the file sent as name in full, using the handshake and codec in
+// opts. It returns nil if the server has no record of the file, as one
+// without a ReceivedIndex never does. It makes a single attempt.
+func LastReceivedRemote(dialer Dialer, name string, opts *SendOptions) (*ReceiveRecord, error) {
+	conn, err := dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	conn = withIdleTimeout(conn, opts.idleTimeout())
+	defer conn.Close()
+
+	if err := handshake(conn, opts); err != nil {
+		return nil, err
+	}
+
+	codec := opts.codec()
+	enc, dec := codec.NewEncoder(conn), codec.NewDecoder(conn)
+	startMsg := startMessage{Version: protocolVersion, Capabilities: capRecord, RecordOf: name}
+	if err := enc.Encode(startMsg); err != nil {
+		return nil, err
+	}
+
+	var msg recordMessage
+	if err := dec.Decode(&msg); err != nil {
+		return nil, err
+	}
+	switch msg.ErrType {
+	case ErrSuccess:
+	case ErrEmptyFilename:
+		return nil, ErrUnsupportedFeature
+	default:
+		return nil, msg.ErrType
+	}
+	if !compatibleVersion(msg.Version) {
+		return nil, ErrUnsupportedVersion
+	}
+	return msg.Record, nil
+}
+
+// LastReceived asks the server at hostport when it last received the file
+// sent as name in full. See LastReceivedRemote.
+func LastReceived(name, hostport string) (*ReceiveRecord, error) {
+	return LastReceivedRemote(netDialer{"tcp", hostport}, name, nil)
+}
@@ -0,0 +1,137 @@
+package rtransfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestLastReceived(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	index := path.Join(dpath, "received")
+	fpath := path.Join(dpath, "file")
+	const size = 10*payloadSize + 3
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	contents, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", fpath, err)
+	}
+	hash := sha256.Sum256(contents)
+
+	var srv Server
+	startServer := func() {
+		listener, err := net.Listen("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+		}
+		srv = NewServerWithOptions(listener, serverDir, &ServerOptions{
+			ReceivedIndex: index,
+			PathFunc: func(name string, recvTime time.Time) string {
+				return path.Join("incoming", name)
+			},
+		})
+		go srv.Serve(newLogRecvNotifierFactory(t))
+	}
+	startServer()
+	defer func() { srv.Stop() }()
+
+	if record, err := LastReceived("file", testSrvHostport); err != nil || record != nil {
+		t.Errorf("Record of a file never sent is %+v, %v, want none", record, err)
+	}
+
+	before := time.Now()
+	if _, err := SendWithResult(context.Background(), netDialer{"tcp", testSrvHostport}, fpath, nil, nil); err != nil {
+		t.Fatalf("Error while sending %s: %v", fpath, err)
+	}
+
+	// The server remembers the file, and so does one that takes over
+	// from it.
+	check := func(who string) {
+		record, err := LastReceived("file", testSrvHostport)
+		if err != nil || record == nil {
+			t.Fatalf("%s has no record of the file: %v", who, err)
+		}
+		if record.Name != "file" || record.StoredPath != "incoming/file" || record.Size != size {
+			t.Errorf("%s has the record %+v, want file stored as incoming/file with %d bytes", who, record, size)
+		}
+		if !bytes.Equal(record.Hash, hash[:]) {
+			t.Errorf("%s has the hash %x, want %x", who, record.Hash, hash)
+		}
+		if record.Completed.Before(before) || record.Completed.After(time.Now()) {
+			t.Errorf("%s has the file completed at %v, not during the send", who, record.Completed)
+		}
+	}
+	check("Server")
+
+	// The index gets a line for each file received. A server that finds
+	// a record replaced, or one cut short, writes it over with the
+	// records it kept.
+	data, err := os.ReadFile(index)
+	if err != nil {
+		t.Fatalf("Couldn't read the index: %v", err)
+	}
+	if n := bytes.Count(data, []byte("\n")); n != 1 {
+		t.Errorf("Index has %d lines after one file, want 1", n)
+	}
+	data = append(append(data, data...), `{"Name":"fi`...)
+	if err := os.WriteFile(index, data, 0644); err != nil {
+		t.Fatalf("Couldn't write the index: %v", err)
+	}
+
+	srv.Stop()
+	startServer()
+	check("Restarted server")
+	if data, err := os.ReadFile(index); err != nil || bytes.Count(data, []byte("\n")) != 1 {
+		t.Errorf("Restarted server left the index as %q (%v), want one line", data, err)
+	}
+}
+
+func TestLastReceivedNoIndex(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, path.Join(dpath, "server"))
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// A server without a ReceivedIndex keeps no records.
+	if err := Send(netDialer{"tcp", testSrvHostport}, fpath, nil); err != nil {
+		t.Fatalf("Error while sending %s: %v", fpath, err)
+	}
+	if record, err := LastReceived("file", testSrvHostport); err != nil || record != nil {
+		t.Errorf("Server without an index has the record %+v, %v, want none", record, err)
+	}
+	s := srv.(*server)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.records) != 0 {
+		t.Errorf("Server without an index holds %d records", len(s.records))
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package rtransfer
+
+import (
+	"syscall"
+)
+
+// errCrossDevice is what renaming a file onto another filesystem fails with.
+const errCrossDevice = syscall.EXDEV
@@ -0,0 +1,9 @@
+package rtransfer
+
+import (
+	"syscall"
+)
+
+// errCrossDevice is what renaming a file onto another volume fails with,
+// ERROR_NOT_SAME_DEVICE.
+const errCrossDevice = syscall.Errno(17)
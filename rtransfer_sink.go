@@ -0,0 +1,119 @@
+package rtransfer
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// blockSink passes the blocks of a file on to the writer ServerOptions.Sink
+// returned for it, in order, taking them as a runningHash does: as they are
+// written, when they are next, and from the file once the blocks before them
+// are in, when they came early. Positions are in the file, whose blocks
+// start at offset. A nil blockSink takes nothing.
+type blockSink struct {
+	mu     sync.Mutex
+	w      io.WriteCloser
+	offset int64
+	pos    int64
+	err    error
+	closed bool
+}
+
+func newBlockSink(w io.WriteCloser, offset int64) *blockSink {
+	return &blockSink{w: w, offset: offset, pos: offset}
+}
+
+func (s *blockSink) add(pos int64, data []byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pos == s.pos && s.err == nil {
+		_, s.err = s.w.Write(data)
+		s.pos += int64(len(data))
+	}
+}
+
+// Write passes data on after what the sink has been given, for a file that
+// arrives in order. It leaves the writer's errors for close to return.
+func (s *blockSink) Write(data []byte) (int, error) {
+	s.add(s.passed(), data)
+	return len(data), nil
+}
+
+// catchUp reads what it hasn't passed on of the first end bytes of the file
+// from r.
+func (s *blockSink) catchUp(r io.ReaderAt, end int64) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if end <= s.pos || s.err != nil {
+		return s.err
+	}
+	n, err := io.Copy(s.w, io.NewSectionReader(r, s.pos, end-s.pos))
+	s.pos += n
+	s.err = err
+	return err
+}
+
+// passed returns how far into the file the sink has been given.
+func (s *blockSink) passed() int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pos
+}
+
+// close closes the writer, returning an error if it failed to take any of
+// the blocks, or didn't get all size of them, where size is the number of
+// bytes the transfer carries.
+func (s *blockSink) close(size int64) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return s.err
+	}
+	s.closed = true
+	err := s.w.Close()
+	switch {
+	case s.err != nil:
+		return s.err
+	case s.pos-s.offset != size:
+		return fmt.Errorf("Sink took %d of %d bytes", s.pos-s.offset, size)
+	}
+	return err
+}
+
+// abort closes the writer with err, for a file that won't arrive whole, so
+// that whatever reads what the writer is given doesn't take it for the file.
+// A writer with a CloseWithError method, as an io.PipeWriter has, is closed
+// with that, and any other is closed as it would be once the file is in.
+// The sink takes nothing more, and close returns err.
+func (s *blockSink) abort(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.err == nil {
+		s.err = err
+	}
+	if w, ok := s.w.(interface{ CloseWithError(error) error }); ok {
+		w.CloseWithError(s.err)
+	} else {
+		s.w.Close()
+	}
+}
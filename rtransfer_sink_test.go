@@ -0,0 +1,305 @@
+package rtransfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// memSink keeps what ServerOptions.Sink is given of each file in memory.
+// A writer closed with an error records it in aborted.
+type memSink struct {
+	mu      sync.Mutex
+	files   map[string]*bytes.Buffer
+	sizes   map[string]int64
+	closed  map[string]bool
+	aborted map[string]error
+}
+
+func newMemSink() *memSink {
+	return &memSink{
+		files:   make(map[string]*bytes.Buffer),
+		sizes:   make(map[string]int64),
+		closed:  make(map[string]bool),
+		aborted: make(map[string]error),
+	}
+}
+
+func (s *memSink) open(name string, size int64) (io.WriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = &bytes.Buffer{}
+	s.sizes[name] = size
+	return &memSinkWriter{s, name}, nil
+}
+
+// contents returns what the sink was given of name, once its writer is
+// closed.
+func (s *memSink) contents(name string) ([]byte, int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed[name] {
+		return nil, 0, false
+	}
+	return s.files[name].Bytes(), s.sizes[name], true
+}
+
+type memSinkWriter struct {
+	sink *memSink
+	name string
+}
+
+func (w *memSinkWriter) Write(p []byte) (int, error) {
+	w.sink.mu.Lock()
+	defer w.sink.mu.Unlock()
+	if w.sink.closed[w.name] {
+		return 0, fmt.Errorf("%s written after it was closed", w.name)
+	}
+	return w.sink.files[w.name].Write(p)
+}
+
+func (w *memSinkWriter) Close() error {
+	w.sink.mu.Lock()
+	defer w.sink.mu.Unlock()
+	w.sink.closed[w.name] = true
+	return nil
+}
+
+func (w *memSinkWriter) CloseWithError(err error) error {
+	w.sink.mu.Lock()
+	defer w.sink.mu.Unlock()
+	w.sink.closed[w.name] = true
+	w.sink.aborted[w.name] = err
+	return nil
+}
+
+// abortedWith returns the error the writer of name was closed with, waiting
+// a while for it, or nil if it wasn't.
+func (s *memSink) abortedWith(name string) error {
+	var err error
+	waitFor(5*time.Second, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		err = s.aborted[name]
+		return err != nil
+	})
+	return err
+}
+
+// failingReader returns err once it has read all of data.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestSink(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+
+	sink := newMemSink()
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{Sink: sink.open})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// However the blocks arrive, the sink gets them in order, and the file
+	// is stored as well.
+	for i, tc := range []struct {
+		size  int64
+		opts  SendOptions
+		lossy bool
+	}{
+		{20*payloadSize + 7, SendOptions{}, false},
+		{0, SendOptions{}, false},
+		{20*payloadSize + 7, SendOptions{Parallelism: 4}, false},
+		{20*payloadSize + 7, SendOptions{}, true},
+	} {
+		name := fmt.Sprintf("file%d", i)
+		fpath := path.Join(clientDir, name)
+		if err := testutil.GenRandFile(fpath, tc.size); err != nil {
+			t.Fatalf("Couldn't create random file: %v", err)
+		}
+		var dialer Dialer = netDialer{"tcp", testSrvHostport}
+		if tc.lossy {
+			dialer = &lossyDialer{hostport: testSrvHostport, limit: 4 * payloadSize}
+		}
+		if _, err := SendWithResult(context.Background(), dialer, fpath, &logSendNotifier{t}, &tc.opts); err != nil {
+			t.Fatalf("Error while sending %s: %v", fpath, err)
+		}
+
+		want, err := os.ReadFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't read %s: %v", fpath, err)
+		}
+		got, size, ok := sink.contents(name)
+		if !ok || size != tc.size || !bytes.Equal(got, want) {
+			t.Errorf("Sink got %d bytes of %s, closed %v, told %d bytes, want the %d sent",
+				len(got), name, ok, size, len(want))
+		}
+		if stored, err := os.ReadFile(path.Join(serverDir, name)); err != nil || !bytes.Equal(stored, want) {
+			t.Errorf("The server doesn't have %s as it was sent (%v)", name, err)
+		}
+	}
+
+	// A stream is passed on as it arrives.
+	stream := bytes.Repeat([]byte("streamed "), 3*payloadSize/9+5)
+	if err := SendStream(netDialer{"tcp", testSrvHostport}, "stream", bytes.NewReader(stream), &logSendNotifier{t}); err != nil {
+		t.Fatalf("Error while streaming: %v", err)
+	}
+	waitFor(5*time.Second, func() bool {
+		_, _, ok := sink.contents("stream")
+		return ok
+	})
+	if got, size, ok := sink.contents("stream"); !ok || size != UnknownSize || !bytes.Equal(got, stream) {
+		t.Errorf("Sink got %d bytes of the stream, closed %v, told %d bytes, want %d", len(got), ok, size, len(stream))
+	}
+}
+
+func TestSinkOutOfOrder(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	sink := newMemSink()
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, dpath, &ServerOptions{Sink: sink.open})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	data := make([]byte, 4*payloadSize)
+	for i := range data {
+		data[i] = byte(i / payloadSize)
+	}
+	hash := sha256.Sum256(data)
+
+	conn, err := net.Dial("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("Couldn't connect to the server: %v", err)
+	}
+	defer conn.Close()
+	enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+	startMsg := startMessage{Version: protocolVersion, Name: "shuffled", Size: int64(len(data)), Hash: hash[:]}
+	if err := enc.Encode(startMsg); err != nil {
+		t.Fatalf("Couldn't send the start message: %v", err)
+	}
+	var ack ackMessage
+	if err := dec.Decode(&ack); err != nil || ack.ErrType != ErrSuccess {
+		t.Fatalf("Server didn't take the file: %v, %v", err, ack.ErrType)
+	}
+
+	// Nothing reaches the sink until the first block is in, and then
+	// everything does.
+	for _, seqNum := range []int64{2, 3, 0, 1} {
+		block := data[getFilePos(seqNum) : getFilePos(seqNum)+payloadSize]
+		if err := enc.Encode(dataMessage{SeqNum: seqNum, Data: block}); err != nil {
+			t.Fatalf("Couldn't send block %d: %v", seqNum, err)
+		}
+		var dataAck dataAckMessage
+		if err := dec.Decode(&dataAck); err != nil || dataAck.SeqNum != seqNum {
+			t.Fatalf("Server acked block %d as %d: %v", seqNum, dataAck.SeqNum, err)
+		}
+
+		sink.mu.Lock()
+		n := sink.files["shuffled"].Len()
+		sink.mu.Unlock()
+		if seqNum == 3 && n != 0 {
+			t.Errorf("Sink got %d bytes before the first block arrived", n)
+		}
+	}
+
+	waitFor(5*time.Second, func() bool {
+		_, _, ok := sink.contents("shuffled")
+		return ok
+	})
+	if got, _, ok := sink.contents("shuffled"); !ok || !bytes.Equal(got, data) {
+		t.Errorf("Sink got the blocks out of order, or wasn't closed")
+	}
+}
+
+func TestSinkAbort(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	sink := newMemSink()
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{
+		Sink:          sink.open,
+		QuarantineDir: path.Join(dpath, "quarantine"),
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// A dry run doesn't reach the sink.
+	fpath := path.Join(dpath, "verified")
+	if err := testutil.GenRandFile(fpath, payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	if err := Verify(netDialer{"tcp", testSrvHostport}, fpath, nil); err != nil {
+		t.Fatalf("Verifying %s returned %v", fpath, err)
+	}
+	sink.mu.Lock()
+	_, opened := sink.files["verified"]
+	sink.mu.Unlock()
+	if opened {
+		t.Errorf("Verifying %s opened a writer for it", fpath)
+	}
+
+	// A file that arrives corrupt, and a stream that fails, close their
+	// writers with the error.
+	sendCorrupt(t, testSrvHostport, "corrupt", []byte("not what the hash says"))
+	if err := sink.abortedWith("corrupt"); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("Writer of a corrupt file was closed with %v, want %v", err, ErrHashMismatch)
+	}
+
+	r := &failingReader{data: make([]byte, 3*payloadSize), err: errors.New("command failed")}
+	if err := SendStream(netDialer{"tcp", testSrvHostport}, "stream", r, &logSendNotifier{t}); err == nil {
+		t.Fatalf("Streaming from a reader that fails succeeded")
+	}
+	if err := sink.abortedWith("stream"); err == nil {
+		t.Errorf("Writer of a failed stream wasn't closed with an error")
+	}
+}
@@ -0,0 +1,12 @@
+package rtransfer
+
+import (
+	"errors"
+)
+
+// errFreeSpaceUnknown is returned by diskFree on systems where it can't tell.
+var errFreeSpaceUnknown = errors.New("free space is unknown on this system")
+
+// freeSpace returns how many bytes can still be written to the filesystem
+// holding dir. It is a variable so tests can pretend the disk is full.
+var freeSpace = diskFree
@@ -0,0 +1,143 @@
+package rtransfer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// limitTest sends size bytes to a server created with opts and returns the
+// result, checking that nothing was stored if the send failed.
+func limitTest(t *testing.T, opts *ServerOptions, size int) error {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, dpath, opts)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	data := bytes.Repeat([]byte{'x'}, size)
+	err = SendReader(newTestDialer(testSrvHostport), "limited", int64(size), bytes.NewReader(data), nil)
+
+	if err != nil {
+		for _, name := range []string{"limited", "limited" + partSuffix} {
+			if fileExists(path.Join(dpath, name)) {
+				t.Errorf("Server created %s for a rejected file", name)
+			}
+		}
+	}
+	return err
+}
+
+func TestMaxFileSize(t *testing.T) {
+	opts := &ServerOptions{MaxFileSize: 2 * payloadSize}
+
+	if err := limitTest(t, opts, 2*payloadSize); err != nil {
+		t.Errorf("Sending a file at the limit returned %v", err)
+	}
+	if err := limitTest(t, opts, 2*payloadSize+1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Sending a file over the limit returned %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestNoSpace(t *testing.T) {
+	defer func(orig func(string) (int64, error)) { freeSpace = orig }(freeSpace)
+	freeSpace = func(dir string) (int64, error) {
+		return 3 * payloadSize, nil
+	}
+
+	if err := limitTest(t, nil, 3*payloadSize); err != nil {
+		t.Errorf("Sending a file that fits returned %v", err)
+	}
+	if err := limitTest(t, nil, 3*payloadSize+1); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Sending a file that doesn't fit returned %v, want %v", err, ErrNoSpace)
+	}
+}
+
+func TestDiskFree(t *testing.T) {
+	free, err := diskFree(os.TempDir())
+	if err == errFreeSpaceUnknown {
+		t.Skip("free space is unknown on this system")
+	}
+	if err != nil {
+		t.Fatalf("Couldn't check free space: %v", err)
+	}
+	if free <= 0 {
+		t.Errorf("Temp directory has %d bytes free", free)
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+
+	const size = 10*payloadSize + 100
+	fpath := path.Join(dpath, "prealloc")
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create random file: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{Preallocate: true})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	notifier := &stallSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		stallAfter:      1,
+		stalled:         make(chan bool),
+		release:         make(chan bool),
+	}
+	sent := make(chan error)
+	go func() {
+		sent <- Send(newTestDialer(testSrvHostport), fpath, notifier)
+	}()
+	<-notifier.stalled
+
+	info, err := os.Stat(path.Join(serverDir, "prealloc"+partSuffix))
+	if err != nil {
+		t.Errorf("Couldn't stat the partial file: %v", err)
+	} else if info.Size() != size {
+		t.Errorf("Partial file has %d bytes after one block, want %d", info.Size(), size)
+	}
+
+	close(notifier.release)
+	if err := <-sent; err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash %s: %v", fpath, err)
+	}
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "prealloc"))
+	if err != nil {
+		t.Fatalf("Couldn't hash the received file: %v", err)
+	}
+	if srcHash != dstHash {
+		t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+	}
+}
@@ -0,0 +1,227 @@
+package rtransfer
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// blockRun is the run of blocks [First, End) of a file.
+type blockRun struct {
+	First int64
+	End   int64
+}
+
+// blocksSuffix is appended to the name of the file in which the server
+// records which blocks of a partial file it has, beside the partial file.
+const blocksSuffix = ".rtblocks"
+
+// blockRecord is what the server records about a partial file: the file, and
+// the blocks of it it has, in order. For an append, which writes to the file
+// itself, Offset is where the append started, and there are no Runs.
+type blockRecord struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Runs    []blockRun
+	Offset  int64
+}
+
+// blocksPath returns where the server records which blocks of the file stored
+// at fpath it has while the file arrives.
+func (srv *server) blocksPath(fpath string) string {
+	return strings.TrimSuffix(srv.partPath(fpath), partSuffix) + blocksSuffix
+}
+
+// aheadRuns returns the blocks of the range that came early, in order.
+func (r *blockRange) aheadRuns() []blockRun {
+	seqNums := make([]int64, 0, len(r.ahead))
+	for seqNum := range r.ahead {
+		seqNums = append(seqNums, seqNum)
+	}
+	sort.Slice(seqNums, func(i, j int) bool { return seqNums[i] < seqNums[j] })
+
+	var runs []blockRun
+	for _, seqNum := range seqNums {
+		if n := len(runs); n > 0 && runs[n-1].End == seqNum {
+			runs[n-1].End++
+		} else {
+			runs = append(runs, blockRun{seqNum, seqNum + 1})
+		}
+	}
+	return runs
+}
+
+// adopt takes runs as blocks the range already has, moving next past the
+// ones at the front and keeping the rest as having come early. It returns how
+// many blocks next moved by.
+func (r *blockRange) adopt(runs []blockRun) int64 {
+	start := r.next
+	for _, run := range runs {
+		for seqNum := run.First; seqNum < run.End; seqNum++ {
+			if seqNum < r.next || seqNum >= r.end {
+				continue
+			}
+			if r.ahead == nil {
+				r.ahead = make(map[int64]bool)
+			}
+			r.ahead[seqNum] = true
+		}
+	}
+	for ; r.ahead[r.next]; r.next++ {
+		delete(r.ahead, r.next)
+	}
+	return r.next - start
+}
+
+// hashRuns returns the SHA-256 of runs of blocks of the size bytes in r, one
+// after another.
+func hashRuns(r io.ReadSeeker, runs []blockRun, size int64) ([]byte, error) {
+	h := sha256.New()
+	for _, run := range runs {
+		start, stop := getFilePos(run.First), getFilePos(run.End)
+		if stop > size {
+			stop = size
+		}
+		if start >= stop {
+			continue
+		}
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(h, r, stop-start); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// checkCommitted returns an error unless runs are in order, apart, and all
+// after seqNum and before end, as an ack's Committed must be.
+func checkCommitted(runs []blockRun, seqNum, end int64) error {
+	prev := seqNum
+	for _, run := range runs {
+		if run.First <= prev || run.End <= run.First || run.End > end {
+			return fmt.Errorf("%w: Server says it has blocks [%d, %d), out of order or outside of (%d, %d)",
+				ErrProtocol, run.First, run.End, seqNum, end)
+		}
+		prev = run.End
+	}
+	return nil
+}
+
+// recordsBlocks reports whether the server records the blocks it has of tr,
+// which only a whole file arriving in the archive directory can pick up
+// again.
+func (srv *server) recordsBlocks(tr *transfer, rng *blockRange) bool {
+	return srv.store == nil && tr.offset == 0 && rng.first == 0 && rng.end == getNumBlocks(tr.size)
+}
+
+// saveBlocks records the blocks the server has of tr, the file the client
+// calls name, in a way that leaves either the old record or the new one if
+// the process dies.
+func (srv *server) saveBlocks(tr *transfer, rng *blockRange, name string) error {
+	tr.mu.Lock()
+	record := blockRecord{Name: name, Size: tr.size, ModTime: tr.modTime}
+	if rng.next > rng.first {
+		record.Runs = append(record.Runs, blockRun{rng.first, rng.next})
+	}
+	record.Runs = append(record.Runs, rng.aheadRuns()...)
+	tr.mu.Unlock()
+
+	return srv.writeBlocks(tr.path, record)
+}
+
+// writeBlocks writes record as the record of the file stored at fpath.
+func (srv *server) writeBlocks(fpath string, record blockRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	blocksPath := srv.blocksPath(fpath)
+	tmp := blocksPath + ".tmp"
+	if err := os.WriteFile(tmp, data, srv.fileMode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, blocksPath)
+}
+
+// markAppend records that an append of the file startMsg describes to the
+// file stored at fpath is under way, until removeBlocks, so that one cut
+// short can be picked up.
+func (srv *server) markAppend(fpath string, startMsg startMessage) error {
+	return srv.writeBlocks(fpath, blockRecord{
+		Name:    startMsg.Name,
+		Size:    startMsg.Size,
+		ModTime: startMsg.ModTime,
+		Offset:  startMsg.AppendFrom,
+	})
+}
+
+// appended returns how many whole blocks of the append startMsg describes
+// the file stored at fpath, which has size bytes, already has from an append
+// from the same offset that was cut short. It reports false if the file
+// isn't longer than the offset because of one. The client checks the blocks
+// before going on.
+func (srv *server) appended(fpath string, startMsg startMessage, size int64) (int64, bool) {
+	data, err := os.ReadFile(srv.blocksPath(fpath))
+	if err != nil {
+		return 0, false
+	}
+	var record blockRecord
+	if err := json.Unmarshal(data, &record); err != nil || record.Name != startMsg.Name ||
+		record.Offset != startMsg.AppendFrom || size < startMsg.AppendFrom || size > startMsg.Size {
+		return 0, false
+	}
+	return (size - startMsg.AppendFrom) / payloadSize, true
+}
+
+// loadBlocks returns the blocks an earlier server recorded having of the file
+// startMsg describes, stored at fpath, or nil if it recorded none, or none of
+// that file.
+func (srv *server) loadBlocks(fpath string, startMsg startMessage) []blockRun {
+	blocksPath := srv.blocksPath(fpath)
+	data, err := os.ReadFile(blocksPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		srv.logger.Logf("Couldn't read %s: %v", blocksPath, err)
+		return nil
+	}
+
+	var record blockRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		srv.logger.Logf("Couldn't read %s: %v", blocksPath, err)
+		return nil
+	}
+	if record.Name != startMsg.Name || record.Size != startMsg.Size || !record.ModTime.Equal(startMsg.ModTime) ||
+		record.Offset != 0 || len(record.Runs) == 0 || checkCommitted(record.Runs, -1, getNumBlocks(startMsg.Size)) != nil {
+		return nil
+	}
+
+	// The partial file must reach the last of the blocks.
+	need := getFilePos(record.Runs[len(record.Runs)-1].End)
+	if need > startMsg.Size {
+		need = startMsg.Size
+	}
+	info, err := os.Stat(srv.partPath(fpath))
+	if err != nil || info.Size() < need {
+		return nil
+	}
+	return record.Runs
+}
+
+// removeBlocks removes the record of the blocks the server has of the file
+// stored at fpath, if there is one.
+func (srv *server) removeBlocks(fpath string) {
+	blocksPath := srv.blocksPath(fpath)
+	if err := os.Remove(blocksPath); err != nil && !os.IsNotExist(err) {
+		srv.logger.Logf("Couldn't remove %s: %v", blocksPath, err)
+	}
+}
@@ -0,0 +1,137 @@
+package rtransfer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestSparseResume(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	const numBlocks = 16
+	contents := make([]byte, numBlocks*payloadSize-5)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatalf("Couldn't generate contents: %v", err)
+	}
+
+	var srv Server
+	startServer := func() {
+		listener, err := net.Listen("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+		}
+		srv = NewServer(listener, serverDir)
+		go srv.Serve(newLogRecvNotifierFactory(t))
+	}
+	startServer()
+	defer func() { srv.Stop() }()
+
+	// commit writes the contents to name and sends the server blocks
+	// [0, 4) and [8, 12) of it, then drops the connection.
+	commit := func(name string) {
+		fpath := path.Join(dpath, name)
+		if err := os.WriteFile(fpath, contents, 0644); err != nil {
+			t.Fatalf("Couldn't write %s: %v", fpath, err)
+		}
+		info, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't stat %s: %v", fpath, err)
+		}
+
+		conn, err := net.Dial("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("Couldn't connect to the server: %v", err)
+		}
+		defer conn.Close()
+		enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+
+		startMsg := startMessage{
+			Version: protocolVersion,
+			Name:    name,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if err := enc.Encode(startMsg); err != nil {
+			t.Fatalf("Couldn't send the start message: %v", err)
+		}
+		var ack ackMessage
+		if err := dec.Decode(&ack); err != nil || ack.err() != nil {
+			t.Fatalf("Server didn't take %s: %v, %v", name, err, ack.err())
+		}
+
+		for _, run := range []blockRun{{0, 4}, {8, 12}} {
+			for seqNum := run.First; seqNum < run.End; seqNum++ {
+				data := contents[getFilePos(seqNum):getFilePos(seqNum+1)]
+				if err := enc.Encode(dataMessage{SeqNum: seqNum, Data: data}); err != nil {
+					t.Fatalf("Couldn't send block %d: %v", seqNum, err)
+				}
+				var dataAckMsg dataAckMessage
+				if err := dec.Decode(&dataAckMsg); err != nil {
+					t.Fatalf("Server didn't ack block %d: %v", seqNum, err)
+				}
+			}
+		}
+	}
+
+	// resume sends name, and checks that the server ends up with it after
+	// want blocks.
+	resume := func(name string, want int64) {
+		stats, err := SendContext(context.Background(), newTestDialer(testSrvHostport), path.Join(dpath, name), nil, nil)
+		if err != nil {
+			t.Fatalf("Error while sending %s: %v", name, err)
+		}
+		if stats.Blocks != want {
+			t.Errorf("Sending %s took %d blocks, want %d", name, stats.Blocks, want)
+		}
+		got, err := os.ReadFile(path.Join(serverDir, name))
+		if err != nil || string(got) != string(contents) {
+			t.Errorf("The server's %s doesn't have the contents it was sent (%v)", name, err)
+		}
+		if fileExists(path.Join(serverDir, name+blocksSuffix)) {
+			t.Errorf("The server's record of the blocks of %s was left behind", name)
+		}
+	}
+
+	// The same server fills in the gaps.
+	commit("gaps")
+	resume("gaps", 8)
+
+	// So does a new one, from its predecessor's record.
+	commit("restart")
+	if !waitFor(5*time.Second, func() bool { return fileExists(path.Join(serverDir, "restart"+blocksSuffix)) }) {
+		t.Fatalf("Server didn't record the blocks it has of restart")
+	}
+	srv.Stop()
+	startServer()
+	resume("restart", 8)
+
+	// A block the record is wrong about is caught, and the file sent again.
+	commit("corrupt")
+	if !waitFor(5*time.Second, func() bool { return fileExists(path.Join(serverDir, "corrupt"+blocksSuffix)) }) {
+		t.Fatalf("Server didn't record the blocks it has of corrupt")
+	}
+	srv.Stop()
+	f, err := os.OpenFile(path.Join(serverDir, "corrupt"+partSuffix), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Couldn't open the partial file: %v", err)
+	}
+	if _, err := f.WriteAt(make([]byte, 10), getFilePos(9)); err != nil {
+		t.Fatalf("Couldn't corrupt the partial file: %v", err)
+	}
+	f.Close()
+	startServer()
+	resume("corrupt", numBlocks)
+}
@@ -0,0 +1,111 @@
+package rtransfer
+
+import (
+	"fmt"
+	"time"
+)
+
+// Stats describes a transfer once it has finished.
+type Stats struct {
+	// Bytes and Blocks count the file data that crossed the wire, including
+	// blocks that had to be sent again. Bytes is counted after compression.
+	Bytes  int64
+	Blocks int64
+
+	// Retransmissions counts blocks sent more than once because the first
+	// try was lost with a connection, and MaxBlockRetransmissions the most
+	// times any one block was.
+	Retransmissions         int64
+	MaxBlockRetransmissions int64
+
+	// Reconnects counts the connections made after the first one.
+	Reconnects int
+
+	// LastFailure is the kind of the last failure of an attempt, whether
+	// the send went on after it or not, or FailureNone if there was none.
+	LastFailure FailureKind
+
+	// Elapsed runs from the first connection attempt to the end of the
+	// transfer.
+	Elapsed time.Duration
+}
+
+// Throughput returns the average rate of the transfer in bytes per second.
+func (s Stats) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+// sendStats accumulates the Stats of one send across its attempts. A nil
+// *sendStats ignores everything.
+type sendStats struct {
+	Stats
+
+	// sentUpTo is one past the highest block sent so far. A block below it
+	// that is sent again is a retransmission.
+	sentUpTo int64
+
+	// retransmits counts the times each block below sentUpTo has been sent
+	// again, and maxRetransmits is the most allowed, if positive.
+	retransmits    map[int64]int64
+	maxRetransmits int
+
+	// result is the server's description of the stored file, if it was
+	// asked for one.
+	result resultMessage
+}
+
+// failed records that an attempt failed with err, if it did, and returns the
+// kind of failure it was.
+func (st *sendStats) failed(err error) FailureKind {
+	kind := classify(err)
+	if st != nil && kind != FailureNone {
+		st.LastFailure = kind
+	}
+	return kind
+}
+
+// resultReceived records the result message of an attempt, unless it is
+// from a range that didn't store the file.
+func (st *sendStats) resultReceived(result resultMessage) {
+	if st == nil || result.StoredPath == "" {
+		return
+	}
+	st.result = result
+}
+
+func (st *sendStats) blockSent(seqNum int64, numBytes int) {
+	if st == nil {
+		return
+	}
+
+	st.Bytes += int64(numBytes)
+	st.Blocks++
+	if seqNum < st.sentUpTo {
+		st.Retransmissions++
+		if st.retransmits == nil {
+			st.retransmits = make(map[int64]int64)
+		}
+		st.retransmits[seqNum]++
+		if n := st.retransmits[seqNum]; n > st.MaxBlockRetransmissions {
+			st.MaxBlockRetransmissions = n
+		}
+	} else {
+		st.sentUpTo = seqNum + 1
+	}
+}
+
+// mayResend returns ErrTooManyRetransmits, wrapped, if sending block seqNum
+// again would go over the limit.
+func (st *sendStats) mayResend(seqNum int64) error {
+	if st == nil || st.maxRetransmits <= 0 || seqNum >= st.sentUpTo {
+		return nil
+	}
+	if n := st.retransmits[seqNum]; n >= int64(st.maxRetransmits) {
+		return fmt.Errorf("%w: Block %d was sent again %d times without being acked",
+			ErrTooManyRetransmits, seqNum, n)
+	}
+	return nil
+}
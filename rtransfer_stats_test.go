@@ -0,0 +1,271 @@
+package rtransfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// lossyConn silently drops the write that takes it past limit bytes and
+// closes the connection, as if the link died with a block in flight.
+type lossyConn struct {
+	net.Conn
+	limit   int
+	written int
+}
+
+func (c *lossyConn) Write(p []byte) (int, error) {
+	c.written += len(p)
+	if c.written > c.limit {
+		c.Conn.Close()
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// lossyDialer hands out times lossyConns, or one if times is zero, and plain
+// connections after that.
+type lossyDialer struct {
+	hostport string
+	limit    int
+	times    int
+
+	mu    sync.Mutex
+	dials int
+}
+
+func (d *lossyDialer) Dial() (net.Conn, error) {
+	conn, err := net.Dial("tcp", d.hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dials >= d.times && d.dials > 0 {
+		return conn, nil
+	}
+	d.dials++
+	return &lossyConn{Conn: conn, limit: d.limit}, nil
+}
+
+func TestStats(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	const size = 10 * payloadSize
+	fpath := path.Join(clientDir, "measured")
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	srvStats := make(chan Stats, 1)
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{
+		StatsFunc: func(name string, stats Stats) {
+			srvStats <- stats
+		},
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := &lossyDialer{hostport: testSrvHostport, limit: 4 * payloadSize}
+	stats, err := SendContext(context.Background(), dialer, fpath, &logSendNotifier{t}, nil)
+	if err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	numBlocks := getNumBlocks(size)
+	if stats.Reconnects != 1 {
+		t.Errorf("Sender saw %d reconnects, want 1", stats.Reconnects)
+	}
+	if stats.Retransmissions < 1 {
+		t.Errorf("Sender counted no retransmissions after losing a block")
+	}
+	if stats.Blocks != numBlocks+stats.Retransmissions {
+		t.Errorf("Sender sent %d blocks with %d retransmissions, want %d in all",
+			stats.Blocks, stats.Retransmissions, numBlocks+stats.Retransmissions)
+	}
+	if stats.Bytes < size {
+		t.Errorf("Sender sent %d bytes, want at least %d", stats.Bytes, size)
+	}
+	if stats.Elapsed <= 0 || stats.Throughput() <= 0 {
+		t.Errorf("Sender reported elapsed %v and throughput %v", stats.Elapsed, stats.Throughput())
+	}
+
+	got := <-srvStats
+	if got.Blocks != numBlocks || got.Bytes != size {
+		t.Errorf("Server received %d blocks and %d bytes, want %d and %d",
+			got.Blocks, got.Bytes, numBlocks, size)
+	}
+	if got.Reconnects != 1 {
+		t.Errorf("Server saw %d reconnects, want 1", got.Reconnects)
+	}
+}
+
+func TestSendWithResultStats(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+
+	const size = 20*payloadSize + 3
+	fpath := path.Join(clientDir, "result")
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := &lossyDialer{hostport: testSrvHostport, limit: 4 * payloadSize, times: 3}
+	result, err := SendWithResult(context.Background(), dialer, fpath, &logSendNotifier{t}, nil)
+	if err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	if result.Stats.Reconnects != 3 {
+		t.Errorf("Sender saw %d reconnects, want 3", result.Stats.Reconnects)
+	}
+	if result.Stats.Bytes < size {
+		t.Errorf("Sender sent %d bytes, want at least %d", result.Stats.Bytes, size)
+	}
+	if result.Stats.Elapsed <= 0 {
+		t.Errorf("Sender reported elapsed %v", result.Stats.Elapsed)
+	}
+	if result.StoredPath != "result" {
+		t.Errorf("Result has StoredPath %q, want %q", result.StoredPath, "result")
+	}
+	if result.Bytes != size {
+		t.Errorf("Result has Bytes %d, want %d", result.Bytes, size)
+	}
+
+	data, err := os.ReadFile(path.Join(serverDir, result.StoredPath))
+	if err != nil {
+		t.Fatalf("Couldn't read the file at StoredPath: %v", err)
+	}
+	hash := sha256.Sum256(data)
+	if !bytes.Equal(result.Hash, hash[:]) {
+		t.Errorf("Result has Hash %x, want %x", result.Hash, hash)
+	}
+	if !result.Verified {
+		t.Errorf("Result wasn't verified against the sender's digest")
+	}
+}
+
+// badBlockConn garbles any write carrying block and closes the connection,
+// as a link that corrupts the block every time would end up doing.
+type badBlockConn struct {
+	net.Conn
+	block []byte
+}
+
+func (c *badBlockConn) Write(p []byte) (int, error) {
+	if bytes.Contains(p, c.block) {
+		garbled := make([]byte, len(p))
+		for i := range garbled {
+			garbled[i] = ^p[i]
+		}
+		c.Conn.Write(garbled)
+		c.Conn.Close()
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// badBlockDialer hands out badBlockConns.
+type badBlockDialer struct {
+	hostport string
+	block    []byte
+}
+
+func (d badBlockDialer) Dial() (net.Conn, error) {
+	conn, err := net.Dial("tcp", d.hostport)
+	if err != nil {
+		return nil, err
+	}
+	return &badBlockConn{Conn: conn, block: d.block}, nil
+}
+
+func TestMaxRetransmits(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	// Block 5 of the file is one the link can't carry.
+	data := make([]byte, 10*payloadSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Couldn't generate data: %v", err)
+	}
+	block := bytes.Repeat([]byte{0x5a}, payloadSize)
+	copy(data[getFilePos(5):], block)
+	fpath := path.Join(dpath, "unlucky")
+	if err := os.WriteFile(fpath, data, 0666); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, path.Join(dpath, "server"))
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	const maxRetransmits = 3
+	opts := &SendOptions{
+		MaxRetransmits: maxRetransmits,
+		Retry:          RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	}
+	dialer := badBlockDialer{testSrvHostport, block}
+	stats, err := SendContext(context.Background(), dialer, fpath, nil, opts)
+	if !errors.Is(err, ErrTooManyRetransmits) {
+		t.Fatalf("Sending over a link that corrupts a block returned %v, want %v", err, ErrTooManyRetransmits)
+	}
+
+	if stats.Retransmissions != maxRetransmits || stats.MaxBlockRetransmissions != maxRetransmits {
+		t.Errorf("Sender counted %d retransmissions, at most %d of one block, want %d of block 5",
+			stats.Retransmissions, stats.MaxBlockRetransmissions, maxRetransmits)
+	}
+	if stats.Reconnects != maxRetransmits+1 {
+		t.Errorf("Sender saw %d reconnects, want %d", stats.Reconnects, maxRetransmits+1)
+	}
+}
@@ -0,0 +1,95 @@
+package rtransfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// WriterAtCloser is a file being written to a Store.
+type WriterAtCloser interface {
+	io.WriterAt
+	io.Closer
+}
+
+// Store is somewhere other than a local directory for a server to keep the
+// files it receives, such as object storage. Names are slash-separated and
+// relative, as PathFunc returns them.
+//
+// A server with a Store receives files as it would into a directory, but
+// leaves out what only works on local files: deltas, appends, picking up a
+// partial file left by an earlier server, checking a resumed file's blocks,
+// preallocation, symbolic links, metadata and ListFiles. OverwriteIfDifferent
+// can't read the stored file to compare it, so it always replaces it.
+type Store interface {
+	// Create starts a file of size bytes called name, replacing any
+	// unfinished one. The size is UnknownSize for a stream. Its blocks are
+	// written in any order, by several goroutines at once for a parallel
+	// transfer, and it is closed before Finalize is called.
+	Create(name string, size int64) (WriterAtCloser, error)
+
+	// Exists reports whether the store holds a finished file called name.
+	Exists(name string) bool
+
+	// Finalize makes the file written through Create available as name.
+	Finalize(name string) error
+}
+
+// storeUnsupported is the capabilities a server with a Store doesn't have.
+const storeUnsupported = capDelta | capAppend | capSymlink | capDedup
+
+// blockFile is the file a connection writes a transfer's blocks to.
+type blockFile interface {
+	io.WriterAt
+	io.Closer
+}
+
+// sharedFile is a file in a Store as one of the transfer's connections sees
+// it. The transfer closes the file itself once it is complete.
+type sharedFile struct {
+	io.WriterAt
+}
+
+func (sharedFile) Close() error {
+	return nil
+}
+
+// offsetWriter writes to w from the start, one Write after another.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// storeUploadIn is storeUpload for a server with a Store.
+func (srv *server) storeUploadIn(body io.Reader, name, fpath string, size int64, want []byte) (int, error) {
+	w, err := srv.store.Create(fpath, size)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	h := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(&offsetWriter{w: w}, h), body, size)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if want != nil && !bytes.Equal(h.Sum(nil), want) {
+		return http.StatusBadRequest, fmt.Errorf("The contents of %s don't match X-Content-SHA256", name)
+	}
+
+	if err := srv.store.Finalize(fpath); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusCreated, nil
+}
@@ -0,0 +1,154 @@
+package rtransfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+// memStore is a Store that keeps files in memory.
+type memStore struct {
+	mu       sync.Mutex
+	pending  map[string]*memFile
+	finished map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		pending:  make(map[string]*memFile),
+		finished: make(map[string][]byte),
+	}
+}
+
+func (s *memStore) Create(name string, size int64) (WriterAtCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := &memFile{data: make([]byte, size)}
+	s.pending[name] = f
+	return f, nil
+}
+
+func (s *memStore) Exists(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.finished[name]
+	return ok
+}
+
+func (s *memStore) Finalize(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.pending[name]
+	if !ok {
+		return fmt.Errorf("No file %s to finalize", name)
+	}
+	delete(s.pending, name)
+	s.finished[name] = f.data
+	return nil
+}
+
+func (s *memStore) get(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.finished[name]
+	return data, ok
+}
+
+type memFile struct {
+	mu     sync.Mutex
+	data   []byte
+	closed bool
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, fmt.Errorf("Write to a closed file")
+	}
+	if off < 0 || off+int64(len(p)) > int64(len(f.data)) {
+		return 0, fmt.Errorf("Write of %d bytes at %d is past the end", len(p), off)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+	for _, name := range []string{"resumed", "parallel"} {
+		if err := testutil.GenRandFile(path.Join(clientDir, name), 10*payloadSize+100); err != nil {
+			t.Fatalf("Couldn't create random file: %v", err)
+		}
+	}
+
+	store := newMemStore()
+	archiveDir := path.Join(dpath, "server")
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, archiveDir, &ServerOptions{Store: store})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// One transfer is cut off partway and resumed, and the other is sent
+	// over several connections at once.
+	dialer := newTestDialer(testSrvHostport)
+	notifier := &midCrashSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		dialer:          dialer,
+		crashAfter:      4,
+	}
+	if err := Send(dialer, path.Join(clientDir, "resumed"), notifier); err != nil {
+		t.Fatalf("Error while sending resumed: %v", err)
+	}
+	opts := &SendOptions{Parallelism: 4}
+	parallelDialer := netDialer{"tcp", testSrvHostport}
+	if _, err := SendContext(context.Background(), parallelDialer, path.Join(clientDir, "parallel"), nil, opts); err != nil {
+		t.Fatalf("Error while sending parallel: %v", err)
+	}
+
+	for _, name := range []string{"resumed", "parallel"} {
+		want, err := os.ReadFile(path.Join(clientDir, name))
+		if err != nil {
+			t.Fatalf("Couldn't read %s: %v", name, err)
+		}
+		got, ok := store.get(name)
+		if !ok {
+			t.Errorf("%s wasn't finalized in the store", name)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("The store's copy of %s doesn't match what was sent", name)
+		}
+	}
+
+	if fileExists(archiveDir) {
+		t.Errorf("The server created its archive directory despite having a store")
+	}
+
+	if err := Send(dialer, path.Join(clientDir, "resumed"), nil); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Sending a file the store has returned %v, want %v", err, ErrAlreadyExists)
+	}
+}
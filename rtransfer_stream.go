@@ -0,0 +1,133 @@
+package rtransfer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// UnknownSize is the size of a file sent with SendStream, whose size isn't
+// known until it has all been sent. Notifiers following a stream get it as
+// the total.
+const UnknownSize = -1
+
+// SendStream sends what it reads from r, up to the end, to be stored as
+// name. It is for data whose size isn't known up front, such as the output
+// of a command: the blocks go out as they are read, and a last message marks
+// the end, once the server has stored the file.
+//
+// A stream can't be resumed, as what was read from r is gone once it is
+// sent. SendStream dials once and fails if the connection does, and the
+// server throws away what it had of the stream. A server too old to take
+// streams turns it down with ErrInvalidSize.
+func SendStream(dialer Dialer, name string, r io.Reader, notifier SendNotifier) error {
+	notifier = guardSendNotifier(notifier, orDefault(nil))
+	conn, err := dialer.Dial()
+	if err != nil {
+		return sendDone(notifier, err)
+	}
+	defer conn.Close()
+
+	if err := handshake(conn, nil); err != nil {
+		return sendDone(notifier, err)
+	}
+	return sendDone(notifier, sendStream(conn, GobCodec, name, r, notifier))
+}
+
+// sendStream sends the stream in r as name to the server on the other end of
+// conn, using codec.
+func sendStream(conn net.Conn, codec MessageCodec, name string, r io.Reader, notifier SendNotifier) error {
+	enc, dec := streams(conn, codec)
+
+	if notifier != nil {
+		notifier.SendStart()
+	}
+
+	startMsg := startMessage{
+		Version:      protocolVersion,
+		Capabilities: capStream,
+		Name:         name,
+		Size:         UnknownSize,
+	}
+	if err := enc.Encode(startMsg); err != nil {
+		return err
+	}
+
+	if notifier != nil {
+		notifier.RecvAck()
+	}
+
+	var ack ackMessage
+	if err := dec.Decode(&ack); err != nil {
+		return err
+	}
+	if err := ack.err(); err != nil {
+		return err
+	}
+	if !compatibleVersion(ack.Version) {
+		return ErrUnsupportedVersion
+	}
+	if ack.Capabilities&capStream == 0 {
+		return ErrUnsupportedFeature
+	}
+	if ack.SeqNum != 0 {
+		return fmt.Errorf("%w: Server asked to resume a stream at block %d", ErrProtocol, ack.SeqNum)
+	}
+
+	// Every block but the last is full, as for a file, so the server knows
+	// where each goes.
+	buf := make([]byte, payloadSize)
+	var numBytes int64
+	var dataAckMsg dataAckMessage
+	for seqNum := int64(0); ; seqNum++ {
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+
+		dataMsg := dataMessage{SeqNum: seqNum, Data: buf[:n]}
+		if n == 0 {
+			dataMsg = dataMessage{SeqNum: seqNum, End: true}
+		}
+		if err := enc.Encode(dataMsg); err != nil {
+			return err
+		}
+
+		dataAckMsg = dataAckMessage{}
+		if err := dec.Decode(&dataAckMsg); err != nil {
+			return err
+		}
+		if dataAckMsg.SeqNum != seqNum {
+			return fmt.Errorf(
+				"%w: Server acked a payload with a different sequence number, got %d, want %d",
+				ErrProtocol, dataAckMsg.SeqNum, seqNum)
+		}
+		if dataMsg.End {
+			return nil
+		}
+
+		numBytes += int64(n)
+		if notifier != nil {
+			notifier.UpdateProgress(numBytes, UnknownSize)
+		}
+	}
+}
+
+// dropStream forgets tr, the transfer of the stream called name, which
+// failed with err, and removes what was written of it, since it can't be
+// resumed.
+func (srv *server) dropStream(tr *transfer, name string, err error) {
+	srv.mu.Lock()
+	if srv.transfers[name] == tr {
+		delete(srv.transfers, name)
+	}
+	srv.mu.Unlock()
+
+	tr.sink.abort(err)
+	if srv.store != nil {
+		tr.w.Close()
+	} else if err := os.Remove(srv.partPath(tr.path)); err != nil && !os.IsNotExist(err) {
+		srv.logger.Logf("Couldn't remove the partial file of %s: %v", name, err)
+	}
+}
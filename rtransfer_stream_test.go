@@ -0,0 +1,84 @@
+package rtransfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestSendStream(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	const maxSize = 10 * payloadSize
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, dpath, &ServerOptions{MaxFileSize: maxSize})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// stream writes data into a pipe in uneven pieces, as a command would,
+	// so that its length can't be known until it ends.
+	stream := func(data []byte) io.Reader {
+		pr, pw := io.Pipe()
+		go func() {
+			for len(data) > 0 {
+				n := 1000
+				if n > len(data) {
+					n = len(data)
+				}
+				pw.Write(data[:n])
+				data = data[n:]
+			}
+			pw.Close()
+		}()
+		return pr
+	}
+
+	dialer := newTestDialer(testSrvHostport)
+	for _, size := range []int{0, 100, 3 * payloadSize, 5*payloadSize + 123} {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatalf("Couldn't generate data: %v", err)
+		}
+
+		name := fmt.Sprintf("stream%d", size)
+		if err := SendStream(dialer, name, stream(data), &logSendNotifier{t}); err != nil {
+			t.Fatalf("Error while streaming %d bytes: %v", size, err)
+		}
+
+		got, err := os.ReadFile(path.Join(dpath, name))
+		if err != nil {
+			t.Fatalf("Couldn't read streamed file: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Streamed file of %d bytes came out as %d different bytes", size, len(got))
+		}
+	}
+
+	// A stream that goes past the limit is cut off, and nothing is kept of
+	// it.
+	r := stream(make([]byte, maxSize+payloadSize))
+	err = SendStream(dialer, "toolong", r, nil)
+	r.(*io.PipeReader).Close()
+	if err == nil {
+		t.Errorf("Streaming past the size limit succeeded")
+	}
+	if !waitFor(time.Second, func() bool { return !fileExists(path.Join(dpath, "toolong"+partSuffix)) }) ||
+		fileExists(path.Join(dpath, "toolong")) {
+		t.Errorf("A stream cut off for its size left a file behind")
+	}
+}
@@ -0,0 +1,99 @@
+package rtransfer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// partPath returns where the file stored at fpath is kept while it arrives:
+// beside it, or in the TempDir. Files from all over the archive share the
+// TempDir, so a partial file there is named for the whole of fpath.
+func (srv *server) partPath(fpath string) string {
+	if srv.tempDir == "" {
+		return fpath + partSuffix
+	}
+	sum := sha256.Sum256([]byte(fpath))
+	return path.Join(srv.tempDir, fmt.Sprintf("%s.%x%s", path.Base(fpath), sum[:8], partSuffix))
+}
+
+// spacePath returns the path whose filesystem must have room for the file
+// stored at fpath while it arrives. An append writes to the file itself.
+func (srv *server) spacePath(fpath string, appending bool) string {
+	if appending {
+		return fpath
+	}
+	return srv.partPath(fpath)
+}
+
+// moveAcross moves the file at partPath to fpath, on another filesystem, by
+// copying it. The copy only appears at fpath once it is complete.
+func (srv *server) moveAcross(partPath, fpath string) error {
+	src, err := os.Open(partPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var unique [8]byte
+	if _, err := rand.Read(unique[:]); err != nil {
+		return err
+	}
+	copyPath := fmt.Sprintf("%s.%x%s", fpath, unique, partSuffix)
+	f, err := os.OpenFile(copyPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, srv.fileMode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(copyPath)
+
+	_, err = io.Copy(f, src)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(copyPath, fpath); err != nil {
+		return err
+	}
+	return os.Remove(partPath)
+}
+
+// listTemp adds to files the partial files in the TempDir of the transfers
+// in progress, given by the paths they will be stored at and their sizes.
+// Partial files left behind by an earlier server aren't listed, as there's
+// no telling where they belong.
+func (srv *server) listTemp(files []FileInfo, totals map[string]int64) ([]FileInfo, error) {
+	var partial []FileInfo
+	for fpath, total := range totals {
+		info, err := os.Stat(srv.partPath(fpath))
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(srv.archiveDir, fpath)
+		if err != nil {
+			return nil, err
+		}
+		// A Router may have put the file outside the archive directory.
+		if !isLocalName(filepath.ToSlash(rel)) {
+			continue
+		}
+		partial = append(partial, FileInfo{
+			Name:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			Partial: true,
+			Total:   total,
+		})
+	}
+	sort.Slice(partial, func(i, j int) bool { return partial[i].Name < partial[j].Name })
+	return append(files, partial...), nil
+}
@@ -0,0 +1,113 @@
+package rtransfer
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestTempDir(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "big")
+	const size = 10 * payloadSize
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	// /dev/shm is a filesystem of its own on most Linux systems.
+	crossDir, err := os.MkdirTemp("/dev/shm", "rtransfer")
+	if err != nil {
+		t.Logf("No other filesystem to try: %v", err)
+	} else {
+		defer os.RemoveAll(crossDir)
+		probe := path.Join(crossDir, "probe")
+		if err := os.WriteFile(probe, nil, 0644); err != nil {
+			t.Fatalf("Couldn't write %s: %v", probe, err)
+		}
+		if err := os.Rename(probe, path.Join(dpath, "probe")); err == nil {
+			t.Logf("%s is on the same filesystem as %s", crossDir, dpath)
+			crossDir = ""
+		}
+		os.Remove(probe)
+		os.Remove(path.Join(dpath, "probe"))
+	}
+
+	for _, tempDir := range []string{path.Join(dpath, "temp"), crossDir} {
+		if tempDir == "" {
+			continue
+		}
+		serverDir := path.Join(dpath, "server")
+		os.RemoveAll(serverDir)
+
+		listener, err := net.Listen("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+		}
+		srv := NewServerWithOptions(listener, serverDir, &ServerOptions{TempDir: tempDir})
+		go srv.Serve(newLogRecvNotifierFactory(t))
+
+		notifier := &stallSendNotifier{
+			logSendNotifier: logSendNotifier{t},
+			stallAfter:      4,
+			stalled:         make(chan bool),
+			release:         make(chan bool),
+		}
+		done := make(chan error, 1)
+		go func() {
+			_, err := SendContext(context.Background(), newTestDialer(testSrvHostport), fpath, notifier, nil)
+			done <- err
+		}()
+		<-notifier.stalled
+
+		// The partial file is in the TempDir, but is listed as if it were
+		// in the archive.
+		if fileExists(path.Join(serverDir, "big"+partSuffix)) {
+			t.Errorf("%s: Partial file was written to the archive directory", tempDir)
+		}
+		if entries, err := os.ReadDir(tempDir); err != nil || len(entries) != 1 {
+			t.Errorf("%s: TempDir holds %d files (%v), want the partial file", tempDir, len(entries), err)
+		}
+		files, err := srv.ListFiles()
+		want := []FileInfo{{Name: "big", Size: 4 * payloadSize, Partial: true, Total: size}}
+		if err != nil || !reflect.DeepEqual(files, want) {
+			t.Errorf("%s: ListFiles returned %+v, %v, want %+v", tempDir, files, err, want)
+		}
+
+		close(notifier.release)
+		if err := <-done; err != nil {
+			t.Fatalf("%s: Error while sending %s: %v", tempDir, fpath, err)
+		}
+		// The client is done before the server has stored the file.
+		if err := srv.ShutdownContext(context.Background()); err != nil {
+			t.Fatalf("%s: Server didn't shut down: %v", tempDir, err)
+		}
+
+		srcHash, err := testutil.HashFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fpath)
+		}
+		dstHash, err := testutil.HashFile(path.Join(serverDir, "big"))
+		if err != nil {
+			t.Fatalf("%s: Couldn't hash received copy of \"%s\"", tempDir, fpath)
+		}
+		if srcHash != dstHash {
+			t.Errorf("%s: Hashes don't match. Got %s, wanted %s", tempDir, dstHash, srcHash)
+		}
+		if entries, err := os.ReadDir(tempDir); err != nil || len(entries) != 0 {
+			t.Errorf("%s: TempDir holds %d files (%v) once the file is stored, want none", tempDir, len(entries), err)
+		}
+		if entries, err := os.ReadDir(serverDir); err != nil || len(entries) != 1 {
+			t.Errorf("%s: Archive holds %d files (%v), want just the stored file", tempDir, len(entries), err)
+		}
+	}
+}
@@ -1,30 +1,45 @@
 package rtransfer
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand"
 	"net"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/shaladdle/goaaw/testutil"
 )
 
 const testSrvHostport = ":9000"
 
+// testDialer dials through dialer, keeping the last connection so that a
+// test can break it.
 type testDialer struct {
-	hostport string
+	dialer   Dialer
 	lastConn net.Conn
 }
 
 func newTestDialer(hostport string) *testDialer {
 	return &testDialer{
-		hostport: hostport,
+		dialer: netDialer{"tcp", hostport},
 	}
 }
 
 func (td *testDialer) Dial() (net.Conn, error) {
 	var err error
-	td.lastConn, err = net.Dial("tcp", td.hostport)
+	td.lastConn, err = td.dialer.Dial()
 	if err != nil {
 		return nil, err
 	}
@@ -36,6 +51,16 @@ func (td *testDialer) Close() {
 	td.lastConn.Close()
 }
 
+// unusedHostport returns an address nobody is listening on.
+func unusedHostport(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
 type logSendNotifier struct {
 	t *testing.T
 }
@@ -52,12 +77,16 @@ func (sn *logSendNotifier) UpdateProgress(numBytes, totBytes int64) {
 	sn.t.Logf("CLI Sent %d/%d bytes", numBytes, totBytes)
 }
 
+func (sn *logSendNotifier) SendDone(err error) {
+	sn.t.Logf("CLI Done: %v", err)
+}
+
 type logRecvNotifier struct {
 	t *testing.T
 }
 
-func newLogRecvNotifierFactory(t *testing.T) func() RecvNotifier {
-	return func() RecvNotifier {
+func newLogRecvNotifierFactory(t *testing.T) func(name string) RecvNotifier {
+	return func(name string) RecvNotifier {
 		return &logRecvNotifier{t}
 	}
 }
@@ -74,7 +103,20 @@ func (sn *logRecvNotifier) UpdateProgress(numBytes, totBytes int64) {
 	sn.t.Logf("SRV Received %d/%d bytes", numBytes, totBytes)
 }
 
-func transferTest(sizes []int64, srvHostport string, dialer Dialer, t *testing.T, sendNotifier SendNotifier) {
+// RecvDone doesn't log, since a connection can outlive the test that made
+// it.
+func (sn *logRecvNotifier) RecvDone(name string, err error) {}
+
+// transferTest sends files of the given sizes to a server through a
+// PipeListener, and checks that the server stored them.
+func transferTest(sizes []int64, t *testing.T, sendNotifier SendNotifier) {
+	listener := NewPipeListener()
+	transferTestOn(listener, listener, sizes, t, sendNotifier)
+}
+
+// transferTestOn is transferTest with a server on listener, reached through
+// dialer.
+func transferTestOn(listener net.Listener, dialer Dialer, sizes []int64, t *testing.T, sendNotifier SendNotifier) {
 	dpath, err := testutil.CreateTestDir()
 	if err != nil {
 		t.Fatalf("Couldn't create test directory")
@@ -106,10 +148,6 @@ func transferTest(sizes []int64, srvHostport string, dialer Dialer, t *testing.T
 		}
 	}
 
-	listener, err := net.Listen("tcp", srvHostport)
-	if err != nil {
-		t.Fatalf("couldn't listen on %s: %s", srvHostport, err)
-	}
 	srv := NewServer(listener, serverDir)
 	go srv.Serve(newLogRecvNotifierFactory(t))
 	defer srv.Stop()
@@ -122,17 +160,32 @@ func transferTest(sizes []int64, srvHostport string, dialer Dialer, t *testing.T
 		}
 	}
 
-	for _, fname := range files {
-		srcHash, err := testutil.HashFile(path.Join(clientDir, fname))
+	// The server may still be storing the last file when the client is
+	// done with it.
+	if err := srv.ShutdownContext(context.Background()); err != nil {
+		t.Fatalf("Couldn't shut the server down: %v", err)
+	}
+
+	for i, fname := range files {
+		info, err := os.Stat(path.Join(serverDir, fname))
 		if err != nil {
+			t.Errorf("File \"%s\" wasn't stored: %v", fname, err)
 			continue
+		}
+		if info.Size() != sizes[i] {
+			t.Errorf("File \"%s\" has %d bytes, want %d", fname, info.Size(), sizes[i])
+		}
+
+		srcHash, err := testutil.HashFile(path.Join(clientDir, fname))
+		if err != nil {
 			t.Errorf("Couldn't hash file \"%s\"", fname)
+			continue
 		}
 
 		dstHash, err := testutil.HashFile(path.Join(serverDir, fname))
 		if err != nil {
-			continue
 			t.Errorf("Couldn't hash file \"%s\"", fname)
+			continue
 		}
 
 		if srcHash != dstHash {
@@ -146,13 +199,31 @@ func transferTest(sizes []int64, srvHostport string, dialer Dialer, t *testing.T
 }
 
 func TestSimple(t *testing.T) {
-	dialer := newTestDialer(testSrvHostport)
-	transferTest([]int64{1024 * 1024}, testSrvHostport, dialer, t, &logSendNotifier{t})
+	t.Parallel()
+	transferTest([]int64{1024 * 1024}, t, &logSendNotifier{t})
+}
+
+// TestSimpleTCP sends a file over the network, which the other tests mostly
+// don't.
+func TestSimpleTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	dialer := netDialer{"tcp", listener.Addr().String()}
+	transferTestOn(listener, dialer, []int64{1024 * 1024}, t, &logSendNotifier{t})
 }
 
 func TestSmall(t *testing.T) {
-	dialer := newTestDialer(testSrvHostport)
-	transferTest([]int64{12}, testSrvHostport, dialer, t, &logSendNotifier{t})
+	t.Parallel()
+	transferTest([]int64{12}, t, &logSendNotifier{t})
+}
+
+// TestBlockBoundaries sends an empty file, which has no blocks, and files
+// whose last block is full.
+func TestBlockBoundaries(t *testing.T) {
+	t.Parallel()
+	transferTest([]int64{0, payloadSize, 2 * payloadSize}, t, &logSendNotifier{t})
 }
 
 func TestMulti(t *testing.T) {
@@ -164,8 +235,8 @@ func TestMulti(t *testing.T) {
 		5 * MB,
 		5 * MB,
 	}
-	dialer := newTestDialer(testSrvHostport)
-	transferTest(sizes, testSrvHostport, dialer, t, &logSendNotifier{t})
+	t.Parallel()
+	transferTest(sizes, t, &logSendNotifier{t})
 }
 
 const (
@@ -217,9 +288,11 @@ func (cn *clientCrashSendNotifier) UpdateProgress(numBytes, totBytes int64) {
 }
 
 func clientCrashTest(crashAt int, t *testing.T) {
-	dialer := newTestDialer(testSrvHostport)
+	t.Parallel()
+	listener := NewPipeListener()
+	dialer := &testDialer{dialer: listener}
 	sendNotifier := newClientCrashSendNotifier(dialer, t, crashAt)
-	transferTest([]int64{1024 * 10}, testSrvHostport, dialer, t, sendNotifier)
+	transferTestOn(listener, dialer, []int64{1024 * 10}, t, sendNotifier)
 }
 
 func TestClientCrashStart(t *testing.T) {
@@ -236,3 +309,1984 @@ func TestClientCrashUpdate(t *testing.T) {
 
 func TestServerCrash(t *testing.T) {
 }
+
+// midCrashSendNotifier drops the connection once, after crashAfter blocks have
+// been acked, so the retry has to resume from the middle of the file.
+type midCrashSendNotifier struct {
+	logSendNotifier
+	dialer     *testDialer
+	crashAfter int
+	blocks     int
+}
+
+func (cn *midCrashSendNotifier) UpdateProgress(numBytes, totBytes int64) {
+	cn.logSendNotifier.UpdateProgress(numBytes, totBytes)
+
+	cn.blocks++
+	if cn.blocks == cn.crashAfter {
+		cn.dialer.Close()
+	}
+}
+
+func TestSendReader(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	data := make([]byte, 10*payloadSize+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Couldn't generate random data: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, dpath)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	notifier := &midCrashSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		dialer:          dialer,
+		crashAfter:      4,
+	}
+	r := bytes.NewReader(data)
+	if err := SendReader(dialer, "buffer", int64(len(data)), r, notifier); err != nil {
+		t.Fatalf("Error while sending reader: %v", err)
+	}
+
+	got, err := os.ReadFile(path.Join(dpath, "buffer"))
+	if err != nil {
+		t.Fatalf("Couldn't read received file: %v", err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Errorf("Received data doesn't match what was sent")
+	}
+}
+
+// shortReader returns at most max bytes from each read, as a pipe or a file
+// on a network filesystem might.
+type shortReader struct {
+	io.ReadSeeker
+	max int
+}
+
+func (r *shortReader) Read(p []byte) (int, error) {
+	if len(p) > r.max {
+		p = p[:r.max]
+	}
+	return r.ReadSeeker.Read(p)
+}
+
+func TestSendShortReads(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	data := make([]byte, 5*payloadSize+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Couldn't generate random data: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, dpath)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	r := &shortReader{bytes.NewReader(data), 1000}
+	if err := SendReader(newTestDialer(testSrvHostport), "short", int64(len(data)), r, nil); err != nil {
+		t.Fatalf("Error while sending reader: %v", err)
+	}
+
+	got, err := os.ReadFile(path.Join(dpath, "short"))
+	if err != nil {
+		t.Fatalf("Couldn't read received file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Received data doesn't match what was sent")
+	}
+}
+
+// partialCheckSendNotifier records, partway through a transfer, whether the
+// server has the final file or only its partial, then drops the connection.
+type partialCheckSendNotifier struct {
+	midCrashSendNotifier
+	finalPath  string
+	sawFinal   bool
+	sawPartial bool
+}
+
+func (cn *partialCheckSendNotifier) UpdateProgress(numBytes, totBytes int64) {
+	if cn.blocks+1 == cn.crashAfter {
+		cn.sawFinal = fileExists(cn.finalPath)
+		cn.sawPartial = fileExists(cn.finalPath + partSuffix)
+	}
+	cn.midCrashSendNotifier.UpdateProgress(numBytes, totBytes)
+}
+
+func TestPartialFile(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	fpath := path.Join(clientDir, "partial")
+	if err := testutil.GenRandFile(fpath, 10*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	notifier := &partialCheckSendNotifier{
+		midCrashSendNotifier: midCrashSendNotifier{
+			logSendNotifier: logSendNotifier{t},
+			dialer:          dialer,
+			crashAfter:      4,
+		},
+		finalPath: path.Join(serverDir, "partial"),
+	}
+	if err := Send(dialer, fpath, notifier); err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	if notifier.sawFinal || !notifier.sawPartial {
+		t.Errorf("Mid-transfer, final file exists: %v, partial exists: %v",
+			notifier.sawFinal, notifier.sawPartial)
+	}
+
+	if fileExists(notifier.finalPath + partSuffix) {
+		t.Errorf("Partial file was left behind after the transfer completed")
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"%s\"", fpath)
+	}
+
+	dstHash, err := testutil.HashFile(notifier.finalPath)
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"%s\"", notifier.finalPath)
+	}
+
+	if srcHash != dstHash {
+		t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+	}
+}
+
+func TestSendAs(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	fpath := path.Join(clientDir, "build-1234.tar")
+	if err := testutil.GenRandFile(fpath, 3*payloadSize+1); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	for _, name := range []string{"", "..", "../release.tar", "/release.tar", "sub/../../release.tar",
+		"sub//release.tar", "./release.tar", "sub/", `sub\release.tar`} {
+		if err := SendAs(dialer, fpath, name, nil); err == nil {
+			t.Errorf("SendAs accepted remote name %q", name)
+		}
+	}
+
+	if err := SendAs(dialer, fpath, "release.tar", &logSendNotifier{t}); err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"%s\"", fpath)
+	}
+
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "release.tar"))
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"release.tar\"")
+	}
+
+	if srcHash != dstHash {
+		t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+	}
+
+	if fileExists(path.Join(serverDir, "build-1234.tar")) {
+		t.Errorf("File was stored under its local name")
+	}
+
+	if err := SendAs(dialer, fpath, "release.tar", nil); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Sending to an existing remote name returned %v, want %v", err, ErrAlreadyExists)
+	}
+}
+
+func TestSendConn(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	for i, size := range []int64{3*payloadSize + 1, 100} {
+		fpath := path.Join(clientDir, fmt.Sprintf("file%d", i))
+		if err := testutil.GenRandFile(fpath, size); err != nil {
+			t.Fatalf("Couldn't create random file: %v", err)
+		}
+
+		conn, err := net.Dial("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("Couldn't connect to the server: %v", err)
+		}
+		if err := SendConn(conn, fpath, &logSendNotifier{t}); err != nil {
+			t.Fatalf("Error while sending file %s: %v", fpath, err)
+		}
+		// The connection is still the caller's to close.
+		if err := conn.Close(); err != nil {
+			t.Errorf("Closing the connection after sending %s failed: %v", fpath, err)
+		}
+
+		srcHash, err := testutil.HashFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fpath)
+		}
+		dstHash, err := testutil.HashFile(path.Join(serverDir, path.Base(fpath)))
+		if err != nil {
+			t.Fatalf("Couldn't hash received copy of \"%s\"", fpath)
+		}
+		if srcHash != dstHash {
+			t.Errorf("Hashes of %s don't match. Got %s, wanted %s", fpath, dstHash, srcHash)
+		}
+	}
+}
+
+func TestRecvBlockOrder(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	contents := make([]byte, 4*payloadSize)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatalf("Couldn't generate contents: %v", err)
+	}
+	block := func(seqNum int64) []byte {
+		return contents[getFilePos(seqNum):getFilePos(seqNum+1)]
+	}
+
+	// send starts a transfer of the contents on a new connection and sends
+	// the blocks in order, expecting each to be acked.
+	send := func(name string, blocks []dataMessage) error {
+		conn, err := net.Dial("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("Couldn't connect to the server: %v", err)
+		}
+		defer conn.Close()
+		enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+
+		startMsg := startMessage{Version: protocolVersion, Name: name, Size: int64(len(contents))}
+		if err := enc.Encode(startMsg); err != nil {
+			return err
+		}
+		var ack ackMessage
+		if err := dec.Decode(&ack); err != nil {
+			return err
+		}
+		if err := ack.err(); err != nil {
+			return err
+		}
+
+		for _, dataMsg := range blocks {
+			if err := enc.Encode(dataMsg); err != nil {
+				return err
+			}
+			var dataAckMsg dataAckMessage
+			if err := dec.Decode(&dataAckMsg); err != nil {
+				return err
+			}
+			if dataAckMsg.SeqNum != dataMsg.SeqNum {
+				t.Errorf("Server acked block %d, want %d", dataAckMsg.SeqNum, dataMsg.SeqNum)
+			}
+		}
+		return nil
+	}
+
+	// Block 0 comes again with other data, which the server ignores, and
+	// block 2 comes before block 1.
+	garbage := make([]byte, payloadSize)
+	err = send("file", []dataMessage{
+		{SeqNum: 0, Data: block(0)},
+		{SeqNum: 0, Data: garbage},
+		{SeqNum: 2, Data: block(2)},
+		{SeqNum: 1, Data: block(1)},
+		{SeqNum: 2, Data: garbage},
+		{SeqNum: 3, Data: block(3)},
+	})
+	if err != nil {
+		t.Fatalf("Error while sending blocks out of order: %v", err)
+	}
+	got, err := os.ReadFile(path.Join(serverDir, "file"))
+	if err != nil {
+		t.Fatalf("Couldn't read the stored file: %v", err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("The stored file doesn't match the blocks sent")
+	}
+
+	// A block past the end of the file is refused.
+	if err := send("past", []dataMessage{{SeqNum: 4, Data: block(0)}}); err == nil {
+		t.Errorf("Server acked a block past the end of the file")
+	}
+	if fileExists(path.Join(serverDir, "past")) {
+		t.Errorf("A file was stored from a block past its end")
+	}
+}
+
+func TestSendRange(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+
+	const mb = 1 << 20
+	fpath := path.Join(dpath, "shards")
+	if err := testutil.GenRandFile(fpath, 3*mb); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	if err := SendRange(dialer, fpath, 2*mb, mb+1, "past-end", nil); err == nil {
+		t.Errorf("SendRange accepted a range past the end of the file")
+	}
+
+	if err := SendRange(dialer, fpath, mb, mb, "shard1", &logSendNotifier{t}); err != nil {
+		t.Fatalf("Error while sending range of %s: %v", fpath, err)
+	}
+
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", fpath, err)
+	}
+	got, err := os.ReadFile(path.Join(serverDir, "shard1"))
+	if err != nil {
+		t.Fatalf("Couldn't read received file: %v", err)
+	}
+	if !bytes.Equal(got, data[mb:2*mb]) {
+		t.Errorf("Received file doesn't match the middle megabyte of %s", fpath)
+	}
+}
+
+func TestRejectTraversal(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	data := []byte("should never be written")
+	for _, name := range []string{"../escape.txt", "a/../../escape.txt", "/escape.txt", ".", ".."} {
+		err := SendReader(dialer, name, int64(len(data)), bytes.NewReader(data), nil)
+		if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Sending %q returned %v, want %v", name, err, ErrInvalidName)
+		}
+	}
+
+	for _, fpath := range []string{
+		path.Join(dpath, "escape.txt"),
+		path.Join(dpath, "escape.txt"+partSuffix),
+		"/escape.txt",
+	} {
+		if fileExists(fpath) {
+			t.Errorf("%s was written outside the server directory", fpath)
+		}
+	}
+
+	if msg := ErrInvalidName.Error(); msg == ErrCode(-1).Error() {
+		t.Errorf("ErrInvalidName has no message of its own: %q", msg)
+	}
+}
+
+func TestErrMessage(t *testing.T) {
+	for code, want := range map[int]string{
+		int(ErrSuccess):              "success",
+		int(ErrAlreadyExists):        "the file already exists",
+		int(ErrEmptyFilename):        "attempt to copy a file with an empty file name",
+		int(ErrWrongFile):            "attempt to copy a different file than the one the server is currently waiting for",
+		int(ErrOpen):                 "could not open the file for writing on the server",
+		int(ErrInvalidName):          "the file name is absolute or leads outside the archive directory",
+		int(ErrInvalidSize):          "the file size is negative or too large to transfer",
+		int(ErrSourceChanged):        "the file changed while it was being sent",
+		int(ErrUnsupportedVersion):   "the peer speaks a protocol version this one doesn't",
+		int(ErrTooLarge):             "the file is larger than the server accepts",
+		int(ErrNoSpace):              "the server doesn't have enough free space for the file",
+		int(ErrInvalidRange):         "the block range doesn't fit the file or overlaps another being sent",
+		int(ErrUnsupportedFeature):   "the server doesn't support a feature the transfer needs",
+		int(ErrUnauthorized):         "the client didn't prove it knows the server's secret",
+		int(ErrServerIdentity):       "the server couldn't prove it is the one expected",
+		int(ErrAppendMismatch):       "the server's copy of the file isn't as long as the append offset",
+		int(ErrRejected):             "the server doesn't accept the file",
+		int(ErrProtocol):             "the peer sent a message the protocol doesn't allow at that point",
+		int(ErrTooManyRetransmits):   "a block was sent again more times than allowed",
+		int(ErrHashMismatch):         "the server's digest of the stored file doesn't match the sender's",
+		int(ErrBusy):                 "another connection is still sending that part of the file",
+		int(ErrIdentityRequired):     "the server proves its identity, and the client didn't ask it to",
+		-1:                           "unknown error",
+		int(ErrIdentityRequired) + 1: "unknown error",
+	} {
+		if got := ErrMessage(code); got != want {
+			t.Errorf("ErrMessage(%d) = %q, want %q", code, got, want)
+		}
+	}
+
+	// The codes are fixed by the protocol.
+	if ErrInvalidName != 5 || ErrBusy != 20 {
+		t.Errorf("Error codes have been renumbered: ErrInvalidName is %d, ErrBusy %d",
+			int(ErrInvalidName), int(ErrBusy))
+	}
+}
+
+func TestSendAsSubpath(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "app.log")
+	if err := testutil.GenRandFile(fpath, 3*payloadSize+1); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	// The client lays out the archive directory, unless the server
+	// forbids it.
+	for _, forbid := range []bool{false, true} {
+		serverDir := path.Join(dpath, "server")
+		if forbid {
+			serverDir += "-flat"
+		}
+		listener := NewPipeListener()
+		srv := NewServerWithOptions(listener, serverDir, &ServerOptions{ForbidSubpaths: forbid})
+		go srv.Serve(newLogRecvNotifierFactory(t))
+
+		err := SendAs(listener, fpath, "logs/2024/app.log", &logSendNotifier{t})
+		stored := path.Join(serverDir, "logs", "2024", "app.log")
+		if forbid {
+			if !errors.Is(err, ErrInvalidName) {
+				t.Errorf("Sending into a subdirectory of a flat server returned %v, want %v", err, ErrInvalidName)
+			}
+			if fileExists(path.Join(serverDir, "logs")) {
+				t.Errorf("A flat server created a subdirectory")
+			}
+			if err := SendAs(listener, fpath, "app.log", nil); err != nil {
+				t.Errorf("Error while sending %s to a flat server: %v", fpath, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("Error while sending %s: %v", fpath, err)
+			}
+
+			// The server may still be storing the file when the client
+			// is done with it.
+			if err := srv.ShutdownContext(context.Background()); err != nil {
+				t.Fatalf("Couldn't shut the server down: %v", err)
+			}
+			srcHash, err := testutil.HashFile(fpath)
+			if err != nil {
+				t.Fatalf("Couldn't hash %s: %v", fpath, err)
+			}
+			dstHash, err := testutil.HashFile(stored)
+			if err != nil || srcHash != dstHash {
+				t.Errorf("%s doesn't hold the file sent (%v)", stored, err)
+			}
+		}
+		srv.Stop()
+	}
+
+	// A name that climbs out of the archive is turned away, however it is
+	// spelled.
+	if err := SendAs(noDialer{t}, fpath, "logs/../../app.log", nil); err == nil {
+		t.Errorf("SendAs accepted a name outside the archive")
+	}
+}
+
+// noDialer fails the test if it is asked to dial.
+type noDialer struct {
+	t *testing.T
+}
+
+func (d noDialer) Dial() (net.Conn, error) {
+	d.t.Errorf("Client dialed the server")
+	return nil, fmt.Errorf("Not dialing")
+}
+
+// TestRejectEmptyName checks that the client turns away paths that leave the
+// file no name before it reaches for the network.
+func TestRejectEmptyName(t *testing.T) {
+	hostport := unusedHostport(t)
+	for _, fpath := range []string{"", "   ", "/", "///", "dir/ \t"} {
+		if err := Send(noDialer{t}, fpath, nil); !errors.Is(err, ErrEmptyFilename) {
+			t.Errorf("Sending %q returned %v, want %v", fpath, err, ErrEmptyFilename)
+		}
+		// Nothing listens at hostport, so a client that dialed would fail
+		// some other way.
+		if err := SendToDaemon(fpath, hostport); !errors.Is(err, ErrEmptyFilename) {
+			t.Errorf("Sending %q through the daemon returned %v, want %v", fpath, err, ErrEmptyFilename)
+		}
+	}
+}
+
+func TestRetryPolicyGivesUp(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 1024); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	deadHostport := unusedHostport(t)
+
+	const backoff = 100 * time.Millisecond
+	opts := &SendOptions{
+		Retry: RetryPolicy{
+			InitialBackoff: backoff,
+			MaxBackoff:     backoff,
+			MaxAttempts:    3,
+			NoJitter:       true,
+		},
+	}
+
+	start := time.Now()
+	_, err = SendContext(context.Background(), newTestDialer(deadHostport), fpath, nil, opts)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatalf("Send to a dead port succeeded")
+	}
+
+	// Three attempts are separated by two backoffs.
+	if elapsed < 2*backoff || elapsed > 2*time.Second {
+		t.Errorf("Send gave up after %v, want about %v", elapsed, 2*backoff)
+	}
+}
+
+func TestServerErrorsArePermanent(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 1024); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	opts := &SendOptions{
+		Retry: RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxAttempts: 5},
+	}
+
+	for _, code := range []ErrCode{ErrOpen, ErrNoSpace, ErrAlreadyExists} {
+		// This server drops the first connection without a word, as a
+		// flaky link would, and turns the file down with code after that.
+		listener, err := net.Listen("tcp", testSrvHostport)
+		if err != nil {
+			t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+		}
+		conns := make(chan int, 1)
+		go func() {
+			n := 0
+			defer func() { conns <- n }()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				n++
+				if n > 1 {
+					var startMsg startMessage
+					gob.NewDecoder(conn).Decode(&startMsg)
+					gob.NewEncoder(conn).Encode(ackMessage{ErrType: code, Reason: "no"})
+				}
+				conn.Close()
+			}
+		}()
+
+		_, err = SendContext(context.Background(), newTestDialer(testSrvHostport), fpath, nil, opts)
+		listener.Close()
+		if !errors.Is(err, code) {
+			t.Errorf("Send to a server answering %v returned %v", code, err)
+		}
+		if n := <-conns; n != 2 {
+			t.Errorf("Send to a server answering %v made %d connections, want 2", code, n)
+		}
+	}
+
+	if permanent(io.EOF) || permanent(os.ErrDeadlineExceeded) {
+		t.Errorf("A lost connection was taken to be permanent")
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+
+	jittered := newBackoff(policy, mrand.New(mrand.NewSource(1)).Int63n)
+	policy.NoJitter = true
+	exact := newBackoff(policy, nil)
+
+	varied := false
+	limit := policy.InitialBackoff
+	for i := 0; i < 20; i++ {
+		if wait := exact.next(); wait != limit {
+			t.Errorf("Backoff %d without jitter is %v, want %v", i, wait, limit)
+		}
+
+		wait := jittered.next()
+		if wait < 0 || wait > limit {
+			t.Errorf("Backoff %d is %v, want it in [0, %v]", i, wait, limit)
+		}
+		if wait != limit {
+			varied = true
+		}
+
+		if limit *= 2; limit > policy.MaxBackoff {
+			limit = policy.MaxBackoff
+		}
+	}
+
+	if !varied {
+		t.Errorf("Jitter never changed a backoff")
+	}
+}
+
+func TestRetryPolicyDefaults(t *testing.T) {
+	// Setting one field leaves the limits of the defaults in place.
+	got := RetryPolicy{NoJitter: true}.or(DaemonRetries)
+	want := DaemonRetries
+	want.NoJitter = true
+	if got != want {
+		t.Errorf("Defaults for a policy without jitter are %+v, want %+v", got, want)
+	}
+
+	budget := newRetryBudget(RetryPolicy{MaxAttempts: 2, NoJitter: true}.or(DaemonRetries), nil)
+	if _, err := budget.fail(io.EOF); err != nil {
+		t.Fatalf("Gave up after the first of two attempts: %v", err)
+	}
+	if _, err := budget.fail(io.EOF); !errors.Is(err, io.EOF) {
+		t.Errorf("The second of two attempts returned %v, want it to give up with %v", err, io.EOF)
+	}
+}
+
+func TestBlockMathBounds(t *testing.T) {
+	if pos := getFilePos(getNumBlocks(maxSize)); pos <= 0 || pos < maxSize {
+		t.Errorf("End of the largest file overflowed: %d", pos)
+	}
+
+	for _, size := range []int64{-1, maxSize + 1, math.MaxInt64} {
+		if validSize(size) {
+			t.Errorf("Size %d was accepted", size)
+		}
+	}
+
+	if !validSize(0) || !validSize(maxSize) {
+		t.Errorf("A size in range was rejected")
+	}
+}
+
+func TestBlockCount(t *testing.T) {
+	for _, tc := range []struct {
+		size      int64
+		blockSize int
+		count     int64
+		lastStart int64
+	}{
+		{0, BlockSize, 0, 0},
+		{1, BlockSize, 1, 0},
+		{BlockSize - 1, BlockSize, 1, 0},
+		{BlockSize, BlockSize, 1, 0},
+		{BlockSize + 1, BlockSize, 2, BlockSize},
+		{3 * BlockSize, BlockSize, 3, 2 * BlockSize},
+		{10, 3, 4, 9},
+		{maxSize, BlockSize, maxSize / BlockSize, maxSize - BlockSize},
+	} {
+		count := BlockCount(tc.size, tc.blockSize)
+		if count != tc.count {
+			t.Errorf("BlockCount(%d, %d) = %d, want %d", tc.size, tc.blockSize, count, tc.count)
+			continue
+		}
+		if count == 0 {
+			continue
+		}
+
+		// The last block starts inside the file and ends at or after it.
+		if start := BlockOffset(count-1, tc.blockSize); start != tc.lastStart {
+			t.Errorf("Last block of %d bytes in blocks of %d starts at %d, want %d",
+				tc.size, tc.blockSize, start, tc.lastStart)
+		}
+		if end := BlockOffset(count, tc.blockSize); end < tc.size {
+			t.Errorf("Blocks of %d bytes end at %d, before the end of %d bytes", tc.blockSize, end, tc.size)
+		}
+	}
+
+	if getNumBlocks(BlockSize+1) != BlockCount(BlockSize+1, BlockSize) {
+		t.Errorf("BlockCount disagrees with the block count transfers use")
+	}
+}
+
+func TestRejectInvalidSize(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, dpath)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	err = SendReader(dialer, "huge", math.MaxInt64, bytes.NewReader(nil), nil)
+	if !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("Client sent a file of size %d, got %v", int64(math.MaxInt64), err)
+	}
+
+	// A client that skips its own check still gets turned away.
+	conn, err := dialer.Dial()
+	if err != nil {
+		t.Fatalf("Couldn't dial the server: %v", err)
+	}
+	defer conn.Close()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	if err := enc.Encode(startMessage{Name: "huge", Size: math.MaxInt64}); err != nil {
+		t.Fatalf("Couldn't send start message: %v", err)
+	}
+
+	var ack ackMessage
+	if err := dec.Decode(&ack); err != nil {
+		t.Fatalf("Couldn't receive ack: %v", err)
+	}
+	if ack.ErrType != ErrInvalidSize {
+		t.Errorf("Server answered %v, want %v", ack.ErrType, ErrInvalidSize)
+	}
+
+	if fileExists(path.Join(dpath, "huge"+partSuffix)) {
+		t.Errorf("Server created a partial file for a rejected size")
+	}
+}
+
+// changeSourceSendNotifier appends to the file being sent and drops the
+// connection after a few blocks, as if someone wrote to it mid-transfer.
+type changeSourceSendNotifier struct {
+	midCrashSendNotifier
+	fpath string
+	extra []byte
+}
+
+func (cn *changeSourceSendNotifier) UpdateProgress(numBytes, totBytes int64) {
+	if cn.blocks+1 == cn.crashAfter {
+		f, err := os.OpenFile(cn.fpath, os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			cn.t.Fatalf("Couldn't open %s to change it: %v", cn.fpath, err)
+		}
+		f.Write(cn.extra)
+		f.Close()
+	}
+	cn.midCrashSendNotifier.UpdateProgress(numBytes, totBytes)
+}
+
+func sourceChangeTest(t *testing.T, opts *SendOptions) (fpath, serverDir string, err error) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+
+	clientDir := path.Join(dpath, "client")
+	serverDir = path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	fpath = path.Join(clientDir, "changing")
+	if err := testutil.GenRandFile(fpath, 10*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	notifier := &changeSourceSendNotifier{
+		midCrashSendNotifier: midCrashSendNotifier{
+			logSendNotifier: logSendNotifier{t},
+			dialer:          dialer,
+			crashAfter:      3,
+		},
+		fpath: fpath,
+		extra: bytes.Repeat([]byte("appended"), 100),
+	}
+	_, err = SendContext(context.Background(), dialer, fpath, notifier, opts)
+	return fpath, serverDir, err
+}
+
+func TestSourceChanged(t *testing.T) {
+	_, serverDir, err := sourceChangeTest(t, nil)
+	defer os.RemoveAll(path.Dir(serverDir))
+
+	if !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("Sending a file that changed returned %v, want %v", err, ErrSourceChanged)
+	}
+
+	if fileExists(path.Join(serverDir, "changing")) {
+		t.Errorf("A file that changed mid-transfer was stored")
+	}
+}
+
+func TestSourceChangedRestart(t *testing.T) {
+	fpath, serverDir, err := sourceChangeTest(t, &SendOptions{RestartOnChange: true})
+	defer os.RemoveAll(path.Dir(serverDir))
+
+	if err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash file \"%s\"", fpath)
+	}
+
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "changing"))
+	if err != nil {
+		t.Fatalf("Couldn't hash received file")
+	}
+
+	if srcHash != dstHash {
+		t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+	}
+}
+
+// stallSendNotifier pauses the transfer after stallAfter blocks, telling the
+// test on stalled and waiting for release to be closed.
+type stallSendNotifier struct {
+	logSendNotifier
+	stallAfter int
+	blocks     int
+	stalled    chan bool
+	release    chan bool
+}
+
+func (sn *stallSendNotifier) UpdateProgress(numBytes, totBytes int64) {
+	sn.logSendNotifier.UpdateProgress(numBytes, totBytes)
+
+	sn.blocks++
+	if sn.blocks == sn.stallAfter {
+		sn.stalled <- true
+		<-sn.release
+	}
+}
+
+// shutdownTest starts sending a file, stalls it partway and shuts the server
+// down with the given timeout, releasing the transfer after releaseAfter. It
+// returns the result of the shutdown and of the send.
+func shutdownTest(t *testing.T, timeout, releaseAfter time.Duration) (shutdownErr, sendErr error) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "draining")
+	if err := testutil.GenRandFile(fpath, 10*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(serverDir); err != nil {
+		t.Fatalf("Couldn't create server test directory")
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+
+	notifier := &stallSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		stallAfter:      3,
+		stalled:         make(chan bool),
+		release:         make(chan bool),
+	}
+	sent := make(chan error)
+	go func() {
+		sent <- Send(newTestDialer(testSrvHostport), fpath, notifier)
+	}()
+	<-notifier.stalled
+
+	time.AfterFunc(releaseAfter, func() { close(notifier.release) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	shutdownErr = srv.ShutdownContext(ctx)
+
+	if shutdownErr == nil {
+		srcHash, err := testutil.HashFile(fpath)
+		if err != nil {
+			t.Fatalf("Couldn't hash file \"%s\"", fpath)
+		}
+		dstHash, err := testutil.HashFile(path.Join(serverDir, "draining"))
+		if err != nil {
+			t.Fatalf("Shutdown returned before the transfer was stored: %v", err)
+		}
+		if srcHash != dstHash {
+			t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+		}
+	}
+
+	return shutdownErr, <-sent
+}
+
+func TestShutdownDrains(t *testing.T) {
+	shutdownErr, sendErr := shutdownTest(t, 5*time.Second, 200*time.Millisecond)
+	if shutdownErr != nil {
+		t.Errorf("Shutdown returned %v, want it to wait for the transfer", shutdownErr)
+	}
+	if sendErr != nil {
+		t.Errorf("Send during shutdown failed: %v", sendErr)
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "draining")
+	if err := testutil.GenRandFile(fpath, 10*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	serverDir := path.Join(dpath, "server")
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ServeContext(ctx, newLogRecvNotifierFactory(t))
+	}()
+
+	notifier := &stallSendNotifier{
+		logSendNotifier: logSendNotifier{t},
+		stallAfter:      3,
+		stalled:         make(chan bool),
+		release:         make(chan bool),
+	}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- Send(newTestDialer(testSrvHostport), fpath, notifier)
+	}()
+	<-notifier.stalled
+
+	// The transfer in progress holds ServeContext up after the cancel.
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatalf("ServeContext returned %v with a transfer in progress", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(notifier.release)
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ServeContext returned %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ServeContext didn't return after its context was cancelled")
+	}
+	if err := <-sent; err != nil {
+		t.Errorf("Send during shutdown failed: %v", err)
+	}
+	if !fileExists(path.Join(serverDir, "draining")) {
+		t.Errorf("ServeContext returned before the transfer was stored")
+	}
+	if _, err := net.Dial("tcp", testSrvHostport); err == nil {
+		t.Errorf("Server still accepts connections after ServeContext returned")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	shutdownErr, _ := shutdownTest(t, 100*time.Millisecond, 300*time.Millisecond)
+	if !errors.Is(shutdownErr, context.DeadlineExceeded) {
+		t.Errorf("Shutdown returned %v, want it to give up on its deadline", shutdownErr)
+	}
+	if shutdownErr != nil && !strings.Contains(shutdownErr.Error(), "draining") {
+		t.Errorf("Shutdown error %q doesn't name the active transfer", shutdownErr)
+	}
+}
+
+func TestRejectFutureVersion(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, dpath)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	conn, err := newTestDialer(testSrvHostport).Dial()
+	if err != nil {
+		t.Fatalf("Couldn't dial the server: %v", err)
+	}
+	defer conn.Close()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	startMsg := startMessage{Version: protocolVersion + 1, Name: "future", Size: 10}
+	if err := enc.Encode(startMsg); err != nil {
+		t.Fatalf("Couldn't send start message: %v", err)
+	}
+
+	var ack ackMessage
+	if err := dec.Decode(&ack); err != nil {
+		t.Fatalf("Couldn't receive ack: %v", err)
+	}
+	if ack.ErrType != ErrUnsupportedVersion {
+		t.Errorf("Server answered %v, want %v", ack.ErrType, ErrUnsupportedVersion)
+	}
+	if ack.Version != protocolVersion {
+		t.Errorf("Server declared version %d, want %d", ack.Version, protocolVersion)
+	}
+
+	if fileExists(path.Join(dpath, "future"+partSuffix)) {
+		t.Errorf("Server created a partial file for a rejected version")
+	}
+}
+
+func TestMisackingServer(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 3*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	// This server acks every block as block 0.
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				enc := gob.NewEncoder(conn)
+				dec := gob.NewDecoder(conn)
+
+				var startMsg startMessage
+				dec.Decode(&startMsg)
+				enc.Encode(ackMessage{Version: protocolVersion, Name: startMsg.Name, Size: startMsg.Size})
+				for {
+					var dataMsg dataMessage
+					if err := dec.Decode(&dataMsg); err != nil {
+						return
+					}
+					enc.Encode(dataAckMessage{SeqNum: 0})
+				}
+			}()
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- Send(newTestDialer(testSrvHostport), fpath, nil) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrProtocol) {
+			t.Errorf("Send returned %v, want %v", err, ErrProtocol)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Send kept retrying against a server that breaks the protocol")
+	}
+}
+
+// metadataTest sends a 0600 file with an old modification time to a server
+// created with opts and returns what the server stored.
+func metadataTest(t *testing.T, opts *ServerOptions) (stored os.FileInfo, modTime time.Time) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	fpath := path.Join(clientDir, "private")
+	if err := testutil.GenRandFile(fpath, 3*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	modTime = time.Date(2013, 7, 4, 9, 0, 0, 0, time.UTC)
+	if err := os.Chmod(fpath, 0600); err != nil {
+		t.Fatalf("Couldn't chmod %s: %v", fpath, err)
+	}
+	if err := os.Chtimes(fpath, modTime, modTime); err != nil {
+		t.Fatalf("Couldn't set the times of %s: %v", fpath, err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, opts)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	if err := Send(newTestDialer(testSrvHostport), fpath, &logSendNotifier{t}); err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	stored, err = os.Stat(path.Join(serverDir, "private"))
+	if err != nil {
+		t.Fatalf("Couldn't stat received file: %v", err)
+	}
+	return stored, modTime
+}
+
+func TestPreserveMetadata(t *testing.T) {
+	info, modTime := metadataTest(t, nil)
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Received file has mode %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("Received file was modified at %v, want %v", info.ModTime(), modTime)
+	}
+}
+
+func TestDiscardMetadata(t *testing.T) {
+	info, modTime := metadataTest(t, &ServerOptions{DiscardMetadata: true})
+
+	if info.ModTime().Equal(modTime) {
+		t.Errorf("Received file kept its modification time with DiscardMetadata set")
+	}
+}
+
+// slowSendNotifier pauses after every block so that transfers overlap.
+type slowSendNotifier struct {
+	logSendNotifier
+	delay time.Duration
+}
+
+func (sn *slowSendNotifier) UpdateProgress(numBytes, totBytes int64) {
+	sn.logSendNotifier.UpdateProgress(numBytes, totBytes)
+	time.Sleep(sn.delay)
+}
+
+func TestCreateArchiveDir(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 3*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	// The modes are left alone by the usual umasks.
+	serverDir := path.Join(dpath, "not", "there", "yet")
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{
+		DiscardMetadata: true,
+		FileMode:        0640,
+		DirMode:         0750,
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	info, err := os.Stat(serverDir)
+	if err != nil {
+		t.Fatalf("The archive directory wasn't created: %v", err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0750 {
+		t.Errorf("The archive directory has mode %v, want a directory with %v", info.Mode(), os.FileMode(0750))
+	}
+
+	if err := Send(newTestDialer(testSrvHostport), fpath, &logSendNotifier{t}); err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	info, err = os.Stat(path.Join(serverDir, "file"))
+	if err != nil {
+		t.Fatalf("Couldn't stat received file: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Received file has mode %v, want %v", info.Mode().Perm(), os.FileMode(0640))
+	}
+}
+
+// doneRecvNotifier records how each connection to a server ended.
+type doneRecvNotifier struct {
+	logRecvNotifier
+	mu    *sync.Mutex
+	names map[string]int
+	errs  map[string]error
+}
+
+func (dn *doneRecvNotifier) RecvDone(name string, err error) {
+	dn.mu.Lock()
+	defer dn.mu.Unlock()
+	dn.names[name]++
+	dn.errs[name] = err
+}
+
+func TestRecvDone(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, dpath)
+
+	var mu sync.Mutex
+	names := make(map[string]int)
+	errs := make(map[string]error)
+	created := make(map[string]int)
+	go srv.Serve(func(name string) RecvNotifier {
+		mu.Lock()
+		created[name]++
+		mu.Unlock()
+		return &doneRecvNotifier{logRecvNotifier{t}, &mu, names, errs}
+	})
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	data := []byte("data")
+	if err := SendReader(dialer, "good", int64(len(data)), bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Couldn't send: %v", err)
+	}
+	if err := SendReader(dialer, "../bad", int64(len(data)), bytes.NewReader(data), nil); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Sending an invalid name returned %v, want %v", err, ErrInvalidName)
+	}
+	conn, err := dialer.Dial()
+	if err != nil {
+		t.Fatalf("Couldn't dial: %v", err)
+	}
+	conn.Close()
+
+	if !waitFor(5*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(names) == 3
+	}) {
+		t.Fatalf("Server only reported the end of %v", names)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range []string{"good", "../bad", ""} {
+		if names[name] != 1 || created[name] != 1 {
+			t.Errorf("Connection sending %q made %d notifiers that reported %d ends, want 1 each",
+				name, created[name], names[name])
+		}
+	}
+	if errs["good"] != nil {
+		t.Errorf("Good transfer ended with %v", errs["good"])
+	}
+	for _, name := range []string{"../bad", ""} {
+		if errs[name] == nil {
+			t.Errorf("Connection sending %q ended without an error", name)
+		}
+	}
+}
+
+func TestTransferErrorAs(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, dpath)
+
+	var mu sync.Mutex
+	names := make(map[string]int)
+	errs := make(map[string]error)
+	go srv.Serve(func(name string) RecvNotifier {
+		return &doneRecvNotifier{logRecvNotifier{t}, &mu, names, errs}
+	})
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	data := []byte("data")
+	if err := SendReader(dialer, "dup", int64(len(data)), bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Couldn't send: %v", err)
+	}
+	err = SendReader(dialer, "dup", int64(len(data)), bytes.NewReader(data), nil)
+
+	var te TransferError
+	if !errors.As(err, &te) || te.Code != ErrAlreadyExists {
+		t.Fatalf("Sending a duplicate returned %v, want a TransferError of %v", err, ErrAlreadyExists)
+	}
+
+	// The server's error carries the code along with the details.
+	if !waitFor(5*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return names["dup"] == 2
+	}) {
+		t.Fatalf("Server didn't report the end of the duplicate")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !errors.As(errs["dup"], &te) || te.Code != ErrAlreadyExists {
+		t.Errorf("Server ended the duplicate with %v, want a TransferError of %v", errs["dup"], ErrAlreadyExists)
+	}
+}
+
+// doneSendNotifier records the calls to SendDone.
+type doneSendNotifier struct {
+	logSendNotifier
+	calls int
+	err   error
+}
+
+func (dn *doneSendNotifier) SendDone(err error) {
+	dn.calls++
+	dn.err = err
+}
+
+func TestSendDone(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 3*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, path.Join(dpath, "server"))
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	for _, want := range []error{nil, ErrAlreadyExists} {
+		notifier := &doneSendNotifier{logSendNotifier: logSendNotifier{t}}
+		err := Send(dialer, fpath, notifier)
+		if !errors.Is(err, want) {
+			t.Fatalf("Send returned %v, want %v", err, want)
+		}
+		if notifier.calls != 1 || !errors.Is(notifier.err, want) {
+			t.Errorf("SendDone was called %d times, last with %v, want once with %v",
+				notifier.calls, notifier.err, want)
+		}
+	}
+
+	notifier := &doneSendNotifier{logSendNotifier: logSendNotifier{t}}
+	data := []byte("data")
+	if err := SendReader(dialer, "reader", int64(len(data)), bytes.NewReader(data), notifier); err != nil {
+		t.Fatalf("SendReader returned %v", err)
+	}
+	if notifier.calls != 1 || notifier.err != nil {
+		t.Errorf("SendDone was called %d times, last with %v, want once with nil", notifier.calls, notifier.err)
+	}
+}
+
+func TestPathFunc(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, dpath, &ServerOptions{
+		PathFunc: func(name string, recvTime time.Time) string {
+			if name == "escape" {
+				return "../escape"
+			}
+			return path.Join(recvTime.Format("2006/01/02"), name)
+		},
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	data := []byte("data")
+	before := time.Now()
+	if err := SendReader(dialer, "log.txt", int64(len(data)), bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Couldn't send: %v", err)
+	}
+
+	// The day may have turned over during the transfer.
+	stored := false
+	for _, day := range []time.Time{before, time.Now()} {
+		stored = stored || fileExists(path.Join(dpath, day.Format("2006/01/02"), "log.txt"))
+	}
+	if !stored {
+		t.Errorf("File wasn't stored under the date it arrived")
+	}
+	if fileExists(path.Join(dpath, "log.txt")) {
+		t.Errorf("File was stored under its name")
+	}
+
+	// The file that already exists is the one at the mapped path.
+	if err := SendReader(dialer, "log.txt", int64(len(data)), bytes.NewReader(data), nil); !errors.Is(err, ErrAlreadyExists) && time.Now().Day() == before.Day() {
+		t.Errorf("Sending the file again returned %v, want %v", err, ErrAlreadyExists)
+	}
+
+	if err := SendReader(dialer, "escape", int64(len(data)), bytes.NewReader(data), nil); !errors.Is(err, ErrOpen) {
+		t.Errorf("Sending a file mapped outside the archive returned %v, want %v", err, ErrOpen)
+	}
+	if fileExists(path.Join(path.Dir(dpath), "escape")) {
+		t.Errorf("File mapped outside the archive was written")
+	}
+}
+
+func TestSendWithResult(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, serverDir, &ServerOptions{
+		PathFunc: func(name string, recvTime time.Time) string {
+			return path.Join("incoming", name)
+		},
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	const size = 50*payloadSize + 10
+	for i, opts := range []*SendOptions{nil, {Parallelism: 4}} {
+		fpath := path.Join(clientDir, fmt.Sprintf("file%d", i))
+		if err := testutil.GenRandFile(fpath, size); err != nil {
+			t.Fatalf("Couldn't create random file: %v", err)
+		}
+
+		dialer := netDialer{"tcp", testSrvHostport}
+		result, err := SendWithResult(context.Background(), dialer, fpath, nil, opts)
+		if err != nil {
+			t.Fatalf("Error while sending %s: %v", fpath, err)
+		}
+
+		want := path.Join("incoming", path.Base(fpath))
+		if result.StoredPath != want {
+			t.Errorf("Sending %s returned StoredPath %q, want %q", fpath, result.StoredPath, want)
+		}
+		if result.Bytes != size {
+			t.Errorf("Sending %s returned Bytes %d, want %d", fpath, result.Bytes, size)
+		}
+
+		data, err := os.ReadFile(path.Join(serverDir, result.StoredPath))
+		if err != nil {
+			t.Fatalf("Couldn't read the file at StoredPath: %v", err)
+		}
+		hash := sha256.Sum256(data)
+		if !bytes.Equal(result.Hash, hash[:]) {
+			t.Errorf("Sending %s returned Hash %x, want %x", fpath, result.Hash, hash)
+		}
+	}
+}
+
+func TestAcceptFunc(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, dpath, &ServerOptions{
+		AcceptFunc: func(name string, size int64) error {
+			if strings.HasSuffix(name, ".exe") {
+				return fmt.Errorf("no executables")
+			}
+			return nil
+		},
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	data := []byte("data")
+	err = SendReader(dialer, "tool.exe", int64(len(data)), bytes.NewReader(data), nil)
+	if !errors.Is(err, ErrRejected) || !strings.Contains(err.Error(), "no executables") {
+		t.Errorf("Sending a rejected file returned %v, want %v with the reason", err, ErrRejected)
+	}
+	for _, name := range []string{"tool.exe", "tool.exe" + partSuffix} {
+		if fileExists(path.Join(dpath, name)) {
+			t.Errorf("Rejected file left %s on the server", name)
+		}
+	}
+
+	if err := SendReader(dialer, "notes.txt", int64(len(data)), bytes.NewReader(data), nil); err != nil {
+		t.Errorf("Sending an accepted file returned %v", err)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	archiveDir := path.Join(dpath, "archive")
+	logDir := path.Join(dpath, "logs")
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, archiveDir, &ServerOptions{
+		Router: func(name string, size int64) (string, error) {
+			switch {
+			case strings.HasSuffix(name, ".log"):
+				return logDir, nil
+			case size > payloadSize:
+				return "", fmt.Errorf("nowhere to put %d bytes", size)
+			}
+			return "", nil
+		},
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	data := []byte("data")
+	for _, name := range []string{"app.log", "sub/app.log", "notes.txt"} {
+		if err := SendReader(dialer, name, int64(len(data)), bytes.NewReader(data), nil); err != nil {
+			t.Fatalf("Couldn't send %s: %v", name, err)
+		}
+	}
+	for _, fpath := range []string{
+		path.Join(logDir, "app.log"),
+		path.Join(logDir, "sub/app.log"),
+		path.Join(archiveDir, "notes.txt"),
+	} {
+		if !fileExists(fpath) {
+			t.Errorf("%s wasn't stored", fpath)
+		}
+	}
+	for _, fpath := range []string{path.Join(archiveDir, "app.log"), path.Join(logDir, "notes.txt")} {
+		if fileExists(fpath) {
+			t.Errorf("%s was stored in the wrong directory", fpath)
+		}
+	}
+
+	// StoredPath is relative to the directory the file went to.
+	fpath := path.Join(dpath, "result.log")
+	if err := os.WriteFile(fpath, data, 0666); err != nil {
+		t.Fatalf("Couldn't create %s: %v", fpath, err)
+	}
+	result, err := SendWithResult(context.Background(), dialer, fpath, nil, nil)
+	if err != nil {
+		t.Fatalf("Error while sending %s: %v", fpath, err)
+	}
+	if result.StoredPath != "result.log" {
+		t.Errorf("Sending %s returned StoredPath %q, want %q", fpath, result.StoredPath, "result.log")
+	}
+
+	big := bytes.Repeat([]byte{'x'}, 2*payloadSize)
+	err = SendReader(dialer, "big.bin", int64(len(big)), bytes.NewReader(big), nil)
+	if !errors.Is(err, ErrRejected) || !strings.Contains(err.Error(), "nowhere to put") {
+		t.Errorf("Sending a file the Router refused returned %v, want %v with the reason", err, ErrRejected)
+	}
+	if fileExists(path.Join(archiveDir, "big.bin")) {
+		t.Errorf("File the Router refused was stored")
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	const limit = 2
+	var mu sync.Mutex
+	var active, most int
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, dpath, &ServerOptions{MaxConcurrent: limit})
+	go srv.Serve(func(name string) RecvNotifier {
+		return &concurrencyRecvNotifier{logRecvNotifier{t}, &mu, &active, &most}
+	})
+	defer srv.Stop()
+
+	data := bytes.Repeat([]byte{'x'}, 20*payloadSize)
+	errs := make(chan error)
+	for i := 0; i < 3*limit; i++ {
+		name := fmt.Sprintf("concurrent%d", i)
+		go func() {
+			notifier := &slowSendNotifier{logSendNotifier{t}, 2 * time.Millisecond}
+			dialer := newTestDialer(testSrvHostport)
+			errs <- SendReader(dialer, name, int64(len(data)), bytes.NewReader(data), notifier)
+		}()
+	}
+
+	for i := 0; i < 3*limit; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Error while sending: %v", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if most > limit {
+		t.Errorf("Server handled %d transfers at once, want at most %d", most, limit)
+	}
+	if most < limit {
+		t.Errorf("Server handled at most %d transfers at once, want %d", most, limit)
+	}
+}
+
+// corruptingDialer drops the first connection like lossyDialer, and before
+// the next one garbles the start of the server's partial file.
+type corruptingDialer struct {
+	*lossyDialer
+	partPath string
+}
+
+func (d *corruptingDialer) Dial() (net.Conn, error) {
+	d.mu.Lock()
+	corrupt := d.dials > 0
+	d.mu.Unlock()
+
+	if corrupt {
+		f, err := os.OpenFile(d.partPath, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.WriteAt(make([]byte, 16), 0)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return d.lossyDialer.Dial()
+}
+
+func TestResumeCorruptPartial(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	for _, dir := range []string{clientDir, serverDir} {
+		if err := testutil.TryMkdir(dir); err != nil {
+			t.Fatalf("Couldn't create directory %s: %v", dir, err)
+		}
+	}
+
+	fpath := path.Join(clientDir, "corrupted")
+	if err := testutil.GenRandFile(fpath, 10*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := &corruptingDialer{
+		lossyDialer: &lossyDialer{hostport: testSrvHostport, limit: 4 * payloadSize},
+		partPath:    path.Join(serverDir, "corrupted"+partSuffix),
+	}
+	opts := &SendOptions{Retry: RetryPolicy{InitialBackoff: 10 * time.Millisecond}}
+	if _, err := SendContext(context.Background(), dialer, fpath, &logSendNotifier{t}, opts); err != nil {
+		t.Fatalf("Error while sending file %s: %v", fpath, err)
+	}
+
+	srcHash, err := testutil.HashFile(fpath)
+	if err != nil {
+		t.Fatalf("Couldn't hash %s: %v", fpath, err)
+	}
+	dstHash, err := testutil.HashFile(path.Join(serverDir, "corrupted"))
+	if err != nil {
+		t.Fatalf("Couldn't hash the received file: %v", err)
+	}
+	if srcHash != dstHash {
+		t.Errorf("Hashes don't match. Got %s, wanted %s", dstHash, srcHash)
+	}
+}
+
+// benchmarkSendBlocks sends blocks bytes of random data to a local server
+// b.N times.
+func benchmarkSendBlocks(b *testing.B, blocks int) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		b.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	data := make([]byte, blocks*payloadSize)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatalf("Couldn't generate random data: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("couldn't listen: %s", err)
+	}
+	srv := NewServerWithOptions(listener, dpath, &ServerOptions{Overwrite: OverwriteAlways})
+	go srv.Serve(nil)
+	defer srv.Stop()
+	dialer := newTestDialer(listener.Addr().String())
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := SendReader(dialer, "bench", int64(len(data)), bytes.NewReader(data), nil); err != nil {
+			b.Fatalf("Error while sending: %v", err)
+		}
+	}
+}
+
+func BenchmarkSendBlocks(b *testing.B) {
+	benchmarkSendBlocks(b, 256)
+}
+
+func TestSendBlockAllocs(t *testing.T) {
+	// Both ends count, and each block costs a few allocations inside the
+	// codec, but neither end allocates a buffer per block.
+	const blocks = 256
+	result := testing.Benchmark(func(b *testing.B) { benchmarkSendBlocks(b, blocks) })
+	if allocs := result.AllocsPerOp(); allocs > 8*blocks {
+		t.Errorf("Sending %d blocks took %d allocations, want at most %d", blocks, allocs, 8*blocks)
+	}
+}
+
+func TestArchiveDirNotDirectory(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	notDir := path.Join(dpath, "file")
+	if err := os.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatalf("Couldn't create %s: %v", notDir, err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	defer listener.Close()
+
+	if srv, err := NewServerChecked(listener, notDir, nil); err == nil || srv != nil {
+		t.Errorf("NewServerChecked with a file for the archive returned %v, %v, want an error", srv, err)
+	} else if !strings.Contains(err.Error(), "archive directory") {
+		t.Errorf("NewServerChecked with a file for the archive returned %q, which doesn't say what is wrong", err)
+	}
+	if _, err := NewServerChecked(listener, dpath, &ServerOptions{TempDir: notDir}); err == nil {
+		t.Errorf("NewServerChecked with a file for the TempDir returned no error")
+	}
+
+	// Serve fails before taking a connection.
+	served := make(chan error, 1)
+	go func() { served <- NewServer(listener, notDir).Serve(nil) }()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Errorf("Serve with a file for the archive returned no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Serve with a file for the archive didn't return")
+	}
+
+	// A directory that is missing is created.
+	missing := path.Join(dpath, "missing", "archive")
+	if _, err := NewServerChecked(listener, missing, nil); err != nil {
+		t.Errorf("NewServerChecked with a missing archive returned %v", err)
+	}
+	if info, err := os.Stat(missing); err != nil || !info.IsDir() {
+		t.Errorf("NewServerChecked didn't create the archive directory: %v", err)
+	}
+}
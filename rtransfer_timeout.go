@@ -0,0 +1,61 @@
+package rtransfer
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultHandshakeTimeout is how long a server gives a new connection to get
+// through the handshake when ServerOptions.HandshakeTimeout isn't set.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// idleConn is a connection that fails any read or write that makes no
+// progress for timeout, so that a peer that goes silent is noticed.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// withIdleTimeout wraps conn in an idleConn, or returns it as is if timeout
+// isn't positive.
+func withIdleTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &idleConn{conn, timeout}
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// handshakeEncoder gives its first message, which is the server's answer to
+// the start message that ends the handshake, timeout to be sent, calling
+// expire if it takes longer.
+type handshakeEncoder struct {
+	Encoder
+	once    sync.Once
+	timeout time.Duration
+	expire  func()
+}
+
+func (e *handshakeEncoder) Encode(msg interface{}) error {
+	first := false
+	e.once.Do(func() { first = true })
+	if first {
+		timer := time.AfterFunc(e.timeout, e.expire)
+		defer timer.Stop()
+	}
+	return e.Encoder.Encode(msg)
+}
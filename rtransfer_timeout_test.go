@@ -0,0 +1,234 @@
+package rtransfer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TestIdleConn(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := withIdleTimeout(local, 50*time.Millisecond)
+	defer conn.Close()
+
+	// Nobody reads or writes at the other end.
+	if _, err := conn.Write([]byte("hello")); !isTimeout(err) {
+		t.Errorf("Write to a stalled peer returned %v, want a timeout", err)
+	}
+	if _, err := conn.Read(make([]byte, 5)); !isTimeout(err) {
+		t.Errorf("Read from a stalled peer returned %v, want a timeout", err)
+	}
+}
+
+func TestSendIdleTimeout(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "stalled")
+	if err := testutil.GenRandFile(fpath, payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	// The server accepts connections and then never answers.
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	defer listener.Close()
+	go func() {
+		var held []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				for _, conn := range held {
+					conn.Close()
+				}
+				return
+			}
+			held = append(held, conn)
+		}
+	}()
+
+	opts := &SendOptions{
+		Retry:       RetryPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 2},
+		IdleTimeout: 100 * time.Millisecond,
+	}
+	start := time.Now()
+	_, err = SendContext(context.Background(), newTestDialer(testSrvHostport), fpath, nil, opts)
+	if !isTimeout(err) {
+		t.Errorf("Send to a stalled server returned %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Send took %v to give up on a stalled server", elapsed)
+	}
+}
+
+func TestRecvIdleTimeout(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, dpath, &ServerOptions{IdleTimeout: 100 * time.Millisecond})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// Connect and never send the start message.
+	conn, err := newTestDialer(testSrvHostport).Dial()
+	if err != nil {
+		t.Fatalf("Couldn't dial the server: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Reading from a server holding an idle connection returned %v, want %v", err, io.EOF)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	// The server handles one connection at a time, and its idle timeout is
+	// too long to matter.
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{
+		MaxConcurrent:    1,
+		IdleTimeout:      time.Minute,
+		HandshakeTimeout: 100 * time.Millisecond,
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// Connect and never send the start message.
+	dialer := newTestDialer(testSrvHostport)
+	conn, err := dialer.Dial()
+	if err != nil {
+		t.Fatalf("Couldn't dial the server: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := Send(dialer, fpath, nil); err != nil {
+		t.Fatalf("Error while sending %s: %v", fpath, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Send waited %v for the stalled connection's slot", elapsed)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Reading from a server holding a stalled handshake returned %v, want %v", err, io.EOF)
+	}
+}
+
+func TestHandshakeTimeoutSlowServer(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	// The server takes longer than the handshake timeout to get ready for
+	// the file, which isn't the client's doing.
+	sink := newMemSink()
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{
+		HandshakeTimeout: 100 * time.Millisecond,
+		Sink: func(name string, size int64) (io.WriteCloser, error) {
+			time.Sleep(500 * time.Millisecond)
+			return sink.open(name, size)
+		},
+	})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	opts := &SendOptions{Retry: RetryPolicy{MaxAttempts: 1}}
+	if _, err := SendContext(context.Background(), netDialer{"tcp", testSrvHostport}, fpath, &logSendNotifier{t}, opts); err != nil {
+		t.Errorf("Error while sending %s to a slow server: %v", fpath, err)
+	}
+}
+
+func TestSendDeadline(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "file")
+	if err := testutil.GenRandFile(fpath, 10*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	// This server takes connections and never answers them.
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	const deadline = 2 * time.Second
+	for _, hostport := range []string{unusedHostport(t), testSrvHostport} {
+		start := time.Now()
+		opts := &SendOptions{Deadline: start.Add(deadline)}
+		_, err := SendContext(context.Background(), netDialer{"tcp", hostport}, fpath, nil, opts)
+		elapsed := time.Since(start)
+		if !errors.Is(err, context.DeadlineExceeded) || !isTimeout(err) {
+			t.Errorf("Send to %s past its deadline returned %v, want a timeout", hostport, err)
+		}
+		if elapsed < deadline || elapsed > deadline+time.Second {
+			t.Errorf("Send to %s with a deadline of %v returned after %v", hostport, deadline, elapsed)
+		}
+	}
+}
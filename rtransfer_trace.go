@@ -0,0 +1,61 @@
+package rtransfer
+
+import (
+	"context"
+)
+
+// Tracer lets senders and servers record spans for transfers in a tracing
+// system such as OpenTelemetry, without this package depending on one. A
+// sender passes the trace context of its spans to the server in the start
+// message, so that the spans of both ends join up into one trace.
+type Tracer interface {
+	// Start starts a span called name, as a child of the span in ctx if
+	// there is one, and returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+
+	// Inject returns the trace context of the span in ctx, to be sent to
+	// the server, or nil if there is nothing to send.
+	Inject(ctx context.Context) []byte
+
+	// Extract returns ctx with the remote span whose trace context a
+	// sender's Tracer injected. The server's spans are started as its
+	// children.
+	Extract(ctx context.Context, traceContext []byte) context.Context
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute records value, which is a string, an int64 or an int,
+	// under key.
+	SetAttribute(key string, value interface{})
+
+	// End ends the span, which failed with err unless it is nil.
+	End(err error)
+}
+
+// The attributes recorded on spans.
+const (
+	attrFile        = "rtransfer.file"
+	attrSize        = "rtransfer.size"
+	attrBlockSize   = "rtransfer.block_size"
+	attrAttempt     = "rtransfer.attempt"
+	attrBlocks      = "rtransfer.blocks"
+	attrBytes       = "rtransfer.bytes"
+	attrRetransmits = "rtransfer.retransmits"
+	attrReconnects  = "rtransfer.reconnects"
+)
+
+// noSpan is the span of a nil Tracer, which records nothing.
+type noSpan struct{}
+
+func (noSpan) SetAttribute(key string, value interface{}) {}
+func (noSpan) End(err error)                              {}
+
+// startSpan is tracer.Start, but returns ctx and a span that records nothing
+// if tracer is nil.
+func startSpan(tracer Tracer, ctx context.Context, name string) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, noSpan{}
+	}
+	return tracer.Start(ctx, name)
+}
@@ -0,0 +1,171 @@
+package rtransfer
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+type spanKey struct{}
+
+// testTracer records the spans it starts. A span's trace context is its id.
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+type testSpan struct {
+	id, parent int
+	name       string
+	attrs      map[string]interface{}
+	ended      bool
+	err        error
+}
+
+func (tt *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	parent, _ := ctx.Value(spanKey{}).(int)
+	span := &testSpan{id: len(tt.spans) + 1, parent: parent, name: name, attrs: make(map[string]interface{})}
+	tt.spans = append(tt.spans, span)
+	return context.WithValue(ctx, spanKey{}, span.id), &testSpanRef{tt, span}
+}
+
+func (tt *testTracer) Inject(ctx context.Context) []byte {
+	id, _ := ctx.Value(spanKey{}).(int)
+	return []byte(strconv.Itoa(id))
+}
+
+func (tt *testTracer) Extract(ctx context.Context, traceContext []byte) context.Context {
+	id, err := strconv.Atoi(string(traceContext))
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, id)
+}
+
+// find returns the spans called name.
+func (tt *testTracer) find(name string) []testSpan {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	var found []testSpan
+	for _, span := range tt.spans {
+		if span.name == name {
+			found = append(found, *span)
+		}
+	}
+	return found
+}
+
+// testSpanRef is a testSpan as its Tracer hands it out, guarded by the
+// Tracer's lock.
+type testSpanRef struct {
+	tt   *testTracer
+	span *testSpan
+}
+
+func (r *testSpanRef) SetAttribute(key string, value interface{}) {
+	r.tt.mu.Lock()
+	defer r.tt.mu.Unlock()
+	r.span.attrs[key] = value
+}
+
+func (r *testSpanRef) End(err error) {
+	r.tt.mu.Lock()
+	defer r.tt.mu.Unlock()
+	r.span.ended, r.span.err = true, err
+}
+
+func TestTracing(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "traced")
+	const size = 5*payloadSize + 10
+	if err := testutil.GenRandFile(fpath, size); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	// One tracer stands in for both ends, so that the server's span can be
+	// checked against the sender's.
+	tracer := &testTracer{}
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{Tracer: tracer})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	ctx, parent := tracer.Start(context.Background(), "upload")
+	opts := &SendOptions{Tracer: tracer}
+	if _, err := SendContext(ctx, newTestDialer(testSrvHostport), fpath, nil, opts); err != nil {
+		t.Fatalf("Error while sending %s: %v", fpath, err)
+	}
+	parent.End(nil)
+
+	sends := tracer.find("rtransfer.Send")
+	if len(sends) != 1 {
+		t.Fatalf("Sender started %d send spans, want 1", len(sends))
+	}
+	send := sends[0]
+	if send.parent != 1 {
+		t.Errorf("Send span is a child of span %d, want the caller's", send.parent)
+	}
+	if !send.ended || send.err != nil {
+		t.Errorf("Send span ended %v with %v, want ended with no error", send.ended, send.err)
+	}
+	want := map[string]interface{}{
+		attrFile:        "traced",
+		attrSize:        int64(size),
+		attrBlockSize:   payloadSize,
+		attrBlocks:      int64(6),
+		attrRetransmits: int64(0),
+	}
+	for key, value := range want {
+		if send.attrs[key] != value {
+			t.Errorf("Send span has %s %v, want %v", key, send.attrs[key], value)
+		}
+	}
+
+	for _, name := range []string{"rtransfer.handshake", "rtransfer.data"} {
+		spans := tracer.find(name)
+		if len(spans) != 1 {
+			t.Errorf("Sender started %d %s spans, want 1", len(spans), name)
+			continue
+		}
+		if spans[0].parent != send.id || !spans[0].ended {
+			t.Errorf("%s span has parent %d and ended %v, want the send span's child, ended",
+				name, spans[0].parent, spans[0].ended)
+		}
+	}
+
+	// The server's span may end just after the sender is done.
+	var recvs []testSpan
+	waitFor(5*time.Second, func() bool {
+		recvs = tracer.find("rtransfer.recv")
+		return len(recvs) == 1 && recvs[0].ended
+	})
+	if len(recvs) != 1 {
+		t.Fatalf("Server started %d receive spans, want 1", len(recvs))
+	}
+	if recvs[0].parent != send.id {
+		t.Errorf("Receive span is a child of span %d, want the send span %d", recvs[0].parent, send.id)
+	}
+	if !recvs[0].ended || recvs[0].err != nil || recvs[0].attrs[attrFile] != "traced" {
+		t.Errorf("Receive span for %v ended %v with %v, want traced, ended with no error",
+			recvs[0].attrs[attrFile], recvs[0].ended, recvs[0].err)
+	}
+}
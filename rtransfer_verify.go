@@ -0,0 +1,101 @@
+package rtransfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Verify asks the server whether it would take fpath, without sending any of
+// it. It returns the error Send would get from the server's ack, such as
+// ErrAlreadyExists or ErrNoSpace, and nil if the server would accept the
+// file. The server only makes its checks, and leaves what it has of the
+// file, even a partial one a later Send resumes, as it was. A server too old
+// to support dry runs takes it for a transfer. Then Verify hangs up and
+// returns ErrUnsupportedFeature, and the server keeps the transfer's partial
+// file as it would after a dropped connection.
+//
+// Verify goes through the handshake, and uses the codec and idle timeout, in
+// opts, which may be nil. Force is honored, and the rest of opts is ignored.
+// Verify makes a single attempt, so a server that can't be reached is
+// reported rather than waited for.
+func Verify(dialer Dialer, fpath string, opts *SendOptions) error {
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", fpath)
+	}
+
+	conn, err := dialer.Dial()
+	if err != nil {
+		return err
+	}
+	conn = withIdleTimeout(conn, opts.idleTimeout())
+	defer conn.Close()
+
+	if err := handshake(conn, opts); err != nil {
+		return err
+	}
+
+	codec := opts.codec()
+	enc, dec := codec.NewEncoder(conn), codec.NewDecoder(conn)
+	startMsg := startMessage{
+		Version:      protocolVersion,
+		Capabilities: capCancel,
+		Name:         filepath.Base(fpath),
+		Size:         info.Size(),
+		ModTime:      info.ModTime(),
+		Mode:         info.Mode().Perm(),
+		Force:        opts != nil && opts.Force,
+	}
+	if err := enc.Encode(startMsg); err != nil {
+		return err
+	}
+
+	var ack ackMessage
+	if err := dec.Decode(&ack); err != nil {
+		return err
+	}
+	if err := ack.err(); err != nil {
+		return err
+	}
+	if !compatibleVersion(ack.Version) {
+		return ErrUnsupportedVersion
+	}
+	if ack.Capabilities&capCancel == 0 {
+		return ErrUnsupportedFeature
+	}
+
+	if err := enc.Encode(dataMessage{Cancel: true}); err != nil {
+		return err
+	}
+	var dataAckMsg dataAckMessage
+	return dec.Decode(&dataAckMsg)
+}
+
+// dryRun acks the start message of a dry run, which openTransfer has checked
+// without opening anything, then waits for the cancel that ends it and acks
+// that.
+func (srv *server) dryRun(enc Encoder, dec Decoder, startMsg startMessage) error {
+	ackMsg := ackMessage{
+		Version:      protocolVersion,
+		Capabilities: startMsg.Capabilities & srv.capabilities(),
+		Name:         startMsg.Name,
+		Size:         startMsg.Size,
+		ErrType:      ErrSuccess,
+	}
+	if err := enc.Encode(ackMsg); err != nil {
+		return err
+	}
+
+	var dataMsg dataMessage
+	if err := dec.Decode(&dataMsg); err != nil {
+		return err
+	}
+	if !dataMsg.Cancel {
+		return fmt.Errorf("Client sent block %d of %s in a dry run", dataMsg.SeqNum, startMsg.Name)
+	}
+	return enc.Encode(dataAckMessage{SeqNum: dataMsg.SeqNum})
+}
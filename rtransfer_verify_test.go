@@ -0,0 +1,119 @@
+package rtransfer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/shaladdle/goaaw/testutil"
+)
+
+func TestVerify(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	clientDir := path.Join(dpath, "client")
+	serverDir := path.Join(dpath, "server")
+	if err := testutil.TryMkdir(clientDir); err != nil {
+		t.Fatalf("Couldn't create client test directory")
+	}
+
+	fpath := path.Join(clientDir, "backup")
+	if err := testutil.GenRandFile(fpath, 3*payloadSize+1); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	empty := path.Join(clientDir, "empty")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatalf("Couldn't create empty file: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", testSrvHostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", testSrvHostport, err)
+	}
+	srv := NewServer(listener, serverDir)
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	dialer := newTestDialer(testSrvHostport)
+	for _, p := range []string{fpath, empty} {
+		if err := Verify(dialer, p, nil); err != nil {
+			t.Fatalf("Verifying %s returned %v", p, err)
+		}
+
+		// The dry run leaves nothing behind.
+		name := path.Base(p)
+		if fileExists(path.Join(serverDir, name)) || fileExists(path.Join(serverDir, name+partSuffix)) {
+			t.Errorf("Verifying %s created a file on the server", name)
+		}
+		s := srv.(*server)
+		s.mu.Lock()
+		_, ok := s.transfers[name]
+		s.mu.Unlock()
+		if ok {
+			t.Errorf("Server still holds the transfer of %s after a dry run", name)
+		}
+	}
+
+	// A partial file a later Send would resume is left as it was.
+	partial := []byte("partly sent")
+	partPath := path.Join(serverDir, "resumable"+partSuffix)
+	if err := os.WriteFile(partPath, partial, 0644); err != nil {
+		t.Fatalf("Couldn't create partial file: %v", err)
+	}
+	resumable := path.Join(clientDir, "resumable")
+	if err := testutil.GenRandFile(resumable, 3*payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+	if err := Verify(dialer, resumable, nil); err != nil {
+		t.Fatalf("Verifying %s returned %v", resumable, err)
+	}
+	if got, err := os.ReadFile(partPath); err != nil || !bytes.Equal(got, partial) {
+		t.Errorf("Verifying %s changed its partial file to %q (%v)", resumable, got, err)
+	}
+
+	if err := Send(dialer, fpath, nil); err != nil {
+		t.Fatalf("Error while sending %s: %v", fpath, err)
+	}
+	if err := Verify(dialer, fpath, nil); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Verifying a file the server has returned %v, want %v", err, ErrAlreadyExists)
+	}
+}
+
+func TestVerifySecret(t *testing.T) {
+	dpath, err := testutil.CreateTestDir()
+	if err != nil {
+		t.Fatalf("Couldn't create test directory")
+	}
+	defer os.RemoveAll(dpath)
+
+	fpath := path.Join(dpath, "backup")
+	if err := testutil.GenRandFile(fpath, payloadSize); err != nil {
+		t.Fatalf("Couldn't create random file: %v", err)
+	}
+
+	hostport := unusedHostport(t)
+	listener, err := net.Listen("tcp", hostport)
+	if err != nil {
+		t.Fatalf("couldn't listen on %s: %s", hostport, err)
+	}
+	secret := []byte("verify secret")
+	srv := NewServerWithOptions(listener, path.Join(dpath, "server"), &ServerOptions{Secret: secret})
+	go srv.Serve(newLogRecvNotifierFactory(t))
+	defer srv.Stop()
+
+	// A dry run goes through the handshake as a transfer does.
+	dialer := netDialer{"tcp", hostport}
+	if err := Verify(dialer, fpath, &SendOptions{Secret: secret}); err != nil {
+		t.Errorf("Verifying with the secret returned %v", err)
+	}
+	if err := Verify(dialer, fpath, nil); err == nil {
+		t.Errorf("Verifying without the secret succeeded")
+	}
+}